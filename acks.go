@@ -0,0 +1,259 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+var (
+	ErrInvalidEntry   = errors.New("Invalid entry")
+	ErrInvalidAckFunc = errors.New("Invalid acknowledgement callback")
+	ErrEntryCached    = errors.New("Entry was diverted to the ingest cache")
+	ErrEntryDropped   = errors.New("Entry was dropped")
+	ErrAckPending     = errors.New("Entry already has a pending acknowledgement")
+)
+
+// AckFunc is called exactly once for an entry written with WriteEntryCallback.
+// A nil error means an indexer confirmed the entry.  ErrEntryCached means the
+// entry was handed to the ingest cache, it will be delivered later but will not
+// be confirmed.  Any other error means the entry was lost.
+// AckFuncs are called from the muxer's connection routines with no muxer locks
+// held, so they may write back into the muxer.  A slow callback holds up the
+// connection it was called from, and a Sync called from one can only time out.
+type AckFunc func(ent *entry.Entry, err error)
+
+// EntryAck is a future returned by WriteEntryAck which resolves when the entry
+// is confirmed by an indexer or diverted away from one.
+type EntryAck struct {
+	ent  *entry.Entry
+	err  error
+	done chan struct{}
+}
+
+// Entry returns the entry the acknowledgement is tracking
+func (ea *EntryAck) Entry() *entry.Entry {
+	return ea.ent
+}
+
+// Done returns a channel which is closed when the acknowledgement resolves
+func (ea *EntryAck) Done() <-chan struct{} {
+	return ea.done
+}
+
+// Err returns the outcome of the write, it is only valid once Done is closed
+func (ea *EntryAck) Err() error {
+	select {
+	case <-ea.done:
+		return ea.err
+	default:
+	}
+	return nil
+}
+
+// Wait blocks until the acknowledgement resolves or the context expires
+func (ea *EntryAck) Wait(ctx context.Context) error {
+	select {
+	case <-ea.done:
+		return ea.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ea *EntryAck) resolve(ent *entry.Entry, err error) {
+	ea.err = err
+	close(ea.done)
+}
+
+// ackTracker maps entries in flight to the callbacks waiting on them.
+// Every confirmation passes through the tracker, so the pending count lets
+// the common case of nobody waiting skip the lock entirely.
+type ackTracker struct {
+	pending int64 //atomic, must stay at the top for alignment
+	mtx     sync.Mutex
+	waiters map[*entry.Entry]AckFunc
+	budget  *inflightBudget       //nil unless the muxer has an in-flight byte budget
+	forget  func(...*entry.Entry) //nil unless in-flight entries are persisted
+	seq     *entrySequencer       //nil unless entries are sequenced
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		waiters: map[*entry.Entry]AckFunc{},
+	}
+}
+
+func (at *ackTracker) add(ent *entry.Entry, cb AckFunc) error {
+	at.mtx.Lock()
+	defer at.mtx.Unlock()
+	if _, ok := at.waiters[ent]; ok {
+		return ErrAckPending
+	}
+	at.waiters[ent] = cb
+	atomic.AddInt64(&at.pending, 1)
+	return nil
+}
+
+// remove drops a waiter without firing it, used when the entry never made it into the muxer
+func (at *ackTracker) remove(ent *entry.Entry) {
+	at.mtx.Lock()
+	if _, ok := at.waiters[ent]; ok {
+		delete(at.waiters, ent)
+		atomic.AddInt64(&at.pending, -1)
+	}
+	at.mtx.Unlock()
+}
+
+func (at *ackTracker) resolve(ent *entry.Entry, err error) {
+	at.budget.release(ent)
+	if at.forget != nil {
+		at.forget(ent)
+	}
+	if err != ErrEntryCached {
+		//cached entries are still on their way, they keep their sequence
+		at.seq.forget(ent)
+	}
+	if ent == nil || atomic.LoadInt64(&at.pending) == 0 {
+		return
+	}
+	at.mtx.Lock()
+	cb, ok := at.waiters[ent]
+	if ok {
+		delete(at.waiters, ent)
+		atomic.AddInt64(&at.pending, -1)
+	}
+	at.mtx.Unlock()
+	if ok {
+		cb(ent, err)
+	}
+}
+
+func (at *ackTracker) resolveSet(ents []*entry.Entry, err error) {
+	if atomic.LoadInt64(&at.pending) == 0 {
+		at.budget.release(ents...)
+		if at.forget != nil {
+			at.forget(ents...)
+		}
+		if err != ErrEntryCached {
+			at.seq.forget(ents...)
+		}
+		return
+	}
+	for _, ent := range ents {
+		at.resolve(ent, err)
+	}
+}
+
+func (at *ackTracker) confirmed(ent *entry.Entry) {
+	at.resolve(ent, nil)
+}
+
+func (at *ackTracker) cached(ent *entry.Entry) {
+	at.resolve(ent, ErrEntryCached)
+}
+
+// split moves the waiter on ent onto a set of replicas, the waiter fires once
+// every replica has resolved with the first error any of them saw
+func (at *ackTracker) split(ent *entry.Entry, replicas []*entry.Entry) {
+	if atomic.LoadInt64(&at.pending) == 0 {
+		return
+	}
+	at.mtx.Lock()
+	defer at.mtx.Unlock()
+	cb, ok := at.waiters[ent]
+	if !ok {
+		return
+	}
+	var jmtx sync.Mutex
+	var jerr error
+	remaining := len(replicas)
+	join := func(_ *entry.Entry, err error) {
+		jmtx.Lock()
+		if jerr == nil {
+			jerr = err
+		}
+		remaining--
+		done := remaining == 0
+		jmtx.Unlock()
+		if done {
+			cb(ent, jerr)
+		}
+	}
+	delete(at.waiters, ent)
+	for _, r := range replicas {
+		at.waiters[r] = join
+	}
+	atomic.AddInt64(&at.pending, int64(len(replicas)-1))
+}
+
+// failAll resolves every outstanding waiter with err
+func (at *ackTracker) failAll(err error) {
+	at.mtx.Lock()
+	waiters := at.waiters
+	at.waiters = map[*entry.Entry]AckFunc{}
+	atomic.StoreInt64(&at.pending, 0)
+	at.mtx.Unlock()
+	for ent, cb := range waiters {
+		cb(ent, err)
+	}
+}
+
+// WriteEntryAck queues an entry like WriteEntry and returns a future which
+// resolves once an indexer confirms the entry.
+func (im *IngestMuxer) WriteEntryAck(e *entry.Entry) (*EntryAck, error) {
+	return im.WriteEntryAckContext(context.Background(), e)
+}
+
+// WriteEntryAckContext queues an entry like WriteEntryContext and returns a future
+// which resolves once an indexer confirms the entry.
+func (im *IngestMuxer) WriteEntryAckContext(ctx context.Context, e *entry.Entry) (*EntryAck, error) {
+	if e == nil {
+		return nil, ErrInvalidEntry
+	}
+	ea := &EntryAck{
+		ent:  e,
+		done: make(chan struct{}),
+	}
+	if err := im.WriteEntryCallbackContext(ctx, e, ea.resolve); err != nil {
+		return nil, err
+	}
+	return ea, nil
+}
+
+// WriteEntryCallback queues an entry like WriteEntry, cb is called once the entry
+// is confirmed by an indexer, diverted to the cache, or dropped.  The entry must not
+// be modified or written again until cb has fired.
+func (im *IngestMuxer) WriteEntryCallback(e *entry.Entry, cb AckFunc) error {
+	return im.WriteEntryCallbackContext(context.Background(), e, cb)
+}
+
+// WriteEntryCallbackContext is WriteEntryCallback with a cancellation context,
+// if the entry is not queued cb is never called.
+func (im *IngestMuxer) WriteEntryCallbackContext(ctx context.Context, e *entry.Entry, cb AckFunc) error {
+	if e == nil {
+		return ErrInvalidEntry
+	} else if cb == nil {
+		return ErrInvalidAckFunc
+	}
+	//register before the entry is queued, the confirmation can beat us back
+	if err := im.acks.add(e, cb); err != nil {
+		return err
+	}
+	if err := im.WriteEntryContext(ctx, e); err != nil {
+		im.acks.remove(e)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestWriteEntryAck(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var acks []*EntryAck
+	for i := 0; i < 16; i++ {
+		ea, err := im.WriteEntryAck(&entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`test data`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ea)
+	}
+	for _, ea := range acks {
+		if err := ea.Wait(ctx); err != nil {
+			t.Fatal("Entry not confirmed", err)
+		}
+	}
+	//the future hands back the entry it is tracking
+	ent := &entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`test data`)}
+	ea, err := im.WriteEntryAck(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ea.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ea.Entry() != ent {
+		t.Fatal("Bad entry on ack")
+	}
+
+	//unknown tags are dropped by the relay and the callback says so
+	errs := make(chan error, 1)
+	cb := func(ent *entry.Entry, err error) {
+		errs <- err
+	}
+	if err := im.WriteEntryCallback(&entry.Entry{TS: entry.Now(), Tag: entry.EntryTag(100)}, cb); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrTagNotFound {
+			t.Fatal("Bad error on dropped entry", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Dropped entry never resolved")
+	}
+	if err := im.WriteEntryCallback(ent, nil); err != ErrInvalidAckFunc {
+		t.Fatal("Failed to catch nil callback", err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteEntryAckClose(t *testing.T) {
+	//grab a port that nothing is listening on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := `tcp://` + lst.Addr().String()
+	lst.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{Target{Address: addr, Secret: testIndexerSecret}},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ea, err := im.WriteEntryAck(&entry.Entry{TS: entry.Now(), Data: []byte(`test data`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ea.Done():
+		t.Fatal("Ack resolved without a connection")
+	default:
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ea.Wait(ctx); err != ErrEntryDropped {
+		t.Fatal("Bad error on close", err)
+	}
+	//the muxer is closed so nothing is registered
+	if _, err := im.WriteEntryAck(&entry.Entry{}); err != ErrNotRunning {
+		t.Fatal("Bad error on closed muxer", err)
+	}
+	if im.acks.pending != 0 {
+		t.Fatal("Registration leaked", im.acks.pending)
+	}
+}
+
+func TestAckTrackerCached(t *testing.T) {
+	at := newAckTracker()
+	ent := &entry.Entry{}
+	var got error
+	if err := at.add(ent, func(e *entry.Entry, err error) { got = err }); err != nil {
+		t.Fatal(err)
+	}
+	if err := at.add(ent, func(*entry.Entry, error) {}); err != ErrAckPending {
+		t.Fatal("Failed to catch duplicate registration", err)
+	}
+	at.cached(ent)
+	if got != ErrEntryCached {
+		t.Fatal("Bad cached error", got)
+	}
+	//resolution is one shot
+	got = nil
+	at.confirmed(ent)
+	if got != nil || at.pending != 0 {
+		t.Fatal("Ack fired twice")
+	}
+}
+
+func TestWriteEntryAckReentrant(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//callbacks run without the entry writer lock, so they can write follow up entries
+	//and even call Sync, which can only time out as it is holding up the connection
+	const cnt = 16
+	errs := make(chan error, cnt)
+	var once sync.Once
+	cb := func(ent *entry.Entry, err error) {
+		if err == nil {
+			err = im.WriteBatch([]*entry.Entry{{TS: entry.Now(), Tag: tag, Data: []byte(`follow up`)}})
+		}
+		once.Do(func() {
+			im.Sync(100 * time.Millisecond)
+		})
+		errs <- err
+	}
+	for i := 0; i < cnt; i++ {
+		if err := im.WriteEntryCallback(&entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`test data`)}, cb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmr := time.NewTimer(5 * time.Second)
+	defer tmr.Stop()
+	for i := 0; i < cnt; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-tmr.C:
+			t.Fatal("Callback deadlocked writing back into the muxer")
+		}
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := ti.Count(); n != 2*cnt {
+		t.Fatal("Bad entry count", n)
+	}
+}
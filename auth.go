@@ -19,6 +19,7 @@ import (
 	"errors"
 	"io"
 	"math/rand"
+	"sync"
 
 	"github.com/gravwell/ingest/v3/entry"
 )
@@ -53,6 +54,7 @@ var (
 
 	prng        *rand.Rand
 	prngCounter int
+	prngMtx     sync.Mutex //challenges may be generated for many connections at once
 )
 
 // AuthHash represents a hashed shared secret.
@@ -176,13 +178,22 @@ func checkAndReseedPRNG() {
 
 // NewChallenge generates a random hash string and a random iteration count
 func NewChallenge(auth AuthHash) (Challenge, error) {
+	return NewChallengeVersion(auth, VERSION)
+}
+
+// NewChallengeVersion generates a challenge which advertises version v.  Servers
+// that can read sequenced entries advertise MINIMUM_SEQ_VERSION so that
+// ingesters know to send them, everyone else should use NewChallenge.
+func NewChallengeVersion(auth AuthHash, v uint16) (Challenge, error) {
 	var chal [32]byte
+	prngMtx.Lock()
+	defer prngMtx.Unlock()
 	checkAndReseedPRNG()
 	iter := uint16(10000 + prng.Intn(10000))
 	for i := 0; i < len(chal); i++ {
 		chal[i] = byte(prng.Intn(0xff))
 	}
-	return Challenge{iter, chal, VERSION}, nil
+	return Challenge{iter, chal, v}, nil
 }
 
 // GenerateResponse creates a ChallengeResponse based on the Challenge and AuthHash
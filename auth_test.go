@@ -42,6 +42,13 @@ func TestChallenge(t *testing.T) {
 	if chalA != chal {
 		t.Fatal("challenge mismatch")
 	}
+	//sequenced entries are opt in, the default version is unchanged
+	if chal.Version != VERSION || VERSION >= MINIMUM_SEQ_VERSION {
+		t.Fatal("Bad challenge version", chal.Version)
+	}
+	if chal, err = NewChallengeVersion(hsh, MINIMUM_SEQ_VERSION); err != nil || chal.Version != MINIMUM_SEQ_VERSION {
+		t.Fatal("Bad challenge version", chal.Version, err)
+	}
 }
 
 func TestChallengeResponse(t *testing.T) {
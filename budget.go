@@ -0,0 +1,269 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	budgetNudgeInterval = 10 * time.Millisecond
+)
+
+var (
+	ErrInvalidBudgetAction = errors.New("Invalid in-flight budget action")
+	ErrBudgetNeedsCache    = errors.New("In-flight budget cache action requires the ingest cache")
+
+	errBudgetExhausted = errors.New("in-flight budget exhausted")
+)
+
+// BudgetAction is what a write does when the in-flight byte budget is exhausted
+type BudgetAction int
+
+const (
+	BudgetBlock BudgetAction = iota // wait for room, honoring any context
+	BudgetCache                     // divert the entries to the ingest cache
+)
+
+func (a BudgetAction) String() string {
+	switch a {
+	case BudgetBlock:
+		return `block`
+	case BudgetCache:
+		return `cache`
+	}
+	return `unknown`
+}
+
+// ParseBudgetAction converts an action name into a BudgetAction
+func ParseBudgetAction(v string) (BudgetAction, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case `block`, ``:
+		return BudgetBlock, nil
+	case `cache`:
+		return BudgetCache, nil
+	}
+	return BudgetBlock, ErrInvalidBudgetAction
+}
+
+// inflightBudget charges every entry admitted by a writer against a byte limit
+// until the entry is confirmed, cached, or dropped.  That covers the muxer
+// queues, the emergency queues and the unconfirmed entry writer buffers.
+// A write is always admitted when nothing is charged so that a batch larger
+// than the whole budget can not wedge the muxer.  Entry writers only collect
+// confirmations periodically, so a waiting writer keeps calling nudge to ask
+// for them early.  Replicas of an entry share its charge, which is returned
+// once the last of them is released.
+type inflightBudget struct {
+	waits    uint64 //atomic, must stay at the top for alignment
+	waitTime int64
+	diverted uint64
+	mtx      sync.Mutex
+	max      uint64
+	used     uint64
+	action   BudgetAction
+	ents     map[*entry.Entry]*budgetCharge
+	charged  int //number of distinct charges, replicas share one
+	waiting  int
+	freed    chan struct{} //closed when room is released and someone is waiting
+	nudge    func()
+}
+
+// budgetCharge is the charge for an entry and the replicas sharing it
+type budgetCharge struct {
+	size uint64
+	refs int
+}
+
+func newInflightBudget(max uint64, action BudgetAction) (*inflightBudget, error) {
+	if action != BudgetBlock && action != BudgetCache {
+		return nil, ErrInvalidBudgetAction
+	}
+	return &inflightBudget{
+		max:    max,
+		action: action,
+		ents:   map[*entry.Entry]*budgetCharge{},
+		freed:  make(chan struct{}),
+	}, nil
+}
+
+// acquire charges a set of entries against the budget, waiting for room if the
+// action is block.  errBudgetExhausted is returned if the action is cache and there is no room.
+func (ib *inflightBudget) acquire(ctx context.Context, ents []*entry.Entry, die chan bool) error {
+	var sz uint64
+	for _, e := range ents {
+		if e != nil {
+			sz += e.Size()
+		}
+	}
+	var start time.Time
+	for {
+		ib.mtx.Lock()
+		if ib.used == 0 || ib.used+sz <= ib.max {
+			for _, e := range ents {
+				if e == nil {
+					continue
+				}
+				if _, ok := ib.ents[e]; !ok {
+					bc := &budgetCharge{size: e.Size(), refs: 1}
+					ib.ents[e] = bc
+					ib.used += bc.size
+					ib.charged++
+				}
+			}
+			ib.mtx.Unlock()
+			if !start.IsZero() {
+				atomic.AddInt64(&ib.waitTime, int64(time.Since(start)))
+			}
+			return nil
+		} else if ib.action == BudgetCache {
+			ib.mtx.Unlock()
+			atomic.AddUint64(&ib.diverted, uint64(len(ents)))
+			return errBudgetExhausted
+		}
+		if start.IsZero() {
+			start = time.Now()
+			atomic.AddUint64(&ib.waits, 1)
+		}
+		ib.waiting++
+		freed := ib.freed
+		ib.mtx.Unlock()
+		if ib.nudge != nil {
+			ib.nudge()
+		}
+
+		var err error
+		tmr := time.NewTimer(budgetNudgeInterval)
+		select {
+		case <-freed:
+			tmr.Stop()
+			continue
+		case <-tmr.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-die:
+			err = ErrNotRunning
+		}
+		tmr.Stop()
+		ib.mtx.Lock()
+		if freed == ib.freed {
+			ib.waiting--
+		}
+		ib.mtx.Unlock()
+		if err != nil {
+			atomic.AddInt64(&ib.waitTime, int64(time.Since(start)))
+			return err
+		}
+	}
+}
+
+// share puts the replicas of a charged entry on its charge, the charge is held
+// until the entry and every replica have been released
+func (ib *inflightBudget) share(ent *entry.Entry, replicas []*entry.Entry) {
+	if ib == nil {
+		return
+	}
+	ib.mtx.Lock()
+	if bc, ok := ib.ents[ent]; ok {
+		for _, e := range replicas {
+			if _, ok := ib.ents[e]; !ok && e != nil {
+				ib.ents[e] = bc
+				bc.refs++
+			}
+		}
+	}
+	ib.mtx.Unlock()
+}
+
+// release drops an entry from its charge, the charge is returned once nothing
+// holds it.  Entries that were never charged are ignored.
+func (ib *inflightBudget) release(ents ...*entry.Entry) {
+	if ib == nil {
+		return
+	}
+	ib.mtx.Lock()
+	for _, e := range ents {
+		if bc, ok := ib.ents[e]; ok {
+			delete(ib.ents, e)
+			if bc.refs--; bc.refs == 0 {
+				ib.used -= bc.size
+				ib.charged--
+			}
+		}
+	}
+	if ib.waiting > 0 {
+		close(ib.freed)
+		ib.freed = make(chan struct{})
+		ib.waiting = 0
+	}
+	ib.mtx.Unlock()
+}
+
+// inUse returns the number of bytes charged and the number of entries they belong to
+func (ib *inflightBudget) inUse() (sz uint64, n int) {
+	ib.mtx.Lock()
+	sz, n = ib.used, ib.charged
+	ib.mtx.Unlock()
+	return
+}
+
+// collectAcks asks the ack collector to have every live connection collect its
+// outstanding confirmations, requests made while a collection runs are folded into the next one
+func (im *IngestMuxer) collectAcks() {
+	select {
+	case im.collectCh <- struct{}{}:
+	default:
+	}
+}
+
+// ackCollector services collectAcks so that budget waiters never pile up syncs
+func (im *IngestMuxer) ackCollector() {
+	defer im.wg.Done()
+	for {
+		select {
+		case <-im.collectCh:
+		case <-im.dieChan:
+			return
+		}
+		im.mtx.RLock()
+		igs := make([]*IngestConnection, 0, len(im.targets))
+		for _, mt := range im.targets {
+			if mt.ig != nil {
+				igs = append(igs, mt.ig)
+			}
+		}
+		im.mtx.RUnlock()
+		for _, ig := range igs {
+			ig.Sync()
+		}
+	}
+}
+
+// reserve charges entries against the in-flight budget.  If the budget is
+// exhausted and the action is cache the entries are handed to the cache and
+// false is returned with the outcome of the caching.
+func (im *IngestMuxer) reserve(ctx context.Context, ents ...*entry.Entry) (bool, error) {
+	err := im.budget.acquire(ctx, ents, im.dieChan)
+	if err == nil {
+		return true, nil
+	} else if err == errBudgetExhausted {
+		if err = im.cacheUnlimited(ents...); err == nil {
+			//the cache routine only unloads when prodded, hot connections never will
+			im.kickCaches()
+		}
+	}
+	return false, err
+}
@@ -0,0 +1,302 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestInflightBudget(t *testing.T) {
+	ents := testEntries(4, 100)
+	esz := ents[0].Size()
+	ib, err := newInflightBudget(3*esz, BudgetBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.acquire(context.Background(), ents[:2], nil); err != nil {
+		t.Fatal(err)
+	}
+	//charging the same entry twice is a no-op
+	if err := ib.acquire(context.Background(), ents[:1], nil); err != nil {
+		t.Fatal(err)
+	}
+	if sz, n := ib.inUse(); sz != 2*esz || n != 2 {
+		t.Fatal("Bad usage", sz, n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ib.acquire(ctx, ents[2:], nil); err != context.DeadlineExceeded {
+		t.Fatal("Budget not enforced", err)
+	}
+
+	//a release wakes up a waiting writer
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ib.release(ents[0])
+	}()
+	if err := ib.acquire(context.Background(), ents[2:], nil); err != nil {
+		t.Fatal(err)
+	}
+	if ib.waits != 2 || ib.waitTime <= 0 {
+		t.Fatal("Bad wait counters", ib.waits, ib.waitTime)
+	}
+	die := make(chan bool)
+	close(die)
+	if err := ib.acquire(context.Background(), ents[:1], die); err != ErrNotRunning {
+		t.Fatal("Close ignored", err)
+	}
+	ib.release(ents...)
+	ib.release(ents...)
+	if sz, n := ib.inUse(); sz != 0 || n != 0 {
+		t.Fatal("Bad usage after release", sz, n)
+	}
+	//an empty budget admits anything so oversize batches can not wedge the muxer
+	big := testEntries(10, 100)
+	if err := ib.acquire(context.Background(), big, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if ib, err = newInflightBudget(esz, BudgetCache); err != nil {
+		t.Fatal(err)
+	}
+	ib.acquire(context.Background(), ents[:1], nil)
+	if err := ib.acquire(context.Background(), ents[1:3], nil); err != errBudgetExhausted || ib.diverted != 2 {
+		t.Fatal("Budget did not divert", err, ib.diverted)
+	}
+	if _, err := newInflightBudget(1, BudgetAction(5)); err != ErrInvalidBudgetAction {
+		t.Fatal("Failed to catch bad action", err)
+	}
+	for _, name := range []string{`block`, `cache`} {
+		if a, err := ParseBudgetAction(name); err != nil || a.String() != name {
+			t.Fatal("Bad action", name, a, err)
+		}
+	}
+}
+
+func TestInflightBudgetReplicas(t *testing.T) {
+	ents := testEntries(2, 100)
+	esz := ents[0].Size()
+	ib, err := newInflightBudget(2*esz, BudgetCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.acquire(context.Background(), ents[:1], nil); err != nil {
+		t.Fatal(err)
+	}
+	a, b := *ents[0], *ents[0]
+	ib.share(ents[0], []*entry.Entry{ents[0], &a, &b})
+	if sz, n := ib.inUse(); sz != esz || n != 1 {
+		t.Fatal("Bad usage", sz, n)
+	}
+	//the charge is held until the last replica is released
+	ib.release(ents[0], &a)
+	ib.release(&a)
+	if sz, n := ib.inUse(); sz != esz || n != 1 {
+		t.Fatal("Released with a replica outstanding", sz, n)
+	}
+	ib.release(&b)
+	if sz, n := ib.inUse(); sz != 0 || n != 0 {
+		t.Fatal("Bad usage after release", sz, n)
+	}
+	//sharing an entry that was never charged does nothing
+	ib.share(ents[1], []*entry.Entry{ents[1], &a})
+	if sz, n := ib.inUse(); sz != 0 || n != 0 || len(ib.ents) != 0 {
+		t.Fatal("Charged an uncharged replica", sz, n)
+	}
+}
+
+func TestMuxerInflightBudget(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:     []Target{ti.Target()},
+		Tags:             []string{`testA`},
+		MaxInFlightBytes: 4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := testEntries(200, 100)
+	for _, e := range ents[:100] {
+		e.Tag = tag
+		if err := im.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range ents[100:] {
+		e.Tag = tag
+	}
+	if err := im.WriteBatch(ents[100:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	//confirmations hand the budget back
+	ts := time.Now()
+	ms := im.Stats()
+	for ms.InFlightBytes != 0 && time.Since(ts) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+		ms = im.Stats()
+	}
+	if ms.InFlightLimit != 4096 || ms.InFlightBytes != 0 || ms.InFlightWaits == 0 {
+		t.Fatalf("Bad stats limit %d bytes %d waits %d", ms.InFlightLimit, ms.InFlightBytes, ms.InFlightWaits)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := ti.Count(); n < 200 {
+		t.Fatal("Lost entries", n)
+	}
+}
+
+func TestMuxerInflightBudgetExhausted(t *testing.T) {
+	//grab an address that nothing is listening on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := Target{Address: `tcp://` + lst.Addr().String(), Secret: testIndexerSecret}
+	lst.Close()
+	ents := testEntries(4, 100)
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:     []Target{down},
+		Tags:             []string{`testA`},
+		MaxInFlightBytes: 2 * ents[0].Size(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range ents[:2] {
+		if err := im.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := im.WriteEntryContext(ctx, ents[2]); err != context.DeadlineExceeded {
+		t.Fatal("Budget not enforced", err)
+	}
+	if err := im.WriteEntryTimeout(ents[2], 10*time.Millisecond); err != ErrWriteTimeout {
+		t.Fatal("Budget not enforced", err)
+	}
+	im.Close()
+
+	if _, err = NewMuxer(MuxerConfig{
+		Destinations:     []Target{down},
+		Tags:             []string{`testA`},
+		MaxInFlightBytes: 1024,
+		InFlightAction:   BudgetCache,
+	}); err != ErrBudgetNeedsCache {
+		t.Fatal("Failed to catch missing cache", err)
+	}
+	im, err = NewMuxer(MuxerConfig{
+		Destinations:     []Target{down},
+		Tags:             []string{`testA`},
+		MaxInFlightBytes: ents[0].Size(),
+		InFlightAction:   BudgetCache,
+		EnableCache:      true,
+		CacheConfig:      IngestCacheConfig{MemoryCacheSize: memCacheSize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	//hold the whole budget with an entry that never leaves
+	if err := im.budget.acquire(context.Background(), ents[:1], nil); err != nil {
+		t.Fatal(err)
+	}
+	ack, err := im.WriteEntryAck(ents[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ack.Wait(ctx); err != ErrEntryCached {
+		t.Fatal("Entry was not diverted to the cache", err)
+	}
+	if ms := im.Stats(); ms.InFlightDiverted != 1 {
+		t.Fatal("Bad diverted count", ms.InFlightDiverted)
+	}
+}
+
+func TestMuxerInflightBudgetDivertDelivered(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	ents := testEntries(2, 100)
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:     []Target{ti.Target()},
+		Tags:             []string{`testA`},
+		MaxInFlightBytes: ents[0].Size(),
+		InFlightAction:   BudgetCache,
+		EnableCache:      true,
+		CacheConfig:      IngestCacheConfig{MemoryCacheSize: memCacheSize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := im.Subscribe(64)
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	//hold the whole budget with an entry that never leaves
+	if err := im.budget.acquire(context.Background(), ents[:1], nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WriteEntry(ents[1]); err != nil {
+		t.Fatal(err)
+	}
+	//the diverted entry must come out of the cache while the connection stays up
+	for ts := time.Now(); ti.Count() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(ts) > 5*time.Second {
+			t.Fatal("Diverted entry was not delivered")
+		}
+	}
+	for {
+		select {
+		case ev := <-sub.C:
+			if ev.Type == EventReconnecting || ev.Type == EventFailed {
+				t.Fatal("Delivery needed a reconnect", ev)
+			}
+			continue
+		default:
+		}
+		break
+	}
+	if ms := im.Stats(); ms.InFlightDiverted != 1 {
+		t.Fatal("Bad diverted count", ms.InFlightDiverted)
+	}
+}
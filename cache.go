@@ -9,10 +9,12 @@
 package ingest
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -34,6 +36,10 @@ var (
 	dbBucketName    []byte        = []byte(`ic`)                // this is the bucket that will hold entries
 	dbTagBucketName []byte        = []byte(`tagmap`)            // this bucket will hold the tag list
 	dbTagKey        []byte        = []byte(`__CACHE_TAG_KEY__`) // special tag to hold tag list
+	dbJournalBucket []byte        = []byte(`inflight`)          // entries sent to an indexer but not yet confirmed
+	dbSeqBucket     []byte        = []byte(`seq`)               // sequence numbers of the stored entries in block order
+	dbSeqNextBucket []byte        = []byte(`seqnext`)           // the next sequence number, only present after a clean close
+	dbSeqNextKey    []byte        = []byte(`next`)
 
 	ErrActiveHotBlocks        = errors.New("There are active hotblocks, close pitched data")
 	ErrNoActiveDB             = errors.New("No active database")
@@ -55,11 +61,16 @@ type IngestCacheConfig struct {
 }
 
 type IngestCache struct {
+	//entsIn and entsOut are atomic counters and must remain
+	//at the top of the struct for alignment on 32bit architectures
+	entsIn          uint64
+	entsOut         uint64
 	mtx             *sync.Mutex
 	fileBacked      bool   //whether we are going to push to a file when there are no outputs available
 	storeLoc        string //location of boltDB
 	storedBlocks    int
 	count           uint64
+	replayed        uint64 //entries moved out of the journal when the cache was opened
 	cacheSize       uint64
 	storeSize       uint64
 	maxMemCacheSize uint64
@@ -72,6 +83,8 @@ type IngestCache struct {
 	running         bool
 	wg              sync.WaitGroup
 	stCh            chan bool
+	onAdd           func(*entry.Entry) //called with each entry added, must be set before Start
+	seq             *entrySequencer    //nil unless entries are sequenced, must be set before Start
 }
 
 // NewIngestCache creates a ingest cache and gets a handle on the store if specified.
@@ -80,7 +93,7 @@ func NewIngestCache(c IngestCacheConfig) (*IngestCache, error) {
 	var fileBacked bool
 	var db *bolt.DB
 	var blockCount int
-	var count uint64
+	var count, replayed uint64
 	if c.FileBackingLocation != `` {
 		fileBacked = true
 		//attempt to open the bolt database
@@ -121,6 +134,12 @@ func NewIngestCache(c IngestCacheConfig) (*IngestCache, error) {
 			return nil, err
 		}
 
+		//anything left in the journal was never confirmed, move it into the cache
+		if replayed, err = replayJournal(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+
 		blockCount = getKVCount(db)
 		count, err = getEntryCount(db)
 		if err != nil {
@@ -167,6 +186,7 @@ func NewIngestCache(c IngestCacheConfig) (*IngestCache, error) {
 		storedBlocks:    blockCount,
 		count:           count,
 		storeSize:       currDataSize,
+		replayed:        replayed,
 		stCh:            make(chan bool, 1),
 	}, nil
 }
@@ -235,6 +255,46 @@ func putTagList(db *bolt.DB, tags []string) error {
 	return nil
 }
 
+// storeNextSequence records where the sequencer left off so the next run can resume there
+func (ic *IngestCache) storeNextSequence(next uint64) error {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	if ic.db == nil {
+		return nil
+	}
+	return ic.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(dbSeqNextBucket)
+		if err != nil {
+			return err
+		}
+		buff := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buff, next)
+		return bkt.Put(dbSeqNextKey, buff)
+	})
+}
+
+// takeNextSequence returns the sequence stored by the last clean close and removes
+// it, so a run that does not close cleanly leaves nothing to resume from.  Zero
+// means there is nothing to resume.
+func (ic *IngestCache) takeNextSequence() (next uint64, err error) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	if ic.db == nil {
+		return
+	}
+	err = ic.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(dbSeqNextBucket)
+		if bkt == nil {
+			return nil
+		}
+		if v := bkt.Get(dbSeqNextKey); len(v) == 8 {
+			next = binary.LittleEndian.Uint64(v)
+		}
+		return bkt.Delete(dbSeqNextKey)
+	})
+	return
+}
+
 // Close flushes hot blocks to the store and closes the cache
 func (ic *IngestCache) Close() error {
 	ic.mtx.Lock()
@@ -256,9 +316,22 @@ func (ic *IngestCache) Close() error {
 
 // HotBlocks returns the number of blocks currently held in memory
 func (ic *IngestCache) HotBlocks() int {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
 	return len(ic.hotBlocks)
 }
 
+// hotEntries returns the number and size of the entries held in memory
+func (ic *IngestCache) hotEntries() (n, sz uint64) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	for _, blk := range ic.hotBlocks {
+		n += uint64(blk.Count())
+		sz += blk.Size()
+	}
+	return
+}
+
 // StoredBlocks returns the total number of blocks held in the store
 func (ic *IngestCache) StoredBlocks() int {
 	ic.mtx.Lock()
@@ -291,11 +364,25 @@ func (ic *IngestCache) getStoredBlocks() int {
 
 // MemoryCacheSize returns how much is held in memory
 func (ic *IngestCache) MemoryCacheSize() uint64 {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
 	return ic.cacheSize
 }
 
+// EntriesIn returns the total number of entries that have been added to the cache
+func (ic *IngestCache) EntriesIn() uint64 {
+	return atomic.LoadUint64(&ic.entsIn)
+}
+
+// EntriesOut returns the total number of entries that have been popped from the cache
+func (ic *IngestCache) EntriesOut() uint64 {
+	return atomic.LoadUint64(&ic.entsOut)
+}
+
 //Count returns the number of entries held, including in the storage system
 func (ic *IngestCache) Count() uint64 {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
 	return ic.count
 }
 
@@ -364,30 +451,17 @@ routineLoop:
 			if !ok {
 				break routineLoop
 			}
-			if ic.addEntry(ent) && ic.fileBacked {
-				//we need to trim the cache to the store
-				if err := ic.trimMemoryCache(); err != nil {
-					ic.err = err
-					break routineLoop
-				}
+			if _, err := ic.cacheEntries(ent); err != nil {
+				ic.err = err
+				break routineLoop
 			}
-			ic.count++
 		case set, ok := <-bchan:
 			if !ok {
 				break routineLoop
 			}
-			for _, e := range set {
-				if e == nil {
-					continue
-				}
-				if ic.addEntry(e) && ic.fileBacked {
-					//we need to trim the cache to the store
-					if err := ic.trimMemoryCache(); err != nil {
-						ic.err = err
-						break routineLoop
-					}
-				}
-				ic.count++
+			if _, err := ic.cacheEntries(set...); err != nil {
+				ic.err = err
+				break routineLoop
 			}
 		case _ = <-ic.stCh:
 			break routineLoop
@@ -401,7 +475,42 @@ routineLoop:
 			}
 		}
 	}
+	ic.mtx.Lock()
 	ic.running = false
+	ic.mtx.Unlock()
+}
+
+// cacheEntries adds entries to the cache, trimming the memory cache to the store when needed.
+// The lock is held so that accessors and PopBlock see a consistent view while the routine runs,
+// onAdd is called once it is released so that it can call back into the muxer.
+// If the store fails the entries that were not added are returned with the error,
+// the entry being added when it failed stays in the memory cache.
+func (ic *IngestCache) cacheEntries(ents ...*entry.Entry) (rest []*entry.Entry, err error) {
+	added := ents
+	ic.mtx.Lock()
+	for i, e := range ents {
+		if e == nil {
+			continue
+		}
+		trim := ic.addEntry(e)
+		ic.count++
+		if trim && ic.fileBacked {
+			//we need to trim the cache to the store
+			if err = ic.trimMemoryCache(); err != nil {
+				added, rest = ents[:i+1], ents[i+1:]
+				break
+			}
+		}
+	}
+	ic.mtx.Unlock()
+	if ic.onAdd != nil {
+		for _, e := range added {
+			if e != nil {
+				ic.onAdd(e)
+			}
+		}
+	}
+	return
 }
 
 // addEntry will add an entry to the cache and returns a boolean
@@ -420,6 +529,7 @@ func (ic *IngestCache) addEntry(ent *entry.Entry) bool {
 	}
 	//at this point the currBlock points at the right key
 	ic.currBlock.Add(ent)
+	atomic.AddUint64(&ic.entsIn, 1)
 	ic.cacheSize += ent.Size()
 	if ic.cacheSize >= ic.maxMemCacheSize {
 		return true
@@ -543,6 +653,11 @@ func (ic *IngestCache) pushBlock(key entry.EntryKey, blk *entry.EntryBlock) erro
 		return err
 	}
 	addSize := uint64(len(buff) - oldSize)
+	//sequence numbers go into the store with their entries
+	var seqs []uint64
+	if ic.seq != nil {
+		seqs = ic.seq.take(blk.Entries())
+	}
 	if err := ic.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket(dbBucketName)
 		if bkt == nil {
@@ -551,9 +666,17 @@ func (ic *IngestCache) pushBlock(key entry.EntryKey, blk *entry.EntryBlock) erro
 		if err := bkt.Put(dbKey, buff); err != nil {
 			return err
 		}
+		if seqs != nil {
+			if err := appendSeqs(tx, dbKey, buff, !newBlock, seqs); err != nil {
+				return err
+			}
+		}
 		ic.storeSize += addSize
 		return nil
 	}); err != nil {
+		if seqs != nil {
+			ic.seq.restore(blk.Entries(), seqs)
+		}
 		return err
 	}
 	if newBlock {
@@ -571,13 +694,20 @@ func (ic *IngestCache) PopBlock() (*entry.EntryBlock, error) {
 		return nil, ErrCannotPopWhileRunning
 	}
 	if !ic.fileBacked {
-		return ic.popHotBlock(), nil
+		blk := ic.popHotBlock()
+		if blk != nil {
+			atomic.AddUint64(&ic.entsOut, uint64(blk.Count()))
+		}
+		return blk, nil
 	}
-	key, blk, err := ic.popStoreBlock()
+	key, blk, seqs, err := ic.popStoreBlock()
 	if err != nil {
 		return nil, err
 	}
 	if key != 0 {
+		if ic.seq != nil && seqs != nil {
+			ic.seq.restore(blk.Entries(), seqs)
+		}
 		blk = ic.popAndMergeHotBlock(key, blk)
 		ic.storeSize -= blk.Size()
 	} else {
@@ -585,6 +715,8 @@ func (ic *IngestCache) PopBlock() (*entry.EntryBlock, error) {
 	}
 	if blk == nil {
 		err = ic.compactDb()
+	} else {
+		atomic.AddUint64(&ic.entsOut, uint64(blk.Count()))
 	}
 	return blk, err
 }
@@ -597,11 +729,15 @@ func (ic *IngestCache) compactDb() error {
 	if err := ic.db.Sync(); err != nil {
 		return err
 	}
-	// Grab the tags before we go
+	// Grab the tags and the journal before we go
 	ctags, err := getTagList(ic.db)
 	if err != nil {
 		return err
 	}
+	jkeys, jvals, jseq, err := getJournal(ic.db)
+	if err != nil {
+		return err
+	}
 
 	if err := ic.db.Close(); err != nil {
 		return err
@@ -637,6 +773,9 @@ func (ic *IngestCache) compactDb() error {
 	if err != nil {
 		return err
 	}
+	if err = putJournal(db, jkeys, jvals, jseq); err != nil {
+		return err
+	}
 
 	ic.storedBlocks = 0
 	ic.count = 0
@@ -646,15 +785,27 @@ func (ic *IngestCache) compactDb() error {
 	return putTagList(db, ctags)
 }
 
-func (ic *IngestCache) popStoreBlock() (key entry.EntryKey, blk *entry.EntryBlock, err error) {
+// popStoreBlock pulls the first decodable block out of the store along with the
+// sequence numbers stored for its entries, seqs is nil if there are none
+func (ic *IngestCache) popStoreBlock() (key entry.EntryKey, blk *entry.EntryBlock, seqs []uint64, err error) {
 	var tblk entry.EntryBlock
 	if err = ic.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket(dbBucketName)
 		if bkt == nil {
 			return ErrBucketMissing
 		}
+		sbkt := tx.Bucket(dbSeqBucket)
 		c := bkt.Cursor()
 		for kb, vb := c.First(); kb != nil && vb != nil; kb, vb = c.Next() {
+			var sv []byte
+			if sbkt != nil {
+				if sv = sbkt.Get(kb); sv != nil {
+					sv = append([]byte(nil), sv...)
+					if err := sbkt.Delete(kb); err != nil {
+						return err
+					}
+				}
+			}
 			c.Delete() //removing, one way or another
 			key, err = getKey(kb)
 			if err != nil {
@@ -665,16 +816,59 @@ func (ic *IngestCache) popStoreBlock() (key entry.EntryKey, blk *entry.EntryBloc
 				continue
 			}
 			blk = &tblk
+			seqs = decodeSeqs(sv, tblk.Count())
 			break //got it
 		}
 		return nil
 	}); err != nil {
 		blk = nil
+		seqs = nil
 		return
 	}
 	return
 }
 
+// appendSeqs stores the sequence numbers of entries just appended to the stored
+// block, existing is set if the block was already in the store.  Entries that
+// went in without numbers are padded out with zeros so that the numbers stay in
+// step with the entries.
+func appendSeqs(tx *bolt.Tx, dbKey, stored []byte, existing bool, seqs []uint64) error {
+	bkt, err := tx.CreateBucketIfNotExists(dbSeqBucket)
+	if err != nil {
+		return err
+	}
+	var cur []byte
+	if existing {
+		if cur = bkt.Get(dbKey); cur == nil {
+			var blk entry.EntryBlock
+			if err := blk.Decode(stored); err != nil {
+				return err
+			}
+			cur = make([]byte, 8*(blk.Count()-len(seqs)))
+		}
+	}
+	v := make([]byte, len(cur), len(cur)+8*len(seqs))
+	copy(v, cur)
+	for _, seq := range seqs {
+		v = append(v, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(v[len(v)-8:], seq)
+	}
+	return bkt.Put(dbKey, v)
+}
+
+// decodeSeqs unpacks the sequence numbers stored for a block of cnt entries,
+// numbers that are out of step with the block are discarded
+func decodeSeqs(v []byte, cnt int) (seqs []uint64) {
+	if len(v) == 0 || len(v) != 8*cnt {
+		return nil
+	}
+	seqs = make([]uint64, cnt)
+	for i := range seqs {
+		seqs[i] = binary.LittleEndian.Uint64(v[8*i:])
+	}
+	return
+}
+
 func (ic *IngestCache) popAndMergeHotBlock(key entry.EntryKey, blk *entry.EntryBlock) *entry.EntryBlock {
 	b, ok := ic.hotBlocks[key]
 	if !ok {
@@ -0,0 +1,112 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestCloseContextDelivered(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 1000
+	for i := 0; i < count; i++ {
+		if err := im.Write(entry.Now(), tag, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rep, err := im.CloseContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//log entries written by the muxer itself may be delivered too
+	if rep.Delivered < count || rep.DeliveredBytes < count*uint64(100+entry.ENTRY_HEADER_SIZE) {
+		t.Fatal("Bad delivered count", rep)
+	}
+	if rep.Cached != 0 || rep.Lost != 0 {
+		t.Fatal("Bad close report", rep)
+	}
+	if n := ti.Count(); uint64(n) != rep.Delivered {
+		t.Fatal("Report does not match the indexer", n, rep.Delivered)
+	}
+	if err := im.Write(entry.Now(), tag, []byte(`late`)); err != ErrNotRunning {
+		t.Fatal("Write accepted after close", err)
+	}
+	//closing again is a no-op
+	if rep, err = im.CloseContext(ctx); err != nil || rep != (CloseReport{}) {
+		t.Fatal("Bad second close", rep, err)
+	}
+}
+
+func TestCloseContextRemainder(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `close`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	esz := uint64(100 + entry.ENTRY_HEADER_SIZE)
+	for _, cached := range []bool{false, true} {
+		c := MuxerConfig{
+			Destinations: []Target{{Address: `tcp://127.1.1.1:55555`, Secret: `x`}},
+			Tags:         []string{`testA`},
+		}
+		if cached {
+			c.EnableCache = true
+			c.CacheConfig = IngestCacheConfig{
+				FileBackingLocation: filepath.Join(dir, `cache.db`),
+				MemoryCacheSize:     memCacheSize,
+			}
+		}
+		im, err := NewMuxer(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//entries stranded in the emergency queue are all that is left to account for
+		im.emergencyPush(im.groups[0], nil, testEntries(5, 100))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rep, err := im.CloseContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := CloseReport{Lost: 5, LostBytes: 5 * esz}
+		if cached {
+			exp = CloseReport{Cached: 5, CachedBytes: 5 * esz}
+		}
+		if rep != exp {
+			t.Fatalf("cached %v: expected %+v, got %+v", cached, exp, rep)
+		}
+	}
+}
@@ -22,6 +22,7 @@ const (
 	kb = 1024
 	mb = 1024 * kb
 	gb = 1024 * mb
+	tb = 1024 * gb
 )
 
 // AppendDefaultPort will append the network port in defPort to the address
@@ -57,6 +58,18 @@ var (
 		multSuff{mult: 1024 * 1024 * 1024, suffix: `gbit`},
 		multSuff{mult: 1024 * 1024 * 1024, suffix: `gbps`},
 	}
+	//longer suffixes must come first so that "kb" is not matched as "b"
+	sizeSuffix = []multSuff{
+		multSuff{mult: kb, suffix: `kb`},
+		multSuff{mult: mb, suffix: `mb`},
+		multSuff{mult: gb, suffix: `gb`},
+		multSuff{mult: tb, suffix: `tb`},
+		multSuff{mult: kb, suffix: `k`},
+		multSuff{mult: mb, suffix: `m`},
+		multSuff{mult: gb, suffix: `g`},
+		multSuff{mult: tb, suffix: `t`},
+		multSuff{mult: 1, suffix: `b`},
+	}
 )
 
 // ParseRate parses a data rate, returning an integer bits per second.
@@ -90,6 +103,29 @@ func ParseRate(s string) (Bps int64, err error) {
 	return
 }
 
+// ParseDataSize parses a size in bytes.  The string may be followed by one of
+// the following suffixes: b, k, kb, m, mb, g, gb, t, tb; multiples are powers of 1024.
+func ParseDataSize(s string) (sz uint64, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	mult := uint64(1)
+	for _, v := range sizeSuffix {
+		if strings.HasSuffix(s, v.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, v.suffix))
+			mult = uint64(v.mult)
+			break
+		}
+	}
+	if sz, err = strconv.ParseUint(s, 10, 64); err != nil {
+		return
+	}
+	if sz > (^uint64(0))/mult {
+		err = fmt.Errorf("Data size %s overflows", s)
+		return
+	}
+	sz *= mult
+	return
+}
+
 // ParseSource returns a net.IP byte buffer
 // the returned buffer will always be a 32bit or 128bit buffer
 // but we accept encodings as IPv4, IPv6, integer, hex encoded hash
@@ -0,0 +1,215 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/minio/highwayhash"
+)
+
+const (
+	defaultDedupMaxEntries int = 64 * 1024
+)
+
+var (
+	ErrInvalidDedupConfig = errors.New("Invalid duplicate suppression config")
+	ErrEntryDuplicate     = errors.New("Entry suppressed as a duplicate")
+)
+
+// DedupConfig enables duplicate suppression on the muxer write path.  An entry
+// whose tag and data match an entry written within the last Window is dropped,
+// MatchTS and MatchSRC add the timestamp and source to the match.
+// MaxEntries bounds the number of entries remembered, the oldest are forgotten
+// first; each costs roughly 40 bytes.  A zero Window disables suppression.
+//
+// Only entries handed to the muxer are checked, entries the muxer recycles after
+// a connection failure are always resent because their delivery was never confirmed.
+type DedupConfig struct {
+	Window     time.Duration
+	MaxEntries int
+	MatchTS    bool
+	MatchSRC   bool
+}
+
+func (dc DedupConfig) enabled() bool {
+	return dc.Window != 0
+}
+
+func (dc DedupConfig) validate() error {
+	if dc.Window < 0 || dc.MaxEntries < 0 {
+		return ErrInvalidDedupConfig
+	}
+	return nil
+}
+
+type dedupRecord struct {
+	hash uint64
+	ts   int64
+}
+
+// dedupWindow remembers the hashes of recently written entries in arrival order
+type dedupWindow struct {
+	suppressed uint64 //atomic, must stay at the top for alignment
+	mtx        sync.Mutex
+	cfg        DedupConfig
+	h          hash.Hash64
+	seen       map[uint64]int64 //hash to the time it was remembered
+	fifo       []dedupRecord
+	head       int
+	buff       [16]byte
+}
+
+func newDedupWindow(cfg DedupConfig) (*dedupWindow, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = defaultDedupMaxEntries
+	}
+	//a random key keeps hostile data from forcing collisions
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	h, err := highwayhash.New64(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupWindow{
+		cfg:  cfg,
+		h:    h,
+		seen: make(map[uint64]int64),
+	}, nil
+}
+
+// sum hashes the identifying fields of an entry, the caller must hold the lock
+func (dw *dedupWindow) sum(e *entry.Entry) uint64 {
+	dw.h.Reset()
+	binary.LittleEndian.PutUint16(dw.buff[:2], uint16(e.Tag))
+	dw.h.Write(dw.buff[:2])
+	if dw.cfg.MatchTS {
+		binary.LittleEndian.PutUint64(dw.buff[:8], uint64(e.TS.Sec))
+		binary.LittleEndian.PutUint64(dw.buff[8:], uint64(e.TS.Nsec))
+		dw.h.Write(dw.buff[:])
+	}
+	if dw.cfg.MatchSRC {
+		//normalize so that v4 and v4-in-v6 addresses match, a missing source hashes as zeros
+		src := dw.buff[:]
+		for i := range src {
+			src[i] = 0
+		}
+		copy(src, e.SRC.To16())
+		dw.h.Write(src)
+	}
+	dw.h.Write(e.Data)
+	return dw.h.Sum64()
+}
+
+// duplicate returns true if the entry was already seen within the window,
+// otherwise the entry is remembered
+func (dw *dedupWindow) duplicate(e *entry.Entry, now time.Time) bool {
+	ts := now.UnixNano()
+	dw.mtx.Lock()
+	defer dw.mtx.Unlock()
+	dw.expire(ts - int64(dw.cfg.Window))
+	h := dw.sum(e)
+	if _, ok := dw.seen[h]; ok {
+		atomic.AddUint64(&dw.suppressed, 1)
+		return true
+	}
+	if len(dw.seen) >= dw.cfg.MaxEntries {
+		dw.pop()
+	}
+	dw.seen[h] = ts
+	dw.fifo = append(dw.fifo, dedupRecord{hash: h, ts: ts})
+	return false
+}
+
+// expire forgets everything remembered at or before the cutoff
+func (dw *dedupWindow) expire(cutoff int64) {
+	for dw.head < len(dw.fifo) && dw.fifo[dw.head].ts <= cutoff {
+		dw.pop()
+	}
+}
+
+// pop forgets the oldest entry, compacting the fifo once half of it is dead space
+func (dw *dedupWindow) pop() {
+	if dw.head >= len(dw.fifo) {
+		return
+	}
+	//the hash may have been forgotten and remembered again since this record was added
+	if r := dw.fifo[dw.head]; dw.seen[r.hash] == r.ts {
+		delete(dw.seen, r.hash)
+	}
+	dw.head++
+	if dw.head == len(dw.fifo) {
+		dw.fifo = dw.fifo[:0]
+		dw.head = 0
+	} else if dw.head >= 1024 && dw.head*2 >= len(dw.fifo) {
+		n := copy(dw.fifo, dw.fifo[dw.head:])
+		dw.fifo = dw.fifo[:n]
+		dw.head = 0
+	}
+}
+
+// forget removes entries that failed to queue so that a retry is not suppressed
+func (dw *dedupWindow) forget(ents ...*entry.Entry) {
+	dw.mtx.Lock()
+	for _, e := range ents {
+		if e != nil {
+			delete(dw.seen, dw.sum(e))
+		}
+	}
+	dw.mtx.Unlock()
+}
+
+func (dw *dedupWindow) tracked() int {
+	dw.mtx.Lock()
+	defer dw.mtx.Unlock()
+	return len(dw.seen)
+}
+
+// dedupEntry returns true if the entry is a duplicate and should not be queued
+func (im *IngestMuxer) dedupEntry(e *entry.Entry) bool {
+	if !im.dedup.duplicate(e, time.Now()) {
+		return false
+	}
+	im.acks.resolve(e, ErrEntryDuplicate)
+	return true
+}
+
+// dedupBatch removes duplicates from a batch, duplicates within the batch are removed as well.
+// The caller's slice is only copied if something has to be removed.
+func (im *IngestMuxer) dedupBatch(b []*entry.Entry) []*entry.Entry {
+	var out []*entry.Entry
+	for i, e := range b {
+		if e == nil {
+			continue
+		}
+		dup := im.dedupEntry(e)
+		if dup && out == nil {
+			out = make([]*entry.Entry, i, len(b))
+			copy(out, b[:i])
+		} else if !dup && out != nil {
+			out = append(out, e)
+		}
+	}
+	if out == nil {
+		return b
+	}
+	return out
+}
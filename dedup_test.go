@@ -0,0 +1,174 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestDedupWindow(t *testing.T) {
+	if _, err := newDedupWindow(DedupConfig{Window: -time.Second}); err != ErrInvalidDedupConfig {
+		t.Fatal("Failed to catch bad window", err)
+	}
+	dw, err := newDedupWindow(DedupConfig{Window: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a := &entry.Entry{TS: entry.Now(), Tag: 1, Data: []byte(`hello`)}
+	if dw.duplicate(a, now) {
+		t.Fatal("First entry flagged as a duplicate")
+	}
+	//timestamps and sources are ignored unless asked for
+	b := &entry.Entry{TS: entry.UnixTime(1, 0), Tag: 1, SRC: net.ParseIP(`10.0.0.1`), Data: []byte(`hello`)}
+	if !dw.duplicate(b, now.Add(time.Second)) {
+		t.Fatal("Duplicate not caught")
+	}
+	//the tag is part of the match
+	if dw.duplicate(&entry.Entry{Tag: 2, Data: []byte(`hello`)}, now) {
+		t.Fatal("Entry with another tag flagged as a duplicate")
+	}
+	if dw.suppressed != 1 || dw.tracked() != 2 {
+		t.Fatal("Bad counters", dw.suppressed, dw.tracked())
+	}
+	//once the window passes the entry is forgotten
+	if dw.duplicate(a, now.Add(2*time.Minute)) {
+		t.Fatal("Entry outside of the window flagged as a duplicate")
+	}
+	if dw.tracked() != 1 {
+		t.Fatal("Expired entries still tracked", dw.tracked())
+	}
+	dw.forget(a)
+	if dw.duplicate(a, now.Add(2*time.Minute)) {
+		t.Fatal("Forgotten entry flagged as a duplicate")
+	}
+}
+
+func TestDedupWindowMatch(t *testing.T) {
+	dw, err := newDedupWindow(DedupConfig{Window: time.Minute, MatchTS: true, MatchSRC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a := &entry.Entry{TS: entry.UnixTime(100, 5), SRC: net.ParseIP(`10.0.0.1`), Data: []byte(`hello`)}
+	if dw.duplicate(a, now) {
+		t.Fatal("First entry flagged as a duplicate")
+	}
+	//v4 and v4-in-v6 encodings of the same source match
+	b := &entry.Entry{TS: entry.UnixTime(100, 5), SRC: net.ParseIP(`10.0.0.1`).To4(), Data: []byte(`hello`)}
+	if !dw.duplicate(b, now) {
+		t.Fatal("Duplicate not caught")
+	}
+	b.TS = entry.UnixTime(100, 6)
+	if dw.duplicate(b, now) {
+		t.Fatal("Entry with another timestamp flagged as a duplicate")
+	}
+	b.TS, b.SRC = a.TS, net.ParseIP(`10.0.0.2`)
+	if dw.duplicate(b, now) {
+		t.Fatal("Entry with another source flagged as a duplicate")
+	}
+}
+
+func TestDedupWindowBound(t *testing.T) {
+	dw, err := newDedupWindow(DedupConfig{Window: time.Hour, MaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 5000; i++ {
+		if dw.duplicate(&entry.Entry{Data: []byte(fmt.Sprintf("entry %d", i))}, now) {
+			t.Fatal("Unique entry flagged as a duplicate", i)
+		}
+	}
+	if n := dw.tracked(); n != 100 {
+		t.Fatal("Window not bounded", n)
+	}
+	if len(dw.fifo)-dw.head != 100 || cap(dw.fifo) > 4096 {
+		t.Fatal("Fifo not compacted", len(dw.fifo), dw.head, cap(dw.fifo))
+	}
+	//the newest entries are kept
+	if !dw.duplicate(&entry.Entry{Data: []byte(`entry 4999`)}, now) {
+		t.Fatal("Newest entry was evicted")
+	}
+	if dw.duplicate(&entry.Entry{Data: []byte(`entry 0`)}, now) {
+		t.Fatal("Oldest entry was not evicted")
+	}
+}
+
+func TestMuxerDedup(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+		Dedup:        DedupConfig{Window: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := im.Write(entry.Now(), tag, []byte(`dup`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//duplicates are removed from within a batch too
+	b := []*entry.Entry{
+		{TS: entry.Now(), Tag: tag, Data: []byte(`dup`)},
+		{TS: entry.Now(), Tag: tag, Data: []byte(`uniq`)},
+		{TS: entry.Now(), Tag: tag, Data: []byte(`uniq`)},
+	}
+	if err := im.WriteBatch(b); err != nil {
+		t.Fatal(err)
+	}
+	ea, err := im.WriteEntryAck(&entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`uniq`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ea.Wait(ctx); err != ErrEntryDuplicate {
+		t.Fatal("Bad ack on duplicate", err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ms := im.Stats()
+	if !ms.DedupEnabled || ms.DedupSuppressed != 6 || ms.DedupTracked != 2 {
+		t.Fatal("Bad dedup stats", ms.DedupSuppressed, ms.DedupTracked)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	for _, e := range ti.Entries() {
+		if s := string(e.Data); s == `dup` || s == `uniq` {
+			got++
+		}
+	}
+	if got != 2 {
+		t.Fatal("Bad delivered count", got)
+	}
+}
@@ -0,0 +1,315 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultFallbackDelay time.Duration = 300 * time.Millisecond
+)
+
+var (
+	ErrInvalidDialConfig = errors.New("Invalid dial config")
+	ErrNoAddresses       = errors.New("Target did not resolve to any addresses")
+)
+
+// DialFunc is a custom dial hook, it has the same signature as net.Dialer.DialContext.
+// The network is tcp for TCP and TLS targets and unix for pipes.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// LookupFunc resolves a target hostname, it has the same signature as net.Resolver.LookupIPAddr.
+type LookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// DialConfig controls how the muxer opens connections to its targets.  Dial
+// replaces the built in dialer, LocalAddr, Interface, KeepAlive, and everything
+// to do with resolving targets only apply to the built in dialer.  NoDelay and
+// the buffer sizes are applied to any TCP connection, including those handed
+// back by Dial.  Proxies are reached through the dialer as well.  Pipe targets
+// only honor Dial and Timeout.
+//
+// The built in dialer resolves TCP and TLS targets on every connection attempt
+// and tries each address in the order the resolver returned them.  An attempt
+// that has not connected after FallbackDelay is left running while the next
+// address is tried, the first to connect wins.  With SpreadAddresses set the
+// parallel connections to a target each start on a different address, so a
+// target with as many connections as addresses holds one to each of them.
+type DialConfig struct {
+	Dial            DialFunc
+	Lookup          LookupFunc    //nil uses the system resolver
+	Timeout         time.Duration //0 is DIAL_TIMEOUT, or the TLS handshake timeout for TLS targets
+	FallbackDelay   time.Duration //0 is 300ms
+	SpreadAddresses bool
+	LocalAddr       string        //local IP to connect from
+	Interface       string        //local interface to connect from, an address matching the target family is used
+	KeepAlive       time.Duration //TCP keepalive period, 0 is the system default and negative disables it
+	DisableNoDelay  bool          //leave Nagle's algorithm on, Go turns it off by default
+	SendBuffer      int           //SO_SNDBUF in bytes, 0 leaves the system default
+	RecvBuffer      int           //SO_RCVBUF in bytes, 0 is sized for the expected acks
+}
+
+func (dc DialConfig) validate() error {
+	if dc.Timeout < 0 || dc.FallbackDelay < 0 || dc.SendBuffer < 0 || dc.RecvBuffer < 0 {
+		return ErrInvalidDialConfig
+	}
+	if dc.LocalAddr != `` {
+		if dc.Interface != `` {
+			return fmt.Errorf("%v: LocalAddr and Interface are mutually exclusive", ErrInvalidDialConfig)
+		} else if net.ParseIP(dc.LocalAddr) == nil {
+			return fmt.Errorf("%v: LocalAddr %q is not an IP", ErrInvalidDialConfig, dc.LocalAddr)
+		}
+	}
+	return nil
+}
+
+// dialer builds the dial function described by the config, offset picks the
+// address to start on when SpreadAddresses is set
+func (dc DialConfig) dialer(offset int) dialFunc {
+	to := dc.Timeout
+	if to == 0 {
+		to = DIAL_TIMEOUT
+	}
+	return func(network, addr string) (conn net.Conn, err error) {
+		ctx, cancel := context.WithTimeout(context.Background(), to)
+		defer cancel()
+		if dc.Dial != nil {
+			if conn, err = dc.Dial(ctx, network, addr); err == nil {
+				if err = dc.setSockOpts(conn); err != nil {
+					conn.Close()
+					conn = nil
+				}
+			}
+			return
+		} else if network != `tcp` {
+			return dc.dialAddr(ctx, network, addr)
+		}
+		return dc.dialHost(ctx, addr, offset)
+	}
+}
+
+// dialHost resolves addr and races connections to the addresses it resolves to
+func (dc DialConfig) dialHost(ctx context.Context, addr string, offset int) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IPAddr{{IP: ip}}
+	} else {
+		lookup := dc.Lookup
+		if lookup == nil {
+			lookup = net.DefaultResolver.LookupIPAddr
+		}
+		if ips, err = lookup(ctx, host); err != nil {
+			return nil, err
+		} else if len(ips) == 0 {
+			return nil, ErrNoAddresses
+		}
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	if dc.SpreadAddresses && offset > 0 {
+		n := offset % len(addrs)
+		addrs = append(addrs[n:], addrs[:n]...)
+	}
+	delay := dc.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	return raceDial(ctx, addrs, delay, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dc.dialAddr(ctx, `tcp`, addr)
+	})
+}
+
+// raceDial tries each address in order, starting on the next one when the last
+// fails or has not connected within delay.  The first connection wins and any
+// that complete after it are closed.  The error from the first address is
+// returned if none connect.
+func raceDial(ctx context.Context, addrs []string, delay time.Duration, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(addrs))
+	var next, pending int
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- result{conn: conn, err: err}
+		}()
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var fallback <-chan time.Time
+		var tmr *time.Timer
+		if next < len(addrs) {
+			tmr = time.NewTimer(delay)
+			fallback = tmr.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if tmr != nil {
+					tmr.Stop()
+				}
+				//the losers see the cancel, anything that connects anyway is closed
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-fallback:
+			start()
+		}
+		if tmr != nil {
+			tmr.Stop()
+		}
+	}
+	return nil, firstErr
+}
+
+// dialAddr connects to a single address with the built in dialer
+func (dc DialConfig) dialAddr(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	d := net.Dialer{KeepAlive: dc.KeepAlive}
+	if network == `tcp` {
+		if d.LocalAddr, err = dc.localAddr(addr); err != nil {
+			return
+		}
+	}
+	if conn, err = d.DialContext(ctx, network, addr); err != nil {
+		return
+	}
+	if err = dc.setSockOpts(conn); err != nil {
+		conn.Close()
+		conn = nil
+	}
+	return
+}
+
+// localAddr returns the address to bind when connecting to addr, nil lets the system pick
+func (dc DialConfig) localAddr(addr string) (net.Addr, error) {
+	if dc.LocalAddr != `` {
+		return &net.TCPAddr{IP: net.ParseIP(dc.LocalAddr)}, nil
+	} else if dc.Interface == `` {
+		return nil, nil
+	}
+	ifc, err := net.InterfaceByName(dc.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	//addresses are resolved before we get here, anything else is assumed to be IPv4
+	want4 := true
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			want4 = ip.To4() != nil
+		}
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || (ipn.IP.To4() != nil) != want4 {
+			continue
+		}
+		return &net.TCPAddr{IP: ipn.IP}, nil
+	}
+	return nil, fmt.Errorf("Interface %s has no address to reach %s", dc.Interface, addr)
+}
+
+// setSockOpts applies the socket options to TCP connections, anything else is left alone
+func (dc DialConfig) setSockOpts(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if dc.DisableNoDelay {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if dc.SendBuffer > 0 {
+		if err := tc.SetWriteBuffer(dc.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if dc.RecvBuffer > 0 {
+		if err := tc.SetReadBuffer(dc.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialFunc establishes the raw connection to a target address
+type dialFunc func(network, addr string) (net.Conn, error)
+
+func defaultDial(network, addr string) (net.Conn, error) {
+	return net.DialTimeout(network, addr, DIAL_TIMEOUT)
+}
+
+// connDialer carries how a connection to a target is established, a nil
+// connDialer dials directly with the defaults
+type connDialer struct {
+	dial       dialFunc
+	ownBuffers bool //the dialer sized the receive buffer, the entry writer leaves it alone
+	custom     bool //connections come from a user hook and may not be IP based
+}
+
+func (cd *connDialer) dialer() dialFunc {
+	if cd == nil {
+		return nil
+	}
+	return cd.dial
+}
+
+func (cd *connDialer) keepBuffers() bool {
+	return cd != nil && cd.ownBuffers
+}
+
+// localIP pulls the source address out of a connection, connections from a
+// custom dialer may not be IP based so they fall back to localhost like pipes
+func localIP(conn net.Conn, cd *connDialer) (net.IP, error) {
+	if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip, nil
+		}
+	}
+	if cd != nil && cd.custom {
+		return localhostAddr, nil
+	}
+	return nil, ErrFailedParseLocalIP
+}
@@ -0,0 +1,327 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialConfigValidate(t *testing.T) {
+	good := []DialConfig{
+		{},
+		{LocalAddr: `127.0.0.1`, KeepAlive: -1},
+		{Interface: `lo`, SendBuffer: 1024, RecvBuffer: 1024, Timeout: time.Second},
+	}
+	for _, v := range good {
+		if err := v.validate(); err != nil {
+			t.Fatalf("Rejected good config %+v: %v", v, err)
+		}
+	}
+	bad := []DialConfig{
+		{Timeout: -1},
+		{SendBuffer: -1},
+		{RecvBuffer: -1},
+		{LocalAddr: `localhost`},
+		{LocalAddr: `127.0.0.1`, Interface: `lo`},
+	}
+	for _, v := range bad {
+		if err := v.validate(); err == nil {
+			t.Fatalf("Accepted bad config %+v", v)
+		}
+	}
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	c := MuxerConfig{Destinations: []Target{ti.Target()}, Tags: []string{`testA`}, Dial: bad[0]}
+	if _, err := NewMuxer(c); err != ErrInvalidDialConfig {
+		t.Fatal("Failed to catch bad dial config", err)
+	}
+}
+
+func TestDialSockOpts(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	dc := DialConfig{
+		LocalAddr:      `127.0.0.1`,
+		KeepAlive:      15 * time.Second,
+		DisableNoDelay: true,
+		SendBuffer:     64 * 1024,
+		RecvBuffer:     64 * 1024,
+	}
+	conn, err := dc.dialer(0)(`tcp`, lst.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("Bad connection type %T", conn)
+	}
+	if ip, err := localIP(conn, nil); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatal("Bad local address", ip, err)
+	}
+
+	//an address in the wrong family can't reach the target
+	dc = DialConfig{LocalAddr: `::1`}
+	if conn, err := dc.dialer(0)(`tcp`, lst.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("Connected from an IPv6 address to an IPv4 target")
+	}
+}
+
+func TestMuxerCustomDial(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	var mtx sync.Mutex
+	var addrs []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Dial context has no deadline")
+		}
+		mtx.Lock()
+		addrs = append(addrs, network+` `+addr)
+		mtx.Unlock()
+		cli, srv := net.Pipe()
+		ti.Lock()
+		ti.conns = append(ti.conns, srv)
+		ti.Unlock()
+		ti.wg.Add(1)
+		go ti.handle(srv)
+		return cli, nil
+	}
+	//the target never resolves, every connection is handed over in memory
+	proxyWrite(t, MuxerConfig{
+		Destinations: []Target{{Address: `tcp://indexer.invalid:4023`, Secret: testIndexerSecret}},
+		Tags:         []string{`testA`},
+		Dial:         DialConfig{Dial: dial, RecvBuffer: 1024},
+	}, 10)
+	if n := countData(ti.Entries()); n != 10 {
+		t.Fatal("Bad entry count", n)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(addrs) != 1 || addrs[0] != `tcp indexer.invalid:4023` {
+		t.Fatal("Bad dials", addrs)
+	}
+}
+
+func TestMuxerDialOptions(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	proxyWrite(t, MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+		Dial: DialConfig{
+			LocalAddr:  `127.0.0.1`,
+			KeepAlive:  -1,
+			SendBuffer: 128 * 1024,
+			RecvBuffer: 128 * 1024,
+		},
+	}, 10)
+	if n := countData(ti.Entries()); n != 10 {
+		t.Fatal("Bad entry count", n)
+	}
+}
+
+func TestRaceDial(t *testing.T) {
+	var mtx sync.Mutex
+	var tried []string
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		mtx.Lock()
+		tried = append(tried, addr)
+		mtx.Unlock()
+		switch addr {
+		case `hang`:
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case `refuse`:
+			return nil, errors.New(addr)
+		}
+		cli, srv := net.Pipe()
+		srv.Close()
+		return cli, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	//a hung address is left behind after the delay, a refused one right away
+	ts := time.Now()
+	conn, err := raceDial(ctx, []string{`hang`, `refuse`, `ok`}, 50*time.Millisecond, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(ts); d < 50*time.Millisecond || d > 2*time.Second {
+		t.Fatal("Bad fallback time", d)
+	}
+	mtx.Lock()
+	if len(tried) != 3 || tried[0] != `hang` || tried[1] != `refuse` || tried[2] != `ok` {
+		t.Fatal("Bad dial order", tried)
+	}
+	tried = nil
+	mtx.Unlock()
+
+	//the first address to fail is what gets reported
+	if _, err := raceDial(ctx, []string{`refuse`, `hang`}, time.Millisecond, func(ctx context.Context, addr string) (net.Conn, error) {
+		if addr == `hang` {
+			return nil, errors.New(`timeout`)
+		}
+		return dial(ctx, addr)
+	}); err == nil || err.Error() != `refuse` {
+		t.Fatal("Bad error", err)
+	}
+}
+
+// testIndexerPair runs test indexers on 127.0.0.1 and 127.0.0.2 with the same port
+func testIndexerPair(t *testing.T) (a, b *testIndexer, port string) {
+	lstA, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ = net.SplitHostPort(lstA.Addr().String())
+	lstB, err := net.Listen("tcp", net.JoinHostPort(`127.0.0.2`, port))
+	if err != nil {
+		lstA.Close()
+		t.Skip("Cannot listen on 127.0.0.2", err)
+	}
+	return newTestIndexerListener(t, lstA), newTestIndexerListener(t, lstB), port
+}
+
+// testLookup is a stand in resolver for indexer.test whose answers can be changed
+type testLookup struct {
+	sync.Mutex
+	ips     []string
+	lookups int
+}
+
+func (tl *testLookup) set(ips ...string) {
+	tl.Lock()
+	tl.ips = ips
+	tl.Unlock()
+}
+
+func (tl *testLookup) count() int {
+	tl.Lock()
+	defer tl.Unlock()
+	return tl.lookups
+}
+
+func (tl *testLookup) lookup(ctx context.Context, host string) (ret []net.IPAddr, err error) {
+	if host != `indexer.test` {
+		return nil, &net.DNSError{Err: `no such host`, Name: host, IsNotFound: true}
+	}
+	tl.Lock()
+	defer tl.Unlock()
+	tl.lookups++
+	for _, ip := range tl.ips {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return
+}
+
+func TestMuxerResolveFailover(t *testing.T) {
+	tiA, tiB, port := testIndexerPair(t)
+	defer tiA.Close()
+	defer tiB.Close()
+	//nothing listens on 127.0.0.3, so the first address is refused
+	tl := &testLookup{}
+	tl.set(`127.0.0.3`, `127.0.0.2`, `127.0.0.1`)
+	proxyWrite(t, MuxerConfig{
+		Destinations: []Target{{Address: `tcp://indexer.test:` + port, Secret: testIndexerSecret}},
+		Tags:         []string{`testA`},
+		Dial:         DialConfig{Lookup: tl.lookup},
+	}, 10)
+	if n := countData(tiB.Entries()); n != 10 {
+		t.Fatal("Bad entry count", n)
+	}
+	if n := tiA.Count(); n != 0 {
+		t.Fatal("Connected past the first good address", n)
+	}
+	if n := tl.count(); n != 1 {
+		t.Fatal("Bad lookup count", n)
+	}
+}
+
+func TestMuxerResolveReconnect(t *testing.T) {
+	tiA, tiB, port := testIndexerPair(t)
+	defer tiA.Close()
+	defer tiB.Close()
+	tl := &testLookup{}
+	tl.set(`127.0.0.1`)
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{{Address: `tcp://indexer.test:` + port, Secret: testIndexerSecret}},
+		Tags:         []string{`testA`},
+		Dial:         DialConfig{Lookup: tl.lookup},
+		RetryPolicy:  RetryPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//the target moves, the reconnect has to find it at the new address
+	tl.set(`127.0.0.2`)
+	tiA.Lock()
+	for _, c := range tiA.conns {
+		c.Close()
+	}
+	tiA.Unlock()
+	ts := time.Now()
+	for {
+		tiB.Lock()
+		n := len(tiB.conns)
+		tiB.Unlock()
+		if n > 0 {
+			break
+		} else if time.Since(ts) > 5*time.Second {
+			t.Fatal("Never reconnected to the new address")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tl.count(); n < 2 {
+		t.Fatal("Target was not resolved again", n)
+	}
+}
+
+func TestMuxerSpreadAddresses(t *testing.T) {
+	tiA, tiB, port := testIndexerPair(t)
+	defer tiA.Close()
+	defer tiB.Close()
+	tl := &testLookup{}
+	tl.set(`127.0.0.1`, `127.0.0.2`)
+	proxyWrite(t, MuxerConfig{
+		Destinations: []Target{{Address: `tcp://indexer.test:` + port, Secret: testIndexerSecret, Connections: 2}},
+		Tags:         []string{`testA`},
+		Dial:         DialConfig{Lookup: tl.lookup, SpreadAddresses: true},
+	}, 100)
+	tiA.Lock()
+	a := len(tiA.conns)
+	tiA.Unlock()
+	tiB.Lock()
+	b := len(tiB.conns)
+	tiB.Unlock()
+	if a != 1 || b != 1 {
+		t.Fatal("Connections were not spread", a, b)
+	}
+	if n := countData(tiA.Entries()) + countData(tiB.Entries()); n != 100 {
+		t.Fatal("Bad entry count", n)
+	}
+}
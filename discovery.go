@@ -0,0 +1,211 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDiscoveryInterval time.Duration = time.Minute
+	minDiscoveryInterval     time.Duration = time.Second
+	discoveryLookupTimeout   time.Duration = 10 * time.Second
+)
+
+var (
+	ErrInvalidDiscoveryScheme = errors.New("Invalid target discovery scheme, must be tcp or tls")
+	ErrMissingDiscoveryPort   = errors.New("Target discovery by A record requires a port")
+)
+
+// TargetDiscoveryConfig enables periodic DNS based discovery of indexer targets.
+// If Service is set, SRV records for _Service._Proto.Name are used to build the
+// target set, otherwise the A/AAAA records for Name are combined with Port.
+// Discovered targets are added and removed as the DNS records change, targets
+// specified directly in the muxer configuration are never removed by discovery.
+type TargetDiscoveryConfig struct {
+	Name     string        // DNS name to resolve, discovery is disabled if empty
+	Service  string        // optional SRV service name
+	Proto    string        // SRV protocol, defaults to tcp
+	Scheme   string        // connection type for discovered targets, tcp or tls
+	Port     uint16        // port used with A/AAAA records
+	Secret   string        // ingest secret for discovered targets
+	Interval time.Duration // how often to re-resolve, defaults to one minute
+	Resolver *net.Resolver // optional resolver, net.DefaultResolver is used if nil
+}
+
+func (dc TargetDiscoveryConfig) enabled() bool {
+	return dc.Name != ``
+}
+
+func (dc *TargetDiscoveryConfig) validate() error {
+	dc.Scheme = strings.ToLower(strings.TrimSpace(dc.Scheme))
+	switch dc.Scheme {
+	case ``:
+		dc.Scheme = `tcp`
+	case `tcp`, `tls`:
+	default:
+		return ErrInvalidDiscoveryScheme
+	}
+	if dc.Proto == `` {
+		dc.Proto = `tcp`
+	}
+	if dc.Service == `` && dc.Port == 0 {
+		return ErrMissingDiscoveryPort
+	}
+	if dc.Interval <= 0 {
+		dc.Interval = defaultDiscoveryInterval
+	} else if dc.Interval < minDiscoveryInterval {
+		dc.Interval = minDiscoveryInterval
+	}
+	return nil
+}
+
+// resolve performs the DNS lookup and returns a sorted set of target addresses
+func (dc TargetDiscoveryConfig) resolve(ctx context.Context) ([]string, error) {
+	r := dc.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	if dc.Service != `` {
+		_, srvs, err := r.LookupSRV(ctx, dc.Service, dc.Proto, dc.Name)
+		if err != nil {
+			return nil, err
+		}
+		return dc.srvAddresses(srvs), nil
+	}
+	hosts, err := r.LookupHost(ctx, dc.Name)
+	if err != nil {
+		return nil, err
+	}
+	return dc.hostAddresses(hosts), nil
+}
+
+func (dc TargetDiscoveryConfig) srvAddresses(srvs []*net.SRV) (addrs []string) {
+	for _, srv := range srvs {
+		if srv == nil || srv.Target == `` || srv.Target == `.` {
+			continue
+		}
+		host := strings.TrimSuffix(srv.Target, `.`)
+		addrs = append(addrs, dc.address(host, srv.Port))
+	}
+	return uniqueSorted(addrs)
+}
+
+func (dc TargetDiscoveryConfig) hostAddresses(hosts []string) (addrs []string) {
+	for _, h := range hosts {
+		addrs = append(addrs, dc.address(h, dc.Port))
+	}
+	return uniqueSorted(addrs)
+}
+
+func (dc TargetDiscoveryConfig) address(host string, port uint16) string {
+	return fmt.Sprintf("%s://%s", dc.Scheme, net.JoinHostPort(host, fmt.Sprintf("%d", port)))
+}
+
+func uniqueSorted(v []string) []string {
+	if len(v) == 0 {
+		return v
+	}
+	sort.Strings(v)
+	r := v[:1]
+	for _, s := range v[1:] {
+		if s != r[len(r)-1] {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+// reconcileTargets compares the resolved address set against the set of targets
+// that were previously discovered and the set that the muxer currently holds.
+// It returns the addresses which should be added and those that should be removed.
+// Addresses that are configured statically are never removed.
+func reconcileTargets(current []Target, discovered map[string]bool, resolved []string) (add, remove []string) {
+	have := make(map[string]bool, len(current))
+	for _, t := range current {
+		have[t.Address] = true
+	}
+	want := make(map[string]bool, len(resolved))
+	for _, addr := range resolved {
+		want[addr] = true
+		if !have[addr] {
+			add = append(add, addr)
+		}
+	}
+	for addr := range discovered {
+		if !want[addr] && have[addr] {
+			remove = append(remove, addr)
+		}
+	}
+	sort.Strings(remove)
+	return
+}
+
+// discoveryRoutine periodically resolves the discovery name and reconciles the target set
+func (im *IngestMuxer) discoveryRoutine(dc TargetDiscoveryConfig) {
+	defer im.wg.Done()
+	discovered := map[string]bool{}
+	tckr := time.NewTicker(dc.Interval)
+	defer tckr.Stop()
+	for {
+		im.discoverTargets(dc, discovered)
+		select {
+		case _ = <-im.dieChan:
+			return
+		case _ = <-tckr.C:
+		}
+	}
+}
+
+func (im *IngestMuxer) discoverTargets(dc TargetDiscoveryConfig, discovered map[string]bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryLookupTimeout)
+	resolved, err := dc.resolve(ctx)
+	cancel()
+	if err != nil {
+		im.Warn("Target discovery on %v failed: %v", dc.Name, err)
+		return
+	} else if len(resolved) == 0 {
+		//an empty response is treated as a transient failure, we never discover our way to zero targets
+		im.Warn("Target discovery on %v returned no addresses", dc.Name)
+		return
+	}
+	im.applyDiscovery(dc, discovered, im.Targets(), resolved)
+}
+
+// applyDiscovery adds and removes targets to match a discovery lookup, current
+// is the set of targets held before the lookup.  Only targets that discovery
+// added itself are marked as discovered, a target that turns out to exist
+// already was configured some other way and is never removed by discovery.
+func (im *IngestMuxer) applyDiscovery(dc TargetDiscoveryConfig, discovered map[string]bool, current []Target, resolved []string) {
+	add, remove := reconcileTargets(current, discovered, resolved)
+	for _, addr := range add {
+		if err := im.AddTarget(Target{Address: addr, Secret: dc.Secret}); err != nil {
+			if err != ErrTargetExists {
+				im.Warn("Failed to add discovered target %v: %v", addr, err)
+			}
+			continue
+		}
+		im.Info("Added discovered target %v", addr)
+		discovered[addr] = true
+	}
+	for _, addr := range remove {
+		if err := im.RemoveTarget(addr); err != nil && err != ErrTargetNotFound {
+			im.Warn("Failed to remove target %v: %v", addr, err)
+			continue
+		}
+		im.Info("Removed target %v, it is no longer present in discovery", addr)
+		delete(discovered, addr)
+	}
+}
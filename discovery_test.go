@@ -0,0 +1,119 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryValidate(t *testing.T) {
+	dc := TargetDiscoveryConfig{Name: `indexers.example.com`}
+	if err := dc.validate(); err != ErrMissingDiscoveryPort {
+		t.Fatal("Failed to catch missing port", err)
+	}
+	dc.Port = 4023
+	if err := dc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.Scheme != `tcp` || dc.Interval != defaultDiscoveryInterval {
+		t.Fatal("Defaults not applied", dc)
+	}
+	dc.Scheme = `pipe`
+	if err := dc.validate(); err != ErrInvalidDiscoveryScheme {
+		t.Fatal("Failed to catch bad scheme", err)
+	}
+}
+
+func TestDiscoveryAddresses(t *testing.T) {
+	dc := TargetDiscoveryConfig{Name: `indexers.example.com`, Service: `gravwell`, Scheme: `tls`}
+	if err := dc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	srvs := []*net.SRV{
+		&net.SRV{Target: `b.example.com.`, Port: 4024},
+		&net.SRV{Target: `a.example.com.`, Port: 4024},
+		&net.SRV{Target: `a.example.com.`, Port: 4024},
+		&net.SRV{Target: `.`, Port: 4024},
+	}
+	addrs := dc.srvAddresses(srvs)
+	if len(addrs) != 2 || addrs[0] != `tls://a.example.com:4024` || addrs[1] != `tls://b.example.com:4024` {
+		t.Fatal("Bad SRV addresses", addrs)
+	}
+
+	dc = TargetDiscoveryConfig{Name: `indexers.example.com`, Port: 4023}
+	if err := dc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	addrs = dc.hostAddresses([]string{`10.0.0.2`, `fe80::1`, `10.0.0.1`})
+	if len(addrs) != 3 || addrs[0] != `tcp://10.0.0.1:4023` || addrs[2] != `tcp://[fe80::1]:4023` {
+		t.Fatal("Bad host addresses", addrs)
+	}
+}
+
+func TestReconcileTargets(t *testing.T) {
+	current := []Target{
+		Target{Address: `tcp://static:4023`},
+		Target{Address: `tcp://10.0.0.1:4023`},
+		Target{Address: `tcp://10.0.0.2:4023`},
+	}
+	discovered := map[string]bool{
+		`tcp://10.0.0.1:4023`: true,
+		`tcp://10.0.0.2:4023`: true,
+	}
+	resolved := []string{`tcp://10.0.0.2:4023`, `tcp://10.0.0.3:4023`}
+	add, remove := reconcileTargets(current, discovered, resolved)
+	if len(add) != 1 || add[0] != `tcp://10.0.0.3:4023` {
+		t.Fatal("Bad add set", add)
+	}
+	if len(remove) != 1 || remove[0] != `tcp://10.0.0.1:4023` {
+		t.Fatal("Bad remove set", remove)
+	}
+
+	//static targets are never removed even when they vanish from DNS
+	add, remove = reconcileTargets(current, discovered, []string{`tcp://10.0.0.1:4023`, `tcp://10.0.0.2:4023`})
+	if len(add) != 0 || len(remove) != 0 {
+		t.Fatal("Unexpected changes", add, remove)
+	}
+}
+
+func TestDiscoveryKeepsStaticTargets(t *testing.T) {
+	static := newTestIndexer(t)
+	defer static.Close()
+	other := newTestIndexer(t)
+	defer other.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{static.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	dc := TargetDiscoveryConfig{Secret: testIndexerSecret}
+	discovered := map[string]bool{}
+	//discovery reports the static target, but it was configured while the lookup ran
+	im.applyDiscovery(dc, discovered, nil, []string{static.Target().Address})
+	if len(discovered) != 0 {
+		t.Fatal("Existing target was marked as discovered", discovered)
+	}
+	//withdrawing it from discovery must leave it alone
+	im.applyDiscovery(dc, discovered, im.Targets(), []string{other.Target().Address})
+	tgts := im.Targets()
+	if len(tgts) != 2 || tgts[0].Address != static.Target().Address || !discovered[other.Target().Address] {
+		t.Fatal("Static target was removed", tgts, discovered)
+	}
+}
@@ -0,0 +1,127 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func testEntries(n, sz int) (ents []*entry.Entry) {
+	for i := 0; i < n; i++ {
+		ents = append(ents, &entry.Entry{TS: entry.Now(), Data: make([]byte, sz)})
+	}
+	return
+}
+
+func TestEmergencyQueueBound(t *testing.T) {
+	esz := uint64(100 + entry.ENTRY_HEADER_SIZE)
+	eq := newEmergencyQueue(3 * esz)
+	ents := testEntries(4, 100)
+	if err := eq.push(nil, ents[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := eq.push(ents[2], nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := eq.push(ents[3], nil); err != ErrEmergencyListOverflow {
+		t.Fatal("Failed to catch overflow", err)
+	}
+	if eq.len() != 2 || eq.bytes() != 3*esz {
+		t.Fatal("Bad queue size", eq.len(), eq.bytes())
+	}
+	//putting back popped entries is never refused
+	e, b, ok := eq.pop()
+	if !ok || e != nil || len(b) != 2 {
+		t.Fatal("Bad pop")
+	}
+	if eq.bytes() != esz {
+		t.Fatal("Bad size after pop", eq.bytes())
+	}
+	eq.push(ents[3], nil)
+	eq.requeue(nil, b)
+	if eq.len() != 3 || eq.bytes() != 4*esz {
+		t.Fatal("Bad queue size after requeue", eq.len(), eq.bytes())
+	}
+
+	//an empty queue takes anything so a single large block can still get through
+	eq = newEmergencyQueue(esz)
+	if err := eq.push(nil, ents); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmergencyPushDrop(t *testing.T) {
+	esz := uint64(100 + entry.ENTRY_HEADER_SIZE)
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:   []Target{{Address: `tcp://127.1.1.1:55555`, Secret: `x`}},
+		Tags:           []string{`testA`},
+		EmergencyBytes: 2 * esz,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := testEntries(5, 100)
+	var acked []error
+	if err := im.acks.add(ents[4], func(e *entry.Entry, err error) { acked = append(acked, err) }); err != nil {
+		t.Fatal(err)
+	}
+	im.emergencyPush(im.groups[0], nil, ents[:2])
+	im.emergencyPush(im.groups[0], ents[2], nil)
+	im.emergencyPush(im.groups[0], nil, ents[3:])
+	ms := im.Stats()
+	if ms.EmergencyPushes != 1 || ms.EmergencyBytes != 2*esz {
+		t.Fatal("Bad emergency queue stats", ms.EmergencyPushes, ms.EmergencyBytes)
+	}
+	if ms.EmergencyDropped != 3 || ms.EmergencyDropBytes != 3*esz || ms.EmergencySpilled != 0 {
+		t.Fatal("Bad drop accounting", ms.EmergencyDropped, ms.EmergencyDropBytes, ms.EmergencySpilled)
+	}
+	if len(acked) != 1 || acked[0] != ErrEmergencyListOverflow {
+		t.Fatal("Dropped entry not reported", acked)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmergencyPushSpill(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `emergency`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	esz := uint64(100 + entry.ENTRY_HEADER_SIZE)
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{{Address: `tcp://127.1.1.1:55555`, Secret: `x`}},
+		Tags:         []string{`testA`},
+		EnableCache:  true,
+		CacheConfig: IngestCacheConfig{
+			FileBackingLocation: filepath.Join(dir, `cache.db`),
+			MemoryCacheSize:     memCacheSize,
+		},
+		EmergencyBytes: esz,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := testEntries(4, 100)
+	im.emergencyPush(im.groups[0], ents[0], nil)
+	im.emergencyPush(im.groups[0], nil, ents[1:])
+	ms := im.Stats()
+	if ms.EmergencySpilled != 3 || ms.EmergencyDropped != 0 || ms.CacheIn != 3 {
+		t.Fatal("Bad spill accounting", ms.EmergencySpilled, ms.EmergencyDropped, ms.CacheIn)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -106,7 +106,7 @@ func NewEntryReaderEx(cfg EntryReaderWriterConfig) (*EntryReader, error) {
 		wg:         &sync.WaitGroup{},
 		ackChan:    make(chan ackCommand, cfg.OutstandingEntryCount),
 		hot:        true,
-		buff:       make([]byte, READ_ENTRY_HEADER_SIZE),
+		buff:       make([]byte, READ_SEQ_ENTRY_HEADER_SIZE),
 		timeout:    cfg.Timeout,
 		tagMan:     cfg.TagMan,
 	}, nil
@@ -173,14 +173,24 @@ func (er *EntryReader) Close() error {
 }
 
 func (er *EntryReader) Read() (e *entry.Entry, err error) {
+	e, _, err = er.ReadSequence()
+	return
+}
+
+// ReadSequence reads an entry along with the sequence number the ingester sent
+// with it.  Sequence numbers increase for every entry an ingester sends and are
+// scoped to the UUID it identified with, see GetIngesterInfo.  Entries sent
+// without one, by ingesters that do not support or have not enabled sequencing,
+// come back with a zero sequence.  Use a SequenceTracker to drop replays.
+func (er *EntryReader) ReadSequence() (e *entry.Entry, seq uint64, err error) {
 	er.mtx.Lock()
-	if e, err = er.read(); err == nil {
+	if e, seq, err = er.read(); err == nil {
 		er.opCount++
 	} else if isTimeout(err) || err == syscall.EPIPE {
 		err = io.EOF
 	}
 	er.mtx.Unlock()
-	return e, err
+	return e, seq, err
 }
 
 //reset the read deadline on the underlying connection, caller must hold the lock
@@ -201,11 +211,12 @@ func isTimeout(err error) bool {
 	return false
 }
 
-func (er *EntryReader) read() (*entry.Entry, error) {
+func (er *EntryReader) read() (*entry.Entry, uint64, error) {
 	var (
 		err error
 		sz  uint32
 		id  entrySendID
+		seq uint64
 	)
 	if er.entCacheIdx >= len(er.entCache) {
 		er.entCache = make([]entry.Entry, entCacheRechargeSize)
@@ -213,25 +224,26 @@ func (er *EntryReader) read() (*entry.Entry, error) {
 	}
 	ent := &er.entCache[er.entCacheIdx]
 
-	if err = er.fillHeader(ent, &id, &sz); err != nil {
-		return nil, err
+	if err = er.fillHeader(ent, &id, &sz, &seq); err != nil {
+		return nil, 0, err
 	}
 	ent.Data = make([]byte, sz)
 	if _, err = io.ReadFull(er.bIO, ent.Data); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if err = er.throwAck(id); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	er.entCacheIdx++
-	return ent, nil
+	return ent, seq, nil
 }
 
 // we just eat bytes until we hit the magic number,  this is a rudimentary
 // error recovery where a bad read can skip the entry
-func (er *EntryReader) fillHeader(ent *entry.Entry, id *entrySendID, sz *uint32) error {
+func (er *EntryReader) fillHeader(ent *entry.Entry, id *entrySendID, sz *uint32, seq *uint64) error {
 	var err error
 	var n int
+	var sequenced bool
 	//read the "new entry" magic number
 headerLoop:
 	for {
@@ -255,6 +267,9 @@ headerLoop:
 			}
 		case NEW_ENTRY_MAGIC:
 			break headerLoop
+		case NEW_SEQ_ENTRY_MAGIC:
+			sequenced = true
+			break headerLoop
 		case TAG_MAGIC:
 			// read length of string
 			n, err = io.ReadFull(er.bIO, er.buff[0:4])
@@ -291,8 +306,12 @@ headerLoop:
 			continue
 		}
 	}
-	//read entry header worth as well as id (64bit)
-	n, err = io.ReadFull(er.bIO, er.buff[:entry.ENTRY_HEADER_SIZE+8])
+	//read entry header worth as well as id (64bit) and the sequence (64bit) if there is one
+	hdrSize := entry.ENTRY_HEADER_SIZE + 8
+	if sequenced {
+		hdrSize += 8
+	}
+	n, err = io.ReadFull(er.bIO, er.buff[:hdrSize])
 	if err != nil {
 		return err
 	}
@@ -305,6 +324,11 @@ headerLoop:
 	}
 	*sz = uint32(dataSize) //dataSize is a uint32 internally, so these casts are OK
 	*id = entrySendID(binary.LittleEndian.Uint64(er.buff[entry.ENTRY_HEADER_SIZE:]))
+	if sequenced {
+		*seq = binary.LittleEndian.Uint64(er.buff[entry.ENTRY_HEADER_SIZE+8:])
+	} else {
+		*seq = 0
+	}
 	return nil
 }
 
@@ -15,6 +15,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravwell/ingest/v3/entry"
@@ -25,6 +26,8 @@ const (
 	//READ_ENTRY_HEADER_SIZE should be 46 bytes
 	//34 + 4 + 4 + 8 (magic, data len, entry ID)
 	READ_ENTRY_HEADER_SIZE int = entry.ENTRY_HEADER_SIZE + 12
+	//sequenced entries carry a 64bit sequence number after the entry ID
+	READ_SEQ_ENTRY_HEADER_SIZE int = READ_ENTRY_HEADER_SIZE + 8
 	//TODO: We should make this configurable by configuration
 	MAX_ENTRY_SIZE              int           = 128 * 1024 * 1024
 	WRITE_BUFFER_SIZE           int           = 1024 * 1024
@@ -37,6 +40,7 @@ const (
 	MINIMUM_TAG_RENEGOTIATE_VERSION uint16        = 0x2 // minimum server version to renegotiate tags
 	MINIMUM_ID_VERSION              uint16        = 0x3 // minimum server version to send ID info
 	MINIMUM_INGEST_OK_VERSION       uint16        = 0x4 // minimum server version to ask
+	MINIMUM_SEQ_VERSION             uint16        = 0x5 // minimum server version to send sequenced entries
 	maxThrottleDur                  time.Duration = 5 * time.Second
 
 	flushTimeout time.Duration = 10 * time.Second
@@ -46,6 +50,7 @@ const (
 	//ingester commands
 	INVALID_MAGIC           IngestCommand = 0x00000000
 	NEW_ENTRY_MAGIC         IngestCommand = 0xC7C95ACB
+	NEW_SEQ_ENTRY_MAGIC     IngestCommand = 0xC7C95ACC
 	FORCE_ACK_MAGIC         IngestCommand = 0x1ADF7350
 	CONFIRM_ENTRY_MAGIC     IngestCommand = 0xF6E0307E
 	THROTTLE_MAGIC          IngestCommand = 0xBDEACC1E
@@ -66,6 +71,9 @@ type IngestCommand uint32
 type entrySendID uint64
 
 type EntryWriter struct {
+	//unconfirmed is accessed atomically so that outstanding counts
+	//can be read without contending for the writer lock
+	unconfirmed   int32
 	conn          conn
 	bIO           *bufio.Writer
 	bAckReader    *bufio.Reader
@@ -77,6 +85,12 @@ type EntryWriter struct {
 	id            entrySendID
 	ackTimeout    time.Duration
 	serverVersion uint16
+	stats         *targetCounters
+	onAck         func(*entry.Entry)        //called with each confirmed entry
+	onThrottle    func(time.Duration)       //called when the indexer asks us to back off
+	onSend        func(...*entry.Entry)     //called with entries before they are written, without the lock held
+	seq           func(*entry.Entry) uint64 //nil unless entries are sent with sequence numbers
+	acked         []*entry.Entry            //confirmed entries waiting on onAck until the lock is released
 }
 
 func NewEntryWriter(conn net.Conn) (*EntryWriter, error) {
@@ -114,7 +128,7 @@ func NewEntryWriterEx(cfg EntryReaderWriterConfig) (*EntryWriter, error) {
 		mtx:        &sync.Mutex{},
 		ecb:        ecb,
 		hot:        true,
-		buff:       make([]byte, READ_ENTRY_HEADER_SIZE),
+		buff:       make([]byte, READ_SEQ_ENTRY_HEADER_SIZE),
 		id:         1,
 		ackTimeout: cfg.Timeout,
 	}, nil
@@ -137,9 +151,59 @@ func (ew *EntryWriter) SetConn(c conn) {
 	ew.mtx.Unlock()
 }
 
+// setStats attaches a set of counters that are updated as entries are written and confirmed
+func (ew *EntryWriter) setStats(tc *targetCounters) {
+	ew.mtx.Lock()
+	ew.stats = tc
+	ew.mtx.Unlock()
+}
+
+func (ew *EntryWriter) setAckHook(f func(*entry.Entry)) {
+	ew.mtx.Lock()
+	ew.onAck = f
+	ew.mtx.Unlock()
+}
+
+func (ew *EntryWriter) setSendHook(f func(...*entry.Entry)) {
+	ew.mtx.Lock()
+	ew.onSend = f
+	ew.mtx.Unlock()
+}
+
+// sent hands entries to the send hook, it may block so it is called before the lock is taken
+func (ew *EntryWriter) sent(ents ...*entry.Entry) {
+	ew.mtx.Lock()
+	f := ew.onSend
+	ew.mtx.Unlock()
+	if f != nil {
+		f(ents...)
+	}
+}
+
+// setSeqHook switches the writer to sequenced entries, f provides the sequence
+// number of each entry.  It is ignored if the server is too old to read them.
+func (ew *EntryWriter) setSeqHook(f func(*entry.Entry) uint64) {
+	ew.mtx.Lock()
+	if ew.serverVersion >= MINIMUM_SEQ_VERSION {
+		ew.seq = f
+	}
+	ew.mtx.Unlock()
+}
+
+func (ew *EntryWriter) setThrottleHook(f func(time.Duration)) {
+	ew.mtx.Lock()
+	ew.onThrottle = f
+	ew.mtx.Unlock()
+}
+
+// unconfirmedCount returns the number of entries written but not yet confirmed
+func (ew *EntryWriter) unconfirmedCount() int {
+	return int(atomic.LoadInt32(&ew.unconfirmed))
+}
+
 func (ew *EntryWriter) Close() (err error) {
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 
 	if err = ew.forceAckNoLock(); err == nil {
 		if err = ew.conn.SetReadTimeout(ew.ackTimeout); err != nil {
@@ -160,7 +224,7 @@ func (ew *EntryWriter) Close() (err error) {
 
 func (ew *EntryWriter) ForceAck() error {
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 	return ew.forceAckNoLock()
 }
 
@@ -182,7 +246,7 @@ func (ew *EntryWriter) throwAckSync() error {
 // the server to flush all acks and a PONG command.  We read until we get the PONG
 func (ew *EntryWriter) Ping() (err error) {
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 	//send the buffer and force it out
 	if err = ew.writeAll(PING_MAGIC.Buff()); err != nil {
 		return
@@ -233,6 +297,7 @@ func (ew *EntryWriter) WriteSync(ent *entry.Entry) error {
 func (ew *EntryWriter) writeFlush(ent *entry.Entry, flush bool) (err error) {
 	var blocking bool
 
+	ew.sent(ent)
 	ew.mtx.Lock()
 	if ew.ecb.Full() {
 		blocking = true
@@ -245,7 +310,7 @@ func (ew *EntryWriter) writeFlush(ent *entry.Entry, flush bool) (err error) {
 		_, err = ew.writeEntry(ent, flush)
 	}
 
-	ew.mtx.Unlock()
+	ew.unlock()
 	return
 }
 
@@ -268,8 +333,9 @@ func (ew *EntryWriter) WriteWithHint(ent *entry.Entry) (bool, error) {
 	var err error
 	var blocking bool
 
+	ew.sent(ent)
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 	if ew.ecb.Full() {
 		blocking = true
 	} else {
@@ -289,8 +355,9 @@ func (ew *EntryWriter) WriteWithHint(ent *entry.Entry) (bool, error) {
 func (ew *EntryWriter) WriteBatch(ents [](*entry.Entry)) error {
 	var err error
 
+	ew.sent(ents...)
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 
 	for i := range ents {
 		if _, err = ew.writeEntry(ents[i], false); err != nil {
@@ -315,15 +382,22 @@ func (ew *EntryWriter) writeEntry(ent *entry.Entry, flush bool) (bool, error) {
 	}
 
 	//throw the magic
-	binary.LittleEndian.PutUint32(ew.buff, uint32(NEW_ENTRY_MAGIC))
+	hdr := ew.buff[:READ_ENTRY_HEADER_SIZE]
+	if ew.seq != nil {
+		hdr = ew.buff[:READ_SEQ_ENTRY_HEADER_SIZE]
+		binary.LittleEndian.PutUint32(hdr, uint32(NEW_SEQ_ENTRY_MAGIC))
+		binary.LittleEndian.PutUint64(hdr[READ_ENTRY_HEADER_SIZE:], ew.seq(ent))
+	} else {
+		binary.LittleEndian.PutUint32(hdr, uint32(NEW_ENTRY_MAGIC))
+	}
 
 	//build out the header with size
-	if err = ent.EncodeHeader(ew.buff[4 : entry.ENTRY_HEADER_SIZE+4]); err != nil {
+	if err = ent.EncodeHeader(hdr[4 : entry.ENTRY_HEADER_SIZE+4]); err != nil {
 		return false, err
 	}
-	binary.LittleEndian.PutUint64(ew.buff[entry.ENTRY_HEADER_SIZE+4:], uint64(ew.id))
+	binary.LittleEndian.PutUint64(hdr[entry.ENTRY_HEADER_SIZE+4:], uint64(ew.id))
 	//throw it and flush it
-	if err = ew.writeAll(ew.buff); err != nil {
+	if err = ew.writeAll(hdr); err != nil {
 		return false, err
 	}
 	//only flush if we need to
@@ -346,6 +420,10 @@ func (ew *EntryWriter) writeEntry(ent *entry.Entry, flush bool) (bool, error) {
 	if err = ew.ecb.Add(&entryConfirmation{ew.id, ent}); err != nil {
 		return false, err
 	}
+	atomic.AddInt32(&ew.unconfirmed, 1)
+	if ew.stats != nil {
+		ew.stats.written(ent)
+	}
 	ew.id++
 	return flushed, nil
 }
@@ -451,7 +529,7 @@ igstOkCmdLoop:
 
 func (ew *EntryWriter) SendIngesterAPIVersion() (err error) {
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 
 	if ew.serverVersion < MINIMUM_INGEST_OK_VERSION {
 		// Return quietly, it's not a big deal
@@ -520,7 +598,7 @@ verCmdLoop:
 
 func (ew *EntryWriter) IdentifyIngester(name string, version string, id string) (err error) {
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 
 	if ew.serverVersion < MINIMUM_ID_VERSION {
 		// Return quietly, it's not a big deal
@@ -606,7 +684,7 @@ idCmdLoop:
 
 func (ew *EntryWriter) NegotiateTag(name string) (tg entry.EntryTag, err error) {
 	ew.mtx.Lock()
-	defer ew.mtx.Unlock()
+	defer ew.unlock()
 
 	if ew.serverVersion < MINIMUM_TAG_RENEGOTIATE_VERSION {
 		err = fmt.Errorf("Server version %v does not meet minimum version %v", ew.serverVersion, MINIMUM_TAG_RENEGOTIATE_VERSION)
@@ -681,11 +759,11 @@ func (ew *EntryWriter) Ack() error {
 	ew.mtx.Lock()
 	//ensure there are outstanding acks
 	if ew.ecb.Count() == 0 {
-		ew.mtx.Unlock()
+		ew.unlock()
 		return nil
 	}
 	err := ew.serviceAcks(true)
-	ew.mtx.Unlock()
+	ew.unlock()
 	return err
 }
 
@@ -746,7 +824,7 @@ loop:
 			//check if the ID is the head, if not pop the head and resend
 			//TODO: if we get an ID we don't know about we just ignore it
 			//      is this the best course of action?
-			if err = ew.ecb.Confirm(entrySendID(ac.val)); err != nil {
+			if err = ew.confirm(entrySendID(ac.val)); err != nil {
 				if err != errEntryNotFound {
 					break loop
 				}
@@ -774,6 +852,34 @@ loop:
 	return
 }
 
+// confirm removes a confirmed entry from the confirmation buffer and updates counters,
+// the caller must hold the lock and release it with unlock
+func (ew *EntryWriter) confirm(id entrySendID) error {
+	ent, err := ew.ecb.confirmEntry(id)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt32(&ew.unconfirmed, -1)
+	if ew.stats != nil {
+		atomic.AddUint64(&ew.stats.acks, 1)
+	}
+	if ew.onAck != nil && ent != nil {
+		ew.acked = append(ew.acked, ent)
+	}
+	return nil
+}
+
+// unlock releases the lock and then hands any confirmed entries to the ack hook,
+// so the hook is free to block or call back into the muxer
+func (ew *EntryWriter) unlock() {
+	acked, f := ew.acked, ew.onAck
+	ew.acked = nil
+	ew.mtx.Unlock()
+	for _, ent := range acked {
+		f(ent)
+	}
+}
+
 // readCommandsUntil pulls out all of the responses and services them,
 // we block until we hit the command we want
 func (ew *EntryWriter) readCommandsUntil(cmd IngestCommand) (err error) {
@@ -793,7 +899,7 @@ func (ew *EntryWriter) readCommandsUntil(cmd IngestCommand) (err error) {
 			//check if the ID is the head, if not pop the head and resend
 			//TODO: if we get an ID we don't know about we just ignore it
 			//      is this the best course of action?
-			if err = ew.ecb.Confirm(entrySendID(ac.val)); err != nil {
+			if err = ew.confirm(entrySendID(ac.val)); err != nil {
 				if err != errEntryNotFound {
 					return
 				}
@@ -818,6 +924,12 @@ func (ew *EntryWriter) readCommandsUntil(cmd IngestCommand) (err error) {
 func (ew *EntryWriter) throttle(dur time.Duration) (err error) {
 	//check if we were asked to throttle
 	if dur > 0 {
+		if ew.stats != nil {
+			defer ew.stats.throttled(time.Now())
+		}
+		if ew.onThrottle != nil {
+			ew.onThrottle(dur)
+		}
 		//set the read deadline, and wait for a byte
 		if err = ew.conn.SetReadTimeout(dur); err != nil {
 			return
@@ -845,6 +957,8 @@ func (ic IngestCommand) String() string {
 	switch ic {
 	case NEW_ENTRY_MAGIC:
 		return `NEW`
+	case NEW_SEQ_ENTRY_MAGIC:
+		return `NEW_SEQ`
 	case FORCE_ACK_MAGIC:
 		return `FORCE ACK`
 	case CONFIRM_ENTRY_MAGIC:
@@ -0,0 +1,205 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultEventBuffer int = 64
+)
+
+type EventType int
+
+const (
+	EventConnecting      EventType = iota // attempting to connect to a target
+	EventHot                              // the target is connected and accepting entries
+	EventFailed                           // fatal error, the muxer will not reconnect
+	EventReconnecting                     // the connection failed and will be retried
+	EventThrottled                        // the indexer asked us to back off
+	EventNotReady                         // the indexer answered IngestOK with false
+	EventTagNegotiated                    // a tag was negotiated on a live connection
+	EventCacheEngaged                     // the group cache started absorbing entries
+	EventCacheDisengaged                  // the group cache stopped absorbing entries
+	EventPaused                           // the muxer was paused
+	EventResumed                          // the muxer was resumed
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventConnecting:
+		return `CONNECTING`
+	case EventHot:
+		return `HOT`
+	case EventFailed:
+		return `FAILED`
+	case EventReconnecting:
+		return `RECONNECTING`
+	case EventThrottled:
+		return `THROTTLED`
+	case EventNotReady:
+		return `NOT_READY`
+	case EventTagNegotiated:
+		return `TAG_NEGOTIATED`
+	case EventCacheEngaged:
+		return `CACHE_ENGAGED`
+	case EventCacheDisengaged:
+		return `CACHE_DISENGAGED`
+	case EventPaused:
+		return `PAUSED`
+	case EventResumed:
+		return `RESUMED`
+	}
+	return `UNKNOWN`
+}
+
+// Event describes a change in the state of a target or target group.  Address is
+// empty for the cache events, which apply to the whole group, and both Address
+// and Group are empty for the pause events, which apply to the whole muxer.
+type Event struct {
+	Type     EventType
+	TS       time.Time
+	Address  string
+	Group    string
+	Tag      string        //negotiated tag name
+	Err      error         //cause of a failure or reconnect
+	Duration time.Duration //requested throttle, or the wait before reconnecting
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s", e.TS.Format(time.RFC3339Nano), e.Type)
+	if e.Address != `` {
+		s += ` ` + e.Address
+	}
+	if e.Group != `` {
+		s += ` group: ` + e.Group
+	}
+	if e.Tag != `` {
+		s += ` tag: ` + e.Tag
+	}
+	if e.Duration > 0 {
+		s += fmt.Sprintf(" duration: %v", e.Duration)
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(" error: %v", e.Err)
+	}
+	return s
+}
+
+// Subscription delivers muxer events on C.  Events are dropped rather than
+// stalling the muxer when the subscriber falls behind.  C is closed when the
+// subscription or the muxer is closed.
+type Subscription struct {
+	dropped uint64 //atomic, must stay at the top for alignment
+	C       <-chan Event
+	c       chan Event
+	hub     *eventHub
+}
+
+// Dropped returns the number of events the subscriber was too slow to receive
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops delivery and closes C
+func (s *Subscription) Close() {
+	s.hub.remove(s)
+}
+
+type eventHub struct {
+	mtx    sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: map[*Subscription]struct{}{},
+	}
+}
+
+func (eh *eventHub) add(size int) *Subscription {
+	if size <= 0 {
+		size = defaultEventBuffer
+	}
+	c := make(chan Event, size)
+	s := &Subscription{C: c, c: c, hub: eh}
+	eh.mtx.Lock()
+	if eh.closed {
+		close(c)
+	} else {
+		eh.subs[s] = struct{}{}
+	}
+	eh.mtx.Unlock()
+	return s
+}
+
+func (eh *eventHub) remove(s *Subscription) {
+	eh.mtx.Lock()
+	if _, ok := eh.subs[s]; ok {
+		delete(eh.subs, s)
+		close(s.c)
+	}
+	eh.mtx.Unlock()
+}
+
+func (eh *eventHub) publish(e Event) {
+	eh.mtx.RLock()
+	defer eh.mtx.RUnlock()
+	if len(eh.subs) == 0 {
+		return
+	}
+	if e.TS.IsZero() {
+		e.TS = time.Now()
+	}
+	for s := range eh.subs {
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// close closes every subscription, anything published afterwards is discarded
+func (eh *eventHub) close() {
+	eh.mtx.Lock()
+	for s := range eh.subs {
+		close(s.c)
+	}
+	eh.subs = map[*Subscription]struct{}{}
+	eh.closed = true
+	eh.mtx.Unlock()
+}
+
+// Subscribe returns a subscription to connection, tag, and cache events, size is
+// the number of events buffered for the subscriber, zero uses a default.
+func (im *IngestMuxer) Subscribe(size int) *Subscription {
+	return im.events.add(size)
+}
+
+// targetEvent publishes an event for a target
+func (im *IngestMuxer) targetEvent(mt *muxTarget, et EventType, err error, d time.Duration) {
+	im.events.publish(Event{
+		Type:     et,
+		Address:  mt.Address,
+		Group:    mt.grp.name,
+		Err:      err,
+		Duration: d,
+	})
+}
+
+// groupEvent publishes an event for a target group
+func (im *IngestMuxer) groupEvent(grp *muxGroup, et EventType) {
+	im.events.publish(Event{Type: et, Group: grp.name})
+}
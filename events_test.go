@@ -0,0 +1,130 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitEvent reads from the subscription until an event of the given type shows up
+func waitEvent(t *testing.T, sub *Subscription, et EventType) Event {
+	tmr := time.NewTimer(5 * time.Second)
+	defer tmr.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				t.Fatal("Subscription closed waiting for", et)
+			}
+			if e.Type == et {
+				return e
+			}
+		case <-tmr.C:
+			t.Fatal("Timed out waiting for", et)
+		}
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	eh := newEventHub()
+	a := eh.add(1)
+	b := eh.add(4)
+	eh.publish(Event{Type: EventHot})
+	eh.publish(Event{Type: EventFailed})
+	if e := <-a.C; e.Type != EventHot || e.TS.IsZero() {
+		t.Fatalf("Bad event %+v", e)
+	}
+	if a.Dropped() != 1 || b.Dropped() != 0 {
+		t.Fatal("Bad drop counts", a.Dropped(), b.Dropped())
+	}
+	a.Close()
+	a.Close()
+	if _, ok := <-a.C; ok {
+		t.Fatal("Subscription not closed")
+	}
+	eh.close()
+	for i := 0; i < 2; i++ {
+		if _, ok := <-b.C; !ok {
+			t.Fatal("Lost buffered events on close")
+		}
+	}
+	if _, ok := <-b.C; ok {
+		t.Fatal("Subscription not closed with the hub")
+	}
+	eh.publish(Event{Type: EventHot})
+	if _, ok := <-eh.add(1).C; ok {
+		t.Fatal("Subscribed to a closed hub")
+	}
+}
+
+func TestMuxerEvents(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+		EnableCache:  true,
+		CacheConfig:  IngestCacheConfig{MemoryCacheSize: memCacheSize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := im.Subscribe(0)
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, sub, EventHot); e.Address != ti.Target().Address || e.Group != DefaultGroupName {
+		t.Fatalf("Bad hot event %+v", e)
+	}
+	//the cache engages at startup and steps aside once a target is hot
+	waitEvent(t, sub, EventCacheDisengaged)
+	if _, err := im.NegotiateTag(`testB`); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, sub, EventTagNegotiated); e.Tag != `testB` {
+		t.Fatalf("Bad tag event %+v", e)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range sub.C {
+	}
+}
+
+func TestMuxerEventsReconnect(t *testing.T) {
+	//grab an address that nothing is listening on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := `tcp://` + lst.Addr().String()
+	lst.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{{Address: down, Secret: testIndexerSecret}},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := im.Subscribe(0)
+	defer sub.Close()
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, sub, EventConnecting); e.Address != down {
+		t.Fatalf("Bad connecting event %+v", e)
+	}
+	if e := waitEvent(t, sub, EventReconnecting); e.Err == nil || e.Duration <= 0 {
+		t.Fatalf("Bad reconnecting event %+v", e)
+	}
+	im.Close()
+}
@@ -0,0 +1,461 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	defaultMaxRecordSize  int = 1024 * 1024
+	defaultPrefixSize     int = 4
+	maxOctetCountDigits   int = 10
+	framerReadBufferSize  int = 64 * 1024
+	octetCountSeparator       = ' '
+	newlineFrameDelimiter     = '\n'
+)
+
+var (
+	ErrInvalidFraming    = errors.New("Invalid framing type")
+	ErrEmptyDelimiter    = errors.New("Delimiter framing requires a delimiter")
+	ErrInvalidPrefixSize = errors.New("Length prefix must be 1, 2, 4, or 8 bytes")
+	ErrInvalidAnchor     = errors.New("Invalid regex anchor")
+	ErrRecordTooLarge    = errors.New("Record exceeds the maximum record size")
+	ErrMalformedFrame    = errors.New("Malformed frame")
+	// ErrSkipRecord may be returned by a record callback to drop the record
+	ErrSkipRecord = errors.New("Skip record")
+)
+
+type FrameType int
+
+const (
+	FrameNewline      FrameType = iota // records end with a newline, a trailing carriage return is removed
+	FrameDelimiter                     // records end with an arbitrary delimiter
+	FrameLengthPrefix                  // records are preceded by a binary length
+	FrameOctetCounted                  // RFC6587 octet counting, records are preceded by an ASCII length and a space
+	FrameRegex                         // records are runs of lines, each starting with a line matching the anchor
+)
+
+func (ft FrameType) String() string {
+	switch ft {
+	case FrameNewline:
+		return `newline`
+	case FrameDelimiter:
+		return `delimiter`
+	case FrameLengthPrefix:
+		return `length`
+	case FrameOctetCounted:
+		return `octet`
+	case FrameRegex:
+		return `regex`
+	}
+	return `unknown`
+}
+
+// ParseFrameType resolves a framing name as returned by FrameType.String
+func ParseFrameType(v string) (FrameType, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case ``, `newline`:
+		return FrameNewline, nil
+	case `delimiter`:
+		return FrameDelimiter, nil
+	case `length`:
+		return FrameLengthPrefix, nil
+	case `octet`:
+		return FrameOctetCounted, nil
+	case `regex`:
+		return FrameRegex, nil
+	}
+	return -1, ErrInvalidFraming
+}
+
+// FramerConfig controls how a Framer splits a stream into entries.  Every
+// record is stamped with the current time, Tag, and SRC before OnRecord is
+// called, the callback may change any of them or return ErrSkipRecord to drop
+// the record, any other error stops the framer.  Records larger than MaxRecord
+// stop the framer with ErrRecordTooLarge unless DropOversize is set.
+type FramerConfig struct {
+	Framing      FrameType
+	Delimiter    []byte //record terminator for FrameDelimiter
+	PrefixSize   int    //bytes in the length prefix, 0 is 4
+	LittleEndian bool   //length prefix byte order, the default is big endian
+	Anchor       string //regex matching the first line of each record for FrameRegex
+	MaxRecord    int    //largest record accepted, 0 is 1MB
+	DropOversize bool
+	Tag          entry.EntryTag
+	SRC          net.IP
+	OnRecord     func(*entry.Entry) error
+}
+
+// FramerStats holds the counters for a framer across every stream it has read
+type FramerStats struct {
+	Records  uint64 //records written
+	Bytes    uint64 //record bytes written
+	Skipped  uint64 //records dropped by the callback
+	Oversize uint64 //records dropped for exceeding the maximum record size
+}
+
+type entryContextWriter interface {
+	WriteEntryContext(context.Context, *entry.Entry) error
+}
+
+// Framer reads streams, splits them into records, and writes each record as an
+// entry.  A single Framer may read several streams at once.
+type Framer struct {
+	records  uint64
+	bytes    uint64
+	skipped  uint64
+	oversize uint64
+	w        entryContextWriter
+	cfg      FramerConfig
+	re       *regexp.Regexp
+}
+
+// NewFramer creates a framer which writes to w, typically an IngestMuxer
+func NewFramer(w entryContextWriter, cfg FramerConfig) (*Framer, error) {
+	if cfg.MaxRecord <= 0 {
+		cfg.MaxRecord = defaultMaxRecordSize
+	}
+	f := &Framer{w: w}
+	switch cfg.Framing {
+	case FrameNewline:
+	case FrameDelimiter:
+		if len(cfg.Delimiter) == 0 {
+			return nil, ErrEmptyDelimiter
+		}
+	case FrameLengthPrefix:
+		if cfg.PrefixSize == 0 {
+			cfg.PrefixSize = defaultPrefixSize
+		}
+		switch cfg.PrefixSize {
+		case 1, 2, 4, 8:
+		default:
+			return nil, ErrInvalidPrefixSize
+		}
+	case FrameOctetCounted:
+	case FrameRegex:
+		if cfg.Anchor == `` {
+			return nil, ErrInvalidAnchor
+		}
+		re, err := regexp.Compile(cfg.Anchor)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", ErrInvalidAnchor, err)
+		}
+		f.re = re
+	default:
+		return nil, ErrInvalidFraming
+	}
+	f.cfg = cfg
+	return f, nil
+}
+
+// Run reads records from r until it is exhausted, returning nil at EOF.  Writes
+// block while the muxer is backed up and give up when ctx is done, ctx is not
+// consulted while blocked on r so callers should close r to stop a quiet stream.
+func (f *Framer) Run(ctx context.Context, r io.Reader) error {
+	fr := &frameReader{
+		Framer: f,
+		br:     bufio.NewReaderSize(r, framerReadBufferSize),
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec, err := fr.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = f.emit(ctx, rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Stats returns the framer counters
+func (f *Framer) Stats() FramerStats {
+	return FramerStats{
+		Records:  atomic.LoadUint64(&f.records),
+		Bytes:    atomic.LoadUint64(&f.bytes),
+		Skipped:  atomic.LoadUint64(&f.skipped),
+		Oversize: atomic.LoadUint64(&f.oversize),
+	}
+}
+
+func (f *Framer) emit(ctx context.Context, rec []byte) error {
+	ent := &entry.Entry{
+		TS:   entry.Now(),
+		Tag:  f.cfg.Tag,
+		SRC:  f.cfg.SRC,
+		Data: rec,
+	}
+	if f.cfg.OnRecord != nil {
+		if err := f.cfg.OnRecord(ent); err == ErrSkipRecord {
+			atomic.AddUint64(&f.skipped, 1)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := f.w.WriteEntryContext(ctx, ent); err != nil {
+		return err
+	}
+	atomic.AddUint64(&f.records, 1)
+	atomic.AddUint64(&f.bytes, uint64(len(rec)))
+	return nil
+}
+
+// tooLarge accounts for an oversize record, returning nil if it should be dropped
+func (f *Framer) tooLarge() error {
+	if !f.cfg.DropOversize {
+		return ErrRecordTooLarge
+	}
+	atomic.AddUint64(&f.oversize, 1)
+	return nil
+}
+
+// frameReader holds the state for a single stream
+type frameReader struct {
+	*Framer
+	br       *bufio.Reader
+	pending  []byte //first line of the next record for regex framing
+	skipping bool   //dropping lines up to the next anchor
+	eof      bool
+}
+
+// next returns the next record, io.EOF means the stream is exhausted
+func (fr *frameReader) next() ([]byte, error) {
+	switch fr.cfg.Framing {
+	case FrameNewline:
+		for {
+			rec, err := fr.readDelimited([]byte{newlineFrameDelimiter})
+			if err == ErrRecordTooLarge {
+				if err = fr.tooLarge(); err != nil {
+					return nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if rec = bytes.TrimSuffix(rec, []byte{'\r'}); len(rec) > 0 {
+				return rec, nil
+			}
+		}
+	case FrameDelimiter:
+		for {
+			rec, err := fr.readDelimited(fr.cfg.Delimiter)
+			if err == ErrRecordTooLarge {
+				if err = fr.tooLarge(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return rec, err
+		}
+	case FrameLengthPrefix:
+		return fr.readLengthPrefixed()
+	case FrameOctetCounted:
+		return fr.readOctetCounted()
+	case FrameRegex:
+		return fr.readAnchored()
+	}
+	return nil, ErrInvalidFraming
+}
+
+// readDelimited returns the bytes up to the next delimiter, the delimiter is
+// removed and a partial record at the end of the stream is returned as is.
+// Oversize records are consumed and reported with ErrRecordTooLarge.
+func (fr *frameReader) readDelimited(delim []byte) ([]byte, error) {
+	var rec []byte
+	var discard bool
+	last := delim[len(delim)-1]
+	for !fr.eof {
+		chunk, err := fr.br.ReadSlice(last)
+		if err == io.EOF {
+			fr.eof = true
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		rec = append(rec, chunk...)
+		if err == nil && bytes.HasSuffix(rec, delim) {
+			if rec = rec[:len(rec)-len(delim)]; discard || len(rec) > fr.cfg.MaxRecord {
+				return nil, ErrRecordTooLarge
+			}
+			return rec, nil
+		}
+		//a partial delimiter may be sitting at the end of what we have
+		if tail := len(delim) - 1; discard || len(rec)-tail > fr.cfg.MaxRecord {
+			rec = append(rec[:0], rec[len(rec)-tail:]...)
+			discard = true
+		}
+	}
+	if discard || len(rec) > fr.cfg.MaxRecord {
+		return nil, ErrRecordTooLarge
+	} else if len(rec) == 0 {
+		return nil, io.EOF
+	}
+	return rec, nil
+}
+
+// readCounted reads a record of n bytes, discarding it if it is too large
+func (fr *frameReader) readCounted(n uint64) ([]byte, bool, error) {
+	if n > uint64(fr.cfg.MaxRecord) {
+		if err := fr.tooLarge(); err != nil {
+			return nil, false, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, fr.br, int64(n)); err != nil {
+			return nil, false, truncated(err)
+		}
+		return nil, false, nil
+	}
+	rec := make([]byte, n)
+	if _, err := io.ReadFull(fr.br, rec); err != nil {
+		return nil, false, truncated(err)
+	}
+	return rec, true, nil
+}
+
+func (fr *frameReader) readLengthPrefixed() ([]byte, error) {
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(fr.br, hdr[:fr.cfg.PrefixSize]); err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+			return nil, truncated(err)
+		}
+		var order binary.ByteOrder = binary.BigEndian
+		if fr.cfg.LittleEndian {
+			order = binary.LittleEndian
+		}
+		var n uint64
+		switch fr.cfg.PrefixSize {
+		case 1:
+			n = uint64(hdr[0])
+		case 2:
+			n = uint64(order.Uint16(hdr[:2]))
+		case 4:
+			n = uint64(order.Uint32(hdr[:4]))
+		case 8:
+			n = order.Uint64(hdr[:8])
+		}
+		if rec, ok, err := fr.readCounted(n); err != nil || ok {
+			return rec, err
+		}
+	}
+}
+
+// readOctetCounted reads RFC6587 octet counted frames, stray line breaks
+// between frames are tolerated
+func (fr *frameReader) readOctetCounted() ([]byte, error) {
+	for {
+		var n uint64
+		var digits int
+		for {
+			b, err := fr.br.ReadByte()
+			if err != nil {
+				if err == io.EOF && digits == 0 {
+					return nil, err
+				}
+				return nil, truncated(err)
+			}
+			if b == octetCountSeparator && digits > 0 {
+				break
+			} else if (b == '\n' || b == '\r') && digits == 0 {
+				continue
+			} else if b < '0' || b > '9' || digits == maxOctetCountDigits {
+				return nil, ErrMalformedFrame
+			}
+			n = n*10 + uint64(b-'0')
+			digits++
+		}
+		if rec, ok, err := fr.readCounted(n); err != nil || ok {
+			return rec, err
+		}
+	}
+}
+
+// readAnchored gathers lines into a record until a line matching the anchor
+// starts the next one.  When a record is dropped for being oversize the lines
+// that follow are dropped with it up to the next anchor.
+func (fr *frameReader) readAnchored() ([]byte, error) {
+	rec := fr.pending
+	fr.pending = nil
+	for {
+		ln, err := fr.readDelimited([]byte{newlineFrameDelimiter})
+		if err == ErrRecordTooLarge {
+			if !fr.skipping {
+				if err = fr.tooLarge(); err != nil {
+					return nil, err
+				}
+			}
+			fr.skipping = true
+			if rec != nil {
+				return rec, nil
+			}
+			continue
+		} else if err == io.EOF {
+			if rec == nil {
+				return nil, io.EOF
+			}
+			return rec, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ln = bytes.TrimSuffix(ln, []byte{'\r'})
+		if fr.re.Match(ln) {
+			fr.skipping = false
+			if rec != nil {
+				fr.pending = ln
+				return rec, nil
+			}
+			rec = ln
+			continue
+		} else if fr.skipping {
+			continue
+		}
+		if rec == nil {
+			if len(ln) == 0 {
+				continue
+			}
+			//lines ahead of the first anchor form a record of their own
+			rec = ln
+		} else {
+			rec = append(append(rec, newlineFrameDelimiter), ln...)
+		}
+		if len(rec) > fr.cfg.MaxRecord {
+			if err := fr.tooLarge(); err != nil {
+				return nil, err
+			}
+			rec, fr.skipping = nil, true
+		}
+	}
+}
+
+// truncated converts an early end of stream inside a frame into a framing error
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%v: truncated", ErrMalformedFrame)
+	}
+	return err
+}
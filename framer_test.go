@@ -0,0 +1,279 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+type captureWriter struct {
+	ents []*entry.Entry
+}
+
+func (cw *captureWriter) WriteEntryContext(ctx context.Context, e *entry.Entry) error {
+	cw.ents = append(cw.ents, e)
+	return nil
+}
+
+func (cw *captureWriter) records() (r []string) {
+	for _, e := range cw.ents {
+		r = append(r, string(e.Data))
+	}
+	return
+}
+
+func lengthPrefixed(size int, little bool, recs ...string) []byte {
+	var order binary.ByteOrder = binary.BigEndian
+	if little {
+		order = binary.LittleEndian
+	}
+	var bb bytes.Buffer
+	for _, r := range recs {
+		hdr := make([]byte, 8)
+		switch size {
+		case 1:
+			hdr[0] = byte(len(r))
+		case 2:
+			order.PutUint16(hdr, uint16(len(r)))
+		case 4:
+			order.PutUint32(hdr, uint32(len(r)))
+		case 8:
+			order.PutUint64(hdr, uint64(len(r)))
+		}
+		bb.Write(hdr[:size])
+		bb.WriteString(r)
+	}
+	return bb.Bytes()
+}
+
+func TestFramer(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   FramerConfig
+		input []byte
+		recs  []string
+	}{
+		{`newline`, FramerConfig{}, []byte("a\nbb\r\n\n\nccc"), []string{`a`, `bb`, `ccc`}},
+		{`delimiter`, FramerConfig{Framing: FrameDelimiter, Delimiter: []byte(`||`)}, []byte("a|b||c||d"), []string{`a|b`, `c`, `d`}},
+		{`length2`, FramerConfig{Framing: FrameLengthPrefix, PrefixSize: 2}, lengthPrefixed(2, false, `hello`, ``, "wo\nrld"), []string{`hello`, ``, "wo\nrld"}},
+		{`length8le`, FramerConfig{Framing: FrameLengthPrefix, PrefixSize: 8, LittleEndian: true}, lengthPrefixed(8, true, `a`, `bc`), []string{`a`, `bc`}},
+		{`length default`, FramerConfig{Framing: FrameLengthPrefix}, lengthPrefixed(4, false, `abc`), []string{`abc`}},
+		{`octet`, FramerConfig{Framing: FrameOctetCounted}, []byte("5 hello11 hello\nworld\n3 abc"), []string{`hello`, "hello\nworld", `abc`}},
+		{`regex`, FramerConfig{Framing: FrameRegex, Anchor: `^\d{4}-`},
+			[]byte("junk\n2020-01-01 a\n  trace 1\n  trace 2\n2020-01-02 b\r\n2020-01-03 c\n  more"),
+			[]string{`junk`, "2020-01-01 a\n  trace 1\n  trace 2", `2020-01-02 b`, "2020-01-03 c\n  more"}},
+	}
+	for _, tst := range tests {
+		var cw captureWriter
+		f, err := NewFramer(&cw, tst.cfg)
+		if err != nil {
+			t.Fatal(tst.name, err)
+		}
+		if err := f.Run(context.Background(), bytes.NewReader(tst.input)); err != nil {
+			t.Fatal(tst.name, err)
+		}
+		if r := cw.records(); !reflect.DeepEqual(r, tst.recs) {
+			t.Fatalf("%s: got %q, expected %q", tst.name, r, tst.recs)
+		}
+		if st := f.Stats(); st.Records != uint64(len(tst.recs)) {
+			t.Fatalf("%s: bad record count %d", tst.name, st.Records)
+		}
+	}
+}
+
+func TestFramerOversize(t *testing.T) {
+	big := strings.Repeat(`x`, 100)
+	tests := []struct {
+		name  string
+		cfg   FramerConfig
+		input []byte
+		recs  []string
+	}{
+		{`newline`, FramerConfig{}, []byte("a\n" + big + "\nb"), []string{`a`, `b`}},
+		{`delimiter`, FramerConfig{Framing: FrameDelimiter, Delimiter: []byte(`--`)}, []byte("a--" + big + "-" + big + "--b--"), []string{`a`, `b`}},
+		{`length`, FramerConfig{Framing: FrameLengthPrefix}, lengthPrefixed(4, false, `a`, big, `b`), []string{`a`, `b`}},
+		{`octet`, FramerConfig{Framing: FrameOctetCounted}, []byte("1 a100 " + big + "1 b"), []string{`a`, `b`}},
+		{`regex line`, FramerConfig{Framing: FrameRegex, Anchor: `^#`}, []byte("#a\n" + big + "\n  dropped\n#b"), []string{`#a`, `#b`}},
+		{`regex record`, FramerConfig{Framing: FrameRegex, Anchor: `^#`}, []byte("#a\n" + big[:40] + "\n" + big[:40] + "\n#b"), []string{`#b`}},
+	}
+	for _, tst := range tests {
+		tst.cfg.MaxRecord = 64
+		var cw captureWriter
+		f, err := NewFramer(&cw, tst.cfg)
+		if err != nil {
+			t.Fatal(tst.name, err)
+		}
+		if err := f.Run(context.Background(), bytes.NewReader(tst.input)); err != ErrRecordTooLarge {
+			t.Fatalf("%s: failed to catch an oversize record: %v", tst.name, err)
+		}
+
+		tst.cfg.DropOversize = true
+		cw = captureWriter{}
+		if f, err = NewFramer(&cw, tst.cfg); err != nil {
+			t.Fatal(tst.name, err)
+		}
+		if err := f.Run(context.Background(), bytes.NewReader(tst.input)); err != nil {
+			t.Fatal(tst.name, err)
+		}
+		if r := cw.records(); !reflect.DeepEqual(r, tst.recs) {
+			t.Fatalf("%s: got %q, expected %q", tst.name, r, tst.recs)
+		}
+		if st := f.Stats(); st.Oversize != 1 {
+			t.Fatalf("%s: bad oversize count %d", tst.name, st.Oversize)
+		}
+	}
+}
+
+func TestFramerErrors(t *testing.T) {
+	bad := []struct {
+		cfg FramerConfig
+		err error
+	}{
+		{FramerConfig{Framing: FrameDelimiter}, ErrEmptyDelimiter},
+		{FramerConfig{Framing: FrameLengthPrefix, PrefixSize: 3}, ErrInvalidPrefixSize},
+		{FramerConfig{Framing: FrameRegex}, ErrInvalidAnchor},
+		{FramerConfig{Framing: FrameType(99)}, ErrInvalidFraming},
+	}
+	for _, v := range bad {
+		if _, err := NewFramer(&captureWriter{}, v.cfg); err != v.err {
+			t.Fatalf("%v: expected %v, got %v", v.cfg.Framing, v.err, err)
+		}
+	}
+	if _, err := NewFramer(&captureWriter{}, FramerConfig{Framing: FrameRegex, Anchor: `[`}); err == nil {
+		t.Fatal("Failed to catch a bad anchor")
+	}
+	for _, name := range []string{`newline`, `delimiter`, `length`, `octet`, `regex`} {
+		if ft, err := ParseFrameType(name); err != nil || ft.String() != name {
+			t.Fatal("Bad frame type", name, ft, err)
+		}
+	}
+
+	//truncated and garbled frames
+	streams := []struct {
+		cfg   FramerConfig
+		input []byte
+	}{
+		{FramerConfig{Framing: FrameLengthPrefix}, lengthPrefixed(4, false, `abc`)[:5]},
+		{FramerConfig{Framing: FrameLengthPrefix}, []byte{0, 0}},
+		{FramerConfig{Framing: FrameOctetCounted}, []byte("10 short")},
+		{FramerConfig{Framing: FrameOctetCounted}, []byte("x hello")},
+		{FramerConfig{Framing: FrameOctetCounted}, []byte("12345678901 hello")},
+	}
+	for i, v := range streams {
+		f, err := NewFramer(&captureWriter{}, v.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Run(context.Background(), bytes.NewReader(v.input)); err == nil || !strings.HasPrefix(err.Error(), ErrMalformedFrame.Error()) {
+			t.Fatalf("%d: failed to catch a malformed frame: %v", i, err)
+		}
+	}
+}
+
+func TestFramerCallback(t *testing.T) {
+	var cw captureWriter
+	src := net.ParseIP(`10.0.0.1`)
+	ts := entry.FromStandard(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	errStop := errors.New("stop")
+	f, err := NewFramer(&cw, FramerConfig{
+		Tag: 1,
+		SRC: src,
+		OnRecord: func(e *entry.Entry) error {
+			switch string(e.Data) {
+			case `skip`:
+				return ErrSkipRecord
+			case `stop`:
+				return errStop
+			case `retag`:
+				e.Tag = 2
+				e.TS = ts
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Run(context.Background(), strings.NewReader("a\nskip\nretag\nstop\nb\n")); err != errStop {
+		t.Fatal("Callback error not returned", err)
+	}
+	if len(cw.ents) != 2 || cw.ents[0].Tag != 1 || !cw.ents[0].SRC.Equal(src) {
+		t.Fatalf("Bad entries %+v", cw.ents)
+	}
+	if cw.ents[1].Tag != 2 || cw.ents[1].TS != ts {
+		t.Fatalf("Callback changes lost %+v", cw.ents[1])
+	}
+	if st := f.Stats(); st.Skipped != 1 || st.Records != 2 || st.Bytes != 6 {
+		t.Fatalf("Bad stats %+v", st)
+	}
+}
+
+func TestFramerMuxer(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFramer(im, FramerConfig{Framing: FrameOctetCounted, Tag: tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Run(context.Background(), strings.NewReader("5 hello5 world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range ti.Entries() {
+		if e.Tag != entry.GravwellTagId {
+			got = append(got, string(e.Data))
+		}
+	}
+	if !reflect.DeepEqual(got, []string{`hello`, `world`}) {
+		t.Fatal("Bad entries", got)
+	}
+
+	//a closed muxer stops the framer
+	if err := f.Run(context.Background(), strings.NewReader("5 hello")); err != ErrNotRunning {
+		t.Fatal("Framer did not stop on a closed muxer", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.Run(ctx, strings.NewReader("5 hello")); err != context.Canceled {
+		t.Fatal("Framer ignored the context", err)
+	}
+}
@@ -0,0 +1,466 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	// DefaultGroupName is the name of the group holding MuxerConfig.Destinations
+	DefaultGroupName string = `default`
+)
+
+var (
+	ErrInvalidGroupName      = errors.New("Invalid target group name")
+	ErrDuplicateGroup        = errors.New("Duplicate target group name")
+	ErrEmptyGroup            = errors.New("Target group has no destinations")
+	ErrGroupNotFound         = errors.New("Target group not found")
+	ErrGroupsNeedReplication = errors.New("Target groups require replication")
+)
+
+// TargetGroup is a named set of targets.  When replicating, every entry is
+// delivered to one target in every group, tag routes narrow the groups a tag
+// is delivered to.  Each group has its own queues,
+// emergency queue, and cache so that a group which is down or slow does not hold
+// up the others.  A zero CacheConfig uses the muxer CacheConfig with the group
+// name appended to the file backing location.
+type TargetGroup struct {
+	Name         string
+	Destinations []Target
+	CacheConfig  IngestCacheConfig
+}
+
+// targetGroups builds the group set from the config, Destinations make up the default group
+func (c MuxerConfig) targetGroups() ([]TargetGroup, error) {
+	if len(c.TargetGroups) > 0 && !c.Replicate && len(c.Routes) == 0 {
+		return nil, ErrGroupsNeedReplication
+	}
+	var groups []TargetGroup
+	if len(c.Destinations) > 0 || len(c.TargetGroups) == 0 {
+		groups = append(groups, TargetGroup{
+			Name:         DefaultGroupName,
+			Destinations: c.Destinations,
+			CacheConfig:  c.CacheConfig,
+		})
+	}
+	for _, tg := range c.TargetGroups {
+		if tg.Name == `` {
+			return nil, ErrInvalidGroupName
+		}
+		for _, g := range groups {
+			if g.Name == tg.Name {
+				return nil, ErrDuplicateGroup
+			}
+		}
+		if len(tg.Destinations) == 0 {
+			return nil, ErrEmptyGroup
+		}
+		if tg.CacheConfig == (IngestCacheConfig{}) {
+			tg.CacheConfig = c.CacheConfig
+			if tg.CacheConfig.FileBackingLocation != `` {
+				tg.CacheConfig.FileBackingLocation += `.` + tg.Name
+			}
+		}
+		groups = append(groups, tg)
+	}
+	return groups, nil
+}
+
+// muxGroup is the delivery pipeline shared by a set of targets, each entry
+// handed to the group is written to exactly one of its targets.
+type muxGroup struct {
+	spilled         uint64 //atomic, must stay at the top for alignment
+	connHot         int32  //atomic, how many connections in the group are functioning
+	resuming        int32  //atomic, set from a Resume until the cache has been unloaded
+	idx             int
+	name            string
+	eChan           chan *entry.Entry
+	bChan           chan []*entry.Entry
+	eq              *emergencyQueue
+	cache           *IngestCache
+	cacheWg         *sync.WaitGroup
+	cacheFileBacked bool
+	cacheRunning    bool
+	cacheError      error
+	cacheSignal     chan bool
+	journal         *inflightJournal //nil unless in-flight entries are persisted
+}
+
+func newMuxGroup(idx int, name string, eChan chan *entry.Entry, bChan chan []*entry.Entry, eq *emergencyQueue) *muxGroup {
+	return &muxGroup{
+		idx:     idx,
+		name:    name,
+		eChan:   eChan,
+		bChan:   bChan,
+		eq:      eq,
+		cacheWg: &sync.WaitGroup{},
+	}
+}
+
+// queued returns the number of items waiting on the group
+func (grp *muxGroup) queued() int {
+	return len(grp.eChan) + len(grp.bChan)
+}
+
+// cached returns true if the group cache holds entries which have not been unloaded
+func (grp *muxGroup) cached() bool {
+	return grp.cache != nil && grp.cache.EntriesIn() > grp.cache.EntriesOut()
+}
+
+// closeCaches closes the caches of groups that failed to come up
+func closeCaches(groups []*muxGroup) {
+	for _, grp := range groups {
+		if grp.cache != nil {
+			grp.cache.Close()
+		}
+	}
+}
+
+// routing returns true if entries are dispatched into more than one group
+func (im *IngestMuxer) routing() bool {
+	return len(im.groups) > 1
+}
+
+// replicating returns true if some entries are copied into more than one group,
+// routing without replication delivers every entry to a single group
+func (im *IngestMuxer) replicating() bool {
+	return im.routing() && im.router.replicates()
+}
+
+// group looks up a group by name, the caller must hold the lock
+func (im *IngestMuxer) group(name string) *muxGroup {
+	for _, grp := range im.groups {
+		if grp.name == name {
+			return grp
+		}
+	}
+	return nil
+}
+
+// replicas returns the entry for each group, indexed by group.  Groups the tag is
+// not routed to get nil, the first routed group gets the original and the rest a
+// copy.  Copies share the data buffer, which the muxer never modifies.
+// Any ack waiter on the entry resolves once every copy has.
+func (im *IngestMuxer) replicas(e *entry.Entry) []*entry.Entry {
+	r := make([]*entry.Entry, len(im.groups))
+	set := im.router.groups(e.Tag)
+	if len(set) == 0 {
+		return r
+	}
+	r[set[0]] = e
+	if len(set) == 1 {
+		return r
+	}
+	copies := make([]*entry.Entry, 0, len(set))
+	copies = append(copies, e)
+	for _, gi := range set[1:] {
+		ne := *e
+		r[gi] = &ne
+		copies = append(copies, &ne)
+	}
+	im.acks.split(e, copies)
+	im.budget.share(e, copies)
+	im.seq.share(e, copies)
+	return r
+}
+
+// dispatch hands an entry to f for each group it is routed to, only replication
+// copies it, routing alone hands the entry itself to its single group
+func (im *IngestMuxer) dispatch(e *entry.Entry, f func(int, *entry.Entry)) {
+	if !im.replicating() {
+		if set := im.router.groups(e.Tag); len(set) > 0 {
+			f(set[0], e)
+		}
+		return
+	}
+	for i, ne := range im.replicas(e) {
+		if ne != nil {
+			f(i, ne)
+		}
+	}
+}
+
+// replicaBatches splits a batch into one batch per group, groups that receive
+// nothing from the batch get an empty batch
+func (im *IngestMuxer) replicaBatches(b []*entry.Entry) [][]*entry.Entry {
+	r := make([][]*entry.Entry, len(im.groups))
+	for _, e := range b {
+		if e == nil {
+			continue
+		}
+		for i, ne := range im.replicas(e) {
+			if ne != nil {
+				r[i] = append(r[i], ne)
+			}
+		}
+	}
+	return r
+}
+
+// replicateRoutine copies everything written to the muxer into each group it is routed to.  A group
+// whose queue is full spills into its cache, if it has one, rather than holding up
+// the other groups; without a cache the routine waits for the group to catch up.
+func (im *IngestMuxer) replicateRoutine() {
+	defer im.wg.Done()
+	for {
+		select {
+		case e := <-im.eChan:
+			if e == nil {
+				continue
+			}
+			atomic.StoreInt32(&im.replHeld, 1)
+			for i, ne := range im.replicas(e) {
+				if ne != nil {
+					im.groupEntry(im.groups[i], ne)
+				}
+			}
+		case b := <-im.bChan:
+			if len(b) == 0 {
+				continue
+			}
+			atomic.StoreInt32(&im.replHeld, 1)
+			for i, nb := range im.replicaBatches(b) {
+				if len(nb) > 0 {
+					im.groupBatch(im.groups[i], nb)
+				}
+			}
+		case <-im.dieChan:
+			return
+		}
+		atomic.StoreInt32(&im.replHeld, 0)
+	}
+}
+
+func (im *IngestMuxer) groupEntry(grp *muxGroup, e *entry.Entry) {
+	select {
+	case grp.eChan <- e:
+		return
+	default:
+	}
+	if len(im.spill(grp, e)) == 0 {
+		return
+	}
+	select {
+	case grp.eChan <- e:
+	case <-im.dieChan:
+		im.emergencyPush(grp, e, nil)
+	}
+}
+
+func (im *IngestMuxer) groupBatch(grp *muxGroup, b []*entry.Entry) {
+	select {
+	case grp.bChan <- b:
+		return
+	default:
+	}
+	if b = im.spill(grp, b...); len(b) == 0 {
+		return
+	}
+	select {
+	case grp.bChan <- b:
+	case <-im.dieChan:
+		im.emergencyPush(grp, nil, b)
+	}
+}
+
+// spill diverts entries for a backed up group into its cache and prods the
+// cache routine to unload them once the group has room.  The entries that
+// still have to be queued to the group are returned.
+func (im *IngestMuxer) spill(grp *muxGroup, ents ...*entry.Entry) []*entry.Entry {
+	if grp.cache == nil || !grp.cacheRunning {
+		return ents
+	}
+	rest, err := grp.cacheSpill(ents...)
+	if err != nil {
+		//only the local logger, a gravwell log entry would have to come back through this routine
+		im.lgr.Error("Failed to spill entries for group %v into the cache: %v", grp.name, err)
+	}
+	atomic.AddUint64(&grp.spilled, uint64(len(ents)-len(rest)))
+	return rest
+}
+
+// cacheSpill hands entries straight to the group cache, the cache routine is
+// prodded so that entries cached while connections are hot are unloaded.
+// Entries the cache could not take are returned with the error.
+func (grp *muxGroup) cacheSpill(ents ...*entry.Entry) ([]*entry.Entry, error) {
+	rest, err := grp.cache.cacheEntries(ents...)
+	if len(rest) < len(ents) {
+		select {
+		case grp.cacheSignal <- true:
+		default:
+		}
+	}
+	return rest, err
+}
+
+// cacheEntries hands entries directly to the group caches, copying them when replicating.
+// Entries, or replicas of them, that a cache could not take are returned with the first
+// error, they are not resolved and are left to the caller.
+func (im *IngestMuxer) cacheEntries(ents ...*entry.Entry) (missed []*entry.Entry, err error) {
+	if !im.routing() {
+		return im.groups[0].cache.cacheEntries(ents...)
+	}
+	for _, e := range ents {
+		if e == nil {
+			continue
+		}
+		im.dispatch(e, func(gi int, ne *entry.Entry) {
+			if _, lerr := im.groups[gi].cache.cacheEntries(ne); lerr != nil {
+				missed = append(missed, ne)
+				if err == nil {
+					err = lerr
+				}
+			}
+		})
+	}
+	return
+}
+
+// cacheActive returns true if any group has a running cache
+func (im *IngestMuxer) cacheActive() bool {
+	for _, grp := range im.groups {
+		if grp.cacheRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheReady returns true if every group has a healthy file backed cache, so
+// entries can be accepted even though nothing is connected
+func (im *IngestMuxer) cacheReady() bool {
+	for _, grp := range im.groups {
+		if !grp.cacheRunning || grp.cacheError != nil || !grp.cacheFileBacked {
+			return false
+		}
+	}
+	return true
+}
+
+// drainToCache pulls everything still held by the muxer into the file backed caches,
+// entries for groups without one, or that a cache could not store, are handed to lost.
+// The muxer channels must be closed and every routine stopped.
+func (im *IngestMuxer) drainToCache(lost func(...*entry.Entry)) {
+	for _, grp := range im.groups {
+		store := lost
+		if grp.cacheFileBacked {
+			store = func(ents ...*entry.Entry) {
+				if rest, err := grp.cache.cacheEntries(ents...); err != nil {
+					lost(rest...)
+					im.acks.resolveSet(rest, err)
+				}
+			}
+		}
+		for _, mt := range im.targets {
+			if mt.grp != grp || mt.ig == nil {
+				continue //skip nil ingesters, these SHOULDN'T be nil
+			}
+			//outstanding entries carry the remote tags
+			ents := mt.ig.outstandingEntries()
+			if mt.tt != nil {
+				for _, e := range ents {
+					if e != nil {
+						e.Tag = mt.tt.Reverse(e.Tag)
+					}
+				}
+			}
+			store(ents...)
+		}
+		if im.routing() {
+			drainQueues(grp.eChan, grp.bChan, grp.eq, store)
+		}
+	}
+
+	//entries that never made it into a group go to each group they are routed to
+	save := func(gi int, e *entry.Entry) {
+		if grp := im.groups[gi]; !grp.cacheFileBacked {
+			lost(e)
+		} else if rest, err := grp.cache.cacheEntries(e); err != nil {
+			lost(rest...)
+			im.acks.resolveSet(rest, err)
+		}
+	}
+	store := func(ents ...*entry.Entry) {
+		for _, e := range ents {
+			if e == nil {
+				continue
+			} else if !im.routing() {
+				save(0, e)
+			} else {
+				im.dispatch(e, save)
+			}
+		}
+	}
+	drainQueues(im.eChan, im.bChan, nil, store)
+	//and anything still waiting in the priority lanes
+	if im.lanes != nil {
+		im.lanes.drain(func(e *entry.Entry) { store(e) }, func(b []*entry.Entry) { store(b...) })
+	}
+	//or lingering in a partial batch
+	if im.linger != nil {
+		store(im.linger.flush()...)
+	}
+	drainQueues(nil, nil, im.eq, store)
+}
+
+// drainQueues hands everything in a set of closed channels and an emergency queue to f
+func drainQueues(eChan chan *entry.Entry, bChan chan []*entry.Entry, eq *emergencyQueue, f func(...*entry.Entry)) {
+	if eChan != nil {
+		for e := range eChan {
+			f(e)
+		}
+	}
+	if bChan != nil {
+		for b := range bChan {
+			f(b...)
+		}
+	}
+	if eq == nil {
+		return
+	}
+	for {
+		ent, ents, ok := eq.pop()
+		if !ok {
+			break
+		}
+		f(ent)
+		f(ents...)
+	}
+}
+
+// closeCache syncs a file backed cache, saves the tag list, and closes it
+func (grp *muxGroup) closeCache(tags []string) error {
+	if grp.cache == nil {
+		return nil
+	}
+	if grp.journal != nil {
+		if err := grp.journal.flush(); err != nil {
+			return err
+		}
+	}
+	if grp.cacheFileBacked {
+		if err := grp.cache.Sync(); err != nil {
+			return err
+		}
+		if grp.cache.seq != nil {
+			if err := grp.cache.storeNextSequence(grp.cache.seq.peek()); err != nil {
+				return err
+			}
+		}
+	}
+	if err := grp.cache.UpdateStoredTagList(tags); err != nil {
+		return err
+	}
+	return grp.cache.Close()
+}
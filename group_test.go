@@ -0,0 +1,262 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestTargetGroups(t *testing.T) {
+	a := Target{Address: `tcp://127.0.0.1:4023`, Secret: `x`}
+	b := Target{Address: `tcp://127.0.0.2:4023`, Secret: `x`}
+	cc := IngestCacheConfig{FileBackingLocation: `/tmp/cache`, MemoryCacheSize: 1024}
+
+	//no groups is just the default group
+	groups, err := MuxerConfig{Destinations: []Target{a}, CacheConfig: cc}.targetGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Name != DefaultGroupName || groups[0].CacheConfig != cc {
+		t.Fatalf("Bad default group: %+v", groups)
+	}
+
+	c := MuxerConfig{
+		Destinations: []Target{a},
+		TargetGroups: []TargetGroup{{Name: `dr`, Destinations: []Target{b}}},
+		CacheConfig:  cc,
+	}
+	if _, err = c.targetGroups(); err != ErrGroupsNeedReplication {
+		t.Fatal("Failed to catch groups without replication", err)
+	}
+	c.Replicate = true
+	if groups, err = c.targetGroups(); err != nil {
+		t.Fatal(err)
+	} else if len(groups) != 2 || groups[1].Name != `dr` {
+		t.Fatalf("Bad groups: %+v", groups)
+	} else if groups[1].CacheConfig.FileBackingLocation != `/tmp/cache.dr` {
+		t.Fatal("Bad inherited cache location", groups[1].CacheConfig.FileBackingLocation)
+	}
+
+	bad := []TargetGroup{
+		{Name: ``, Destinations: []Target{b}},
+		{Name: DefaultGroupName, Destinations: []Target{b}},
+		{Name: `empty`},
+	}
+	errs := []error{ErrInvalidGroupName, ErrDuplicateGroup, ErrEmptyGroup}
+	for i, tg := range bad {
+		c.TargetGroups = []TargetGroup{tg}
+		if _, err = c.targetGroups(); err != errs[i] {
+			t.Fatalf("%d: expected %v, got %v", i, errs[i], err)
+		}
+	}
+}
+
+func TestAckTrackerSplit(t *testing.T) {
+	at := newAckTracker()
+	ent := &entry.Entry{}
+	var got error
+	var fired int
+	if err := at.add(ent, func(e *entry.Entry, err error) {
+		if e != ent {
+			t.Error("Callback got a replica")
+		}
+		got = err
+		fired++
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := []*entry.Entry{ent, {}, {}}
+	at.split(ent, r)
+	if at.pending != 3 {
+		t.Fatal("Bad pending count", at.pending)
+	}
+	at.confirmed(r[0])
+	at.cached(r[2])
+	if fired != 0 {
+		t.Fatal("Fired before every replica resolved")
+	}
+	at.confirmed(r[1])
+	if fired != 1 || got != ErrEntryCached || at.pending != 0 {
+		t.Fatal("Bad join", fired, got, at.pending)
+	}
+}
+
+func TestMuxerReplicate(t *testing.T) {
+	tiA := newTestIndexer(t)
+	defer tiA.Close()
+	tiB := newTestIndexer(t)
+	defer tiB.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{tiA.Target()},
+		TargetGroups: []TargetGroup{{Name: `dr`, Destinations: []Target{tiB.Target()}}},
+		Replicate:    true,
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 100
+	for i := 0; i < count/2; i++ {
+		if err := im.Write(entry.Now(), tag, []byte(fmt.Sprintf("entry %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b []*entry.Entry
+	for i := count / 2; i < count; i++ {
+		b = append(b, &entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(fmt.Sprintf("entry %d", i))})
+	}
+	if err := im.WriteBatch(b); err != nil {
+		t.Fatal(err)
+	}
+	//the ack only fires once both groups have confirmed
+	ea, err := im.WriteEntryAck(&entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`acked`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ea.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ms := im.Stats()
+	if len(ms.Groups) != 2 || ms.Groups[0].Name != DefaultGroupName || ms.Groups[1].Name != `dr` {
+		t.Fatalf("Bad group stats: %+v", ms.Groups)
+	}
+	if ms.Targets[0].Group != DefaultGroupName || ms.Targets[1].Group != `dr` {
+		t.Fatal("Bad target groups", ms.Targets[0].Group, ms.Targets[1].Group)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ti := range []*testIndexer{tiA, tiB} {
+		seen := map[string]bool{}
+		for _, e := range ti.Entries() {
+			seen[string(e.Data)] = true
+		}
+		for i := 0; i < count; i++ {
+			if !seen[fmt.Sprintf("entry %d", i)] {
+				t.Fatal("Missing entry", i)
+			}
+		}
+		if !seen[`acked`] {
+			t.Fatal("Missing acked entry")
+		}
+	}
+}
+
+func TestMuxerReplicateGroupDown(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	//grab an address that nothing is listening on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := `tcp://` + lst.Addr().String()
+	lst.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		TargetGroups: []TargetGroup{{Name: `dr`, Destinations: []Target{{Address: down, Secret: testIndexerSecret}}}},
+		Replicate:    true,
+		Tags:         []string{`testA`},
+		EnableCache:  true,
+		CacheConfig:  IngestCacheConfig{MemoryCacheSize: 1024 * 1024},
+		ChannelSize:  8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//far more than the group queues hold, the down group must not hold up the other
+	const count = 1000
+	for i := 0; i < count; i++ {
+		if err := im.WriteEntryTimeout(&entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`data`)}, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ms := im.Stats()
+	if len(ms.Groups) != 2 || ms.Groups[1].Hot != 0 || ms.Groups[1].CacheIn != count {
+		t.Fatalf("Bad down group stats: %+v", ms.Groups)
+	}
+	//the down group only has a memory cache, closing pitches what it holds
+	if err := im.Close(); err == nil {
+		t.Fatal("Close did not report the lost entries")
+	}
+	var got int
+	for _, e := range ti.Entries() {
+		if string(e.Data) == `data` {
+			got++
+		}
+	}
+	if got != count {
+		t.Fatal("Bad delivered count", got)
+	}
+}
+
+func TestAddGroupTarget(t *testing.T) {
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{{Address: `tcp://127.1.1.1:55555`, Secret: `x`}},
+		TargetGroups: []TargetGroup{{Name: `dr`, Destinations: []Target{{Address: `tcp://127.2.2.2:55555`, Secret: `x`}}}},
+		Replicate:    true,
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.AddGroupTarget(`nope`, Target{Address: `tcp://127.3.3.3:55555`, Secret: `x`}); err != ErrGroupNotFound {
+		t.Fatal("Failed to catch a missing group", err)
+	}
+	if err := im.AddGroupTarget(`dr`, Target{Address: `tcp://127.3.3.3:55555`, Secret: `x`}); err != nil {
+		t.Fatal(err)
+	}
+	//each group has to keep at least one target
+	if err := im.RemoveTarget(`tcp://127.1.1.1:55555`); err != ErrLastTarget {
+		t.Fatal("Removed the last target in a group", err)
+	}
+	if err := im.RemoveTarget(`tcp://127.2.2.2:55555`); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.RemoveTarget(`tcp://127.3.3.3:55555`); err != ErrLastTarget {
+		t.Fatal("Removed the last target in a group", err)
+	}
+}
@@ -179,6 +179,16 @@ func (igst *IngestConnection) Sync() error {
 	return igst.ew.ForceAck()
 }
 
+// ping keeps an idle connection alive, the indexer answers once it has flushed its acks
+func (igst *IngestConnection) ping() error {
+	igst.mtx.Lock()
+	defer igst.mtx.Unlock()
+	if !igst.running {
+		return ErrNotRunning
+	}
+	return igst.ew.Ping()
+}
+
 func (igst *IngestConnection) Running() bool {
 	igst.mtx.Lock()
 	defer igst.mtx.Unlock()
@@ -0,0 +1,385 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	journalCommitInterval = 100 * time.Millisecond //how often resolved entries are deleted when nothing is being sent
+)
+
+var (
+	ErrPersistNeedsFileCache = errors.New("Persisting in-flight entries requires a file backed cache")
+)
+
+// inflightJournal records every entry handed to an indexer in the file backed
+// cache until the indexer confirms it.  Whatever is left in the journal when the
+// process dies is moved into the cache the next time it is opened, so entries
+// are delivered at least once across restarts.  Entries are committed before
+// they are sent, senders that record at the same time share a commit.  Entries
+// that resolve are deleted from the store along with the next commit, a crash in
+// between just means a few extra replays.  Sequenced entries are journaled with
+// their sequence number appended so that they replay with it.
+type inflightJournal struct {
+	recorded uint64 //atomic, must stay at the top for alignment
+	mtx      sync.Mutex
+	cmtx     sync.Mutex //held while committing so commits land in order
+	ic       *IngestCache
+	ids      map[*entry.Entry]uint64 //0 until the entry is committed
+	queue    []*entry.Entry
+	vals     [][]byte        //encoded queue entries
+	next     *journalCommit  //the commit that will carry the queue
+	done     []uint64        //ids of resolved entries that are still in the store
+	seq      *entrySequencer //nil unless entries are sequenced
+}
+
+// journalCommit is closed once the entries queued for it are in the store
+type journalCommit struct {
+	done chan struct{}
+	err  error
+}
+
+func newInflightJournal(ic *IngestCache) *inflightJournal {
+	return &inflightJournal{
+		ic:   ic,
+		ids:  map[*entry.Entry]uint64{},
+		next: &journalCommit{done: make(chan struct{})},
+	}
+}
+
+// record journals entries before they are sent and returns once they are in the
+// store, entries that are already journaled, such as those being resent after a
+// failure, are skipped but still waited on.  The entries may carry remote tags,
+// tt reverses them back to the muxer tags.  Whoever gets to the store first
+// commits everything queued so far, so concurrent senders share a commit.
+func (j *inflightJournal) record(tt *tagTrans, ents ...*entry.Entry) error {
+	var wait bool
+	j.mtx.Lock()
+	for _, e := range ents {
+		if e == nil {
+			continue
+		} else if id, ok := j.ids[e]; ok {
+			wait = wait || id == 0
+			continue
+		}
+		buff, err := e.MarshallBytes()
+		if err != nil {
+			j.mtx.Unlock()
+			return err
+		}
+		if tt != nil {
+			binary.LittleEndian.PutUint16(buff[16:], uint16(tt.Reverse(e.Tag)))
+		}
+		if j.seq != nil {
+			buff = append(buff, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(buff[len(buff)-8:], j.seq.get(e))
+		}
+		j.ids[e] = 0
+		j.queue = append(j.queue, e)
+		j.vals = append(j.vals, buff)
+		atomic.AddUint64(&j.recorded, 1)
+		wait = true
+	}
+	c := j.next
+	j.mtx.Unlock()
+	if !wait {
+		return nil
+	}
+
+	j.cmtx.Lock()
+	defer j.cmtx.Unlock()
+	select {
+	case <-c.done:
+		//someone else committed our entries while we waited
+	default:
+		j.flushNoLock()
+	}
+	return c.err
+}
+
+// forget marks entries as resolved, entries that were never journaled are ignored
+// and queued entries are never committed
+func (j *inflightJournal) forget(ents ...*entry.Entry) {
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	for _, e := range ents {
+		if id, ok := j.ids[e]; ok {
+			delete(j.ids, e)
+			if id != 0 {
+				j.done = append(j.done, id)
+			}
+		}
+	}
+	j.mtx.Unlock()
+}
+
+// flush commits the queued entries and deletes every resolved entry from the
+// store in a single transaction.  The journal is free for record and forget
+// while the transaction runs.
+func (j *inflightJournal) flush() error {
+	j.cmtx.Lock()
+	defer j.cmtx.Unlock()
+	return j.flushNoLock()
+}
+
+// flushNoLock is flush with the commit lock already held, everyone waiting on the
+// queued entries is released with the result
+func (j *inflightJournal) flushNoLock() (err error) {
+	j.mtx.Lock()
+	var add []*entry.Entry
+	var vals [][]byte
+	for i, e := range j.queue {
+		if _, ok := j.ids[e]; ok {
+			add = append(add, e)
+			vals = append(vals, j.vals[i])
+		}
+	}
+	done := j.done
+	c := j.next
+	j.queue, j.vals, j.done = nil, nil, nil
+	j.next = &journalCommit{done: make(chan struct{})}
+	j.mtx.Unlock()
+	defer func() {
+		c.err = err
+		close(c.done)
+	}()
+	if len(vals) == 0 && len(done) == 0 {
+		return nil
+	}
+
+	ids, err := j.ic.journalUpdate(vals, done)
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if err != nil {
+		//resolved entries are deleted with the next commit, the queued entries are
+		//dropped so that a resend queues them again
+		j.done = append(j.done, done...)
+		for _, e := range add {
+			if id, ok := j.ids[e]; ok && id == 0 {
+				delete(j.ids, e)
+			}
+		}
+		return err
+	}
+	for i, e := range add {
+		if _, ok := j.ids[e]; ok {
+			j.ids[e] = ids[i]
+		} else {
+			//resolved while we were committing
+			j.done = append(j.done, ids[i])
+		}
+	}
+	return nil
+}
+
+// pending returns the number of journaled entries that have not resolved
+func (j *inflightJournal) pending() int {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return len(j.ids)
+}
+
+// forgetJournaled marks entries as resolved in every group journal
+func (im *IngestMuxer) forgetJournaled(ents ...*entry.Entry) {
+	for _, grp := range im.groups {
+		grp.journal.forget(ents...)
+	}
+}
+
+// journalHook returns the send hook for a connection in grp, it holds the send
+// until the entries are journaled.  Failing to write the journal is logged but
+// does not hold up delivery
+func (im *IngestMuxer) journalHook(grp *muxGroup, tt *tagTrans) func(...*entry.Entry) {
+	return func(ents ...*entry.Entry) {
+		if err := grp.journal.record(tt, ents...); err != nil {
+			im.Error("Failed to journal in-flight entries: %v", err)
+		}
+	}
+}
+
+// journalRoutine deletes resolved entries from the group journal while nothing is
+// being sent, the cache makes the last commit when it is closed
+func (im *IngestMuxer) journalRoutine(grp *muxGroup) {
+	defer im.wg.Done()
+	tckr := time.NewTicker(journalCommitInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-tckr.C:
+		case <-im.dieChan:
+			return
+		}
+		if err := grp.journal.flush(); err != nil {
+			im.Error("Failed to journal in-flight entries: %v", err)
+		}
+	}
+}
+
+func journalKey(id uint64) (k []byte) {
+	k = make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return
+}
+
+// journalUpdate adds encoded entries to the journal and deletes resolved ones in a
+// single transaction, the ids assigned to the new entries are returned in order
+func (ic *IngestCache) journalUpdate(vals [][]byte, del []uint64) (ids []uint64, err error) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	if ic.db == nil {
+		return nil, ErrNoActiveDB
+	}
+	err = ic.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(dbJournalBucket)
+		if err != nil {
+			return err
+		}
+		for _, id := range del {
+			if err := bkt.Delete(journalKey(id)); err != nil {
+				return err
+			}
+		}
+		for _, v := range vals {
+			id, err := bkt.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(journalKey(id), v); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return
+}
+
+// Replayed returns the number of unconfirmed entries recovered from the journal when the cache was opened
+func (ic *IngestCache) Replayed() uint64 {
+	return ic.replayed
+}
+
+// getJournal pulls a copy of the journal and its sequence out of the store
+func getJournal(db *bolt.DB) (keys, vals [][]byte, seq uint64, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(dbJournalBucket)
+		if bkt == nil {
+			return nil
+		}
+		seq = bkt.Sequence()
+		return bkt.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			vals = append(vals, append([]byte(nil), v...))
+			return nil
+		})
+	})
+	return
+}
+
+// putJournal restores a journal pulled with getJournal
+func putJournal(db *bolt.DB, keys, vals [][]byte, seq uint64) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(dbJournalBucket)
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			if err := bkt.Put(keys[i], vals[i]); err != nil {
+				return err
+			}
+		}
+		return bkt.SetSequence(seq)
+	})
+}
+
+// replayJournal moves every entry left in the journal into the cache bucket,
+// along with any sequence numbers they were journaled with.  Entries that
+// cannot be decoded are discarded.
+func replayJournal(db *bolt.DB) (cnt uint64, err error) {
+	err = db.Update(func(tx *bolt.Tx) error {
+		jbkt := tx.Bucket(dbJournalBucket)
+		if jbkt == nil {
+			_, err := tx.CreateBucket(dbJournalBucket)
+			return err
+		}
+		bkt := tx.Bucket(dbBucketName)
+		if bkt == nil {
+			return ErrBucketMissing
+		}
+		blks := map[entry.EntryKey]*entry.EntryBlock{}
+		seqs := map[entry.EntryKey][]uint64{}
+		var sequenced bool
+		if err := jbkt.ForEach(func(k, v []byte) error {
+			if len(v) < entry.ENTRY_HEADER_SIZE {
+				return nil
+			}
+			ent := &entry.Entry{}
+			n, err := ent.DecodeHeader(v)
+			if err != nil {
+				return nil
+			}
+			var seq uint64
+			switch len(v) - entry.ENTRY_HEADER_SIZE - n {
+			case 0:
+			case 8:
+				seq = binary.LittleEndian.Uint64(v[len(v)-8:])
+				sequenced = true
+			default:
+				return nil
+			}
+			ent.DecodeEntry(v[:entry.ENTRY_HEADER_SIZE+n])
+			blk, ok := blks[ent.Key()]
+			if !ok {
+				blk = &entry.EntryBlock{}
+				blks[ent.Key()] = blk
+			}
+			blk.Add(ent)
+			seqs[ent.Key()] = append(seqs[ent.Key()], seq)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for k, blk := range blks {
+			dbKey := makeKey(k)
+			old := bkt.Get(dbKey)
+			buff, err := blk.EncodeAppend(append([]byte(nil), old...))
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(dbKey, buff); err != nil {
+				return err
+			}
+			if sequenced {
+				if err := appendSeqs(tx, dbKey, buff, old != nil, seqs[k]); err != nil {
+					return err
+				}
+			}
+			cnt += uint64(blk.Count())
+		}
+		//start the journal over
+		if err := tx.DeleteBucket(dbJournalBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(dbJournalBucket)
+		return err
+	})
+	return
+}
@@ -0,0 +1,234 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestInflightJournal(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `journal`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := IngestCacheConfig{
+		FileBackingLocation: filepath.Join(dir, `cache.db`),
+		MemoryCacheSize:     memCacheSize,
+	}
+	ic, err := NewIngestCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := newInflightJournal(ic)
+	ents := testEntries(5, 100)
+	if err := j.record(nil, ents...); err != nil {
+		t.Fatal(err)
+	}
+	//the entries are in the store before record returns
+	if keys, _, _, err := getJournal(ic.db); err != nil || len(keys) != 5 {
+		t.Fatal("Entries not committed", len(keys), err)
+	}
+	//resending an entry does not journal it twice
+	if err := j.record(nil, ents[0]); err != nil || j.pending() != 5 || j.recorded != 5 {
+		t.Fatal("Bad journal state", j.pending(), j.recorded, err)
+	}
+	//resolved entries are deleted with the next commit
+	j.forget(ents[0], ents[1])
+	if err := j.flush(); err != nil || j.pending() != 3 {
+		t.Fatal("Bad journal state", j.pending(), err)
+	}
+	if keys, _, _, err := getJournal(ic.db); err != nil || len(keys) != 3 {
+		t.Fatal("Resolved entries not deleted", len(keys), err)
+	}
+	//compacting an empty cache must keep the journal
+	if blk, err := ic.PopBlock(); err != nil || blk != nil {
+		t.Fatal("Bad pop", blk, err)
+	}
+	if err := ic.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the unresolved entries come back as ordinary cached entries
+	if ic, err = NewIngestCache(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+	if ic.Replayed() != 3 || ic.Count() != 3 {
+		t.Fatal("Bad replay", ic.Replayed(), ic.Count())
+	}
+	blk, err := ic.PopBlock()
+	if err != nil || blk == nil || blk.Count() != 3 {
+		t.Fatal("Bad replayed block", blk, err)
+	}
+	for i, e := range blk.Entries() {
+		if !bytes.Equal(e.Data, ents[i+2].Data) || e.TS != ents[i+2].TS {
+			t.Fatal("Replayed entry does not match", i)
+		}
+	}
+}
+
+func TestInflightJournalConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `journal`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ic, err := NewIngestCache(IngestCacheConfig{
+		FileBackingLocation: filepath.Join(dir, `cache.db`),
+		MemoryCacheSize:     memCacheSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+	j := newInflightJournal(ic)
+	ents := testEntries(64, 100)
+	errs := make(chan error, len(ents))
+	var wg sync.WaitGroup
+	for _, e := range ents {
+		wg.Add(1)
+		go func(e *entry.Entry) {
+			defer wg.Done()
+			if err := j.record(nil, e); err != nil {
+				errs <- err
+				return
+			}
+			//every sender waits on the commit carrying its entry
+			j.mtx.Lock()
+			id := j.ids[e]
+			j.mtx.Unlock()
+			if id == 0 {
+				errs <- errors.New("Entry not committed before record returned")
+			}
+		}(e)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if keys, _, _, err := getJournal(ic.db); err != nil || len(keys) != len(ents) {
+		t.Fatal("Bad journal", len(keys), err)
+	}
+}
+
+func TestMuxerPersistInFlight(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `journal`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	c := MuxerConfig{
+		Destinations:    []Target{ti.Target()},
+		Tags:            []string{`testA`},
+		EnableCache:     true,
+		CacheConfig:     IngestCacheConfig{MemoryCacheSize: memCacheSize},
+		PersistInFlight: true,
+	}
+	if _, err := NewMuxer(c); err != ErrPersistNeedsFileCache {
+		t.Fatal("Failed to catch memory only cache", err)
+	}
+	c.CacheConfig.FileBackingLocation = filepath.Join(dir, `cache.db`)
+	im, err := NewMuxer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := testEntries(50, 100)
+	for _, e := range ents {
+		e.Tag = tag
+	}
+	if err := im.WriteBatch(ents[:40]); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	//confirmations clear the journal
+	j := im.groups[0].journal
+	ts := time.Now()
+	ms := im.Stats()
+	for (ms.JournalPending != 0 || atomic.LoadUint64(&j.recorded) != 40) && time.Since(ts) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+		ms = im.Stats()
+	}
+	if !ms.JournalEnabled || ms.JournalPending != 0 || atomic.LoadUint64(&j.recorded) != 40 {
+		t.Fatal("Bad journal state", ms.JournalEnabled, ms.JournalPending, atomic.LoadUint64(&j.recorded))
+	}
+	//stand in for entries that were sent when the process died, they carry remote tags
+	im.mtx.RLock()
+	tt := im.targets[0].tt
+	im.mtx.RUnlock()
+	for _, e := range ents[40:] {
+		var ok bool
+		if e.Tag, ok = tt.Translate(e.Tag); !ok {
+			t.Fatal("Failed to translate tag")
+		}
+	}
+	if err := j.record(tt, ents[40:]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countData(ti.Entries()); n != 40 {
+		t.Fatal("Bad entry count", n)
+	}
+
+	//the next run picks them up and delivers them
+	if im, err = NewMuxer(c); err != nil {
+		t.Fatal(err)
+	}
+	if ms := im.Stats(); ms.JournalReplayed != 10 {
+		t.Fatal("Bad replay count", ms.JournalReplayed)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ts = time.Now()
+	for countData(ti.Entries()) != 50 {
+		if time.Since(ts) > 10*time.Second {
+			t.Fatal("Replayed entries were never delivered", countData(ti.Entries()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ti.Lock()
+	rtag := ti.tags[`testA`]
+	ti.Unlock()
+	for _, e := range ti.Entries() {
+		if e.Tag != rtag && countData([]*entry.Entry{e}) == 1 {
+			t.Fatal("Replayed entry has the wrong tag", e.Tag)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	defaultLingerEntries int    = 512
+	defaultLingerBytes   uint64 = 1024 * 1024
+)
+
+var (
+	ErrInvalidLingerConfig = errors.New("Invalid linger config")
+)
+
+// LingerConfig coalesces entries handed to WriteEntry and friends into batches.
+// A batch is queued once it holds MaxEntries entries or MaxBytes bytes, or once
+// its first entry has waited Timeout.  A zero Timeout disables lingering, zero
+// limits use defaults.  Lingering is skipped when tag priorities are configured
+// so that the priority lanes see individual entries.
+type LingerConfig struct {
+	Timeout    time.Duration
+	MaxEntries int
+	MaxBytes   uint64
+}
+
+func (lc LingerConfig) enabled() bool {
+	return lc.Timeout != 0
+}
+
+func (lc LingerConfig) validate() error {
+	if lc.Timeout < 0 || lc.MaxEntries < 0 {
+		return ErrInvalidLingerConfig
+	}
+	return nil
+}
+
+// lingerBuffer holds single entries until there are enough of them to queue as
+// a batch.  Full batches are handed to the linger routine by the writer that
+// filled them, the routine flushes anything that lingers past the timeout.
+type lingerBuffer struct {
+	batches uint64 //atomic, must stay at the top for alignment
+	entries uint64
+	held    int32 //batches taken from the buffer that have not reached the muxer queue
+	mtx     sync.Mutex
+	cfg     LingerConfig
+	ents    []*entry.Entry
+	size    uint64
+	ready   chan []*entry.Entry //full batches waiting on the linger routine
+	kick    chan struct{}       //the buffer went from empty to holding entries
+	now     chan struct{}       //flush without waiting for the timeout
+}
+
+func newLingerBuffer(cfg LingerConfig) (*lingerBuffer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = defaultLingerEntries
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = defaultLingerBytes
+	}
+	return &lingerBuffer{
+		cfg:   cfg,
+		ents:  make([]*entry.Entry, 0, cfg.MaxEntries),
+		ready: make(chan []*entry.Entry, 1),
+		kick:  make(chan struct{}, 1),
+		now:   make(chan struct{}, 1),
+	}, nil
+}
+
+// add buffers an entry, if the buffer is full the batch is handed to the linger
+// routine.  An entry that could not be handed off before the context expired is
+// pulled back out of the batch so the caller can treat the write as failed.
+func (lb *lingerBuffer) add(ctx context.Context, e *entry.Entry, die chan bool) (b []*entry.Entry, err error) {
+	lb.mtx.Lock()
+	lb.ents = append(lb.ents, e)
+	lb.size += e.Size()
+	if len(lb.ents) == 1 {
+		signal(lb.kick)
+	}
+	if len(lb.ents) < lb.cfg.MaxEntries && lb.size < lb.cfg.MaxBytes {
+		lb.mtx.Unlock()
+		return
+	}
+	b = lb.take()
+	lb.mtx.Unlock()
+
+	select {
+	case lb.ready <- b:
+		b = nil
+	case <-ctx.Done():
+		//our entry is always the last one in the batch, put the rest back
+		lb.requeue(b[:len(b)-1])
+		b, err = nil, ctx.Err()
+	case <-die:
+		//the muxer is closing, the caller has to push the batch aside
+	}
+	return
+}
+
+// take empties the buffer, the caller must hold the lock and call done once the
+// batch is queued or pushed aside
+func (lb *lingerBuffer) take() (b []*entry.Entry) {
+	if len(lb.ents) == 0 {
+		return
+	}
+	atomic.AddInt32(&lb.held, 1)
+	b = lb.ents
+	lb.ents = make([]*entry.Entry, 0, lb.cfg.MaxEntries)
+	lb.size = 0
+	return
+}
+
+func (lb *lingerBuffer) done() {
+	atomic.AddInt32(&lb.held, -1)
+}
+
+// requeue puts entries taken from the buffer back at the front of it
+func (lb *lingerBuffer) requeue(b []*entry.Entry) {
+	lb.mtx.Lock()
+	lb.ents = append(b, lb.ents...)
+	for _, e := range b {
+		lb.size += e.Size()
+	}
+	lb.done()
+	lb.mtx.Unlock()
+	if len(b) > 0 {
+		signal(lb.kick)
+	}
+}
+
+func (lb *lingerBuffer) flush() (b []*entry.Entry) {
+	lb.mtx.Lock()
+	b = lb.take()
+	lb.mtx.Unlock()
+	return
+}
+
+// flushNow asks the linger routine to queue whatever is buffered
+func (lb *lingerBuffer) flushNow() {
+	signal(lb.now)
+}
+
+// pending returns the number of entries buffered or waiting to be queued
+func (lb *lingerBuffer) pending() int {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	return len(lb.ents) + int(atomic.LoadInt32(&lb.held))
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// lingerRoutine queues the batches built by the linger buffer
+func (im *IngestMuxer) lingerRoutine() {
+	defer im.wg.Done()
+	lb := im.linger
+	tmr := time.NewTimer(lb.cfg.Timeout)
+	tmr.Stop()
+	var armed bool
+	for {
+		var b []*entry.Entry
+		select {
+		case b = <-lb.ready:
+		case <-lb.kick:
+			if !armed {
+				tmr.Reset(lb.cfg.Timeout)
+				armed = true
+			}
+			continue
+		case <-tmr.C:
+			armed = false
+			b = lb.flush()
+		case <-lb.now:
+			b = lb.flush()
+		case <-im.dieChan:
+			select {
+			case b = <-lb.ready:
+				im.emergencyPush(nil, nil, b)
+				lb.done()
+			default:
+			}
+			if b = lb.flush(); len(b) > 0 {
+				im.emergencyPush(nil, nil, b)
+				lb.done()
+			}
+			return
+		}
+		if len(b) == 0 {
+			continue
+		}
+		atomic.AddUint64(&lb.batches, 1)
+		atomic.AddUint64(&lb.entries, uint64(len(b)))
+		select {
+		case im.bChan <- b:
+			lb.done()
+		case <-im.dieChan:
+			im.emergencyPush(nil, nil, b)
+			lb.done()
+			return
+		}
+	}
+}
+
+// lingerEntry buffers an entry in place of queueing it directly
+func (im *IngestMuxer) lingerEntry(ctx context.Context, e *entry.Entry) error {
+	b, err := im.linger.add(ctx, e, im.dieChan)
+	if len(b) > 0 {
+		im.emergencyPush(nil, nil, b)
+		im.linger.done()
+	}
+	return err
+}
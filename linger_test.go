@@ -0,0 +1,136 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestLingerBuffer(t *testing.T) {
+	if _, err := newLingerBuffer(LingerConfig{Timeout: -time.Second}); err != ErrInvalidLingerConfig {
+		t.Fatal("Failed to catch bad config", err)
+	}
+	lb, err := newLingerBuffer(LingerConfig{Timeout: time.Second, MaxEntries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	die := make(chan bool)
+	ents := testEntries(6, 10)
+	for _, e := range ents[:3] {
+		if b, err := lb.add(context.Background(), e, die); err != nil || b != nil {
+			t.Fatal("Bad add", b, err)
+		}
+	}
+	if b := <-lb.ready; len(b) != 3 || b[2] != ents[2] {
+		t.Fatal("Bad batch", b)
+	}
+	lb.done()
+	if lb.pending() != 0 {
+		t.Fatal("Bad pending count", lb.pending())
+	}
+
+	//fill the handoff so the next full batch has nowhere to go
+	lb.ready <- nil
+	lb.add(context.Background(), ents[3], die)
+	lb.add(context.Background(), ents[4], die)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := lb.add(ctx, ents[5], die); err != context.Canceled {
+		t.Fatal("Context ignored", err)
+	}
+	//the failed entry is pulled back out, the others are kept in order
+	if b := lb.flush(); len(b) != 2 || b[0] != ents[3] || b[1] != ents[4] {
+		t.Fatal("Bad requeue", b)
+	}
+	lb.done()
+
+	//a batch that cannot be handed off on close goes back to the caller
+	lb.add(context.Background(), ents[3], die)
+	lb.add(context.Background(), ents[4], die)
+	close(die)
+	if b, err := lb.add(context.Background(), ents[5], die); err != nil || len(b) != 3 {
+		t.Fatal("Bad close handling", b, err)
+	}
+
+	//the byte limit fills a batch too
+	if lb, err = newLingerBuffer(LingerConfig{Timeout: time.Second, MaxBytes: 2 * ents[0].Size()}); err != nil {
+		t.Fatal(err)
+	}
+	lb.add(context.Background(), ents[0], nil)
+	lb.add(context.Background(), ents[1], nil)
+	if len(lb.ready) != 1 {
+		t.Fatal("Byte limit not enforced")
+	}
+}
+
+func TestMuxerLinger(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+		Linger:       LingerConfig{Timeout: 50 * time.Millisecond, MaxEntries: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a lone entry goes out once the linger timeout expires
+	if err := im.WriteEntry(&entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`lone`)}); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now()
+	for im.Stats().LingerBatches != 1 {
+		if time.Since(ts) > 5*time.Second {
+			t.Fatal("Lingering entry was never flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, e := range testEntries(25, 10) {
+		e.Tag = tag
+		if err := im.WriteEntryContext(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//sync flushes the partial batch without waiting on the timeout
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	//the timer may split a batch on a slow machine, so only bound the batch count
+	if ms := im.Stats(); !ms.LingerEnabled || ms.LingerBatches < 4 || ms.LingerBatches > 10 || ms.LingerEntries != 26 {
+		t.Fatalf("Bad stats %d batches %d entries", ms.LingerBatches, ms.LingerEntries)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, e := range ti.Entries() {
+		if e.Tag != entry.GravwellTagId {
+			n++
+		}
+	}
+	if n != 26 {
+		t.Fatal("Bad entry count", n)
+	}
+}
@@ -0,0 +1,104 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package metrics
+
+import (
+	"strings"
+)
+
+type metricType string
+
+const (
+	counter  metricType = `counter`
+	gauge    metricType = `gauge`
+	stateset metricType = `stateset`
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+type labels []label
+
+type sample struct {
+	lbls  labels
+	value string
+}
+
+// family is a single OpenMetrics metric family and all of its samples
+type family struct {
+	name    string
+	typ     metricType
+	unit    string
+	help    string
+	samples []sample
+}
+
+// newFamily creates a family, if unit is set the name must end in it
+func newFamily(name string, typ metricType, unit, help string) *family {
+	return &family{
+		name: name,
+		typ:  typ,
+		unit: unit,
+		help: help,
+	}
+}
+
+func (f *family) add(l labels, v string) {
+	f.samples = append(f.samples, sample{lbls: l, value: v})
+}
+
+// write renders the family, families without samples are omitted
+func (f *family) write(sb *strings.Builder) {
+	if len(f.samples) == 0 {
+		return
+	}
+	sb.WriteString("# TYPE " + f.name + " " + string(f.typ) + "\n")
+	if f.unit != `` {
+		sb.WriteString("# UNIT " + f.name + " " + f.unit + "\n")
+	}
+	sb.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+	name := f.name
+	if f.typ == counter {
+		name += `_total`
+	}
+	for _, s := range f.samples {
+		sb.WriteString(name)
+		s.lbls.write(sb)
+		sb.WriteString(" " + s.value + "\n")
+	}
+}
+
+func (l labels) write(sb *strings.Builder) {
+	if len(l) == 0 {
+		return
+	}
+	sb.WriteByte('{')
+	for i, v := range l {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(v.name + `="` + escapeLabel(v.value) + `"`)
+	}
+	sb.WriteByte('}')
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
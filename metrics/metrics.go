@@ -0,0 +1,350 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package metrics exposes ingester internals in the OpenMetrics text format
+// so that they can be scraped by Prometheus or any compatible collector.
+// An Exporter is an http.Handler, register muxers and processor sets with it
+// and hang it off an HTTP server:
+//
+//	exp := metrics.New()
+//	exp.AddMuxer(`main`, igst)
+//	exp.AddProcessorSet(`main`, procs)
+//	exp.Register(nil, ``) //serves /metrics on the http.DefaultServeMux
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/processors"
+)
+
+const (
+	ContentType    string = `application/openmetrics-text; version=1.0.0; charset=utf-8`
+	DefaultPattern string = `/metrics`
+
+	muxerPrefix string = `gravwell_muxer_`
+	procPrefix  string = `gravwell_processor_`
+)
+
+var (
+	ErrEmptyName     = errors.New("Metric source name is empty")
+	ErrNilSource     = errors.New("Metric source is nil")
+	ErrDuplicateName = errors.New("Metric source name already registered")
+)
+
+// MuxerSource is satisfied by *ingest.IngestMuxer
+type MuxerSource interface {
+	Stats() ingest.MuxerStats
+}
+
+// ProcessorSource is satisfied by *processors.ProcessorSet
+type ProcessorSource interface {
+	Stats() []processors.ProcessorStats
+}
+
+// Exporter renders the counters of every registered source on each scrape.
+// Sources are identified by name, which is attached to every sample as the
+// "muxer" or "set" label.
+type Exporter struct {
+	mtx    sync.Mutex
+	muxers map[string]MuxerSource
+	procs  map[string]ProcessorSource
+}
+
+// New creates an Exporter with no registered sources
+func New() *Exporter {
+	return &Exporter{
+		muxers: map[string]MuxerSource{},
+		procs:  map[string]ProcessorSource{},
+	}
+}
+
+// AddMuxer registers a muxer under the given name
+func (e *Exporter) AddMuxer(name string, src MuxerSource) error {
+	if name == `` {
+		return ErrEmptyName
+	} else if src == nil {
+		return ErrNilSource
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if _, ok := e.muxers[name]; ok {
+		return ErrDuplicateName
+	}
+	e.muxers[name] = src
+	return nil
+}
+
+// AddProcessorSet registers a preprocessor set under the given name
+func (e *Exporter) AddProcessorSet(name string, src ProcessorSource) error {
+	if name == `` {
+		return ErrEmptyName
+	} else if src == nil {
+		return ErrNilSource
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if _, ok := e.procs[name]; ok {
+		return ErrDuplicateName
+	}
+	e.procs[name] = src
+	return nil
+}
+
+// Register attaches the exporter to mux at pattern, a nil mux uses
+// http.DefaultServeMux and an empty pattern uses DefaultPattern
+func (e *Exporter) Register(mux *http.ServeMux, pattern string) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	if pattern == `` {
+		pattern = DefaultPattern
+	}
+	mux.Handle(pattern, e)
+}
+
+// ServeHTTP implements http.Handler
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set(`Allow`, `GET, HEAD`)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var bb bytes.Buffer
+	if _, err := e.WriteTo(&bb); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(`Content-Type`, ContentType)
+	w.Header().Set(`Content-Length`, strconv.Itoa(bb.Len()))
+	if r.Method == http.MethodGet {
+		bb.WriteTo(w)
+	}
+}
+
+// WriteTo renders the current state of every registered source
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	for _, f := range e.collect() {
+		f.write(&sb)
+	}
+	sb.WriteString("# EOF\n")
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+type muxerSnapshot struct {
+	name string
+	ms   ingest.MuxerStats
+}
+
+type procSnapshot struct {
+	name string
+	ps   []processors.ProcessorStats
+}
+
+// collect snapshots every source and groups the samples into families,
+// OpenMetrics requires all samples for a family to be contiguous
+func (e *Exporter) collect() (fams []*family) {
+	e.mtx.Lock()
+	muxers := make([]muxerSnapshot, 0, len(e.muxers))
+	for k, v := range e.muxers {
+		muxers = append(muxers, muxerSnapshot{name: k, ms: v.Stats()})
+	}
+	procs := make([]procSnapshot, 0, len(e.procs))
+	for k, v := range e.procs {
+		procs = append(procs, procSnapshot{name: k, ps: v.Stats()})
+	}
+	e.mtx.Unlock()
+	sort.Slice(muxers, func(i, j int) bool { return muxers[i].name < muxers[j].name })
+	sort.Slice(procs, func(i, j int) bool { return procs[i].name < procs[j].name })
+
+	if len(muxers) > 0 {
+		fams = append(fams, muxerFamilies(muxers)...)
+	}
+	if len(procs) > 0 {
+		fams = append(fams, procFamilies(procs)...)
+	}
+	return
+}
+
+func muxerFamilies(muxers []muxerSnapshot) []*family {
+	uptime := newFamily(muxerPrefix+`uptime_seconds`, gauge, `seconds`, `Time since the muxer was started.`)
+	tstate := newFamily(muxerPrefix+`target_state`, stateset, ``, `Connection state of each target.`)
+	tents := newFamily(muxerPrefix+`target_entries`, counter, ``, `Entries written to the target.`)
+	tbytes := newFamily(muxerPrefix+`target_bytes`, counter, `bytes`, `Bytes written to the target.`)
+	tacks := newFamily(muxerPrefix+`target_acks`, counter, ``, `Entries confirmed by the target.`)
+	trecyc := newFamily(muxerPrefix+`target_recycled`, counter, ``, `Entries recycled after a target connection failed.`)
+	trecon := newFamily(muxerPrefix+`target_reconnects`, counter, ``, `Reconnections to the target.`)
+	tthrot := newFamily(muxerPrefix+`target_throttle_seconds`, counter, `seconds`, `Time spent honoring throttle requests from the target.`)
+	tout := newFamily(muxerPrefix+`target_outstanding`, gauge, ``, `Entries written on the current connection but not yet confirmed.`)
+	tconns := newFamily(muxerPrefix+`target_hot_connections`, gauge, ``, `Hot connections to the target.`)
+	qdepth := newFamily(muxerPrefix+`queue_depth`, gauge, ``, `Number of items waiting in the muxer input queues.`)
+	eqlen := newFamily(muxerPrefix+`emergency_queue_length`, gauge, ``, `Number of blocks in the emergency queue.`)
+	eqpush := newFamily(muxerPrefix+`emergency_queue_pushes`, counter, ``, `Pushes into the emergency queue.`)
+	eqbytes := newFamily(muxerPrefix+`emergency_queue_bytes`, gauge, `bytes`, `Bytes held by the emergency queue.`)
+	eqspill := newFamily(muxerPrefix+`emergency_queue_spilled`, counter, ``, `Entries the full emergency queue diverted to the cache.`)
+	eqdrop := newFamily(muxerPrefix+`emergency_queue_dropped`, counter, ``, `Entries lost because the emergency queue was full.`)
+	eqdropb := newFamily(muxerPrefix+`emergency_queue_dropped_bytes`, counter, `bytes`, `Bytes lost because the emergency queue was full.`)
+	cin := newFamily(muxerPrefix+`cache_entries_in`, counter, ``, `Entries written into the ingest cache.`)
+	cout := newFamily(muxerPrefix+`cache_entries_out`, counter, ``, `Entries read back out of the ingest cache.`)
+	chot := newFamily(muxerPrefix+`cache_hot_blocks`, gauge, ``, `Blocks held in memory by the ingest cache.`)
+	cstored := newFamily(muxerPrefix+`cache_stored_blocks`, gauge, ``, `Blocks stored on disk by the ingest cache.`)
+	cmem := newFamily(muxerPrefix+`cache_memory_bytes`, gauge, `bytes`, `Memory used by the ingest cache.`)
+	unk := newFamily(muxerPrefix+`unknown_tag_drops`, counter, ``, `Entries dropped because their tag was never negotiated.`)
+	rwait := newFamily(muxerPrefix+`rate_limit_wait_seconds`, counter, `seconds`, `Time writers were held back by the muxer rate limit.`)
+	pdepth := newFamily(muxerPrefix+`priority_queue_depth`, gauge, ``, `Number of items waiting in each priority lane.`)
+	pshed := newFamily(muxerPrefix+`priority_shed`, counter, ``, `Low priority entries shed because their lane was full.`)
+	lents := newFamily(muxerPrefix+`tag_limit_entries`, counter, ``, `Entries admitted by a tag limit.`)
+	lbytes := newFamily(muxerPrefix+`tag_limit_bytes`, counter, `bytes`, `Bytes admitted by a tag limit.`)
+	ldrop := newFamily(muxerPrefix+`tag_limit_dropped`, counter, ``, `Entries dropped by a tag limit.`)
+	lcache := newFamily(muxerPrefix+`tag_limit_cached`, counter, ``, `Entries diverted to the cache by a tag limit.`)
+	lquota := newFamily(muxerPrefix+`tag_limit_quota_used_bytes`, gauge, `bytes`, `Bytes counted against the current daily quota.`)
+	lblock := newFamily(muxerPrefix+`tag_limit_blocked_seconds`, counter, `seconds`, `Time writers were blocked by a tag limit.`)
+	dsupp := newFamily(muxerPrefix+`dedup_suppressed`, counter, ``, `Entries dropped as duplicates.`)
+	dtrack := newFamily(muxerPrefix+`dedup_tracked`, gauge, ``, `Entries remembered by the duplicate suppression window.`)
+	tsclamp := newFamily(muxerPrefix+`timestamp_clamped`, counter, ``, `Entries whose out of range timestamp was set to the current time.`)
+	tsrej := newFamily(muxerPrefix+`timestamp_rejected`, counter, ``, `Entries dropped for an out of range timestamp.`)
+	lgbatch := newFamily(muxerPrefix+`linger_batches`, counter, ``, `Batches built from single entry writes.`)
+	lgents := newFamily(muxerPrefix+`linger_entries`, counter, ``, `Entries coalesced into linger batches.`)
+	iflimit := newFamily(muxerPrefix+`in_flight_limit_bytes`, gauge, `bytes`, `Configured in-flight byte budget.`)
+	ifbytes := newFamily(muxerPrefix+`in_flight_bytes`, gauge, `bytes`, `Bytes charged against the in-flight budget.`)
+	ifwait := newFamily(muxerPrefix+`in_flight_wait_seconds`, counter, `seconds`, `Time writers waited for room in the in-flight budget.`)
+	ifdiv := newFamily(muxerPrefix+`in_flight_diverted`, counter, ``, `Entries sent to the cache because the in-flight budget was exhausted.`)
+	tsquar := newFamily(muxerPrefix+`timestamp_quarantined`, counter, ``, `Entries moved to the quarantine tag for an out of range timestamp.`)
+	jpend := newFamily(muxerPrefix+`journal_pending`, gauge, ``, `Journaled entries sent but not yet confirmed.`)
+	jreplay := newFamily(muxerPrefix+`journal_replayed`, counter, ``, `Unconfirmed entries recovered from the journal of a previous run.`)
+	paused := newFamily(muxerPrefix+`paused`, gauge, ``, `Set to 1 while the muxer is paused.`)
+	ghot := newFamily(muxerPrefix+`group_hot_targets`, gauge, ``, `Hot targets in each target group.`)
+	gqueue := newFamily(muxerPrefix+`group_queue_depth`, gauge, ``, `Number of items waiting in the target group queues.`)
+	gspill := newFamily(muxerPrefix+`group_spilled`, counter, ``, `Entries diverted into the group cache because the group fell behind.`)
+
+	for _, m := range muxers {
+		ml := labels{{`muxer`, m.name}}
+		uptime.add(ml, seconds(m.ms.Uptime))
+		for _, ts := range m.ms.Targets {
+			tl := labels{{`muxer`, m.name}, {`target`, ts.Address}}
+			for s := ingest.TargetConnecting; s <= ingest.TargetFailed; s++ {
+				v := `0`
+				if s == ts.State {
+					v = `1`
+				}
+				tstate.add(labels{{`muxer`, m.name}, {`target`, ts.Address}, {tstate.name, s.String()}}, v)
+			}
+			tents.add(tl, count(ts.EntriesWritten))
+			tbytes.add(tl, count(ts.BytesWritten))
+			tacks.add(tl, count(ts.Acks))
+			trecyc.add(tl, count(ts.Recycled))
+			trecon.add(tl, count(ts.Reconnects))
+			tthrot.add(tl, seconds(ts.ThrottleTime))
+			tout.add(tl, strconv.Itoa(ts.Outstanding))
+			tconns.add(tl, strconv.Itoa(ts.HotConnections))
+		}
+		qdepth.add(labels{{`muxer`, m.name}, {`queue`, `entry`}}, strconv.Itoa(m.ms.EntryQueueDepth))
+		qdepth.add(labels{{`muxer`, m.name}, {`queue`, `batch`}}, strconv.Itoa(m.ms.BatchQueueDepth))
+		eqlen.add(ml, strconv.Itoa(m.ms.EmergencyQueued))
+		eqpush.add(ml, count(m.ms.EmergencyPushes))
+		eqbytes.add(ml, count(m.ms.EmergencyBytes))
+		eqspill.add(ml, count(m.ms.EmergencySpilled))
+		eqdrop.add(ml, count(m.ms.EmergencyDropped))
+		eqdropb.add(ml, count(m.ms.EmergencyDropBytes))
+		if m.ms.CacheEnabled {
+			cin.add(ml, count(m.ms.CacheIn))
+			cout.add(ml, count(m.ms.CacheOut))
+			chot.add(ml, strconv.Itoa(m.ms.CacheHotBlocks))
+			cstored.add(ml, strconv.Itoa(m.ms.CacheStoredBlocks))
+			cmem.add(ml, count(m.ms.CacheMemorySize))
+		}
+		unk.add(ml, count(m.ms.UnknownTagDrops))
+		rwait.add(ml, seconds(m.ms.RateLimitWait))
+		if m.ms.PriorityQueueDepth != nil {
+			for _, p := range []ingest.Priority{ingest.PriorityHigh, ingest.PriorityNormal, ingest.PriorityLow} {
+				pdepth.add(labels{{`muxer`, m.name}, {`priority`, p.String()}}, strconv.Itoa(m.ms.PriorityQueueDepth[p]))
+			}
+			pshed.add(ml, count(m.ms.PriorityShed))
+		}
+		for _, tl := range m.ms.TagLimits {
+			l := labels{{`muxer`, m.name}, {`tag`, tl.Tag}}
+			lents.add(l, count(tl.Entries))
+			lbytes.add(l, count(tl.Bytes))
+			ldrop.add(l, count(tl.Dropped))
+			lcache.add(l, count(tl.Cached))
+			lquota.add(l, count(tl.QuotaUsed))
+			lblock.add(l, seconds(tl.BlockedTime))
+		}
+		if m.ms.DedupEnabled {
+			dsupp.add(ml, count(m.ms.DedupSuppressed))
+			dtrack.add(ml, strconv.Itoa(m.ms.DedupTracked))
+		}
+		if m.ms.TimestampEnabled {
+			tsclamp.add(ml, count(m.ms.TimestampClamped))
+			tsrej.add(ml, count(m.ms.TimestampRejected))
+			tsquar.add(ml, count(m.ms.TimestampQuarantined))
+		}
+		if m.ms.InFlightLimit > 0 {
+			iflimit.add(ml, count(m.ms.InFlightLimit))
+			ifbytes.add(ml, count(m.ms.InFlightBytes))
+			ifwait.add(ml, seconds(m.ms.InFlightWaitTime))
+			ifdiv.add(ml, count(m.ms.InFlightDiverted))
+		}
+		if m.ms.LingerEnabled {
+			lgbatch.add(ml, count(m.ms.LingerBatches))
+			lgents.add(ml, count(m.ms.LingerEntries))
+		}
+		if m.ms.JournalEnabled {
+			jpend.add(ml, strconv.Itoa(m.ms.JournalPending))
+			jreplay.add(ml, count(m.ms.JournalReplayed))
+		}
+		if m.ms.Paused {
+			paused.add(ml, `1`)
+		} else {
+			paused.add(ml, `0`)
+		}
+		for _, gs := range m.ms.Groups {
+			gl := labels{{`muxer`, m.name}, {`group`, gs.Name}}
+			ghot.add(gl, strconv.Itoa(gs.Hot))
+			gqueue.add(gl, strconv.Itoa(gs.EntryQueueDepth+gs.BatchQueueDepth))
+			gspill.add(gl, count(gs.Spilled))
+		}
+	}
+	return []*family{uptime, tstate, tents, tbytes, tacks, trecyc, trecon, tthrot, tout, tconns,
+		qdepth, eqlen, eqpush, eqbytes, eqspill, eqdrop, eqdropb, cin, cout, chot, cstored, cmem, unk, rwait, pdepth, pshed,
+		lents, lbytes, ldrop, lcache, lquota, lblock, dsupp, dtrack, tsclamp, tsrej, tsquar, lgbatch, lgents, iflimit, ifbytes, ifwait, ifdiv, jpend, jreplay, paused, ghot, gqueue, gspill}
+}
+
+func procFamilies(procs []procSnapshot) []*family {
+	in := newFamily(procPrefix+`entries_in`, counter, ``, `Entries handed to the preprocessor.`)
+	out := newFamily(procPrefix+`entries_out`, counter, ``, `Entries produced by the preprocessor.`)
+	errs := newFamily(procPrefix+`errors`, counter, ``, `Preprocessor failures.`)
+	for _, p := range procs {
+		for i, ps := range p.ps {
+			l := labels{{`set`, p.name}, {`index`, strconv.Itoa(i)}, {`processor`, ps.Name}}
+			in.add(l, count(ps.EntriesIn))
+			out.add(l, count(ps.EntriesOut))
+			errs.add(l, count(ps.Errors))
+		}
+	}
+	return []*family{in, out, errs}
+}
+
+func count(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,253 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package metrics
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/processors"
+)
+
+type staticMuxer ingest.MuxerStats
+
+func (sm staticMuxer) Stats() ingest.MuxerStats {
+	return ingest.MuxerStats(sm)
+}
+
+type staticProcs []processors.ProcessorStats
+
+func (sp staticProcs) Stats() []processors.ProcessorStats {
+	return sp
+}
+
+func testSources() (staticMuxer, staticProcs) {
+	ms := ingest.MuxerStats{
+		Uptime: 90 * time.Second,
+		Targets: []ingest.TargetStats{
+			{
+				TargetStatus:   ingest.TargetStatus{Address: `tcp://10.0.0.1:4023`, State: ingest.TargetHot},
+				EntriesWritten: 100,
+				BytesWritten:   4096,
+				Acks:           90,
+				Outstanding:    10,
+				ThrottleTime:   1500 * time.Millisecond,
+				Connections:    4,
+				HotConnections: 3,
+			},
+			{
+				TargetStatus: ingest.TargetStatus{Address: `tcp://"odd"\host:4023`, State: ingest.TargetBackoff},
+				Reconnects:   3,
+				Recycled:     7,
+			},
+		},
+		EntryQueueDepth:   5,
+		BatchQueueDepth:   2,
+		EmergencyQueued:   1,
+		EmergencyPushes:   4,
+		EmergencyBytes:    512,
+		EmergencyDropped:  6,
+		CacheEnabled:      true,
+		CacheIn:           20,
+		CacheOut:          12,
+		CacheHotBlocks:    3,
+		CacheStoredBlocks: 8,
+		CacheMemorySize:   1024,
+		UnknownTagDrops:   2,
+		PriorityQueueDepth: map[ingest.Priority]int{
+			ingest.PriorityHigh: 1,
+			ingest.PriorityLow:  6,
+		},
+		PriorityShed: 9,
+		TagLimits: []ingest.TagLimitStats{
+			{Tag: `netflow`, Entries: 50, Bytes: 5000, Dropped: 3, QuotaUsed: 5000},
+		},
+		DedupEnabled:         true,
+		DedupSuppressed:      11,
+		DedupTracked:         42,
+		TimestampEnabled:     true,
+		TimestampClamped:     4,
+		TimestampQuarantined: 1,
+		LingerEnabled:        true,
+		LingerBatches:        3,
+		LingerEntries:        700,
+		InFlightLimit:        4096,
+		InFlightBytes:        1024,
+		InFlightWaitTime:     1500 * time.Millisecond,
+		InFlightDiverted:     6,
+		Paused:               true,
+		JournalEnabled:       true,
+		JournalPending:       12,
+		JournalReplayed:      30,
+		Groups: []ingest.GroupStats{
+			{Name: `default`, Hot: 2, EntryQueueDepth: 1},
+			{Name: `dr`, EntryQueueDepth: 4, BatchQueueDepth: 3, Spilled: 70},
+		},
+	}
+	ps := []processors.ProcessorStats{
+		{Name: `gz`, EntriesIn: 10, EntriesOut: 10},
+		{Name: `split`, EntriesIn: 10, EntriesOut: 40, Errors: 1},
+	}
+	return staticMuxer(ms), staticProcs(ps)
+}
+
+func TestExporterRegistration(t *testing.T) {
+	exp := New()
+	sm, sp := testSources()
+	if err := exp.AddMuxer(``, sm); err != ErrEmptyName {
+		t.Fatal("Failed to catch empty name", err)
+	}
+	if err := exp.AddMuxer(`a`, nil); err != ErrNilSource {
+		t.Fatal("Failed to catch nil source", err)
+	}
+	if err := exp.AddMuxer(`a`, sm); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.AddMuxer(`a`, sm); err != ErrDuplicateName {
+		t.Fatal("Failed to catch duplicate name", err)
+	}
+	//muxers and processor sets live in different namespaces
+	if err := exp.AddProcessorSet(`a`, sp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExporterHTTP(t *testing.T) {
+	exp := New()
+	sm, sp := testSources()
+	if err := exp.AddMuxer(`main`, sm); err != nil {
+		t.Fatal(err)
+	}
+	if err := exp.AddProcessorSet(`main`, sp); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	exp.Register(mux, ``)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + DefaultPattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Bad status", resp.Status)
+	}
+	if ct := resp.Header.Get(`Content-Type`); ct != ContentType {
+		t.Fatal("Bad content type", ct)
+	}
+	out := string(body)
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Fatal("Missing EOF marker")
+	}
+	expected := []string{
+		`# TYPE gravwell_muxer_target_entries counter`,
+		`gravwell_muxer_target_entries_total{muxer="main",target="tcp://10.0.0.1:4023"} 100`,
+		`# UNIT gravwell_muxer_target_bytes bytes`,
+		`gravwell_muxer_target_bytes_total{muxer="main",target="tcp://10.0.0.1:4023"} 4096`,
+		`gravwell_muxer_target_throttle_seconds_total{muxer="main",target="tcp://10.0.0.1:4023"} 1.5`,
+		`gravwell_muxer_target_outstanding{muxer="main",target="tcp://10.0.0.1:4023"} 10`,
+		`gravwell_muxer_target_hot_connections{muxer="main",target="tcp://10.0.0.1:4023"} 3`,
+		`gravwell_muxer_target_state{muxer="main",target="tcp://10.0.0.1:4023",gravwell_muxer_target_state="HOT"} 1`,
+		`gravwell_muxer_target_state{muxer="main",target="tcp://10.0.0.1:4023",gravwell_muxer_target_state="BACKOFF"} 0`,
+		`gravwell_muxer_target_reconnects_total{muxer="main",target="tcp://\"odd\"\\host:4023"} 3`,
+		`gravwell_muxer_queue_depth{muxer="main",queue="entry"} 5`,
+		`gravwell_muxer_queue_depth{muxer="main",queue="batch"} 2`,
+		`gravwell_muxer_emergency_queue_length{muxer="main"} 1`,
+		`gravwell_muxer_emergency_queue_bytes{muxer="main"} 512`,
+		`gravwell_muxer_emergency_queue_dropped_total{muxer="main"} 6`,
+		`gravwell_muxer_cache_hot_blocks{muxer="main"} 3`,
+		`gravwell_muxer_cache_stored_blocks{muxer="main"} 8`,
+		`gravwell_muxer_cache_memory_bytes{muxer="main"} 1024`,
+		`gravwell_muxer_uptime_seconds{muxer="main"} 90`,
+		`gravwell_muxer_priority_queue_depth{muxer="main",priority="low"} 6`,
+		`gravwell_muxer_priority_queue_depth{muxer="main",priority="normal"} 0`,
+		`gravwell_muxer_priority_shed_total{muxer="main"} 9`,
+		`gravwell_muxer_tag_limit_bytes_total{muxer="main",tag="netflow"} 5000`,
+		`gravwell_muxer_tag_limit_dropped_total{muxer="main",tag="netflow"} 3`,
+		`gravwell_muxer_tag_limit_quota_used_bytes{muxer="main",tag="netflow"} 5000`,
+		`gravwell_muxer_dedup_suppressed_total{muxer="main"} 11`,
+		`gravwell_muxer_dedup_tracked{muxer="main"} 42`,
+		`gravwell_muxer_timestamp_clamped_total{muxer="main"} 4`,
+		`gravwell_muxer_timestamp_rejected_total{muxer="main"} 0`,
+		`gravwell_muxer_timestamp_quarantined_total{muxer="main"} 1`,
+		`gravwell_muxer_linger_batches_total{muxer="main"} 3`,
+		`gravwell_muxer_linger_entries_total{muxer="main"} 700`,
+		`gravwell_muxer_in_flight_limit_bytes{muxer="main"} 4096`,
+		`gravwell_muxer_in_flight_bytes{muxer="main"} 1024`,
+		`gravwell_muxer_in_flight_wait_seconds_total{muxer="main"} 1.5`,
+		`gravwell_muxer_in_flight_diverted_total{muxer="main"} 6`,
+		`gravwell_muxer_journal_pending{muxer="main"} 12`,
+		`gravwell_muxer_journal_replayed_total{muxer="main"} 30`,
+		`gravwell_muxer_paused{muxer="main"} 1`,
+		`gravwell_muxer_group_hot_targets{muxer="main",group="default"} 2`,
+		`gravwell_muxer_group_queue_depth{muxer="main",group="dr"} 7`,
+		`gravwell_muxer_group_spilled_total{muxer="main",group="dr"} 70`,
+		`gravwell_processor_entries_out_total{set="main",index="1",processor="split"} 40`,
+		`gravwell_processor_errors_total{set="main",index="1",processor="split"} 1`,
+	}
+	for _, v := range expected {
+		if !strings.Contains(out, v+"\n") {
+			t.Fatalf("Missing %q in output:\n%s", v, out)
+		}
+	}
+
+	//every family must be declared once and its samples must be contiguous
+	seen := map[string]bool{}
+	var current string
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		ln := sc.Text()
+		if strings.HasPrefix(ln, `# TYPE `) {
+			current = strings.Fields(ln)[2]
+			if seen[current] {
+				t.Fatal("Family declared twice", current)
+			}
+			seen[current] = true
+		} else if !strings.HasPrefix(ln, `#`) && !strings.HasPrefix(ln, current) {
+			t.Fatal("Sample outside of its family", ln)
+		}
+	}
+
+	resp, err = http.Post(srv.URL+DefaultPattern, `text/plain`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("Bad status on POST", resp.Status)
+	}
+}
+
+func TestExporterCacheDisabled(t *testing.T) {
+	exp := New()
+	sm, _ := testSources()
+	sm.CacheEnabled = false
+	if err := exp.AddMuxer(`main`, sm); err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if _, err := exp.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sb.String(), `gravwell_muxer_cache_`) {
+		t.Fatal("Cache metrics emitted for a muxer without a cache")
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/gravwell/ingest/v3/entry"
 	"github.com/gravwell/ingest/v3/log"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -37,28 +38,39 @@ var (
 	ErrEmergencyListOverflow = errors.New("Emergency list overflow")
 	ErrTimeout               = errors.New("Timed out waiting for ingesters")
 	ErrWriteTimeout          = errors.New("Timed out waiting to write entry")
-
-	errNotImp = errors.New("Not implemented yet")
+	ErrTargetExists          = errors.New("Target already exists")
+	ErrTargetNotFound        = errors.New("Target not found")
+	ErrLastTarget            = errors.New("Cannot remove the last target")
+	ErrInvalidConnCount      = errors.New("Invalid target connection count")
+
+	errNotImp        = errors.New("Not implemented yet")
+	errMuxerClosing  = errors.New("Muxer closing")
+	errTargetRemoved = errors.New("Target removed")
+	errConnUnstable  = errors.New("Connection dropped before it was stable")
 )
 
 const (
 	empty   muxState = 0
 	running muxState = 1
 	closed  muxState = 2
-
-	defaultChannelSize   int           = 64
-	defaultRetryTime     time.Duration = 10 * time.Second
-	recycleTimeout       time.Duration = time.Second
-	maxEmergencyListSize int           = 256
-	unknownAddr          string        = `unknown`
-	waitTickerDur        time.Duration = 50 * time.Millisecond
+	closing muxState = 3
+
+	defaultChannelSize        int           = 64
+	defaultRetryTime          time.Duration = 10 * time.Second
+	recycleTimeout            time.Duration = time.Second
+	defaultCloseTimeout       time.Duration = time.Second
+	defaultEmergencyQueueSize uint64        = 64 * 1024 * 1024
+	unknownAddr               string        = `unknown`
+	waitTickerDur             time.Duration = 50 * time.Millisecond
 )
 
 type muxState int
 
 type Target struct {
-	Address string
-	Secret  string
+	Address     string
+	Secret      string
+	Connections int    //parallel connections to open, 0 uses the muxer default
+	Proxy       string //socks5:// or http:// proxy to connect through, empty uses the muxer default
 }
 
 type TargetError struct {
@@ -66,20 +78,95 @@ type TargetError struct {
 	Error   error
 }
 
+// muxTarget holds the live state of a single connection to a destination managed
+// by the muxer, a target with parallel connections has one muxTarget per connection.
+// The die channel is closed when the target is removed, done is closed by the
+// connection routine once the target has been fully retired.
+type muxTarget struct {
+	Target
+	conn     int //index among the parallel connections to the target
+	ig       *IngestConnection
+	tt       *tagTrans
+	die      chan bool
+	done     chan bool
+	grp      *muxGroup
+	health   targetHealth
+	counters targetCounters
+	bo       *backoff  //only touched by the connection routine
+	up       time.Time //when the current connection went hot
+}
+
+func newMuxTarget(tgt Target, grp *muxGroup, conn int) *muxTarget {
+	return &muxTarget{
+		Target: tgt,
+		conn:   conn,
+		grp:    grp,
+		die:    make(chan bool),
+		done:   make(chan bool),
+	}
+}
+
+// newMuxTargets builds the set of connections for a target, def is the
+// number of connections used when the target does not specify one
+func newMuxTargets(tgt Target, grp *muxGroup, def int) (mts []*muxTarget) {
+	if tgt.Connections <= 0 {
+		tgt.Connections = def
+	}
+	if tgt.Connections <= 0 {
+		tgt.Connections = 1
+	}
+	for i := 0; i < tgt.Connections; i++ {
+		mts = append(mts, newMuxTarget(tgt, grp, i))
+	}
+	return
+}
+
+// retired returns true if the target has been removed from the muxer
+func (mt *muxTarget) retired() bool {
+	select {
+	case <-mt.die:
+		return true
+	default:
+	}
+	return false
+}
+
 type IngestMuxer struct {
 	//connHot, and connDead have atomic operations
 	//its important that these are aligned on 8 byte boundries
 	//or it will panic on 32bit architectures
 	connHot         int32 //how many connections are functioning
 	connDead        int32 //how many connections are dead
+	eqPushes        uint64
+	unknownTagDrops uint64
+	eqSpilled       uint64 //entries the emergency queue could not hold that went to the cache
+	eqDropped       uint64 //entries the emergency queue could not hold that were lost
+	eqDroppedBytes  uint64
+	acked           uint64 //entries confirmed by an indexer
+	ackedBytes      uint64
+	persisted       uint64 //entries written to a file backed cache
+	persistedBytes  uint64
+	replHeld        int32 //set while the replication routine holds an item it has not handed off
 	mtx             *sync.RWMutex
 	sig             *sync.Cond
-	igst            []*IngestConnection
-	tagTranslators  []*tagTrans
-	dests           []Target
+	targets         []*muxTarget
+	groups          []*muxGroup
+	router          *tagRouter
+	acks            *ackTracker
+	lanes           *priorityLanes  //nil unless tag priorities are configured
+	limits          *tagLimits      //nil unless tag limits are configured
+	dedup           *dedupWindow    //nil unless duplicate suppression is configured
+	tsPolicy        *tsPolicy       //nil unless a timestamp policy is configured
+	linger          *lingerBuffer   //nil unless lingering is configured
+	budget          *inflightBudget //nil unless MaxInFlightBytes is set
+	collectCh       chan struct{}   //nil unless MaxInFlightBytes is set
+	seq             *entrySequencer //nil unless SequenceEntries is set
+	events          *eventHub
 	errDest         []TargetError
 	tags            []string
 	tagMap          map[string]entry.EntryTag
+	negMtx          sync.Mutex                 //held while a new tag is negotiated with the targets
+	negotiating     map[string]*tagNegotiation //tags registered locally that the targets are still learning
 	pubKey          string
 	privKey         string
 	verifyCert      bool
@@ -94,51 +181,97 @@ type IngestMuxer struct {
 	logLevel        gll
 	lgr             Logger
 	cacheEnabled    bool
-	cache           *IngestCache
-	cacheWg         *sync.WaitGroup
-	cacheFileBacked bool
-	cacheRunning    bool
-	cacheError      error
-	cacheSignal     chan bool
 	name            string
 	version         string
 	uuid            string
 	rateParent      *parent
+	pause           atomic.Value  //*pauseState
+	defConns        int           //connections opened to targets that do not set their own
+	proxy           string        //proxy used by targets that do not set their own
+	dial            DialConfig    //custom dialer and socket options, zero value dials directly
+	resumeLimit     *rate.Limiter //nil unless ResumeRateBps is set
+	discovery       TargetDiscoveryConfig
+	retry           RetryPolicy
+	started         time.Time
 }
 
 type UniformMuxerConfig struct {
-	Destinations    []string
-	Tags            []string
-	Auth            string
-	PublicKey       string
-	PrivateKey      string
-	VerifyCert      bool
-	ChannelSize     int
-	EnableCache     bool
-	CacheConfig     IngestCacheConfig
-	LogLevel        string
-	Logger          Logger
-	IngesterName    string
-	IngesterVersion string
-	IngesterUUID    string
-	RateLimitBps    int64
+	Destinations     []string
+	Tags             []string
+	Auth             string
+	PublicKey        string
+	PrivateKey       string
+	VerifyCert       bool
+	ChannelSize      int
+	EnableCache      bool
+	CacheConfig      IngestCacheConfig
+	LogLevel         string
+	Logger           Logger
+	IngesterName     string
+	IngesterVersion  string
+	IngesterUUID     string
+	RateLimitBps     int64
+	TargetDiscovery  TargetDiscoveryConfig
+	RetryPolicy      RetryPolicy
+	TagPriorities    map[string]Priority
+	TagLimits        map[string]TagLimit
+	Dedup            DedupConfig
+	TimestampPolicy  TimestampPolicy
+	Linger           LingerConfig
+	MaxInFlightBytes uint64 //bytes written but not yet confirmed, cached, or dropped
+	InFlightAction   BudgetAction
+	ResumeRateBps    int64 //rate the cache is unloaded at after a Resume, 0 is unlimited
+	TargetGroups     []TargetGroup
+	Replicate        bool
+	Routes           []TagRoute
+	DefaultGroup     string
+	EmergencyBytes   uint64 //bytes each emergency queue may hold before spilling to the cache, 0 is 64MB
+	ConnsPerTarget   int    //parallel connections to each target that does not set its own, 0 is 1
+	PersistInFlight  bool   //journal unconfirmed entries in the file backed cache so they survive a restart
+	SequenceEntries  bool   //send a sequence number with each entry so indexers can drop replays, requires IngesterUUID
+	Proxy            string //socks5:// or http:// proxy for TCP and TLS targets that do not set their own
+	//proxies for individual destinations keyed by address, these take precedence over Proxy
+	TargetProxies map[string]string
+	//custom dialer, source address, socket options, and address selection used to reach targets
+	Dial DialConfig
 }
 
 type MuxerConfig struct {
-	Destinations    []Target
-	Tags            []string
-	PublicKey       string
-	PrivateKey      string
-	VerifyCert      bool
-	ChannelSize     int
-	EnableCache     bool
-	CacheConfig     IngestCacheConfig
-	LogLevel        string
-	Logger          Logger
-	IngesterName    string
-	IngesterVersion string
-	IngesterUUID    string
-	RateLimitBps    int64
+	Destinations     []Target
+	Tags             []string
+	PublicKey        string
+	PrivateKey       string
+	VerifyCert       bool
+	ChannelSize      int
+	EnableCache      bool
+	CacheConfig      IngestCacheConfig
+	LogLevel         string
+	Logger           Logger
+	IngesterName     string
+	IngesterVersion  string
+	IngesterUUID     string
+	RateLimitBps     int64
+	TargetDiscovery  TargetDiscoveryConfig
+	RetryPolicy      RetryPolicy
+	TagPriorities    map[string]Priority
+	TagLimits        map[string]TagLimit
+	Dedup            DedupConfig
+	TimestampPolicy  TimestampPolicy
+	Linger           LingerConfig
+	MaxInFlightBytes uint64 //bytes written but not yet confirmed, cached, or dropped
+	InFlightAction   BudgetAction
+	ResumeRateBps    int64 //rate the cache is unloaded at after a Resume, 0 is unlimited
+	TargetGroups     []TargetGroup
+	Replicate        bool
+	Routes           []TagRoute
+	DefaultGroup     string
+	EmergencyBytes   uint64 //bytes each emergency queue may hold before spilling to the cache, 0 is 64MB
+	ConnsPerTarget   int    //parallel connections to each target that does not set its own, 0 is 1
+	PersistInFlight  bool   //journal unconfirmed entries in the file backed cache so they survive a restart
+	SequenceEntries  bool   //send a sequence number with each entry so indexers can drop replays, requires IngesterUUID
+	Proxy            string //socks5:// or http:// proxy for TCP and TLS targets that do not set their own
+	//custom dialer, source address, socket options, and address selection used to reach targets
+	Dial DialConfig
 }
 
 func NewUniformMuxer(c UniformMuxerConfig) (*IngestMuxer, error) {
@@ -174,25 +307,66 @@ func newUniformIngestMuxerEx(c UniformMuxerConfig) (*IngestMuxer, error) {
 	for i := range c.Destinations {
 		destinations[i].Address = c.Destinations[i]
 		destinations[i].Secret = c.Auth
+		destinations[i].Proxy = c.TargetProxies[c.Destinations[i]]
 	}
-	if len(destinations) == 0 {
+	if len(destinations) == 0 && len(c.TargetGroups) == 0 && !c.TargetDiscovery.enabled() {
 		return nil, ErrNoTargets
 	}
+	//discovered targets inherit the uniform secret unless told otherwise
+	if c.TargetDiscovery.enabled() && c.TargetDiscovery.Secret == `` {
+		c.TargetDiscovery.Secret = c.Auth
+	}
+	//grouped targets inherit the uniform secret unless told otherwise
+	groups := make([]TargetGroup, 0, len(c.TargetGroups))
+	for _, tg := range c.TargetGroups {
+		dsts := make([]Target, len(tg.Destinations))
+		for i, d := range tg.Destinations {
+			if d.Secret == `` {
+				d.Secret = c.Auth
+			}
+			if d.Proxy == `` {
+				d.Proxy = c.TargetProxies[d.Address]
+			}
+			dsts[i] = d
+		}
+		tg.Destinations = dsts
+		groups = append(groups, tg)
+	}
 	cfg := MuxerConfig{
-		Destinations:    destinations,
-		Tags:            c.Tags,
-		PublicKey:       c.PublicKey,
-		PrivateKey:      c.PrivateKey,
-		VerifyCert:      c.VerifyCert,
-		ChannelSize:     c.ChannelSize,
-		EnableCache:     c.EnableCache,
-		CacheConfig:     c.CacheConfig,
-		LogLevel:        c.LogLevel,
-		IngesterName:    c.IngesterName,
-		IngesterVersion: c.IngesterVersion,
-		IngesterUUID:    c.IngesterUUID,
-		RateLimitBps:    c.RateLimitBps,
-		Logger:          c.Logger,
+		Destinations:     destinations,
+		Tags:             c.Tags,
+		PublicKey:        c.PublicKey,
+		PrivateKey:       c.PrivateKey,
+		VerifyCert:       c.VerifyCert,
+		ChannelSize:      c.ChannelSize,
+		EnableCache:      c.EnableCache,
+		CacheConfig:      c.CacheConfig,
+		LogLevel:         c.LogLevel,
+		IngesterName:     c.IngesterName,
+		IngesterVersion:  c.IngesterVersion,
+		IngesterUUID:     c.IngesterUUID,
+		RateLimitBps:     c.RateLimitBps,
+		Logger:           c.Logger,
+		TargetDiscovery:  c.TargetDiscovery,
+		RetryPolicy:      c.RetryPolicy,
+		TagPriorities:    c.TagPriorities,
+		TagLimits:        c.TagLimits,
+		Dedup:            c.Dedup,
+		TimestampPolicy:  c.TimestampPolicy,
+		Linger:           c.Linger,
+		MaxInFlightBytes: c.MaxInFlightBytes,
+		InFlightAction:   c.InFlightAction,
+		ResumeRateBps:    c.ResumeRateBps,
+		TargetGroups:     groups,
+		Replicate:        c.Replicate,
+		Routes:           c.Routes,
+		DefaultGroup:     c.DefaultGroup,
+		EmergencyBytes:   c.EmergencyBytes,
+		ConnsPerTarget:   c.ConnsPerTarget,
+		PersistInFlight:  c.PersistInFlight,
+		SequenceEntries:  c.SequenceEntries,
+		Proxy:            c.Proxy,
+		Dial:             c.Dial,
 	}
 	return newIngestMuxer(cfg)
 }
@@ -213,64 +387,130 @@ func NewIngestMuxerExt(dests []Target, tags []string, pubKey, privKey string, ch
 }
 
 func newIngestMuxer(c MuxerConfig) (*IngestMuxer, error) {
-	localTags := make([]string, 0, len(c.Tags))
+	localTags := make([]string, 0, len(c.Tags)+1)
 	for i := range c.Tags {
 		localTags = append(localTags, c.Tags[i])
 	}
+	if c.TimestampPolicy.enabled() {
+		if err := c.TimestampPolicy.validate(); err != nil {
+			return nil, err
+		}
+		//the quarantine tag has to be negotiated up front like any other
+		if c.TimestampPolicy.Action == TimestampQuarantine && !inTagList(localTags, c.TimestampPolicy.QuarantineTag) {
+			localTags = append(localTags, c.TimestampPolicy.QuarantineTag)
+		}
+	}
 	if c.Logger == nil {
 		c.Logger = log.NewDiscardLogger()
 	}
+	if c.SequenceEntries && c.IngesterUUID == `` {
+		return nil, ErrSequenceNeedsUUID
+	}
 
-	//if the cache is enabled, attempt to fire it up
-	var cache *IngestCache
-	var cacheSig chan bool
-	var err error
-	if c.EnableCache {
-		cache, err = NewIngestCache(c.CacheConfig)
-		if err != nil {
-			return nil, err
+	groupCfgs, err := c.targetGroups()
+	if err != nil {
+		return nil, err
+	}
+	router, err := newTagRouter(c, groupCfgs)
+	if err != nil {
+		return nil, err
+	}
+	if c.ChannelSize <= 0 {
+		c.ChannelSize = defaultChannelSize
+	}
+	//when priorities are in use the lanes do the buffering and hand entries
+	//off to the writers one at a time so that nothing queues behind a full channel
+	dispatchSize := c.ChannelSize
+	if len(c.TagPriorities) > 0 {
+		dispatchSize = 0
+	}
+	eChan := make(chan *entry.Entry, dispatchSize)
+	bChan := make(chan []*entry.Entry, dispatchSize)
+	if c.EmergencyBytes == 0 {
+		c.EmergencyBytes = defaultEmergencyQueueSize
+	}
+	eq := newEmergencyQueue(c.EmergencyBytes)
+
+	//a single group reads straight from the muxer queues, routed groups get their own
+	groups := make([]*muxGroup, 0, len(groupCfgs))
+	for i, gc := range groupCfgs {
+		var grp *muxGroup
+		if len(groupCfgs) == 1 {
+			grp = newMuxGroup(i, gc.Name, eChan, bChan, eq)
+		} else {
+			grp = newMuxGroup(i, gc.Name, make(chan *entry.Entry, c.ChannelSize), make(chan []*entry.Entry, c.ChannelSize), newEmergencyQueue(c.EmergencyBytes))
+		}
+		//if the cache is enabled, attempt to fire it up
+		if c.EnableCache {
+			if grp.cache, err = NewIngestCache(gc.CacheConfig); err != nil {
+				closeCaches(groups)
+				return nil, err
+			}
+			grp.cacheSignal = make(chan bool, 1)
+			grp.cacheFileBacked = gc.CacheConfig.FileBackingLocation != ``
 		}
-		cacheSig = make(chan bool, 1)
+		groups = append(groups, grp)
+		if c.PersistInFlight {
+			if !grp.cacheFileBacked {
+				closeCaches(groups)
+				return nil, ErrPersistNeedsFileCache
+			}
+			grp.journal = newInflightJournal(grp.cache)
+		}
+	}
 
+	if c.EnableCache {
 		// If there were stored entries, re-initialize localTags and the tagMap
-		if cache.Count() > 0 {
-			ctags, err := cache.GetTagList()
+		// every group stores the same tag list, so the longest one covers them all
+		var ctags []string
+		for _, grp := range groups {
+			if grp.cache.Count() == 0 {
+				continue
+			}
+			gtags, err := grp.cache.GetTagList()
 			if err != nil {
+				closeCaches(groups)
 				return nil, err
 			}
-			if len(ctags) > 0 {
-				// First, check if there are cached tags which are NOT in our configured set
-				var uniques []string
-			uniqueLoop:
-				for _, ct := range ctags {
-					for _, lt := range localTags {
-						if ct == lt {
-							continue uniqueLoop
-						}
+			if len(gtags) > len(ctags) {
+				ctags = gtags
+			}
+		}
+		if len(ctags) > 0 {
+			// First, check if there are cached tags which are NOT in our configured set
+			var uniques []string
+		uniqueLoop:
+			for _, ct := range ctags {
+				for _, lt := range localTags {
+					if ct == lt {
+						continue uniqueLoop
 					}
-					uniques = append(uniques, ct)
-				}
-				if len(uniques) > 0 {
-					c.Logger.Warn("The cache file contains entries. To ensure ingestion under the correct tags, the ingester will negotiate the following tags even if the config file does not currently require them: %v", uniques)
 				}
+				uniques = append(uniques, ct)
+			}
+			if len(uniques) > 0 {
+				c.Logger.Warn("The cache file contains entries. To ensure ingestion under the correct tags, the ingester will negotiate the following tags even if the config file does not currently require them: %v", uniques)
+			}
 
-				// Now, append any new configured tags to the end of the cached tags and use that as our localTags
-			tagLoop:
-				for _, lt := range localTags {
-					for _, ct := range ctags {
-						if lt == ct {
-							// the tag was already in the set, skip
-							continue tagLoop
-						}
+			// Now, append any new configured tags to the end of the cached tags and use that as our localTags
+		tagLoop:
+			for _, lt := range localTags {
+				for _, ct := range ctags {
+					if lt == ct {
+						// the tag was already in the set, skip
+						continue tagLoop
 					}
-					ctags = append(ctags, lt)
 				}
-				localTags = ctags
+				ctags = append(ctags, lt)
 			}
+			localTags = ctags
 		}
 		// Now update the stored tags list no matter what
-		if err := cache.UpdateStoredTagList(localTags); err != nil {
-			return nil, err
+		for _, grp := range groups {
+			if err := grp.cache.UpdateStoredTagList(localTags); err != nil {
+				closeCaches(groups)
+				return nil, err
+			}
 		}
 	}
 
@@ -279,87 +519,420 @@ func newIngestMuxer(c MuxerConfig) (*IngestMuxer, error) {
 	for i, v := range localTags {
 		tagMap[v] = entry.EntryTag(i)
 	}
+	router.register(localTags)
+	if len(groups) > 1 {
+		if err = router.checkGroups(len(groups), len(localTags)); err != nil {
+			closeCaches(groups)
+			return nil, err
+		}
+	}
 
-	if c.ChannelSize <= 0 {
-		c.ChannelSize = defaultChannelSize
+	if c.TargetDiscovery.enabled() {
+		if err = c.TargetDiscovery.validate(); err != nil {
+			closeCaches(groups)
+			return nil, err
+		}
+	}
+	if c.ConnsPerTarget < 0 {
+		closeCaches(groups)
+		return nil, ErrInvalidConnCount
+	}
+	if c.Proxy != `` {
+		if _, err = parseProxy(c.Proxy); err != nil {
+			closeCaches(groups)
+			return nil, err
+		}
+	}
+	if err = c.Dial.validate(); err != nil {
+		closeCaches(groups)
+		return nil, err
+	}
+	var targets []*muxTarget
+	for i, gc := range groupCfgs {
+		for _, d := range gc.Destinations {
+			if d.Connections < 0 {
+				closeCaches(groups)
+				return nil, ErrInvalidConnCount
+			} else if d.Proxy != `` {
+				if _, err = parseProxy(d.Proxy); err != nil {
+					closeCaches(groups)
+					return nil, err
+				}
+			}
+			targets = append(targets, newMuxTargets(d, groups[i], c.ConnsPerTarget)...)
+		}
 	}
 
 	var p *parent
 	if c.RateLimitBps > 0 {
 		p = newParent(c.RateLimitBps, 0)
 	}
-	return &IngestMuxer{
-		dests:           c.Destinations,
-		tags:            localTags,
-		tagMap:          tagMap,
-		pubKey:          c.PublicKey,
-		privKey:         c.PrivateKey,
-		verifyCert:      c.VerifyCert,
-		mtx:             &sync.RWMutex{},
-		wg:              &sync.WaitGroup{},
-		state:           empty,
-		lgr:             c.Logger,
-		logLevel:        logLevel(c.LogLevel),
-		eChan:           make(chan *entry.Entry, c.ChannelSize),
-		bChan:           make(chan []*entry.Entry, c.ChannelSize),
-		eq:              newEmergencyQueue(),
-		dieChan:         make(chan bool, len(c.Destinations)),
-		upChan:          make(chan bool, 1),
-		errChan:         make(chan error, len(c.Destinations)),
-		cache:           cache,
-		cacheEnabled:    c.EnableCache,
-		cacheWg:         &sync.WaitGroup{},
-		cacheFileBacked: c.CacheConfig.FileBackingLocation != ``,
-		cacheSignal:     cacheSig,
-		name:            c.IngesterName,
-		version:         c.IngesterVersion,
-		uuid:            c.IngesterUUID,
-		rateParent:      p,
-	}, nil
-}
-
-//Start starts the connection process. This will return immediately, and does
-//not mean that connections are ready. Callers should call WaitForHot immediately after
-//to wait for the connections to be ready.
+	acks := newAckTracker()
+	var lanes *priorityLanes
+	if len(c.TagPriorities) > 0 {
+		if lanes, err = newPriorityLanes(c.TagPriorities, tagMap, c.ChannelSize); err != nil {
+			closeCaches(groups)
+			return nil, err
+		}
+	}
+	var limits *tagLimits
+	if len(c.TagLimits) > 0 {
+		if limits, err = newTagLimits(c.TagLimits, tagMap, c.EnableCache); err != nil {
+			closeCaches(groups)
+			return nil, err
+		}
+	}
+	var dedup *dedupWindow
+	if c.Dedup.enabled() {
+		if dedup, err = newDedupWindow(c.Dedup); err != nil {
+			closeCaches(groups)
+			return nil, err
+		}
+	}
+	var linger *lingerBuffer
+	if c.Linger.enabled() {
+		if linger, err = newLingerBuffer(c.Linger); err != nil {
+			closeCaches(groups)
+			return nil, err
+		} else if lanes != nil {
+			linger = nil //the lanes need to see individual entries
+		}
+	}
+	var budget *inflightBudget
+	if c.MaxInFlightBytes > 0 {
+		if c.InFlightAction == BudgetCache && !c.EnableCache {
+			closeCaches(groups)
+			return nil, ErrBudgetNeedsCache
+		} else if budget, err = newInflightBudget(c.MaxInFlightBytes, c.InFlightAction); err != nil {
+			closeCaches(groups)
+			return nil, err
+		}
+	}
+	var tsp *tsPolicy
+	if c.TimestampPolicy.enabled() {
+		tsp = &tsPolicy{cfg: c.TimestampPolicy, qtag: tagMap[c.TimestampPolicy.QuarantineTag]}
+	}
+	im := &IngestMuxer{
+		targets:      targets,
+		groups:       groups,
+		router:       router,
+		acks:         acks,
+		tags:         localTags,
+		tagMap:       tagMap,
+		negotiating:  map[string]*tagNegotiation{},
+		pubKey:       c.PublicKey,
+		privKey:      c.PrivateKey,
+		verifyCert:   c.VerifyCert,
+		mtx:          &sync.RWMutex{},
+		wg:           &sync.WaitGroup{},
+		state:        empty,
+		lgr:          c.Logger,
+		logLevel:     logLevel(c.LogLevel),
+		eChan:        eChan,
+		bChan:        bChan,
+		lanes:        lanes,
+		limits:       limits,
+		dedup:        dedup,
+		tsPolicy:     tsp,
+		linger:       linger,
+		budget:       budget,
+		events:       newEventHub(),
+		eq:           eq,
+		dieChan:      make(chan bool),
+		upChan:       make(chan bool, 1),
+		errChan:      make(chan error, len(targets)+1),
+		cacheEnabled: c.EnableCache,
+		name:         c.IngesterName,
+		version:      c.IngesterVersion,
+		uuid:         c.IngesterUUID,
+		rateParent:   p,
+		resumeLimit:  newResumeLimiter(c.ResumeRateBps),
+		defConns:     c.ConnsPerTarget,
+		proxy:        c.Proxy,
+		dial:         c.Dial,
+		discovery:    c.TargetDiscovery,
+		retry:        c.RetryPolicy.normalize(),
+	}
+	im.pause.Store(&pauseState{changed: make(chan struct{})})
+	if budget != nil {
+		im.collectCh = make(chan struct{}, 1)
+		budget.nudge = im.collectAcks
+		acks.budget = budget
+	}
+	if c.PersistInFlight {
+		acks.forget = im.forgetJournaled
+	}
+	if c.SequenceEntries {
+		im.seq = newEntrySequencer()
+		acks.seq = im.seq
+	}
+	var seqNext uint64
+	for _, grp := range groups {
+		if grp.cache != nil {
+			grp.cache.onAdd = im.cacheHook(grp)
+			grp.cache.seq = im.seq
+			if im.seq != nil && grp.cacheFileBacked {
+				//pick up where the last clean close left off
+				next, err := grp.cache.takeNextSequence()
+				if err != nil {
+					closeCaches(groups)
+					return nil, err
+				} else if next > seqNext {
+					seqNext = next
+				}
+			}
+		}
+		if grp.journal != nil {
+			grp.journal.seq = im.seq
+		}
+	}
+	if im.seq != nil {
+		im.seq.resume(seqNext)
+	}
+	return im, nil
+}
+
+// Start starts the connection process. This will return immediately, and does
+// not mean that connections are ready. Callers should call WaitForHot immediately after
+// to wait for the connections to be ready.
 func (im *IngestMuxer) Start() error {
 	im.mtx.Lock()
 	defer im.mtx.Unlock()
-	if im.state != empty || len(im.igst) != 0 {
+	if im.state != empty {
 		return ErrNotReady
 	}
-	//fire up the cache if its in use
-	if im.cacheEnabled {
-		im.cacheWg.Add(1)
-		im.cacheRunning = true
-		go im.cacheRoutine()
+	//fire up the caches if they are in use
+	for _, grp := range im.groups {
+		if grp.cache != nil {
+			grp.cacheWg.Add(1)
+			grp.cacheRunning = true
+			go im.cacheRoutine(grp)
+		}
+	}
+	if im.routing() {
+		im.wg.Add(1)
+		go im.replicateRoutine()
+	}
+	for _, grp := range im.groups {
+		if grp.journal != nil {
+			im.wg.Add(1)
+			go im.journalRoutine(grp)
+		}
 	}
 
 	//fire up the ingest routines
-	im.igst = make([]*IngestConnection, len(im.dests))
-	im.tagTranslators = make([]*tagTrans, len(im.dests))
-	im.wg.Add(len(im.dests))
-	im.connDead = int32(len(im.dests))
-	for i := 0; i < len(im.dests); i++ {
-		go im.connRoutine(i)
+	for _, mt := range im.targets {
+		im.startTarget(mt)
+	}
+	if im.discovery.enabled() {
+		im.wg.Add(1)
+		go im.discoveryRoutine(im.discovery)
+	}
+	if im.lanes != nil {
+		im.wg.Add(1)
+		go im.laneRoutine()
+	}
+	if im.linger != nil {
+		im.wg.Add(1)
+		go im.lingerRoutine()
+	}
+	if im.budget != nil {
+		im.wg.Add(1)
+		go im.ackCollector()
 	}
 	im.state = running
+	im.started = time.Now()
 	return nil
 }
 
-// Close the connection
+// startTarget fires up the connection routine for a target, the caller must hold the lock
+func (im *IngestMuxer) startTarget(mt *muxTarget) {
+	im.wg.Add(1)
+	atomic.AddInt32(&im.connDead, 1)
+	go im.connRoutine(mt)
+}
+
+// AddTarget adds a new destination to the muxer.  If the muxer is already running
+// a connection to the new target is started immediately, otherwise it will be
+// started along with all other targets when Start is called.  When the muxer has
+// more than one target group the target joins the first group.
+func (im *IngestMuxer) AddTarget(tgt Target) error {
+	return im.addTarget(``, tgt)
+}
+
+// AddGroupTarget adds a new destination to the named target group
+func (im *IngestMuxer) AddGroupTarget(group string, tgt Target) error {
+	if group == `` {
+		return ErrInvalidGroupName
+	}
+	return im.addTarget(group, tgt)
+}
+
+func (im *IngestMuxer) addTarget(group string, tgt Target) error {
+	if _, _, err := ConnectionType(tgt.Address); err != nil {
+		return err
+	} else if tgt.Connections < 0 {
+		return ErrInvalidConnCount
+	} else if tgt.Proxy != `` {
+		if _, err := parseProxy(tgt.Proxy); err != nil {
+			return err
+		}
+	}
+	im.mtx.Lock()
+	defer im.mtx.Unlock()
+	if im.state == closed || im.state == closing {
+		return ErrNotRunning
+	}
+	grp := im.groups[0]
+	if group != `` {
+		if grp = im.group(group); grp == nil {
+			return ErrGroupNotFound
+		}
+	}
+	for _, mt := range im.targets {
+		if mt.Address == tgt.Address {
+			return ErrTargetExists
+		}
+	}
+	mts := newMuxTargets(tgt, grp, im.defConns)
+	im.targets = append(im.targets, mts...)
+	if im.state == running {
+		for _, mt := range mts {
+			im.startTarget(mt)
+		}
+	}
+	return nil
+}
+
+// RemoveTarget retires the destination with the given address.  The connections
+// are synced and closed, any entries that were not confirmed by the remote side
+// are recycled to the remaining targets.  RemoveTarget blocks until every
+// connection has been retired.  The last remaining target in a group cannot be removed.
+func (im *IngestMuxer) RemoveTarget(addr string) error {
+	im.mtx.Lock()
+	var grp *muxGroup
+	for _, mt := range im.targets {
+		if mt.Address == addr {
+			grp = mt.grp
+			break
+		}
+	}
+	if grp == nil {
+		im.mtx.Unlock()
+		return ErrTargetNotFound
+	}
+	var peers int
+	for _, v := range im.targets {
+		if v.grp == grp && v.Address != addr {
+			peers++
+		}
+	}
+	if peers == 0 {
+		im.mtx.Unlock()
+		return ErrLastTarget
+	}
+	var retired []*muxTarget
+	targets := make([]*muxTarget, 0, len(im.targets))
+	for _, mt := range im.targets {
+		if mt.Address == addr {
+			retired = append(retired, mt)
+		} else {
+			targets = append(targets, mt)
+		}
+	}
+	im.targets = targets
+
+	//the target is gone, so are its errors
+	errDest := im.errDest[:0]
+	for _, v := range im.errDest {
+		if v.Address != addr {
+			errDest = append(errDest, v)
+		}
+	}
+	im.errDest = errDest
+	for _, mt := range retired {
+		close(mt.die)
+	}
+	started := im.state != empty
+	im.mtx.Unlock()
+
+	if started {
+		//wait for the connection routines to sync and retire
+		for _, mt := range retired {
+			<-mt.done
+		}
+	}
+	return nil
+}
+
+// Targets returns the set of destinations currently managed by the muxer
+func (im *IngestMuxer) Targets() []Target {
+	im.mtx.RLock()
+	defer im.mtx.RUnlock()
+	tgts := make([]Target, 0, len(im.targets))
+	for _, mt := range im.targets {
+		if mt.conn == 0 {
+			tgts = append(tgts, mt.Target)
+		}
+	}
+	return tgts
+}
+
+// Close the connection, in-flight entries are given a second to drain to the
+// hot targets before they are cached or discarded
 func (im *IngestMuxer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	_, err := im.CloseContext(ctx)
+	return err
+}
+
+// CloseContext stops accepting writes and drains in-flight entries to the hot
+// targets until the context is done.  Whatever remains is persisted to the cache
+// if it is file backed and discarded otherwise.  The report accounts for what
+// happened to the entries that were in flight.
+func (im *IngestMuxer) CloseContext(ctx context.Context) (rep CloseReport, err error) {
 	// Inform the world that we're done.
 	im.Info("Ingester %v exiting\n", im.name)
-	im.Sync(time.Second)
-
-	var ok bool
 
 	im.mtx.Lock()
-	if im.state == closed {
+	if im.state == closed || im.state == closing {
 		im.mtx.Unlock()
-		return nil
+		return
+	}
+	started := im.state == running
+	im.state = closing
+	im.mtx.Unlock()
+
+	acked := atomic.LoadUint64(&im.acked)
+	ackedBytes := atomic.LoadUint64(&im.ackedBytes)
+	persisted := atomic.LoadUint64(&im.persisted)
+	persistedBytes := atomic.LoadUint64(&im.persistedBytes)
+	dropped := atomic.LoadUint64(&im.eqDropped)
+	droppedBytes := atomic.LoadUint64(&im.eqDroppedBytes)
+	defer func() {
+		rep.Delivered = atomic.LoadUint64(&im.acked) - acked
+		rep.DeliveredBytes = atomic.LoadUint64(&im.ackedBytes) - ackedBytes
+		rep.Cached = atomic.LoadUint64(&im.persisted) - persisted
+		rep.CachedBytes = atomic.LoadUint64(&im.persistedBytes) - persistedBytes
+		rep.Lost += atomic.LoadUint64(&im.eqDropped) - dropped
+		rep.LostBytes += atomic.LoadUint64(&im.eqDroppedBytes) - droppedBytes
+	}()
+	if started {
+		if im.linger != nil {
+			im.linger.flushNow()
+		}
+		//a paused muxer does not send, whatever is queued goes to the cache
+		if !im.Paused() {
+			im.drain(ctx)
+		}
 	}
+
+	im.mtx.Lock()
 	im.state = closed
+	defer im.events.close()
+	//anything that was not confirmed or cached by the time we are done is lost
+	defer im.acks.failAll(ErrEntryDropped)
 
 	//just close the channel, that will be a permenent signal for everything to close
 	close(im.dieChan)
@@ -367,25 +940,30 @@ func (im *IngestMuxer) Close() error {
 	//there is a chance that we are fully blocked with another async caller
 	//writing to the channel, so we set the state to closed and check if we need to
 	//discard some items from the channel
-	if atomic.LoadInt32(&im.connHot) == 0 && !im.cacheRunning {
+	if atomic.LoadInt32(&im.connHot) == 0 && !im.cacheActive() {
 		//no connections are hot, and there is no cache
 		//closeing is GOING to pitch entries, so... it is what it is...
 		//clear the channels
 	consumer:
 		for {
 			select {
-			case _, ok = <-im.eChan:
+			case e, ok := <-im.eChan:
 				if !ok {
 					break consumer
 				}
-			case _, ok = <-im.bChan:
+				rep.lose(e)
+			case b, ok := <-im.bChan:
 				if !ok {
 					break consumer
 				}
+				rep.lose(b...)
 			default:
 				break consumer
 			}
 		}
+		if im.lanes != nil {
+			im.lanes.drain(func(e *entry.Entry) { rep.lose(e) }, func(b []*entry.Entry) { rep.lose(b...) })
+		}
 	}
 
 	//we MUST unlock the mutex while we wait so that if a connection
@@ -395,10 +973,12 @@ func (im *IngestMuxer) Close() error {
 	//wait for everyone to quit
 	im.wg.Wait()
 
-	//if the cache is in use, signal for it to terminate and wait
-	if im.cacheRunning && im.cacheSignal != nil {
-		close(im.cacheSignal)
-		im.cacheWg.Wait()
+	//if the caches are in use, signal for them to terminate and wait
+	for _, grp := range im.groups {
+		if grp.cacheRunning && grp.cacheSignal != nil {
+			close(grp.cacheSignal)
+			grp.cacheWg.Wait()
+		}
 	}
 
 	im.mtx.Lock()
@@ -407,76 +987,88 @@ func (im *IngestMuxer) Close() error {
 	//close the echan now that all the routines have closed
 	close(im.eChan)
 	close(im.bChan)
+	if im.routing() {
+		for _, grp := range im.groups {
+			close(grp.eChan)
+			close(grp.bChan)
+		}
+	}
 
-	//sync the cache and close it
-	if im.cacheEnabled && im.cache != nil {
-		if im.cacheFileBacked {
-			// pull all outstanding items from each ingester connection and the channel
-			// and shove them into the cache, then sync it
-			for i := range im.igst {
-				if im.igst[i] == nil {
-					continue //skip nil ingesters, these SHOULDN'T be nil
-				}
-				ents := im.igst[i].outstandingEntries()
-				for i := range ents {
-					if ents[i] == nil {
-						continue
-					}
-					im.cache.addEntry(ents[i])
-				}
-			}
-			//clean out the entry channel too
-			for e := range im.eChan {
-				if e == nil {
-					continue
-				}
-				im.cache.addEntry(e)
-			}
-			//clean out the entry block channel too
-			for b := range im.bChan {
-				if b == nil {
-					continue
-				}
-				for _, e := range b {
-					if e == nil {
-						continue
-					}
-					im.cache.addEntry(e)
-				}
-			}
+	// pull all outstanding items from each ingester connection and the channels
+	// and shove them into the file backed caches, anything else is lost
+	im.drainToCache(rep.lose)
 
-			// clear the emergency queue into cache
-			for {
-				ent, ents, ok := im.eq.pop()
-				if !ok {
-					break
-				}
-				if ent != nil {
-					im.cache.addEntry(ent)
-				}
-				if len(ents) > 0 {
-					for _, e := range ents {
-						im.cache.addEntry(e)
-					}
-				}
+	//sync the caches and close them
+	if im.cacheEnabled {
+		for _, grp := range im.groups {
+			if grp.cache != nil && !grp.cacheFileBacked {
+				//a memory only cache takes what it holds with it
+				n, sz := grp.cache.hotEntries()
+				rep.Lost += n
+				rep.LostBytes += sz
 			}
-
-			//if we are file backed, sync the backing cache
-			if err := im.cache.Sync(); err != nil {
-				return err
+			if lerr := grp.closeCache(im.tags); lerr != nil && err == nil {
+				err = lerr
 			}
 		}
-		if err := im.cache.UpdateStoredTagList(im.tags); err != nil {
-			return err
-		}
-		if err := im.cache.Close(); err != nil {
-			return err
+		if err != nil {
+			return
 		}
 	}
 
 	//everyone is dead, clean up
 	close(im.upChan)
-	return nil
+	return
+}
+
+// drain waits for the queues to empty and for the hot targets to confirm everything
+// they were sent, it gives up when the context is done or nothing is hot
+func (im *IngestMuxer) drain(ctx context.Context) {
+	tckr := time.NewTicker(10 * time.Millisecond)
+	defer tckr.Stop()
+	for im.inFlight() {
+		if atomic.LoadInt32(&im.connHot) == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+// inFlight returns true if entries are queued or waiting on confirmation
+func (im *IngestMuxer) inFlight() bool {
+	im.mtx.Lock()
+	defer im.mtx.Unlock()
+	if im.queued() > 0 {
+		return true
+	}
+	for _, mt := range im.targets {
+		if mt.ig != nil && mt.ig.ew.unconfirmedCount() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmed is the ack hook handed to every entry writer
+func (im *IngestMuxer) confirmed(ent *entry.Entry) {
+	atomic.AddUint64(&im.acked, 1)
+	atomic.AddUint64(&im.ackedBytes, ent.Size())
+	im.acks.confirmed(ent)
+}
+
+// cacheHook returns the function called with every entry that lands in a group cache
+func (im *IngestMuxer) cacheHook(grp *muxGroup) func(*entry.Entry) {
+	return func(ent *entry.Entry) {
+		if grp.cacheFileBacked {
+			atomic.AddUint64(&im.persisted, 1)
+			atomic.AddUint64(&im.persistedBytes, ent.Size())
+		}
+		im.acks.cached(ent)
+	}
 }
 
 // LookupTag will reverse a tag id into a name, this operation is more expensive than a straight lookup
@@ -502,44 +1094,103 @@ func (im *IngestMuxer) NegotiateTag(name string) (tg entry.EntryTag, err error)
 		return
 	}
 
-	im.mtx.Lock()
-	defer im.mtx.Unlock()
-
-	if tag, ok := im.tagMap[name]; ok {
+	im.mtx.RLock()
+	tg, ok := im.tagMap[name]
+	tn := im.negotiating[name]
+	im.mtx.RUnlock()
+	if tn != nil {
+		// someone else is already negotiating it, wait for them
+		<-tn.done
+		return tn.tg, nil
+	} else if ok {
 		// tag already exists, just return it
-		tg = tag
 		return
 	}
 
+	// targets must learn new tags in the order they are registered, so only one
+	// negotiation runs at a time.  The muxer lock is only held while the tag is
+	// registered locally, writers are not held up by the round trips to the targets.
+	im.negMtx.Lock()
+	defer im.negMtx.Unlock()
+
+	im.mtx.Lock()
+	if tg, ok = im.tagMap[name]; ok {
+		// negotiated while we waited
+		im.mtx.Unlock()
+		return
+	}
 	// update the tag list and map
+	im.tagMap[name] = entry.EntryTag(len(im.tags))
 	im.tags = append(im.tags, name)
-	for i, v := range im.tags {
-		im.tagMap[v] = entry.EntryTag(i)
-	}
-	if im.cacheEnabled && im.cacheFileBacked {
-		// Now update the stored tags list
-		if err = im.cache.UpdateStoredTagList(im.tags); err != nil {
-			return
+	for i, grp := range im.groups {
+		if grp.cache != nil && grp.cacheFileBacked {
+			// Now update the stored tags list
+			if err = grp.cache.UpdateStoredTagList(im.tags); err != nil {
+				//back the tag out so the next attempt negotiates it from scratch,
+				//the stored lists already updated must not keep it at this index
+				delete(im.tagMap, name)
+				im.tags = im.tags[:len(im.tags)-1]
+				for _, ug := range im.groups[:i] {
+					if ug.cache != nil && ug.cacheFileBacked {
+						if lerr := ug.cache.UpdateStoredTagList(im.tags); lerr != nil {
+							im.lgr.Error("Failed to roll back the stored tag list for group %v: %v", ug.name, lerr)
+						}
+					}
+				}
+				im.mtx.Unlock()
+				return
+			}
 		}
 	}
 	tg = im.tagMap[name]
+	im.router.register(im.tags)
+	if im.lanes != nil {
+		im.lanes.register(name, tg)
+	}
+	if im.limits != nil {
+		im.limits.register(name, tg)
+	}
+	conns := make([]tagNegotiationConn, 0, len(im.targets))
+	for _, mt := range im.targets {
+		if mt.ig != nil {
+			conns = append(conns, tagNegotiationConn{mt: mt, ig: mt.ig, tt: mt.tt})
+		}
+	}
+	tn = &tagNegotiation{tg: tg, done: make(chan struct{})}
+	im.negotiating[name] = tn
+	im.mtx.Unlock()
 
-	for k, v := range im.igst {
-		if v != nil {
-			remoteTag, err := v.NegotiateTag(name)
-			if err != nil {
-				// something went wrong, kill it and let it re-initialize
+	defer func() {
+		im.mtx.Lock()
+		delete(im.negotiating, name)
+		im.mtx.Unlock()
+		close(tn.done)
+	}()
+
+	for _, c := range conns {
+		mt, v := c.mt, c.ig
+		if !im.router.allowed(tg, mt.grp.idx) {
+			//the tag is never routed to this target, keep the translator in step
+			if c.tt == nil || c.tt.RegisterTag(tg, unroutedTag) != nil {
 				v.Close()
-				continue
 			}
-			if im.tagTranslators[k] != nil {
-				err = im.tagTranslators[k].RegisterTag(tg, remoteTag)
-				if err != nil {
-					v.Close()
-				}
-			} else {
+			continue
+		}
+		remoteTag, err := v.NegotiateTag(name)
+		if err != nil {
+			// something went wrong, kill it and let it re-initialize
+			v.Close()
+			continue
+		}
+		if c.tt != nil {
+			err = c.tt.RegisterTag(tg, remoteTag)
+			if err != nil {
 				v.Close()
+			} else {
+				im.events.publish(Event{Type: EventTagNegotiated, Address: mt.Address, Group: mt.grp.name, Tag: name})
 			}
+		} else {
+			v.Close()
 		}
 	}
 	return
@@ -550,12 +1201,17 @@ func (im *IngestMuxer) Sync(to time.Duration) error {
 }
 
 func (im *IngestMuxer) SyncContext(ctx context.Context, to time.Duration) error {
-	if atomic.LoadInt32(&im.connHot) == 0 && !im.cacheRunning {
+	if atomic.LoadInt32(&im.connHot) == 0 && !im.cacheActive() {
 		return ErrAllConnsDown
+	} else if im.Paused() {
+		return ErrPaused
 	}
 	ts := time.Now()
+	if im.linger != nil {
+		im.linger.flushNow()
+	}
 	im.mtx.Lock()
-	for len(im.eChan) > 0 || len(im.bChan) > 0 {
+	for im.queued() > 0 {
 		if err := ctx.Err(); err != nil {
 			im.mtx.Unlock()
 			return err
@@ -572,17 +1228,18 @@ func (im *IngestMuxer) SyncContext(ctx context.Context, to time.Duration) error
 	}
 
 	var count int
-	for _, v := range im.igst {
-		if v != nil {
-			if err := v.Sync(); err != nil {
+	for _, mt := range im.targets {
+		if mt.ig != nil {
+			if err := mt.ig.Sync(); err != nil {
 				if err == ErrNotRunning {
 					count++
 				}
 			}
 		}
 	}
+	total := len(im.targets)
 	im.mtx.Unlock()
-	if count == len(im.igst) {
+	if count == total {
 		return ErrAllConnsDown
 	}
 	return nil
@@ -636,14 +1293,14 @@ mainLoop:
 			}
 			//timeout, check state and force a return
 			//if we have a hot, filebacked cache, then endpoints are go for ingest
-			if im.cacheRunning && im.cacheError == nil && im.cacheFileBacked {
+			if im.cacheReady() {
 				return nil
 			}
 			return ErrConnectionTimeout
 		case err := <-im.errChan:
 			//lock the mutex and check if all our connections failed
 			im.mtx.RLock()
-			if len(im.errDest) == len(im.dests) {
+			if len(im.errDest) >= len(im.targets) {
 				im.mtx.RUnlock()
 				return errors.New("All connections failed " + err.Error())
 			}
@@ -668,13 +1325,36 @@ func (im *IngestMuxer) Hot() (int, error) {
 // the returned boolean indicates whether we were able to entirely unload the cache
 // the cache MUST be stopped when we call this function
 // we are potentially bypassing the channel and adding directly into it
-func (im *IngestMuxer) unloadCache() (bool, error) {
+func (im *IngestMuxer) unloadCache(grp *muxGroup) (emptied bool, err error) {
 	//attempt to pull all our entries from the cache and push them through the entry channel
 	//this is used when a connection goes hot, we pull from our cache and drop them into channel
 	//for the muxer to fire at indexers
+	var ctx context.Context
+	var held []*entry.Entry
+	if im.limits != nil {
+		//tag limits can hold the unload up, entries they keep back go in the cache once we are done
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-im.dieChan:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		defer func() {
+			if len(held) == 0 {
+				return
+			}
+			if _, lerr := grp.cache.cacheEntries(held...); lerr != nil && err == nil {
+				err = lerr
+			}
+		}()
+	}
 	for {
 		//pop a block and attempt to push into the ingest routine
-		blk, err := im.cache.PopBlock()
+		blk, err := grp.cache.PopBlock()
 		if err != nil {
 			return false, err
 		}
@@ -682,99 +1362,146 @@ func (im *IngestMuxer) unloadCache() (bool, error) {
 			break //no more blocks
 		}
 		ents := blk.Entries()
+		if im.limits != nil {
+			var hb []*entry.Entry
+			var lerr error
+			ents, hb, lerr = im.replayLimits(ctx, ents)
+			held = append(held, hb...)
+			if lerr != nil {
+				if _, err := grp.cache.cacheEntries(ents...); err != nil {
+					return false, err
+				}
+				return false, nil
+			} else if len(ents) == 0 {
+				continue
+			}
+		}
+		if !im.resumeWait(grp, ents) {
+			if _, err := grp.cache.cacheEntries(ents...); err != nil {
+				return false, err
+			}
+			return false, nil
+		}
 		select {
-		case im.bChan <- ents:
-		case _, ok := <-im.cacheSignal:
+		case grp.bChan <- ents:
+		case _, ok := <-grp.cacheSignal:
 			//push things back into the cache if we have zero connections or
 			// the cacheSignal channel closed
-			v := atomic.LoadInt32(&im.connHot)
-			//if !ok || atomic.LoadInt32(&im.connHot) == 0 {
+			v := atomic.LoadInt32(&grp.connHot)
+			//if !ok || atomic.LoadInt32(&grp.connHot) == 0 {
 			if !ok || v == 0 {
 				//push the block items back into the cache and bail
-				im.cache.addBlock(ents)
+				if _, err := grp.cache.cacheEntries(ents...); err != nil {
+					return false, err
+				}
 				return false, nil //we need a transition
 			}
+			//just a spill, push the block and keep going
+			select {
+			case grp.bChan <- ents:
+			case <-im.dieChan:
+				if _, err := grp.cache.cacheEntries(ents...); err != nil {
+					return false, err
+				}
+				return false, nil
+			}
 		}
 	}
 	return true, nil
 }
 
-func (im *IngestMuxer) cacheRoutine() {
-	defer im.cacheWg.Done()
+func (im *IngestMuxer) cacheRoutine(grp *muxGroup) {
+	defer grp.cacheWg.Done()
 	var cacheActive bool
 
 	//when the cache is fired up, we ALWAYS start
 	//that way we are garunteed to be able to consume entries
-	if err := im.cache.Start(im.eChan, im.bChan); err != nil {
-		im.cacheError = err
-		im.cacheRunning = false
+	if err := grp.cache.Start(grp.eChan, grp.bChan); err != nil {
+		grp.cacheError = err
+		grp.cacheRunning = false
 		return
 	}
 	cacheActive = true
+	im.groupEvent(grp, EventCacheEngaged)
 
 mainLoop:
 	for {
-		if _, ok := <-im.cacheSignal; !ok {
+		if _, ok := <-grp.cacheSignal; !ok {
 			break mainLoop
 		}
 		//we have been signaled about a start or stop
-		if atomic.LoadInt32(&im.connHot) > 0 {
+		if atomic.LoadInt32(&grp.connHot) > 0 {
 			if cacheActive == true {
 				//a connection just went hot, stop the cache and
 				//attempt to dump entries out to the connection
 				cacheActive = false
-				if err := im.cache.Stop(); err != nil {
-					im.cacheError = err
+				if err := grp.cache.Stop(); err != nil {
+					grp.cacheError = err
 					break mainLoop
 				}
-				//attempt to unload the cache
-				emptied, err := im.unloadCache()
-				if err != nil {
-					im.cacheError = err
+				im.groupEvent(grp, EventCacheDisengaged)
+			} else if !grp.cached() {
+				//we were not active and another ingester came online, do nothing
+				atomic.StoreInt32(&grp.resuming, 0)
+				continue
+			}
+			if im.Paused() {
+				//hold on to everything until we resume
+				continue
+			}
+			//attempt to unload the cache, this also picks up entries spilled by a backed up group
+			emptied, err := im.unloadCache(grp)
+			if err != nil {
+				grp.cacheError = err
+				break mainLoop
+			} else if emptied {
+				atomic.StoreInt32(&grp.resuming, 0)
+			}
+			if !emptied && atomic.LoadInt32(&grp.connHot) == 0 {
+				//the cache couldn't empty due to ingesters disconnecting
+				//fire it back up and continue our loop
+				cacheActive = true
+				if err := grp.cache.Start(grp.eChan, grp.bChan); err != nil {
+					grp.cacheError = err
 					break mainLoop
 				}
-				if !emptied {
-					//the cache couldn't empty due to ingesters disconnecting
-					//fire it back up and continue our loop
-					cacheActive = true
-					if err := im.cache.Start(im.eChan, im.bChan); err != nil {
-						im.cacheError = err
-						break mainLoop
-					}
-				}
+				im.groupEvent(grp, EventCacheEngaged)
 			}
-			//we were not active and another ingester came online, do nothing
 		} else {
 			//no hot connections
 			if cacheActive == false {
 				//we just transitioned into no active ingest links
 				//and the cache is not active, get it fired up and rolling
 				cacheActive = true
-				if err := im.cache.Start(im.eChan, im.bChan); err != nil {
-					im.cacheError = err
+				if err := grp.cache.Start(grp.eChan, grp.bChan); err != nil {
+					grp.cacheError = err
 					break mainLoop
 				}
+				im.groupEvent(grp, EventCacheEngaged)
 			}
 		}
 	}
 
 	//check if we need to stop the cache on our way out
 	if cacheActive {
-		if err := im.cache.Stop(); err != nil {
-			im.cacheError = err
+		if err := grp.cache.Stop(); err != nil {
+			grp.cacheError = err
+		} else {
+			im.groupEvent(grp, EventCacheDisengaged)
 		}
 		cacheActive = false
 	}
-	im.cacheRunning = false
+	grp.cacheRunning = false
 }
 
 //goHot is a convienence function used by routines when they become active
-func (im *IngestMuxer) goHot() {
+func (im *IngestMuxer) goHot(grp *muxGroup) {
 	atomic.AddInt32(&im.connDead, -1)
+	atomic.AddInt32(&im.connHot, 1)
 	//attempt a single on going hot, but don't block
 	//increment the hot counter
-	if atomic.AddInt32(&im.connHot, 1) == 1 {
-		im.stopCache()
+	if atomic.AddInt32(&grp.connHot, 1) == 1 {
+		im.stopCache(grp)
 	}
 	select {
 	case im.upChan <- true:
@@ -782,38 +1509,39 @@ func (im *IngestMuxer) goHot() {
 	}
 }
 
-func (im *IngestMuxer) startCache() {
-	if im.cacheRunning {
+func (im *IngestMuxer) startCache(grp *muxGroup) {
+	if grp.cacheRunning {
 		//try to tell the cache about the need to fire back up
 		//if we can't send the signal, then the cache routine is busy.
 		//this is fine, because the cache routine will test the hot count
 		//in its loop and do the right thing
 		select {
-		case im.cacheSignal <- true: //true means an ingester stopped
+		case grp.cacheSignal <- true: //true means an ingester stopped
 		default:
 		}
 
 	}
 }
 
-func (im *IngestMuxer) stopCache() {
-	if im.cacheRunning {
+func (im *IngestMuxer) stopCache(grp *muxGroup) {
+	if grp.cacheRunning {
 		//try to tell the cache about the stoppage
 		//if we can't send the signal, then the cache routine is busy
 		//this is fine, because the cache routine will test the hot count
 		//in its loop and do the right thing
 		select {
-		case im.cacheSignal <- false: //false means an ingester started
+		case grp.cacheSignal <- false: //false means an ingester started
 		default:
 		}
 	}
 }
 
 //goDead is a convienence function used by routines when they become dead
-func (im *IngestMuxer) goDead() {
+func (im *IngestMuxer) goDead(grp *muxGroup) {
 	//decrement the hot counter
-	if atomic.AddInt32(&im.connHot, -1) == 0 {
-		im.startCache()
+	atomic.AddInt32(&im.connHot, -1)
+	if atomic.AddInt32(&grp.connHot, -1) == 0 {
+		im.startCache(grp)
 	}
 	atomic.AddInt32(&im.connDead, 1)
 }
@@ -835,7 +1563,7 @@ func (im *IngestMuxer) Size() (int, error) {
 	if im.state != running {
 		return -1, ErrNotRunning
 	}
-	return len(im.dests), nil
+	return len(im.targets), nil
 }
 
 // GetTag pulls back an intermediary tag id
@@ -851,18 +1579,86 @@ func (im *IngestMuxer) GetTag(tag string) (tg entry.EntryTag, err error) {
 	return
 }
 
+// admit runs entries through every admission step ahead of the queues: the
+// timestamp policy, duplicate suppression, sequencing, pause, the in-flight
+// budget and tag limits.  The entries that should be queued are returned, an
+// empty set with a nil error means they were all filtered or diverted.  The
+// returned function must be called with the outcome of queueing them, it hands
+// back everything the steps took if the entries could not be queued.
+func (im *IngestMuxer) admit(ctx context.Context, b []*entry.Entry) (ents []*entry.Entry, done func(error), err error) {
+	im.mtx.RLock()
+	runok := im.state == running
+	im.mtx.RUnlock()
+	if !runok {
+		return nil, nil, ErrNotRunning
+	}
+	var undo []func()
+	done = func(err error) {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	if im.tsPolicy != nil {
+		if b = im.checkTimestamps(b); len(b) == 0 {
+			return nil, done, nil
+		}
+	}
+	if im.dedup != nil {
+		if b = im.dedupBatch(b); len(b) == 0 {
+			return nil, done, nil
+		}
+		queued := b
+		undo = append(undo, func() { im.dedup.forget(queued...) })
+	}
+	if im.seq != nil {
+		im.seq.assign(b...)
+		assigned := b
+		undo = append(undo, func() { im.seq.forget(assigned...) })
+	}
+	if ok, err := im.pauseWait(ctx, b...); !ok {
+		done(err)
+		return nil, done, err
+	}
+	if im.budget != nil {
+		if ok, err := im.reserve(ctx, b...); !ok {
+			done(err)
+			return nil, done, err
+		}
+		reserved := b
+		undo = append(undo, func() { im.budget.release(reserved...) })
+	}
+	if im.limits != nil {
+		if b, err = im.limitBatch(ctx, b); err != nil {
+			done(err)
+			return nil, done, err
+		} else if len(b) == 0 {
+			return nil, done, nil
+		}
+		limited := b
+		undo = append(undo, func() { im.refundLimits(limited...) })
+	}
+	return b, done, nil
+}
+
 // WriteEntry puts an entry into the queue to be sent out by the first available
 // entry writer routine, if all routines are dead, THIS WILL BLOCK once the
 // channel fills up.  We figure this is a natural "wait" mechanism
-func (im *IngestMuxer) WriteEntry(e *entry.Entry) error {
+func (im *IngestMuxer) WriteEntry(e *entry.Entry) (err error) {
 	if e == nil {
 		return nil
 	}
-	im.mtx.RLock()
-	runok := im.state == running
-	im.mtx.RUnlock()
-	if !runok {
-		return ErrNotRunning
+	ents, done, err := im.admit(context.Background(), []*entry.Entry{e})
+	if err != nil || len(ents) == 0 {
+		return err
+	}
+	defer func() { done(err) }()
+	if im.lanes != nil {
+		return im.queueEntry(context.Background(), e)
+	} else if im.linger != nil {
+		return im.lingerEntry(context.Background(), e)
 	}
 	im.eChan <- e
 	return nil
@@ -872,15 +1668,19 @@ func (im *IngestMuxer) WriteEntry(e *entry.Entry) error {
 // entry writer routine, if all routines are dead, THIS WILL BLOCK once the
 // channel fills up.  We figure this is a natural "wait" mechanism
 // if not using a context, use WriteEntry as it is faster due to the lack of a select
-func (im *IngestMuxer) WriteEntryContext(ctx context.Context, e *entry.Entry) error {
+func (im *IngestMuxer) WriteEntryContext(ctx context.Context, e *entry.Entry) (err error) {
 	if e == nil {
 		return nil
 	}
-	im.mtx.RLock()
-	runok := im.state == running
-	im.mtx.RUnlock()
-	if !runok {
-		return ErrNotRunning
+	ents, done, err := im.admit(ctx, []*entry.Entry{e})
+	if err != nil || len(ents) == 0 {
+		return err
+	}
+	defer func() { done(err) }()
+	if im.lanes != nil {
+		return im.queueEntry(ctx, e)
+	} else if im.linger != nil {
+		return im.lingerEntry(ctx, e)
 	}
 	select {
 	case im.eChan <- e:
@@ -895,19 +1695,12 @@ func (im *IngestMuxer) WriteEntryContext(ctx context.Context, e *entry.Entry) er
 // a timeout.  It is therefor every expensive and shouldn't be used for normal writes
 // The typical use case is via the gravwell_log calls
 func (im *IngestMuxer) WriteEntryTimeout(e *entry.Entry, d time.Duration) (err error) {
-	tmr := time.NewTimer(d)
 	if e == nil {
 		return
 	}
-	im.mtx.RLock()
-	runok := im.state == running
-	im.mtx.RUnlock()
-	if !runok {
-		return ErrNotRunning
-	}
-	select {
-	case im.eChan <- e:
-	case _ = <-tmr.C:
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if err = im.WriteEntryContext(ctx, e); err == context.DeadlineExceeded {
 		err = ErrWriteTimeout
 	}
 	return
@@ -916,15 +1709,17 @@ func (im *IngestMuxer) WriteEntryTimeout(e *entry.Entry, d time.Duration) (err e
 // WriteBatch puts a slice of entries into the queue to be sent out by the first
 // available entry writer routine.  The entry writer routines will consume the
 // entire slice, so extremely large slices will go to a single indexer.
-func (im *IngestMuxer) WriteBatch(b []*entry.Entry) error {
+func (im *IngestMuxer) WriteBatch(b []*entry.Entry) (err error) {
 	if len(b) == 0 {
 		return nil
 	}
-	im.mtx.RLock()
-	runok := im.state == running
-	im.mtx.RUnlock()
-	if !runok {
-		return ErrNotRunning
+	b, done, err := im.admit(context.Background(), b)
+	if err != nil || len(b) == 0 {
+		return err
+	}
+	defer func() { done(err) }()
+	if im.lanes != nil {
+		return im.queueBatch(context.Background(), b)
 	}
 	im.bChan <- b
 	return nil
@@ -934,15 +1729,17 @@ func (im *IngestMuxer) WriteBatch(b []*entry.Entry) error {
 // available entry writer routine.  The entry writer routines will consume the
 // entire slice, so extremely large slices will go to a single indexer.
 // if a cancellation context isn't needed, use WriteBatch
-func (im *IngestMuxer) WriteBatchContext(ctx context.Context, b []*entry.Entry) error {
+func (im *IngestMuxer) WriteBatchContext(ctx context.Context, b []*entry.Entry) (err error) {
 	if len(b) == 0 {
 		return nil
 	}
-	im.mtx.RLock()
-	runok := im.state == running
-	im.mtx.RUnlock()
-	if !runok {
-		return ErrNotRunning
+	b, done, err := im.admit(ctx, b)
+	if err != nil || len(b) == 0 {
+		return err
+	}
+	defer func() { done(err) }()
+	if im.lanes != nil {
+		return im.queueBatch(ctx, b)
 	}
 	select {
 	case im.bChan <- b:
@@ -980,14 +1777,20 @@ func (im *IngestMuxer) WriteContext(ctx context.Context, tm entry.Timestamp, tag
 }
 
 //connFailed will put the destination in a failed state and inform the muxer
-func (im *IngestMuxer) connFailed(dst string, err error) {
+func (im *IngestMuxer) connFailed(mt *muxTarget, err error) {
+	mt.health.setError(TargetFailed, err, time.Time{})
+	im.targetEvent(mt, EventFailed, err, 0)
 	im.mtx.Lock()
 	defer im.mtx.Unlock()
 	im.errDest = append(im.errDest, TargetError{
-		Address: dst,
+		Address: mt.Address,
 		Error:   err,
 	})
-	im.errChan <- err
+	//targets can come and go, so never block on the notification
+	select {
+	case im.errChan <- err:
+	default:
+	}
 }
 
 type connSet struct {
@@ -995,14 +1798,17 @@ type connSet struct {
 	tt  *tagTrans
 	dst string
 	src net.IP
+	cnt *targetCounters
 }
 
 //keep attempting to get a new connection set that we can actually write to
-func (im *IngestMuxer) getNewConnSet(csc chan connSet, connFailure chan bool, orig bool) (nc connSet, ok bool) {
+//failed tells the connection routine if the old connection failed or is only
+//being replaced to renegotiate tags, only failures count against the target
+func (im *IngestMuxer) getNewConnSet(grp *muxGroup, csc chan connSet, connFailure chan bool, orig, failed bool) (nc connSet, ok bool) {
 	if !orig {
 		//try to send, if we can't just roll on
 		select {
-		case connFailure <- true:
+		case connFailure <- failed:
 		default:
 		}
 	}
@@ -1011,7 +1817,7 @@ func (im *IngestMuxer) getNewConnSet(csc chan connSet, connFailure chan bool, or
 			return
 		}
 		//attempt to clear the emergency queue and throw at our new connection
-		if !im.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
+		if !grp.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
 			//try to send, if we can't just roll on
 			select {
 			case connFailure <- true:
@@ -1036,12 +1842,12 @@ func tickerInterval() time.Duration {
 	return time.Duration(750+rand.Int63n(500)) * time.Millisecond
 }
 
-func (im *IngestMuxer) shouldSched() bool {
+func (im *IngestMuxer) shouldSched(grp *muxGroup) bool {
 	//if pipelines are empty, schedule ourselves so that we can get a better distribution of entries
-	return len(im.igst) > 1 && len(im.eChan) == 0 && len(im.bChan) == 0
+	return atomic.LoadInt32(&grp.connHot) > 1 && len(grp.eChan) == 0 && len(grp.bChan) == 0
 }
 
-func (im *IngestMuxer) writeRelayRoutine(csc chan connSet, connFailure chan bool) {
+func (im *IngestMuxer) writeRelayRoutine(grp *muxGroup, csc chan connSet, connFailure chan bool, tdie chan bool) {
 	tmr := time.NewTimer(tickerInterval())
 	defer tmr.Stop()
 	defer close(connFailure)
@@ -1052,21 +1858,34 @@ func (im *IngestMuxer) writeRelayRoutine(csc chan connSet, connFailure chan bool
 	var ok bool
 	var err error
 	var ttag entry.EntryTag
-	if nc, ok = im.getNewConnSet(csc, connFailure, true); !ok {
+	if nc, ok = im.getNewConnSet(grp, csc, connFailure, true, true); !ok {
 		return
 	}
 
-	eC := im.eChan
-	bC := im.bChan
+	eC := grp.eChan
+	bC := grp.bChan
 
 inputLoop:
 	for {
+		ps := im.pauseState()
+		ein, bin := eC, bC
+		if ps.paused {
+			//leave everything queued until we resume
+			ein, bin = nil, nil
+		}
 		select {
 		case _ = <-im.dieChan:
 			nc.ig.Sync()
 			nc.ig.Close()
 			return
-		case e, ok := <-eC:
+		case <-ps.changed:
+		case _ = <-tdie:
+			//the target was removed, sync and hand anything unconfirmed back to the muxer
+			nc.ig.Sync()
+			nc.ig.Close()
+			im.recycleEntries(grp, nil, nc.ig.outstandingEntries(), nc.tt, true, nc.cnt)
+			return
+		case e, ok := <-ein:
 			if !ok {
 				eC = nil
 				if bC == nil {
@@ -1081,6 +1900,8 @@ inputLoop:
 			if !ok {
 				// If the ingest muxer has no idea what this tag is, drop it and notify
 				if name, ok := im.LookupTag(e.Tag); !ok {
+					atomic.AddUint64(&im.unknownTagDrops, 1)
+					im.acks.resolve(e, ErrTagNotFound)
 					im.Error("Got entry tagged with completely unknown intermediate tag %v, dropping it", e.Tag)
 					continue inputLoop
 				} else {
@@ -1088,8 +1909,8 @@ inputLoop:
 					// Could not translate, but it's a valid tag the muxer has seen before.
 					// We need to push this to the equeue and reconnect
 					// so we get the correct tag set.
-					im.recycleEntries(e, nil, nc.tt, false)
-					if nc, ok = im.getNewConnSet(csc, connFailure, false); !ok {
+					im.recycleEntries(grp, e, nil, nc.tt, false, nc.cnt)
+					if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, false); !ok {
 						break inputLoop
 					}
 					continue inputLoop
@@ -1101,25 +1922,25 @@ inputLoop:
 				e.SRC = nc.src
 			}
 			if err = nc.ig.WriteEntry(e); err != nil {
-				im.recycleEntries(e, nil, nc.tt, true)
-				if nc, ok = im.getNewConnSet(csc, connFailure, false); !ok {
+				im.recycleEntries(grp, e, nil, nc.tt, true, nc.cnt)
+				if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, true); !ok {
 					break inputLoop
 				}
 			}
 			//hack to get better distribution across connections in an muxer
-			if im.shouldSched() {
+			if im.shouldSched(grp) {
 				if !tmr.Stop() {
 					<-tmr.C
 				}
-				if !im.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
-					if nc, ok = im.getNewConnSet(csc, connFailure, false); !ok {
+				if !grp.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
+					if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, true); !ok {
 						break inputLoop
 					}
 				}
 				tmr.Reset(tickerInterval())
 				runtime.Gosched()
 			}
-		case b, ok := <-bC:
+		case b, ok := <-bin:
 			if !ok {
 				bC = nil
 				if eC == nil {
@@ -1135,7 +1956,10 @@ inputLoop:
 					ttag, ok = nc.tt.Translate(b[i].Tag)
 					if !ok {
 						if name, ok := im.LookupTag(b[i].Tag); !ok {
+							atomic.AddUint64(&im.unknownTagDrops, 1)
 							im.Error("Got entry tagged with completely unknown intermediate tag %v, dropping it", b[i].Tag)
+							//the rest of the block goes with it
+							im.acks.resolveSet(b, ErrTagNotFound)
 							continue inputLoop
 						} else {
 							im.Info("Got entry tagged with tag %v (%v), need to renegotiate connection", name, b[i].Tag) // Could not translate! We need to push this to the equeue and reconnect
@@ -1145,8 +1969,8 @@ inputLoop:
 							for j := 0; j < i; j++ {
 								b[j].Tag = nc.tt.Reverse(b[j].Tag)
 							}
-							im.recycleEntries(nil, b, nc.tt, false)
-							if nc, ok = im.getNewConnSet(csc, connFailure, false); !ok {
+							im.recycleEntries(grp, nil, b, nc.tt, false, nc.cnt)
+							if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, false); !ok {
 								break inputLoop
 							}
 							continue inputLoop
@@ -1160,18 +1984,18 @@ inputLoop:
 				}
 			}
 			if err = nc.ig.WriteBatchEntry(b); err != nil {
-				im.recycleEntries(nil, b, nc.tt, true)
-				if nc, ok = im.getNewConnSet(csc, connFailure, false); !ok {
+				im.recycleEntries(grp, nil, b, nc.tt, true, nc.cnt)
+				if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, true); !ok {
 					break inputLoop
 				}
 			}
 			//hack to get better distribution across connections in an muxer
-			if im.shouldSched() {
+			if im.shouldSched(grp) {
 				if !tmr.Stop() {
 					<-tmr.C
 				}
-				if !im.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
-					if nc, ok = im.getNewConnSet(csc, connFailure, false); !ok {
+				if !grp.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
+					if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, true); !ok {
 						break inputLoop
 					}
 				}
@@ -1187,9 +2011,19 @@ inputLoop:
 			}
 			nc = tnc //just an update
 		case <-tmr.C:
+			if ps.paused {
+				//just keep the connection alive
+				if nc.ig.ping() != nil {
+					if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, true); !ok {
+						break inputLoop
+					}
+				}
+				tmr.Reset(tickerInterval())
+				continue
+			}
 			//periodically check the emergency queue and sync
-			if !im.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
-				if nc, ok = im.getNewConnSet(csc, connFailure, false); !ok {
+			if !grp.eq.clear(nc.ig, nc.tt) || nc.ig.Sync() != nil {
+				if nc, ok = im.getNewConnSet(grp, csc, connFailure, false, true); !ok {
 					break inputLoop
 				}
 			}
@@ -1199,96 +2033,151 @@ inputLoop:
 }
 
 //the routine that manages
-func (im *IngestMuxer) connRoutine(igIdx int) {
+func (im *IngestMuxer) connRoutine(mt *muxTarget) {
 	var src net.IP
 	defer im.wg.Done()
-	if igIdx >= len(im.igst) || igIdx >= len(im.dests) {
-		//this SHOULD NEVER HAPPEN.  Bail
-		im.connFailed(unknownAddr, errors.New("Invalid ingester index on muxer"))
-		return
-	}
-	dst := im.dests[igIdx]
-	if im.igst[igIdx] != nil {
-		//this SHOULD NEVER HAPPEN.  Bail
-		im.connFailed(dst.Address, errors.New("Ingester already populated for destination in muxer"))
-		return
-	}
+	defer close(mt.done)
+	dst := mt.Target
 
 	var igst *IngestConnection
-	var tt tagTrans
+	var tt *tagTrans
 	var err error
 	connErrNotif := make(chan bool, 1)
 	ncc := make(chan connSet, 1)
 	defer close(ncc)
 
-	go im.writeRelayRoutine(ncc, connErrNotif)
+	go im.writeRelayRoutine(mt.grp, ncc, connErrNotif, mt.die)
 
+	mt.bo = im.retry.newBackoff()
 	connErrNotif <- true
 
 	//loop, trying to grab entries, or dying
 	for {
 		select {
-		case _, ok := <-connErrNotif:
+		case failed, ok := <-connErrNotif:
 			if igst != nil {
 				//if it throws an error we don't care, and cant do anything about it
-				im.Warn("reconnecting to %v", dst.Address)
+				if ok && failed {
+					im.Warn("reconnecting to %v", dst.Address)
+				} else if ok {
+					im.Info("reconnecting to %v to renegotiate tags", dst.Address)
+				}
 				igst.Close()
 			}
 			if !ok {
 				//this means that the relay function bailed
-				im.goDead()
-				im.connFailed(dst.Address, errors.New("Closed"))
+				im.goDead(mt.grp)
+				if mt.retired() {
+					//retired targets no longer count towards the dead set
+					im.clearTargetConn(mt)
+					atomic.AddInt32(&im.connDead, -1)
+					im.Info("retired target %v", dst.Address)
+					return
+				}
+				im.connFailed(mt, errors.New("Closed"))
 				return
 			}
 
 			if igst != nil {
-				im.goDead() //let the world know of our failures
-				im.igst[igIdx] = nil
-				im.tagTranslators[igIdx] = nil
+				im.goDead(mt.grp) //let the world know of our failures
+				im.clearTargetConn(mt)
 
 				//pull any entrys out of the ingest connection and put them into the emergency queue
 				ents := igst.outstandingEntries()
-				im.recycleEntries(nil, ents, &tt, true)
+				im.recycleEntries(mt.grp, nil, ents, tt, true, &mt.counters)
+				atomic.AddUint64(&mt.counters.reconnects, 1)
+
+				//a renegotiation is not a failure, reconnect straight away
+				//repeated failures open the circuit, leave the target alone for a while
+				if !failed {
+					im.targetEvent(mt, EventReconnecting, nil, 0)
+				} else if d := mt.health.recordFailure(im.retry, time.Now()); d > 0 {
+					im.targetEvent(mt, EventReconnecting, nil, d)
+					im.Warn("circuit breaker opened on %v after repeated failures, next attempt in %v", dst.Address, d)
+					im.targetWait(mt, d)
+				} else if time.Since(mt.up) < im.retry.StableInterval {
+					//connecting is not enough to call the target healthy, keep backing off
+					im.retryWait(mt, mt.bo, errConnUnstable)
+				} else {
+					mt.bo.reset()
+					im.targetEvent(mt, EventReconnecting, nil, 0)
+				}
 			}
 
 			//attempt to get the connection rolling again
-			igst, tt, err = im.getConnection(dst)
+			igst, tt, err = im.getConnection(mt)
+			if mt.retired() {
+				if igst != nil {
+					igst.Close()
+				}
+				atomic.AddInt32(&im.connDead, -1)
+				im.Info("retired target %v", dst.Address)
+				return
+			}
 			if err != nil {
-				im.connFailed(dst.Address, err)
+				im.connFailed(mt, err)
 				return //we are done
 			}
 			if igst == nil {
-				im.connFailed(dst.Address, errors.New("Nil connection"))
+				im.connFailed(mt, errors.New("Nil connection"))
 				return
 			}
 
+			igst.ew.setStats(&mt.counters)
+			igst.ew.setAckHook(im.confirmed)
+			if mt.grp.journal != nil {
+				igst.ew.setSendHook(im.journalHook(mt.grp, tt))
+			}
+			if im.seq != nil {
+				igst.ew.setSeqHook(im.seq.get)
+			}
+			igst.ew.setThrottleHook(func(d time.Duration) {
+				im.targetEvent(mt, EventThrottled, nil, d)
+			})
+
 			//get the source fired back up
 			src, err = igst.Source()
 			if err != nil {
 				igst.Close()
-				im.connFailed(dst.Address, err)
+				im.connFailed(mt, err)
 				return
 			}
 
 			im.mtx.Lock()
-			im.igst[igIdx] = igst
-			im.tagTranslators[igIdx] = &tt
+			mt.ig = igst
+			mt.tt = tt
 			im.mtx.Unlock()
 
-			im.goHot()
+			mt.up = time.Now()
+			mt.health.setState(TargetHot)
+			im.targetEvent(mt, EventHot, nil, 0)
+			im.goHot(mt.grp)
 			ncc <- connSet{
 				dst: dst.Address,
 				src: src,
 				ig:  igst,
-				tt:  &tt,
+				tt:  tt,
+				cnt: &mt.counters,
 			}
 		}
 	}
 }
 
+func (im *IngestMuxer) clearTargetConn(mt *muxTarget) {
+	im.mtx.Lock()
+	mt.ig = nil
+	mt.tt = nil
+	im.mtx.Unlock()
+}
+
 //we don't want to fully block here, so we attempt to push back on the channel
 //and listen for a die signal
-func (im *IngestMuxer) recycleEntries(e *entry.Entry, ents []*entry.Entry, tt *tagTrans, reverseTags bool) {
+func (im *IngestMuxer) recycleEntries(grp *muxGroup, e *entry.Entry, ents []*entry.Entry, tt *tagTrans, reverseTags bool, tc *targetCounters) {
+	if e != nil {
+		tc.recycle(1)
+	}
+	tc.recycle(len(ents))
+
 	//reset the tags to the globally translatable set
 	//this operation is expensive
 	if len(ents) > 0 && reverseTags {
@@ -1310,24 +2199,77 @@ func (im *IngestMuxer) recycleEntries(e *entry.Entry, ents []*entry.Entry, tt *t
 		e.Tag = tt.Reverse(e.Tag)
 		select {
 		case _ = <-tmr.C:
-			if err := im.eq.push(e, ents); err != nil {
-				//FIXME - throw a fit about this via some logging, aight?
-				return
-			}
+			im.emergencyPush(grp, e, nil)
 			//timer expired, reset it in case we have a block too
 			tmr.Reset(0)
-		case im.eChan <- e:
+		case grp.eChan <- e:
 		}
 	}
 	//try block entry
 	if len(ents) > 0 {
 		select {
 		case _ = <-tmr.C:
-			if err := im.eq.push(nil, ents); err != nil {
-				//FIXME - throw a fit about this
-				return
-			}
-		case im.bChan <- ents:
+			im.emergencyPush(grp, nil, ents)
+		case grp.bChan <- ents:
+		}
+	}
+	return
+}
+
+// emergencyPush puts entries that could not be recycled into the emergency queue of a group,
+// a nil group is the muxer queue ahead of the groups.  Once the queue is full entries
+// spill into the cache, if there is no cache, or it fails, they are dropped.
+func (im *IngestMuxer) emergencyPush(grp *muxGroup, e *entry.Entry, ents []*entry.Entry) {
+	if grp == nil && !im.routing() {
+		grp = im.groups[0] //a single group shares the muxer queue
+	}
+	eq := im.eq
+	if grp != nil {
+		eq = grp.eq
+	}
+	err := eq.push(e, ents)
+	if err == nil {
+		atomic.AddUint64(&im.eqPushes, 1)
+		return
+	}
+	all := ents
+	if e != nil {
+		all = append([]*entry.Entry{e}, ents...)
+	}
+	if im.cacheEnabled {
+		var missed []*entry.Entry
+		if grp != nil {
+			missed, err = grp.cacheSpill(all...)
+		} else {
+			missed, err = im.cacheEntries(all...)
+		}
+		atomic.AddUint64(&im.eqSpilled, uint64(countEntries(all)-countEntries(missed)))
+		if err == nil {
+			return
+		}
+		all = missed
+	}
+	im.dropEntries(err, all)
+}
+
+// dropEntries accounts for entries that could not be held anywhere
+func (im *IngestMuxer) dropEntries(err error, ents []*entry.Entry) {
+	cnt := countEntries(ents)
+	if cnt == 0 {
+		return
+	}
+	sz := entriesSize(nil, ents)
+	atomic.AddUint64(&im.eqDropped, uint64(cnt))
+	atomic.AddUint64(&im.eqDroppedBytes, sz)
+	im.acks.resolveSet(ents, err)
+	//only the local logger, a gravwell log entry would have to go through the queues we just overflowed
+	im.lgr.Error("Emergency queue overflow, dropped %d entries (%s): %v", cnt, HumanSize(sz), err)
+}
+
+func countEntries(ents []*entry.Entry) (n int) {
+	for _, e := range ents {
+		if e != nil {
+			n++
 		}
 	}
 	return
@@ -1350,18 +2292,32 @@ func isFatalConnError(err error) bool {
 		fallthrough
 	case ErrFailedParseLocalIP:
 		fallthrough
+	case ErrInvalidProxy:
+		fallthrough
 	case ErrEmptyTag:
 		return true
 	}
 	return false
 }
 
-func (im *IngestMuxer) getConnection(tgt Target) (ig *IngestConnection, tt tagTrans, err error) {
+func (im *IngestMuxer) getConnection(mt *muxTarget) (ig *IngestConnection, tt *tagTrans, err error) {
+	tgt := mt.Target
+	bo := mt.bo
+	dial, err := im.targetDialer(mt)
+	if err != nil {
+		im.Error("Fatal Connection Error on %v: %v", tgt.Address, err)
+		return nil, nil, err
+	}
 loop:
 	for {
+		if err = im.targetExiting(mt); err != nil {
+			return nil, nil, err
+		}
+		mt.health.setState(TargetConnecting)
+		im.targetEvent(mt, EventConnecting, nil, 0)
 		//attempt a connection, timeouts are built in to the IngestConnection
 		im.mtx.RLock()
-		if ig, err = InitializeConnection(tgt.Address, tgt.Secret, im.tags, im.pubKey, im.privKey, im.verifyCert); err != nil {
+		if ig, err = initializeConnection(tgt.Address, tgt.Secret, im.groupTags(mt.grp), im.pubKey, im.privKey, im.verifyCert, dial); err != nil {
 			im.mtx.RUnlock()
 			if isFatalConnError(err) {
 				im.Error("Fatal Connection Error on %v: %v", tgt.Address, err)
@@ -1369,11 +2325,8 @@ loop:
 			}
 			im.Warn("Connection error on %v: %v", tgt.Address, err)
 			//non-fatal, sleep and continue
-			select {
-			case _ = <-time.After(defaultRetryTime):
-			case _ = <-im.dieChan:
-				//told to exit, just bail
-				return nil, nil, errors.New("Muxer closing")
+			if err = im.retryWait(mt, bo, err); err != nil {
+				return nil, nil, err
 			}
 			continue
 		}
@@ -1383,37 +2336,54 @@ loop:
 
 		//no error, attempt to do a tag translation
 		//we have a good connection, build our tag map
-		if tt, err = im.newTagTrans(ig); err != nil {
+		if tt, err = im.newTagTrans(ig, mt.grp); err != nil {
 			ig.Close()
 			ig = nil
 			tt = nil
 			im.mtx.RUnlock()
 			im.Error("Fatal Connection Error, failed to get get tag translation map: %v", err)
+			if err = im.retryWait(mt, bo, err); err != nil {
+				return nil, nil, err
+			}
 			continue
 		}
 		im.mtx.RUnlock()
 
 		// set the info
-		if err := ig.IdentifyIngester(im.name, im.version, im.uuid); err != nil {
+		if err = ig.IdentifyIngester(im.name, im.version, im.uuid); err != nil {
 			im.Error("Failed to identify ingester on %v: %v", tgt.Address, err)
+			ig.Close()
+			if err = im.retryWait(mt, bo, err); err != nil {
+				return nil, nil, err
+			}
 			continue
 		}
 
+		okbo := im.retry.ingestOKBackoff()
 		for {
-			select {
-			case _ = <-im.dieChan:
-				return
-			default:
-			}
 			ok, err := ig.IngestOK()
 			if err != nil {
 				im.Error("IngestOK query failed on %v: %v", tgt.Address, err)
+				ig.Close()
+				if err = im.retryWait(mt, bo, err); err != nil {
+					return nil, nil, err
+				}
 				continue loop
 			}
 			if ok {
 				break
 			}
-			time.Sleep(5 * time.Second)
+			mt.health.setState(TargetWaiting)
+			im.targetEvent(mt, EventNotReady, nil, 0)
+			select {
+			case _ = <-time.After(okbo.next()):
+			case _ = <-im.dieChan:
+				ig.Close()
+				return nil, nil, errMuxerClosing
+			case _ = <-mt.die:
+				ig.Close()
+				return nil, nil, errTargetRemoved
+			}
 		}
 
 		im.Info("Successfully connected to %v", tgt.Address)
@@ -1422,8 +2392,74 @@ loop:
 	return
 }
 
-func (im *IngestMuxer) newTagTrans(igst *IngestConnection) (tagTrans, error) {
-	tt := tagTrans(make([]entry.EntryTag, len(im.tagMap)))
+// targetDialer returns how a connection to a target is dialed, targets are
+// resolved again on every attempt
+func (im *IngestMuxer) targetDialer(mt *muxTarget) (*connDialer, error) {
+	tgt := mt.Target
+	proxy := tgt.Proxy
+	if proxy == `` {
+		proxy = im.proxy
+	}
+	dc := im.dial
+	if dc.Timeout == 0 {
+		if t, _, err := ConnectionType(tgt.Address); err == nil && t == `tls` {
+			dc.Timeout = tlsDialTimeout
+		}
+	}
+	cd := &connDialer{
+		dial:       dc.dialer(mt.conn),
+		ownBuffers: dc.RecvBuffer > 0,
+		custom:     dc.Dial != nil,
+	}
+	if proxy != `` {
+		u, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		cd.dial = proxyDial(u, cd.dial)
+	}
+	return cd, nil
+}
+
+// targetExiting checks whether the muxer is closing or the target has been removed
+func (im *IngestMuxer) targetExiting(mt *muxTarget) error {
+	select {
+	case _ = <-im.dieChan:
+		return errMuxerClosing
+	case _ = <-mt.die:
+		return errTargetRemoved
+	default:
+	}
+	return nil
+}
+
+// retryWait records a failed connection attempt and waits according to the
+// retry policy.  A non-nil error means we were told to exit while waiting.
+func (im *IngestMuxer) retryWait(mt *muxTarget, bo *backoff, cause error) error {
+	d := bo.next()
+	mt.health.setError(TargetBackoff, cause, time.Now().Add(d))
+	im.targetEvent(mt, EventReconnecting, cause, d)
+	return im.targetWait(mt, d)
+}
+
+// targetWait waits for the specified duration, returning early with an error
+// if the muxer is closing or the target is removed
+func (im *IngestMuxer) targetWait(mt *muxTarget, d time.Duration) error {
+	tmr := time.NewTimer(d)
+	defer tmr.Stop()
+	select {
+	case _ = <-tmr.C:
+	case _ = <-im.dieChan:
+		//told to exit, just bail
+		return errMuxerClosing
+	case _ = <-mt.die:
+		return errTargetRemoved
+	}
+	return nil
+}
+
+func (im *IngestMuxer) newTagTrans(igst *IngestConnection, grp *muxGroup) (*tagTrans, error) {
+	tt := make([]entry.EntryTag, len(im.tagMap))
 	if len(tt) == 0 {
 		return nil, ErrTagMapInvalid
 	}
@@ -1431,13 +2467,17 @@ func (im *IngestMuxer) newTagTrans(igst *IngestConnection) (tagTrans, error) {
 		if int(v) > len(tt) {
 			return nil, ErrTagMapInvalid
 		}
+		if im.routing() && !im.router.allowed(v, grp.idx) {
+			tt[v] = unroutedTag
+			continue
+		}
 		tg, ok := igst.GetTag(k)
 		if !ok {
 			return nil, ErrTagNotFound
 		}
 		tt[v] = tg
 	}
-	return tt, nil
+	return newTagTransTable(tt), nil
 }
 
 // SourceIP is a convienence function used to pull back a source value
@@ -1445,12 +2485,13 @@ func (im *IngestMuxer) SourceIP() (net.IP, error) {
 	var ip net.IP
 	im.mtx.RLock()
 	defer im.mtx.RUnlock()
-	if im.connHot == 0 || len(im.igst) == 0 {
+	if im.connHot == 0 || len(im.targets) == 0 {
 		return ip, errors.New("No active connections")
 	}
 	var set bool
 	var wasErr bool
-	for _, ig := range im.igst {
+	for _, mt := range im.targets {
+		ig := mt.ig
 		if ig == nil {
 			continue
 		}
@@ -1480,17 +2521,21 @@ func (im *IngestMuxer) SourceIP() (net.IP, error) {
 type emStruct struct {
 	e    *entry.Entry
 	ents []*entry.Entry
+	size uint64
 }
 
 type emergencyQueue struct {
-	mtx *sync.Mutex
-	lst *list.List
+	mtx     *sync.Mutex
+	lst     *list.List
+	size    uint64
+	maxSize uint64
 }
 
-func newEmergencyQueue() *emergencyQueue {
+func newEmergencyQueue(maxSize uint64) *emergencyQueue {
 	return &emergencyQueue{
-		mtx: &sync.Mutex{},
-		lst: list.New(),
+		mtx:     &sync.Mutex{},
+		lst:     list.New(),
+		maxSize: maxSize,
 	}
 }
 
@@ -1501,24 +2546,63 @@ func newEmergencyQueue() *emergencyQueue {
 // we this ingest connection disconnects.  Instead we push into this queue
 // when new ingest connections become active, they will always attempt to feed from
 // this queue before going to the channels.  This is essentially a deadlock fix.
+// The queue holds at most maxSize bytes, an empty queue always takes the push.
 func (eq *emergencyQueue) push(e *entry.Entry, ents []*entry.Entry) error {
+	return eq.add(e, ents, false)
+}
+
+// requeue puts back entries that were just popped, ignoring the size bound
+func (eq *emergencyQueue) requeue(e *entry.Entry, ents []*entry.Entry) {
+	eq.add(e, ents, true)
+}
+
+func (eq *emergencyQueue) add(e *entry.Entry, ents []*entry.Entry, force bool) error {
 	if e == nil && len(ents) == 0 {
 		return nil
 	}
 	ems := emStruct{
 		e:    e,
 		ents: ents,
+		size: entriesSize(e, ents),
 	}
 	eq.mtx.Lock()
-	if eq.lst.Len() > maxEmergencyListSize {
+	if !force && eq.lst.Len() > 0 && eq.size+ems.size > eq.maxSize {
 		eq.mtx.Unlock()
 		return ErrEmergencyListOverflow
 	}
 	eq.lst.PushBack(ems)
+	eq.size += ems.size
 	eq.mtx.Unlock()
 	return nil
 }
 
+func (eq *emergencyQueue) len() (n int) {
+	eq.mtx.Lock()
+	n = eq.lst.Len()
+	eq.mtx.Unlock()
+	return
+}
+
+// bytes returns the size of everything in the queue
+func (eq *emergencyQueue) bytes() (n uint64) {
+	eq.mtx.Lock()
+	n = eq.size
+	eq.mtx.Unlock()
+	return
+}
+
+func entriesSize(e *entry.Entry, ents []*entry.Entry) (sz uint64) {
+	if e != nil {
+		sz = e.Size()
+	}
+	for _, v := range ents {
+		if v != nil {
+			sz += v.Size()
+		}
+	}
+	return
+}
+
 // emergencyPop checks to see if there are any values on the emergency list
 // waiting to be ingested.  New routines should go to this list FIRST
 func (eq *emergencyQueue) pop() (e *entry.Entry, ents []*entry.Entry, ok bool) {
@@ -1539,6 +2623,7 @@ func (eq *emergencyQueue) pop() (e *entry.Entry, ents []*entry.Entry, ok bool) {
 		//shit?  FIXME - THROW A FIT
 		return
 	}
+	eq.size -= elm.size
 	e = elm.e
 	ents = elm.ents
 	return
@@ -1557,7 +2642,7 @@ func (eq *emergencyQueue) clear(igst *IngestConnection, tt *tagTrans) (ok bool)
 			ttag, ok = tt.Translate(e.Tag)
 			if !ok {
 				// could not translate, push it back on the queue and bail
-				eq.push(e, blk)
+				eq.requeue(e, blk)
 				return
 			}
 			e.Tag = ttag
@@ -1566,9 +2651,7 @@ func (eq *emergencyQueue) clear(igst *IngestConnection, tt *tagTrans) (ok bool)
 				e.Tag = tt.Reverse(e.Tag)
 
 				//push the entries back into the queue
-				if err := eq.push(e, blk); err != nil {
-					//FIXME - log this?
-				}
+				eq.requeue(e, blk)
 
 				//return our failure
 				break
@@ -1588,7 +2671,7 @@ func (eq *emergencyQueue) clear(igst *IngestConnection, tt *tagTrans) (ok bool)
 						for j := 0; j < i; j++ {
 							blk[j].Tag = tt.Reverse(blk[j].Tag)
 						}
-						eq.push(e, blk)
+						eq.requeue(e, blk)
 						return
 					}
 					blk[i].Tag = ttag
@@ -1601,9 +2684,7 @@ func (eq *emergencyQueue) clear(igst *IngestConnection, tt *tagTrans) (ok bool)
 						blk[i].Tag = tt.Reverse(blk[i].Tag)
 					}
 				}
-				if err := eq.push(e, blk); err != nil {
-					//FIXME - log this?
-				}
+				eq.requeue(e, blk)
 				break
 			}
 		}
@@ -1611,41 +2692,67 @@ func (eq *emergencyQueue) clear(igst *IngestConnection, tt *tagTrans) (ok bool)
 	return
 }
 
-type tagTrans []entry.EntryTag
+// tagTrans maps local tags to the remote tags negotiated on a connection.  Tags
+// are registered while the connection is being written to, so the table is
+// replaced rather than modified in place.
+type tagTrans struct {
+	tbl atomic.Value //[]entry.EntryTag
+}
+
+func newTagTransTable(tbl []entry.EntryTag) *tagTrans {
+	tt := &tagTrans{}
+	tt.tbl.Store(tbl)
+	return tt
+}
+
+func (tt *tagTrans) table() []entry.EntryTag {
+	if tt == nil {
+		return nil
+	}
+	tbl, _ := tt.tbl.Load().([]entry.EntryTag)
+	return tbl
+}
 
 // Translate translates a local tag to a remote tag.  Senders should not use this function
-func (tt tagTrans) Translate(t entry.EntryTag) (entry.EntryTag, bool) {
+func (tt *tagTrans) Translate(t entry.EntryTag) (entry.EntryTag, bool) {
 	//check if this is the gravwell and if soo, pass it on through
 	if t == entry.GravwellTagId {
 		return t, true
 	}
+	tbl := tt.table()
 	//if this is a tag we have not negotiated, set it to the first one we have
 	//we are assuming that its an error, but we still want the entry
-	if int(t) >= len(tt) {
-		return tt[0], false
+	if int(t) >= len(tbl) {
+		return tbl[0], false
 	}
-	return tt[t], true
+	return tbl[t], true
 }
 
+// RegisterTag adds the next local tag, callers must hold the muxer lock
 func (tt *tagTrans) RegisterTag(local entry.EntryTag, remote entry.EntryTag) error {
-	if int(local) != len(*tt) {
+	tbl := tt.table()
+	if int(local) != len(tbl) {
 		// this means the local tag numbers got out of sync and something is bad
 		return errors.New("Cannot register tag, local tag out of sync with tag translator")
 	}
-	*tt = append(*tt, remote)
+	ntbl := make([]entry.EntryTag, len(tbl)+1)
+	copy(ntbl, tbl)
+	ntbl[local] = remote
+	tt.tbl.Store(ntbl)
 	return nil
 }
 
 // Reverse translates a remote tag back to a local tag
 // this is ONLY used when a connection dies while holding unconfirmed entries
 // this operation is stupid expensive, so... be gracious
-func (tt tagTrans) Reverse(t entry.EntryTag) entry.EntryTag {
+func (tt *tagTrans) Reverse(t entry.EntryTag) entry.EntryTag {
 	//check if this is gravwell and if soo, pass it on through
 	if t == entry.GravwellTagId {
 		return t
 	}
-	for i := range tt {
-		if tt[i] == t {
+	tbl := tt.table()
+	for i := range tbl {
+		if tbl[i] == t {
 			return entry.EntryTag(i)
 		}
 	}
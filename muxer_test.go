@@ -9,6 +9,8 @@
 package ingest
 
 import (
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,7 +18,8 @@ import (
 )
 
 const (
-	testMuxerFeederCount int = 4096
+	testMuxerFeederCount int    = 4096
+	testIndexerSecret    string = `testsecret`
 )
 
 var (
@@ -228,6 +231,349 @@ func TestNewMuxerCacheMultiFeed(t *testing.T) {
 	clean(t)
 }
 
+func TestMuxerAddRemoveTarget(t *testing.T) {
+	tiA := newTestIndexer(t)
+	defer tiA.Close()
+	tiB := newTestIndexer(t)
+	defer tiB.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{tiA.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.AddTarget(tiA.Target()); err != ErrTargetExists {
+		t.Fatal("Failed to catch duplicate target", err)
+	}
+	if err := im.AddTarget(tiB.Target()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := im.Size(); err != nil || n != 2 {
+		t.Fatal("Bad size", n, err)
+	}
+	waitForHotCount(t, im, 2)
+
+	//retire the original target, everything must end up on the new one
+	if err := im.RemoveTarget(tiA.Target().Address); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.RemoveTarget(tiB.Target().Address); err != ErrLastTarget {
+		t.Fatal("Failed to catch removal of last target", err)
+	}
+	if err := im.RemoveTarget(`tcp://127.0.0.1:1`); err != ErrTargetNotFound {
+		t.Fatal("Failed to catch removal of unknown target", err)
+	}
+	if n, err := im.Size(); err != nil || n != 1 {
+		t.Fatal("Bad size", n, err)
+	}
+	before := tiA.Count()
+	for i := 0; i < 128; i++ {
+		if err := im.Write(entry.Now(), tag, []byte(`hello`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tiA.Count() != before {
+		t.Fatal("Retired target received entries", before, tiA.Count())
+	}
+	if tiB.Count() != 128 {
+		t.Fatal("Bad entry count on new target", tiB.Count())
+	}
+}
+
+func TestMuxerParallelConnections(t *testing.T) {
+	tiA := newTestIndexer(t)
+	defer tiA.Close()
+	tiB := newTestIndexer(t)
+	defer tiB.Close()
+	tgt := tiA.Target()
+	tgt.Connections = 3
+
+	if _, err := NewMuxer(MuxerConfig{
+		Destinations:   []Target{tgt},
+		Tags:           []string{`testA`},
+		ConnsPerTarget: -1,
+	}); err != ErrInvalidConnCount {
+		t.Fatal("Failed to catch bad connection count", err)
+	}
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:   []Target{tgt},
+		Tags:           []string{`testA`},
+		ConnsPerTarget: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForHotCount(t, im, 3)
+	//the muxer default applies to targets that do not set a count
+	if err := im.AddTarget(tiB.Target()); err != nil {
+		t.Fatal(err)
+	}
+	waitForHotCount(t, im, 5)
+	if n, err := im.Size(); err != nil || n != 5 {
+		t.Fatal("Bad size", n, err)
+	}
+	if tgts := im.Targets(); len(tgts) != 2 || tgts[0].Connections != 3 || tgts[1].Connections != 2 {
+		t.Fatalf("Bad targets %+v", tgts)
+	}
+	if st := im.TargetStatus(); len(st) != 2 || st[0].State != TargetHot {
+		t.Fatalf("Bad target status %+v", st)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range testEntries(300, 100) {
+		e.Tag = tag
+		if err := im.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ms := im.Stats()
+	if len(ms.Targets) != 2 {
+		t.Fatal("Connections were not merged into their target", len(ms.Targets))
+	}
+	if ts := ms.Targets[0]; ts.Connections != 3 || ts.HotConnections != 3 || ts.Address != tgt.Address {
+		t.Fatalf("Bad target stats %+v", ts)
+	}
+	if ms.EntriesWritten() != 300 {
+		t.Fatal("Bad entry count", ms.EntriesWritten())
+	}
+
+	//removing a target retires every one of its connections
+	if err := im.RemoveTarget(tgt.Address); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := im.Size(); err != nil || n != 2 {
+		t.Fatal("Bad size", n, err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tiA.Lock()
+	conns := len(tiA.conns)
+	tiA.Unlock()
+	if conns != 3 {
+		t.Fatal("Bad connection count", conns)
+	}
+	if n := tiA.Count() + tiB.Count(); n != 300 {
+		t.Fatal("Lost entries", n)
+	}
+}
+
 func TestMuxerClean(t *testing.T) {
 	clean(t)
 }
+
+func waitForHotCount(t *testing.T, im *IngestMuxer, cnt int) {
+	ts := time.Now()
+	for time.Since(ts) < 5*time.Second {
+		if n, err := im.Hot(); err != nil {
+			t.Fatal(err)
+		} else if n >= cnt {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for connections to go hot")
+}
+
+// testIndexer is a minimal indexer implementation that accepts ingest connections
+// and keeps every entry it receives
+type testIndexer struct {
+	sync.Mutex
+	t     *testing.T
+	lst   net.Listener
+	auth  AuthHash
+	tags  map[string]entry.EntryTag
+	ents  []*entry.Entry
+	seqs  []uint64 //sequence sent with each entry
+	conns []net.Conn
+	delay time.Duration //held before answering a tag negotiation
+	wg    sync.WaitGroup
+}
+
+func newTestIndexer(t *testing.T) *testIndexer {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestIndexerListener(t, lst)
+}
+
+// newTestIndexerListener runs a test indexer on an existing listener
+func newTestIndexerListener(t *testing.T, lst net.Listener) *testIndexer {
+	auth, err := GenAuthHash(testIndexerSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti := &testIndexer{
+		t:    t,
+		lst:  lst,
+		auth: auth,
+		tags: map[string]entry.EntryTag{},
+	}
+	ti.wg.Add(1)
+	go ti.accept()
+	return ti
+}
+
+func (ti *testIndexer) Target() Target {
+	return Target{
+		Address: `tcp://` + ti.lst.Addr().String(),
+		Secret:  testIndexerSecret,
+	}
+}
+
+func (ti *testIndexer) Count() int {
+	ti.Lock()
+	defer ti.Unlock()
+	return len(ti.ents)
+}
+
+func (ti *testIndexer) Entries() []*entry.Entry {
+	ti.Lock()
+	defer ti.Unlock()
+	return append([]*entry.Entry(nil), ti.ents...)
+}
+
+func (ti *testIndexer) Sequences() []uint64 {
+	ti.Lock()
+	defer ti.Unlock()
+	return append([]uint64(nil), ti.seqs...)
+}
+
+func (ti *testIndexer) Close() {
+	ti.lst.Close()
+	ti.Lock()
+	for _, c := range ti.conns {
+		c.Close()
+	}
+	ti.Unlock()
+	ti.wg.Wait()
+}
+
+// GetAndPopulate implements the TagManager interface
+func (ti *testIndexer) GetAndPopulate(name string) (entry.EntryTag, error) {
+	ti.Lock()
+	d := ti.delay
+	ti.Unlock()
+	time.Sleep(d)
+	ti.Lock()
+	defer ti.Unlock()
+	tg, ok := ti.tags[name]
+	if !ok {
+		tg = entry.EntryTag(len(ti.tags) + 1)
+		ti.tags[name] = tg
+	}
+	return tg, nil
+}
+
+func (ti *testIndexer) accept() {
+	defer ti.wg.Done()
+	for {
+		c, err := ti.lst.Accept()
+		if err != nil {
+			return
+		}
+		ti.Lock()
+		ti.conns = append(ti.conns, c)
+		ti.Unlock()
+		ti.wg.Add(1)
+		go ti.handle(c)
+	}
+}
+
+func (ti *testIndexer) handle(c net.Conn) {
+	defer ti.wg.Done()
+	defer c.Close()
+	chal, err := NewChallengeVersion(ti.auth, MINIMUM_SEQ_VERSION)
+	if err != nil {
+		return
+	}
+	if err = chal.Write(c); err != nil {
+		return
+	}
+	var resp ChallengeResponse
+	if err = resp.Read(c); err != nil {
+		return
+	}
+	state := StateResponse{ID: STATE_AUTHENTICATED}
+	if err = VerifyResponse(ti.auth, chal, resp); err != nil {
+		state.ID = STATE_NOT_AUTHENTICATED
+		state.Write(c)
+		return
+	}
+	if err = state.Write(c); err != nil {
+		return
+	}
+	var tr TagRequest
+	if err = tr.Read(c); err != nil {
+		return
+	}
+	tresp := TagResponse{
+		Tags: map[string]entry.EntryTag{},
+	}
+	for _, name := range tr.Tags {
+		if tresp.Tags[name], err = ti.GetAndPopulate(name); err != nil {
+			return
+		}
+	}
+	tresp.Count = uint32(len(tresp.Tags))
+	if err = tresp.Write(c); err != nil {
+		return
+	}
+	if err = state.Read(c); err != nil || state.ID != STATE_HOT {
+		return
+	}
+
+	er, err := NewEntryReader(c)
+	if err != nil {
+		return
+	}
+	er.SetTagManager(ti)
+	if err = er.Start(); err != nil {
+		return
+	}
+	defer er.Close()
+	if err = er.SetupConnection(); err != nil {
+		return
+	}
+	if err = er.IngestOK(true); err != nil {
+		return
+	}
+	for {
+		ent, seq, err := er.ReadSequence()
+		if err != nil {
+			return
+		}
+		lent := *ent
+		ti.Lock()
+		ti.ents = append(ti.ents, &lent)
+		ti.seqs = append(ti.seqs, seq)
+		ti.Unlock()
+	}
+}
@@ -0,0 +1,170 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrPaused = errors.New("Muxer is paused")
+)
+
+// pauseState is replaced wholesale on every Pause and Resume, changed is closed
+// when the state is replaced so that anyone waiting on it can look again
+type pauseState struct {
+	paused  bool
+	changed chan struct{}
+}
+
+func (im *IngestMuxer) pauseState() *pauseState {
+	return im.pause.Load().(*pauseState)
+}
+
+// Paused returns true if the muxer is paused
+func (im *IngestMuxer) Paused() bool {
+	return im.pauseState().paused
+}
+
+// setPaused swaps in a new pause state, returning false if nothing changed.
+// The caller must hold the lock.
+func (im *IngestMuxer) setPaused(paused bool) bool {
+	old := im.pauseState()
+	if old.paused == paused {
+		return false
+	}
+	im.pause.Store(&pauseState{paused: paused, changed: make(chan struct{})})
+	close(old.changed)
+	return true
+}
+
+// Pause stops sending entries to the indexers without tearing down the connections.
+// Entries already handed to the indexers are confirmed and the connections are kept
+// alive with pings.  While paused new writes go to the ingest cache, or block if
+// there is no cache.  Entries already queued stay queued until Resume.
+func (im *IngestMuxer) Pause() error {
+	im.mtx.Lock()
+	if im.state != running {
+		im.mtx.Unlock()
+		return ErrNotRunning
+	}
+	changed := im.setPaused(true)
+	igs := make([]*IngestConnection, 0, len(im.targets))
+	for _, mt := range im.targets {
+		if mt.ig != nil {
+			igs = append(igs, mt.ig)
+		}
+	}
+	im.mtx.Unlock()
+	if !changed {
+		return nil
+	}
+	im.Info("Ingester %v paused\n", im.name)
+	im.events.publish(Event{Type: EventPaused})
+	for _, ig := range igs {
+		ig.Sync()
+	}
+	return nil
+}
+
+// Resume restarts sending after a Pause.  Anything cached while paused is
+// unloaded at ResumeRateBps, if set, so the indexers are not flooded.
+func (im *IngestMuxer) Resume() error {
+	im.mtx.Lock()
+	if im.state != running {
+		im.mtx.Unlock()
+		return ErrNotRunning
+	}
+	changed := im.setPaused(false)
+	im.mtx.Unlock()
+	if !changed {
+		return nil
+	}
+	im.events.publish(Event{Type: EventResumed})
+	for _, grp := range im.groups {
+		if grp.cache == nil {
+			continue
+		}
+		atomic.StoreInt32(&grp.resuming, 1)
+		select {
+		case grp.cacheSignal <- false:
+		default:
+		}
+	}
+	return nil
+}
+
+// pauseWait holds a write while the muxer is paused.  With a cache the entries
+// are cached and false is returned with the outcome, otherwise the write blocks
+// until the muxer resumes or the context expires.
+func (im *IngestMuxer) pauseWait(ctx context.Context, ents ...*entry.Entry) (bool, error) {
+	for {
+		ps := im.pauseState()
+		if !ps.paused {
+			return true, nil
+		} else if im.cacheEnabled {
+			return false, im.cacheUnlimited(ents...)
+		}
+		select {
+		case <-ps.changed:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-im.dieChan:
+			return false, ErrNotRunning
+		}
+	}
+}
+
+// newResumeLimiter builds the limiter used to unload the cache after a Resume
+func newResumeLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bps), int(bps))
+}
+
+// resumeWait holds back the cache unload of a resuming group, returning false
+// if the muxer closed while waiting
+func (im *IngestMuxer) resumeWait(grp *muxGroup, ents []*entry.Entry) bool {
+	if im.resumeLimit == nil || atomic.LoadInt32(&grp.resuming) == 0 {
+		return true
+	}
+	var sz int
+	for _, e := range ents {
+		if e != nil {
+			sz += int(e.Size())
+		}
+	}
+	burst := im.resumeLimit.Burst()
+	for sz > 0 {
+		n := sz
+		if n > burst {
+			n = burst
+		}
+		sz -= n
+		d := im.resumeLimit.ReserveN(time.Now(), n).Delay()
+		if d <= 0 {
+			continue
+		}
+		tmr := time.NewTimer(d)
+		select {
+		case <-tmr.C:
+		case <-im.dieChan:
+			tmr.Stop()
+			return false
+		}
+	}
+	return true
+}
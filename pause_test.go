@@ -0,0 +1,172 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func countData(ents []*entry.Entry) (n int) {
+	for _, e := range ents {
+		if e.Tag != entry.GravwellTagId {
+			n++
+		}
+	}
+	return
+}
+
+func TestMuxerPause(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Pause(); err != ErrNotRunning {
+		t.Fatal("Paused a muxer that was not running", err)
+	}
+	sub := im.Subscribe(0)
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := testEntries(10, 100)
+	for _, e := range ents {
+		e.Tag = tag
+	}
+
+	if err := im.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, sub, EventPaused)
+	if !im.Paused() || !im.Stats().Paused {
+		t.Fatal("Muxer is not paused")
+	}
+	//without a cache writers block until we resume
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := im.WriteEntryContext(ctx, ents[0]); err != context.DeadlineExceeded {
+		t.Fatal("Write was not held", err)
+	}
+	if err := im.WriteEntryTimeout(ents[0], 10*time.Millisecond); err != ErrWriteTimeout {
+		t.Fatal("Write was not held", err)
+	}
+	if err := im.Sync(time.Second); err != ErrPaused {
+		t.Fatal("Sync while paused", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- im.WriteBatch(ents)
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatal("Batch went through while paused", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := im.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, sub, EventResumed)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countData(ti.Entries()); n != len(ents) {
+		t.Fatal("Bad entry count", n)
+	}
+}
+
+func TestMuxerPauseCache(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	ents := testEntries(20, 100)
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:  []Target{ti.Target()},
+		Tags:          []string{`testA`},
+		EnableCache:   true,
+		CacheConfig:   IngestCacheConfig{MemoryCacheSize: memCacheSize},
+		ResumeRateBps: 10 * int64(ents[0].Size()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range ents {
+		e.Tag = tag
+	}
+	if err := im.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	//with a cache writes land in the cache straight away
+	ack, err := im.WriteEntryAck(ents[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ack.Wait(ctx); err != ErrEntryCached {
+		t.Fatal("Entry was not cached", err)
+	}
+	if err := im.WriteBatch(ents[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if ms := im.Stats(); ms.CacheIn != uint64(len(ents)) {
+		t.Fatal("Bad cache count", ms.CacheIn)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := countData(ti.Entries()); n != 0 {
+		t.Fatal("Entries sent while paused", n)
+	}
+
+	//the cache drains at the resume rate, 20 entries at 10 per second
+	ts := time.Now()
+	if err := im.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	for countData(ti.Entries()) != len(ents) {
+		if time.Since(ts) > 10*time.Second {
+			t.Fatal("Cache was never drained", countData(ti.Entries()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := time.Since(ts); d < 500*time.Millisecond {
+		t.Fatal("Resume rate not honored", d)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,350 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	// a lower lane is serviced at least once every starvationLimit entries
+	starvationLimit int = 16
+)
+
+var (
+	ErrInvalidPriority = errors.New("Invalid priority")
+)
+
+// Priority is the queueing class of a tag.  When priorities are configured,
+// entries are queued into per class lanes and the muxer always drains higher
+// priority lanes first, lower lanes are guaranteed a share of the throughput so
+// that they are never starved outright.  Low priority entries do not block the
+// writer when their lane is full, they are diverted into the ingest cache or shed
+// if it is not enabled.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return `low`
+	case PriorityNormal:
+		return `normal`
+	case PriorityHigh:
+		return `high`
+	}
+	return `unknown`
+}
+
+// ParsePriority converts a priority name into a Priority
+func ParsePriority(v string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case `low`:
+		return PriorityLow, nil
+	case `normal`, ``:
+		return PriorityNormal, nil
+	case `high`:
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, ErrInvalidPriority
+}
+
+func (p Priority) valid() bool {
+	return p >= PriorityLow && p <= PriorityHigh
+}
+
+// lane index, lanes are ordered from highest to lowest priority
+func (p Priority) lane() int {
+	return int(PriorityHigh - p)
+}
+
+const numLanes int = int(PriorityHigh-PriorityLow) + 1
+
+type lane struct {
+	eChan chan *entry.Entry
+	bChan chan []*entry.Entry
+}
+
+// priorityLanes queues entries by the priority of their tag and feeds them
+// to the muxer channels in priority order.
+type priorityLanes struct {
+	shed   uint64 //atomic, must stay at the top for alignment
+	held   int32  //atomic, set while the lane routine holds an item it has not handed off
+	mtx    sync.RWMutex
+	byName map[string]Priority
+	byTag  map[entry.EntryTag]Priority
+	lanes  [numLanes]lane
+	served int
+}
+
+func newPriorityLanes(prios map[string]Priority, tagMap map[string]entry.EntryTag, chanSize int) (*priorityLanes, error) {
+	pl := &priorityLanes{
+		byName: make(map[string]Priority, len(prios)),
+		byTag:  map[entry.EntryTag]Priority{},
+	}
+	for k, v := range prios {
+		if !v.valid() {
+			return nil, fmt.Errorf("Tag %s has an invalid priority %d", k, v)
+		}
+		pl.byName[k] = v
+	}
+	for k, v := range tagMap {
+		pl.register(k, v)
+	}
+	//our own log entries are high priority unless told otherwise
+	pl.byTag[entry.GravwellTagId] = PriorityHigh
+	for i := range pl.lanes {
+		pl.lanes[i] = lane{
+			eChan: make(chan *entry.Entry, chanSize),
+			bChan: make(chan []*entry.Entry, chanSize),
+		}
+	}
+	return pl, nil
+}
+
+// register maps a newly negotiated tag to its configured priority
+func (pl *priorityLanes) register(name string, tag entry.EntryTag) {
+	pl.mtx.Lock()
+	if p, ok := pl.byName[name]; ok {
+		pl.byTag[tag] = p
+	}
+	pl.mtx.Unlock()
+}
+
+func (pl *priorityLanes) priority(tag entry.EntryTag) Priority {
+	pl.mtx.RLock()
+	p, ok := pl.byTag[tag]
+	pl.mtx.RUnlock()
+	if !ok {
+		return PriorityNormal
+	}
+	return p
+}
+
+// batchPriority is the highest priority of any entry in the batch
+func (pl *priorityLanes) batchPriority(b []*entry.Entry) Priority {
+	p := PriorityLow
+	pl.mtx.RLock()
+	for _, e := range b {
+		if e == nil {
+			continue
+		}
+		v, ok := pl.byTag[e.Tag]
+		if !ok {
+			v = PriorityNormal
+		}
+		if v > p {
+			if p = v; p == PriorityHigh {
+				break
+			}
+		}
+	}
+	pl.mtx.RUnlock()
+	return p
+}
+
+// writeEntry queues an entry on its lane, low priority entries are turned away if their lane is full
+func (pl *priorityLanes) writeEntry(ctx context.Context, e *entry.Entry) (full bool, err error) {
+	p := pl.priority(e.Tag)
+	ln := pl.lanes[p.lane()]
+	if p == PriorityLow {
+		select {
+		case ln.eChan <- e:
+		default:
+			full = true
+		}
+		return
+	}
+	select {
+	case ln.eChan <- e:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// writeBatch queues a batch on the lane of its highest priority entry
+func (pl *priorityLanes) writeBatch(ctx context.Context, b []*entry.Entry) (full bool, err error) {
+	p := pl.batchPriority(b)
+	ln := pl.lanes[p.lane()]
+	if p == PriorityLow {
+		select {
+		case ln.bChan <- b:
+		default:
+			full = true
+		}
+		return
+	}
+	select {
+	case ln.bChan <- b:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// next pulls the next item to send, highest priority first.  Every starvationLimit
+// items the search starts at a lower lane so that they always make progress.
+func (pl *priorityLanes) next(die chan bool) (e *entry.Entry, b []*entry.Entry, ok bool) {
+	pl.served++
+	start := 0
+	if pl.served%starvationLimit == 0 {
+		start = 1 + (pl.served/starvationLimit)%(numLanes-1)
+	}
+	for i := 0; i < numLanes; i++ {
+		ln := pl.lanes[(start+i)%numLanes]
+		select {
+		case e = <-ln.eChan:
+			return e, nil, true
+		case b = <-ln.bChan:
+			return nil, b, true
+		default:
+		}
+	}
+	//nothing is waiting, block until something shows up
+	hi, norm, lo := pl.lanes[0], pl.lanes[1], pl.lanes[2]
+	select {
+	case e = <-hi.eChan:
+	case b = <-hi.bChan:
+	case e = <-norm.eChan:
+	case b = <-norm.bChan:
+	case e = <-lo.eChan:
+	case b = <-lo.bChan:
+	case <-die:
+		return nil, nil, false
+	}
+	return e, b, true
+}
+
+// drain pulls everything still sitting in the lanes without blocking
+func (pl *priorityLanes) drain(fe func(*entry.Entry), fb func([]*entry.Entry)) {
+	for _, ln := range pl.lanes {
+	drainLoop:
+		for {
+			select {
+			case e := <-ln.eChan:
+				fe(e)
+			case b := <-ln.bChan:
+				fb(b)
+			default:
+				break drainLoop
+			}
+		}
+	}
+}
+
+func (pl *priorityLanes) depth() (d [numLanes]int) {
+	for i, ln := range pl.lanes {
+		d[i] = len(ln.eChan) + len(ln.bChan)
+	}
+	return
+}
+
+// pending returns the number of items waiting in the lanes, including one in hand
+func (pl *priorityLanes) pending() (n int) {
+	for _, v := range pl.depth() {
+		n += v
+	}
+	return n + int(atomic.LoadInt32(&pl.held))
+}
+
+// laneRoutine feeds the muxer channels from the priority lanes
+func (im *IngestMuxer) laneRoutine() {
+	defer im.wg.Done()
+	for {
+		e, b, ok := im.lanes.next(im.dieChan)
+		if !ok {
+			return
+		}
+		atomic.StoreInt32(&im.lanes.held, 1)
+		if e != nil {
+			select {
+			case im.eChan <- e:
+			case <-im.dieChan:
+				im.emergencyPush(nil, e, nil)
+				return
+			}
+		} else if len(b) > 0 {
+			select {
+			case im.bChan <- b:
+			case <-im.dieChan:
+				im.emergencyPush(nil, nil, b)
+				return
+			}
+		}
+		atomic.StoreInt32(&im.lanes.held, 0)
+	}
+}
+
+// queued returns the number of items waiting to be picked up by a writer
+func (im *IngestMuxer) queued() int {
+	n := len(im.eChan) + len(im.bChan)
+	if im.lanes != nil {
+		n += im.lanes.pending()
+	}
+	if im.linger != nil {
+		n += im.linger.pending()
+	}
+	if im.routing() {
+		//an entry held by the replication routine has not reached every group yet
+		n += int(atomic.LoadInt32(&im.replHeld))
+		for _, grp := range im.groups {
+			n += grp.queued()
+		}
+	}
+	return n
+}
+
+// queueEntry hands an entry to the priority lanes, entries turned away by a full lane are shed
+func (im *IngestMuxer) queueEntry(ctx context.Context, e *entry.Entry) error {
+	full, err := im.lanes.writeEntry(ctx, e)
+	if full {
+		im.shed(e)
+	}
+	return err
+}
+
+func (im *IngestMuxer) queueBatch(ctx context.Context, b []*entry.Entry) error {
+	full, err := im.lanes.writeBatch(ctx, b)
+	if full {
+		im.shed(b...)
+	}
+	return err
+}
+
+// shed diverts low priority entries that found their lane full into the cache,
+// they are only dropped and reported to any ack waiter if the cache is not
+// enabled or refuses them
+func (im *IngestMuxer) shed(ents ...*entry.Entry) {
+	if im.cacheEnabled {
+		missed, err := im.cacheEntries(ents...)
+		if len(missed) < len(ents) {
+			im.kickCaches()
+		}
+		if err == nil {
+			return
+		}
+		//only what the cache did not take is dropped, the rest is still on its way
+		ents = missed
+	}
+	atomic.AddUint64(&im.lanes.shed, uint64(len(ents)))
+	im.acks.resolveSet(ents, ErrEntryDropped)
+}
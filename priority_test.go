@@ -0,0 +1,219 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestParsePriority(t *testing.T) {
+	tests := map[string]Priority{
+		`low`:    PriorityLow,
+		` HIGH `: PriorityHigh,
+		`normal`: PriorityNormal,
+		``:       PriorityNormal,
+	}
+	for k, v := range tests {
+		if p, err := ParsePriority(k); err != nil || p != v {
+			t.Fatal("Bad priority", k, p, err)
+		}
+	}
+	if _, err := ParsePriority(`urgent`); err != ErrInvalidPriority {
+		t.Fatal("Failed to catch bad priority", err)
+	}
+	if _, err := newPriorityLanes(map[string]Priority{`foo`: Priority(5)}, nil, 4); err == nil {
+		t.Fatal("Failed to catch bad priority in config")
+	}
+}
+
+func TestPriorityLaneOrder(t *testing.T) {
+	tags := map[string]entry.EntryTag{`alerts`: 0, `debug`: 1, `other`: 2}
+	pl, err := newPriorityLanes(map[string]Priority{`alerts`: PriorityHigh, `debug`: PriorityLow}, tags, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pl.priority(2) != PriorityNormal || pl.priority(entry.GravwellTagId) != PriorityHigh {
+		t.Fatal("Bad default priorities")
+	}
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if _, err := pl.writeEntry(ctx, &entry.Entry{Tag: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		if _, err := pl.writeEntry(ctx, &entry.Entry{Tag: 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//high priority goes first, but the low lane still gets a turn
+	var low int
+	for i := 0; i < 40; i++ {
+		e, _, ok := pl.next(nil)
+		if !ok || e == nil {
+			t.Fatal("Failed to get entry")
+		}
+		if e.Tag == 1 {
+			if i == 0 {
+				t.Fatal("Low priority entry served first")
+			}
+			low++
+		}
+	}
+	if low == 0 || low > 40/starvationLimit {
+		t.Fatal("Bad starvation protection", low)
+	}
+	//a batch takes the priority of its most important entry
+	if p := pl.batchPriority([]*entry.Entry{{Tag: 1}, {Tag: 0}}); p != PriorityHigh {
+		t.Fatal("Bad batch priority", p)
+	}
+}
+
+func TestPriorityLaneShed(t *testing.T) {
+	tags := map[string]entry.EntryTag{`debug`: 0, `other`: 1}
+	pl, err := newPriorityLanes(map[string]Priority{`debug`: PriorityLow}, tags, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full int
+	for i := 0; i < 5; i++ {
+		f, err := pl.writeEntry(context.Background(), &entry.Entry{Tag: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f {
+			full++
+		}
+	}
+	if full != 3 {
+		t.Fatal("Bad full count", full)
+	}
+	//normal priority blocks instead
+	for i := 0; i < 2; i++ {
+		if _, err := pl.writeEntry(context.Background(), &entry.Entry{Tag: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if f, err := pl.writeEntry(ctx, &entry.Entry{Tag: 1}); f || err != context.DeadlineExceeded {
+		t.Fatal("Normal priority entry was not blocked", f, err)
+	}
+}
+
+func TestPriorityShedToCache(t *testing.T) {
+	for _, cache := range []bool{true, false} {
+		im, err := NewMuxer(MuxerConfig{
+			Destinations:  []Target{Target{Address: `tcp://127.0.0.1:1`, Secret: testIndexerSecret}},
+			Tags:          []string{`debug`},
+			TagPriorities: map[string]Priority{`debug`: PriorityLow},
+			ChannelSize:   2,
+			EnableCache:   cache,
+			CacheConfig:   IngestCacheConfig{MemoryCacheSize: memCacheSize},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, err := im.GetTag(`debug`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//nothing is running, so the low lane stays full
+		for i := 0; i < 2; i++ {
+			if err := im.queueEntry(context.Background(), &entry.Entry{TS: entry.Now(), Tag: tag}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		e := &entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`extra`)}
+		var res error
+		if err := im.acks.add(e, func(_ *entry.Entry, err error) { res = err }); err != nil {
+			t.Fatal(err)
+		}
+		if err := im.queueEntry(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+		ms := im.Stats()
+		if cache {
+			//the cache takes the entry, nothing is shed
+			if res != ErrEntryCached || ms.PriorityShed != 0 || im.groups[0].cache.Count() != 1 {
+				t.Fatal("Entry was not diverted to the cache", res, ms.PriorityShed)
+			}
+			im.groups[0].cache.Close()
+		} else if res != ErrEntryDropped || ms.PriorityShed != 1 {
+			t.Fatal("Entry was not shed", res, ms.PriorityShed)
+		}
+	}
+}
+
+func TestMuxerPriorities(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:  []Target{ti.Target()},
+		Tags:          []string{`alerts`, `debug`},
+		TagPriorities: map[string]Priority{`alerts`: PriorityHigh, `debug`: PriorityLow, `late`: PriorityHigh},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	late, err := im.NegotiateTag(`late`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.lanes.priority(late) != PriorityHigh {
+		t.Fatal("Negotiated tag did not pick up its priority")
+	}
+	var count int
+	for _, name := range []string{`alerts`, `debug`, `late`} {
+		tag, err := im.GetTag(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 32; i++ {
+			if err := im.Write(entry.Now(), tag, []byte(name)); err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		if err := im.WriteBatch([]*entry.Entry{{TS: entry.Now(), Tag: tag, Data: []byte(name)}}); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ms := im.Stats()
+	if ms.PriorityQueueDepth == nil {
+		t.Fatal("Missing priority stats")
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	for _, e := range ti.Entries() {
+		if s := string(e.Data); s == `alerts` || s == `debug` || s == `late` {
+			got++
+		}
+	}
+	if got+int(ms.PriorityShed) != count {
+		t.Fatal("Entries went missing", got, ms.PriorityShed, count)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gravwell/ingest/v3/config"
 	"github.com/gravwell/ingest/v3/entry"
@@ -38,8 +39,29 @@ var (
 
 type ProcessorSet struct {
 	sync.Mutex
-	wtr entWriter
-	set []Processor
+	wtr  entWriter
+	set  []Processor
+	cnts []*processorCounters
+	cmtx sync.Mutex //protects cnts so stats can be read while entries are processed
+}
+
+// processorCounters are accessed atomically and must stay 8 byte aligned
+type processorCounters struct {
+	in   uint64
+	out  uint64
+	errs uint64
+	name string
+}
+
+// ProcessorStats contains the counters for a single processor in a set.
+// EntriesIn is the number of entries handed to the processor, EntriesOut
+// is the number of entries it produced, and Errors is the number of times
+// processing failed.
+type ProcessorStats struct {
+	Name       string
+	EntriesIn  uint64
+	EntriesOut uint64
+	Errors     uint64
 }
 
 type ProcessorConfig map[string]*config.VariableConfig
@@ -201,9 +223,45 @@ func (pr *ProcessorSet) Enabled() bool {
 }
 
 func (pr *ProcessorSet) AddProcessor(p Processor) {
+	pr.addProcessor(fmt.Sprintf("%T", p), p)
+}
+
+func (pr *ProcessorSet) addProcessor(name string, p Processor) {
 	pr.Lock()
 	defer pr.Unlock()
 	pr.set = append(pr.set, p)
+	pr.cmtx.Lock()
+	pr.cnts = append(pr.cnts, &processorCounters{name: name})
+	pr.cmtx.Unlock()
+}
+
+// Stats returns the counters for each processor in the set, in processing order
+func (pr *ProcessorSet) Stats() []ProcessorStats {
+	pr.cmtx.Lock()
+	defer pr.cmtx.Unlock()
+	r := make([]ProcessorStats, 0, len(pr.cnts))
+	for _, c := range pr.cnts {
+		r = append(r, ProcessorStats{
+			Name:       c.name,
+			EntriesIn:  atomic.LoadUint64(&c.in),
+			EntriesOut: atomic.LoadUint64(&c.out),
+			Errors:     atomic.LoadUint64(&c.errs),
+		})
+	}
+	return r
+}
+
+// process hands an entry to the processor at index i, updating its counters
+func (pr *ProcessorSet) process(ent *entry.Entry, i int) ([]*entry.Entry, error) {
+	c := pr.cnts[i]
+	atomic.AddUint64(&c.in, 1)
+	set, err := pr.set[i].Process(ent)
+	if err != nil {
+		atomic.AddUint64(&c.errs, 1)
+		return nil, err
+	}
+	atomic.AddUint64(&c.out, uint64(len(set)))
+	return set, nil
 }
 
 func (pr *ProcessorSet) Process(ent *entry.Entry) error {
@@ -240,7 +298,7 @@ func (pr *ProcessorSet) processItem(ent *entry.Entry, i int) error {
 		//we are at the end of the line, just write the entry
 		return pr.wtr.WriteEntry(ent)
 	}
-	if set, err := pr.set[i].Process(ent); err != nil {
+	if set, err := pr.process(ent, i); err != nil {
 		return err
 	} else {
 		for _, v := range set {
@@ -258,7 +316,7 @@ func (pr *ProcessorSet) processItemContext(ent *entry.Entry, i int, ctx context.
 		//we are at the end of the line, just write the entry
 		return pr.wtr.WriteEntryContext(ctx, ent)
 	}
-	if set, err := pr.set[i].Process(ent); err != nil {
+	if set, err := pr.process(ent, i); err != nil {
 		return err
 	} else {
 		for _, v := range set {
@@ -310,7 +368,7 @@ func (pc ProcessorConfig) ProcessorSet(t tagWriter, names []string) (pr *Process
 			err = fmt.Errorf("%s %v", n, err)
 			return
 		}
-		pr.AddProcessor(p)
+		pr.addProcessor(n, p)
 	}
 	return
 }
@@ -239,6 +239,36 @@ func TestSingleProcessorSet(t *testing.T) {
 	return
 }
 
+func TestProcessorSetStats(t *testing.T) {
+	var tw testWriter
+	ps := NewProcessorSet(&tw)
+	p, err := NewGzipDecompressor(GzipDecompressorConfig{Passthrough_Non_Gzip: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.AddProcessor(p)
+	gz, err := gzipCompress([]byte("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := ps.Process(&entry.Entry{TS: entry.Now(), Data: gz}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//not compressed and no passthrough, this must fail
+	if err := ps.Process(&entry.Entry{TS: entry.Now(), Data: []byte("Hello")}); err == nil {
+		t.Fatal("Failed to catch bad gzip data")
+	}
+	st := ps.Stats()
+	if len(st) != 1 {
+		t.Fatal("Bad stats count", len(st))
+	}
+	if st[0].Name == `` || st[0].EntriesIn != 5 || st[0].EntriesOut != 4 || st[0].Errors != 1 {
+		t.Fatalf("Bad processor stats: %+v", st[0])
+	}
+}
+
 func TestMultiProcessorSet(t *testing.T) {
 	var err error
 	data := []byte("Hello")
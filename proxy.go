@@ -0,0 +1,235 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyTimeout       time.Duration = 10 * time.Second //time allowed for the proxy to set up the tunnel
+	maxProxyHeaderSize int           = 8 * 1024
+
+	socks5Version     byte = 0x05
+	socks5AuthNone    byte = 0x00
+	socks5AuthPass    byte = 0x02
+	socks5AuthNoMatch byte = 0xFF
+	socks5PassVersion byte = 0x01
+	socks5CmdConnect  byte = 0x01
+	socks5AddrIPv4    byte = 0x01
+	socks5AddrDomain  byte = 0x03
+	socks5AddrIPv6    byte = 0x04
+)
+
+var (
+	ErrInvalidProxy    = errors.New("Invalid proxy")
+	ErrProxyAuthFailed = errors.New("Proxy authentication failed")
+	ErrProxyProtocol   = errors.New("Malformed response from proxy")
+)
+
+// parseProxy validates a proxy URL of the form socks5://[user:pass@]host:port
+// or http://[user:pass@]host:port, the latter uses HTTP CONNECT
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, ErrInvalidProxy
+	}
+	switch strings.ToLower(u.Scheme) {
+	case `socks5`, `http`:
+	default:
+		return nil, ErrInvalidProxy
+	}
+	if u.Hostname() == `` || u.Port() == `` {
+		return nil, ErrInvalidProxy
+	}
+	return u, nil
+}
+
+// proxyDial returns a dial function that tunnels TCP connections through a proxy
+// which is reached with base, the connection handed back is a plain connection to
+// the target address.  Anything that is not TCP goes straight to base.
+func proxyDial(p *url.URL, base dialFunc) dialFunc {
+	return func(network, addr string) (conn net.Conn, err error) {
+		if network != `tcp` {
+			return base(network, addr)
+		}
+		if conn, err = base(`tcp`, p.Host); err != nil {
+			return
+		}
+		if err = conn.SetDeadline(time.Now().Add(proxyTimeout)); err == nil {
+			if strings.ToLower(p.Scheme) == `socks5` {
+				err = socks5Connect(conn, p.User, addr)
+			} else {
+				err = httpConnect(conn, p.User, addr)
+			}
+		}
+		if err == nil {
+			err = conn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+		return
+	}
+}
+
+// socks5Connect asks a SOCKS5 proxy to connect to addr, hostnames are handed
+// to the proxy to resolve.  See RFC 1928 and RFC 1929.
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) (err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return ErrMalformedDestination
+	}
+
+	//offer the auth methods we can do
+	hello := []byte{socks5Version, 1, socks5AuthNone}
+	if user != nil {
+		hello = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPass}
+	}
+	if _, err = conn.Write(hello); err != nil {
+		return
+	}
+	resp := make([]byte, 2)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return
+	} else if resp[0] != socks5Version {
+		return ErrProxyProtocol
+	}
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthPass:
+		if user == nil {
+			return ErrProxyAuthFailed
+		}
+		pass, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(pass) > 255 {
+			return ErrInvalidProxy
+		}
+		b := []byte{socks5PassVersion, byte(len(name))}
+		b = append(b, name...)
+		b = append(b, byte(len(pass)))
+		b = append(b, pass...)
+		if _, err = conn.Write(b); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, resp); err != nil {
+			return
+		} else if resp[1] != 0 {
+			return ErrProxyAuthFailed
+		}
+	case socks5AuthNoMatch:
+		return ErrProxyAuthFailed
+	default:
+		return ErrProxyProtocol
+	}
+
+	//request the connection
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return ErrMalformedDestination
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+
+	//the reply carries the address the proxy bound, which we just have to get past
+	hdr := make([]byte, 4)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return
+	} else if hdr[0] != socks5Version {
+		return ErrProxyProtocol
+	} else if hdr[1] != 0 {
+		return fmt.Errorf("Proxy refused connection to %v: SOCKS5 error %d", addr, hdr[1])
+	}
+	var skip int
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		if _, err = io.ReadFull(conn, hdr[:1]); err != nil {
+			return
+		}
+		skip = int(hdr[0])
+	default:
+		return ErrProxyProtocol
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to addr with the CONNECT method
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (err error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if user != nil {
+		pass, _ := user.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(user.Username() + `:` + pass))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	if _, err = io.WriteString(conn, req+"\r\n"); err != nil {
+		return
+	}
+
+	//the indexer speaks first once the tunnel is up, so the response is read a
+	//byte at a time to avoid buffering anything past the end of the headers
+	hdr := make([]byte, 0, 512)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(hdr, []byte("\r\n\r\n")) {
+		if len(hdr) >= maxProxyHeaderSize {
+			return ErrProxyProtocol
+		}
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return
+		}
+		hdr = append(hdr, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(hdr)), nil)
+	if err != nil {
+		return ErrProxyProtocol
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		err = ErrProxyAuthFailed
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		err = fmt.Errorf("Proxy refused connection to %v: %v", addr, resp.Status)
+	}
+	return
+}
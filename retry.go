@@ -0,0 +1,285 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIngestOKInterval time.Duration = 5 * time.Second
+	defaultBreakerWindow    time.Duration = time.Minute
+	defaultBreakerOpen      time.Duration = 30 * time.Second
+	maxBackoffShift         int           = 32
+)
+
+// RetryPolicy controls how the muxer re-establishes connections to targets.
+// The zero value retries at a fixed interval, matching the legacy behavior.
+//
+// Connection attempts back off exponentially from InitialInterval by Multiplier
+// up to MaxInterval. Jitter is a fraction (0.0 - 1.0) of each interval which is
+// randomly added or subtracted so that ingesters do not retry in lock step.
+// A connection that drops before it has been up for StableInterval is retried
+// after the next interval as well, so a target that keeps accepting and then
+// dropping connections is backed off like one that refuses them.  Connections
+// that stay up longer reset the backoff, StableInterval defaults to MaxInterval.
+//
+// If BreakerThreshold is non-zero, a target whose connection fails mid-stream
+// BreakerThreshold times within BreakerWindow has its circuit opened, the muxer
+// will not attempt to reconnect to it for BreakerOpenDuration.
+type RetryPolicy struct {
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	Multiplier          float64
+	Jitter              float64
+	StableInterval      time.Duration
+	BreakerThreshold    int
+	BreakerWindow       time.Duration
+	BreakerOpenDuration time.Duration
+}
+
+func (rp RetryPolicy) normalize() RetryPolicy {
+	if rp.InitialInterval <= 0 {
+		rp.InitialInterval = defaultRetryTime
+	}
+	if rp.Multiplier < 1.0 {
+		rp.Multiplier = 1.0
+	}
+	if rp.MaxInterval < rp.InitialInterval {
+		if rp.Multiplier == 1.0 {
+			rp.MaxInterval = rp.InitialInterval
+		} else {
+			rp.MaxInterval = 30 * rp.InitialInterval
+		}
+	}
+	if rp.StableInterval <= 0 {
+		rp.StableInterval = rp.MaxInterval
+	}
+	if rp.Jitter < 0 {
+		rp.Jitter = 0
+	} else if rp.Jitter > 1.0 {
+		rp.Jitter = 1.0
+	}
+	if rp.BreakerThreshold < 0 {
+		rp.BreakerThreshold = 0
+	}
+	if rp.BreakerWindow <= 0 {
+		rp.BreakerWindow = defaultBreakerWindow
+	}
+	if rp.BreakerOpenDuration <= 0 {
+		rp.BreakerOpenDuration = defaultBreakerOpen
+	}
+	return rp
+}
+
+func (rp RetryPolicy) newBackoff() *backoff {
+	return &backoff{
+		initial: rp.InitialInterval,
+		max:     rp.MaxInterval,
+		mult:    rp.Multiplier,
+		jitter:  rp.Jitter,
+	}
+}
+
+// ingestOKBackoff is used when polling an indexer that is not yet ready for ingest
+func (rp RetryPolicy) ingestOKBackoff() *backoff {
+	bo := rp.newBackoff()
+	bo.initial = defaultIngestOKInterval
+	if bo.max < bo.initial {
+		bo.max = bo.initial
+	}
+	return bo
+}
+
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	mult    float64
+	jitter  float64
+	attempt int
+}
+
+// next returns the next interval to wait and advances the backoff
+func (bo *backoff) next() time.Duration {
+	d := float64(bo.initial)
+	for i := 0; i < bo.attempt && i < maxBackoffShift; i++ {
+		if d *= bo.mult; d >= float64(bo.max) {
+			d = float64(bo.max)
+			break
+		}
+	}
+	bo.attempt++
+	if bo.jitter > 0 {
+		d += d * bo.jitter * (2*rand.Float64() - 1)
+	}
+	if d > float64(bo.max) {
+		d = float64(bo.max)
+	} else if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+func (bo *backoff) reset() {
+	bo.attempt = 0
+}
+
+type TargetState int
+
+const (
+	TargetConnecting  TargetState = iota // attempting to establish a connection
+	TargetBackoff                        // waiting to retry after a failed connection
+	TargetWaiting                        // connected, but the indexer is not ready for ingest
+	TargetHot                            // connected and accepting entries
+	TargetCircuitOpen                    // circuit breaker is open after repeated failures
+	TargetFailed                         // fatal error, the muxer will not reconnect
+)
+
+func (ts TargetState) String() string {
+	switch ts {
+	case TargetConnecting:
+		return `CONNECTING`
+	case TargetBackoff:
+		return `BACKOFF`
+	case TargetWaiting:
+		return `WAITING`
+	case TargetHot:
+		return `HOT`
+	case TargetCircuitOpen:
+		return `CIRCUIT_OPEN`
+	case TargetFailed:
+		return `FAILED`
+	}
+	return `UNKNOWN`
+}
+
+// TargetStatus is a point in time snapshot of the connection state for a target
+type TargetStatus struct {
+	Address     string
+	State       TargetState
+	LastError   error
+	LastErrorTS time.Time
+	NextAttempt time.Time // set when backing off or the circuit is open
+	Failures    int       // mid-stream failures inside the breaker window
+}
+
+// targetHealth tracks connection state and circuit breaker history for a target
+type targetHealth struct {
+	mtx      sync.Mutex
+	status   TargetStatus
+	failures []time.Time
+}
+
+func (th *targetHealth) setState(s TargetState) {
+	th.mtx.Lock()
+	th.status.State = s
+	if s != TargetBackoff && s != TargetCircuitOpen {
+		th.status.NextAttempt = time.Time{}
+	}
+	th.mtx.Unlock()
+}
+
+func (th *targetHealth) setError(s TargetState, err error, next time.Time) {
+	th.mtx.Lock()
+	th.status.State = s
+	th.status.LastError = err
+	th.status.LastErrorTS = time.Now()
+	th.status.NextAttempt = next
+	th.mtx.Unlock()
+}
+
+// recordFailure registers a mid-stream connection failure and returns how long
+// the circuit should stay open, a zero duration means the breaker is closed
+func (th *targetHealth) recordFailure(rp RetryPolicy, now time.Time) time.Duration {
+	th.mtx.Lock()
+	defer th.mtx.Unlock()
+	if rp.BreakerThreshold <= 0 {
+		return 0
+	}
+	//prune anything that has aged out of the window
+	cutoff := now.Add(-rp.BreakerWindow)
+	fails := th.failures[:0]
+	for _, ts := range th.failures {
+		if ts.After(cutoff) {
+			fails = append(fails, ts)
+		}
+	}
+	th.failures = append(fails, now)
+	th.status.Failures = len(th.failures)
+	if len(th.failures) < rp.BreakerThreshold {
+		return 0
+	}
+	//trip the breaker and start with a clean slate when it closes
+	th.failures = th.failures[:0]
+	th.status.State = TargetCircuitOpen
+	th.status.NextAttempt = now.Add(rp.BreakerOpenDuration)
+	return rp.BreakerOpenDuration
+}
+
+func (th *targetHealth) snapshot() TargetStatus {
+	th.mtx.Lock()
+	defer th.mtx.Unlock()
+	return th.status
+}
+
+// healthRank orders states from least to most able to take entries
+func healthRank(s TargetState) int {
+	switch s {
+	case TargetHot:
+		return 5
+	case TargetWaiting:
+		return 4
+	case TargetConnecting:
+		return 3
+	case TargetBackoff:
+		return 2
+	case TargetCircuitOpen:
+		return 1
+	}
+	return 0
+}
+
+// mergeStatus folds the status of another connection to the same target into st.
+// The target takes the healthiest state, the most recent error, and the sum of the failures.
+func mergeStatus(st, o TargetStatus) TargetStatus {
+	if r, or := healthRank(st.State), healthRank(o.State); or > r {
+		st.State = o.State
+		st.NextAttempt = o.NextAttempt
+	} else if or == r && !o.NextAttempt.IsZero() && (st.NextAttempt.IsZero() || o.NextAttempt.Before(st.NextAttempt)) {
+		st.NextAttempt = o.NextAttempt
+	}
+	if o.LastErrorTS.After(st.LastErrorTS) {
+		st.LastError = o.LastError
+		st.LastErrorTS = o.LastErrorTS
+	}
+	st.Failures += o.Failures
+	return st
+}
+
+// TargetStatus returns the connection state of every target managed by the muxer,
+// targets with parallel connections are reported once
+func (im *IngestMuxer) TargetStatus() []TargetStatus {
+	im.mtx.RLock()
+	defer im.mtx.RUnlock()
+	r := make([]TargetStatus, 0, len(im.targets))
+	idx := make(map[string]int, len(im.targets))
+	for _, mt := range im.targets {
+		st := mt.health.snapshot()
+		st.Address = mt.Address
+		if i, ok := idx[mt.Address]; ok {
+			r[i] = mergeStatus(r[i], st)
+			continue
+		}
+		idx[mt.Address] = len(r)
+		r = append(r, st)
+	}
+	return r
+}
@@ -0,0 +1,268 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestRetryPolicyDefault(t *testing.T) {
+	//the zero value should retry at the legacy fixed interval
+	bo := RetryPolicy{}.normalize().newBackoff()
+	for i := 0; i < 8; i++ {
+		if d := bo.next(); d != defaultRetryTime {
+			t.Fatal("Bad default interval", i, d)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	rp := RetryPolicy{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		Multiplier:      2.0,
+	}.normalize()
+	bo := rp.newBackoff()
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, v := range expected {
+		if d := bo.next(); d != v {
+			t.Fatal("Bad backoff interval", i, d, v)
+		}
+	}
+	bo.reset()
+	if d := bo.next(); d != rp.InitialInterval {
+		t.Fatal("Reset did not restore the initial interval", d)
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	rp := RetryPolicy{
+		InitialInterval: time.Second,
+		MaxInterval:     time.Second,
+		Jitter:          0.5,
+	}.normalize()
+	bo := rp.newBackoff()
+	for i := 0; i < 128; i++ {
+		if d := bo.next(); d < 500*time.Millisecond || d > time.Second {
+			t.Fatal("Jittered interval out of range", d)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	rp := RetryPolicy{
+		BreakerThreshold:    3,
+		BreakerWindow:       time.Minute,
+		BreakerOpenDuration: 10 * time.Second,
+	}.normalize()
+	var th targetHealth
+	now := time.Now()
+	//failures that age out of the window do not count
+	if d := th.recordFailure(rp, now.Add(-2*time.Minute)); d != 0 {
+		t.Fatal("Breaker opened early")
+	}
+	if d := th.recordFailure(rp, now); d != 0 {
+		t.Fatal("Breaker opened early")
+	}
+	if d := th.recordFailure(rp, now); d != 0 {
+		t.Fatal("Breaker opened early")
+	}
+	if d := th.recordFailure(rp, now); d != rp.BreakerOpenDuration {
+		t.Fatal("Breaker did not open", d)
+	}
+	if st := th.snapshot(); st.State != TargetCircuitOpen || !st.NextAttempt.Equal(now.Add(rp.BreakerOpenDuration)) {
+		t.Fatal("Bad status on open breaker", st)
+	}
+	//disabled breakers never open
+	var th2 targetHealth
+	for i := 0; i < 16; i++ {
+		if d := th2.recordFailure(RetryPolicy{}.normalize(), now); d != 0 {
+			t.Fatal("Disabled breaker opened")
+		}
+	}
+}
+
+func TestTargetStatusBackoff(t *testing.T) {
+	//grab a port that nothing is listening on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := `tcp://` + lst.Addr().String()
+	lst.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{Target{Address: addr, Secret: testIndexerSecret}},
+		Tags:         []string{`testA`},
+		RetryPolicy: RetryPolicy{
+			InitialInterval: time.Minute,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var st TargetStatus
+	for ts := time.Now(); time.Since(ts) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if sts := im.TargetStatus(); len(sts) == 1 && sts[0].State == TargetBackoff {
+			st = sts[0]
+			break
+		}
+	}
+	if st.State != TargetBackoff || st.LastError == nil || st.Address != addr {
+		t.Fatal("Target did not enter backoff", st)
+	}
+	if time.Until(st.NextAttempt) < 50*time.Second {
+		t.Fatal("Retry policy not honored", st.NextAttempt)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlappingTargetBackoff(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+		RetryPolicy: RetryPolicy{
+			InitialInterval: 100 * time.Millisecond,
+			MaxInterval:     10 * time.Second,
+			Multiplier:      2.0,
+			StableInterval:  3 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := im.Subscribe(64)
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+
+	//the indexer accepts connections and then drops them
+	drop := func() {
+		ti.Lock()
+		for _, c := range ti.conns {
+			c.Close()
+		}
+		ti.conns = nil
+		ti.Unlock()
+	}
+	tmo := time.After(30 * time.Second)
+	next := func(et EventType) Event {
+		for {
+			select {
+			case ev := <-sub.C:
+				if ev.Type == et {
+					return ev
+				}
+			case <-tmo:
+				t.Fatal("Timed out waiting for", et)
+			}
+		}
+	}
+	for _, d := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		next(EventHot)
+		drop()
+		if ev := next(EventReconnecting); ev.Err != errConnUnstable || ev.Duration != d {
+			t.Fatal("Flapping connection was not backed off", ev, d)
+		}
+	}
+	//a connection that stays up resets the backoff
+	next(EventHot)
+	time.Sleep(3500 * time.Millisecond)
+	drop()
+	if ev := next(EventReconnecting); ev.Err != nil || ev.Duration != 0 {
+		t.Fatal("Stable connection did not reset the backoff", ev)
+	}
+	next(EventHot)
+	drop()
+	if ev := next(EventReconnecting); ev.Err != errConnUnstable || ev.Duration != 100*time.Millisecond {
+		t.Fatal("Backoff was not reset", ev)
+	}
+}
+
+func TestRenegotiateNoBackoff(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+		RetryPolicy: RetryPolicy{
+			InitialInterval:  time.Minute,
+			StableInterval:   time.Minute,
+			BreakerThreshold: 1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := im.Subscribe(64)
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//sneak a tag in behind the connection so the relay has to renegotiate
+	im.mtx.Lock()
+	tag := entry.EntryTag(len(im.tags))
+	im.tagMap[`testB`] = tag
+	im.tags = append(im.tags, `testB`)
+	im.router.register(im.tags)
+	im.mtx.Unlock()
+	if err := im.Write(entry.Now(), tag, []byte(`hello`)); err != nil {
+		t.Fatal(err)
+	}
+	tmo := time.After(5 * time.Second)
+	next := func(et EventType) Event {
+		for {
+			select {
+			case ev := <-sub.C:
+				if ev.Type == et {
+					return ev
+				}
+			case <-tmo:
+				t.Fatal("Timed out waiting for", et)
+			}
+		}
+	}
+	next(EventHot)
+	if ev := next(EventReconnecting); ev.Err != nil || ev.Duration != 0 {
+		t.Fatal("Renegotiation was backed off", ev)
+	}
+	next(EventHot)
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ti.Count() != 1 {
+		t.Fatal("Bad entry count", ti.Count())
+	}
+	if sts := im.TargetStatus(); len(sts) != 1 || sts[0].State != TargetHot || sts[0].Failures != 0 {
+		t.Fatal("Renegotiation counted as a failure", sts)
+	}
+}
@@ -0,0 +1,189 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"errors"
+	"path"
+	"sync/atomic"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	// unroutedTag stands in for the remote tag on targets that are not allowed a tag,
+	// entries carrying the tag are never handed to those targets
+	unroutedTag entry.EntryTag = entry.GravwellTagId - 1
+)
+
+var (
+	ErrInvalidTagRoute = errors.New("Invalid tag route")
+	ErrNoDefaultGroup  = errors.New("Tag routes without replication require a default group")
+	ErrGroupNoTags     = errors.New("Target group is not routed any tags")
+)
+
+// TagRoute sends every tag matching Tag to the named target group.  Tag is a tag
+// name or a glob pattern as understood by path.Match.  A tag matching several
+// routes is delivered to each of their groups.
+type TagRoute struct {
+	Tag   string
+	Group string
+}
+
+// tagRouter decides which groups receive each tag.  Tags that match no route go
+// to the default set, which is DefaultGroup if set, every group when Replicate is set,
+// and otherwise the group holding MuxerConfig.Destinations.
+type tagRouter struct {
+	routes []TagRoute
+	idx    []int //group index of each route
+	def    []int
+	sets   atomic.Value //[][]int of group indexes, indexed by local tag
+	copies int32        //set when some tag is delivered to more than one group
+}
+
+func newTagRouter(c MuxerConfig, groups []TargetGroup) (*tagRouter, error) {
+	lookup := func(name string) int {
+		for i, g := range groups {
+			if g.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+	tr := &tagRouter{}
+	for _, r := range c.Routes {
+		if r.Tag == `` {
+			return nil, ErrInvalidTagRoute
+		} else if _, err := path.Match(r.Tag, ``); err != nil {
+			return nil, ErrInvalidTagRoute
+		}
+		gi := lookup(r.Group)
+		if gi < 0 {
+			return nil, ErrGroupNotFound
+		}
+		tr.routes = append(tr.routes, r)
+		tr.idx = append(tr.idx, gi)
+	}
+	if c.DefaultGroup != `` {
+		gi := lookup(c.DefaultGroup)
+		if gi < 0 {
+			return nil, ErrGroupNotFound
+		}
+		tr.def = []int{gi}
+	} else if c.Replicate || len(groups) == 1 {
+		for i := range groups {
+			tr.def = append(tr.def, i)
+		}
+	} else if gi := lookup(DefaultGroupName); gi >= 0 {
+		tr.def = []int{gi}
+	} else {
+		return nil, ErrNoDefaultGroup
+	}
+	tr.sets.Store([][]int(nil))
+	if len(tr.def) > 1 {
+		tr.copies = 1
+	}
+	return tr, nil
+}
+
+// route returns the groups a tag name is delivered to, in group order
+func (tr *tagRouter) route(name string) (set []int) {
+	for i, r := range tr.routes {
+		if ok, _ := path.Match(r.Tag, name); ok {
+			set = addGroupIndex(set, tr.idx[i])
+		}
+	}
+	if len(set) == 0 {
+		set = tr.def
+	}
+	return
+}
+
+func addGroupIndex(set []int, gi int) []int {
+	for i, v := range set {
+		if v == gi {
+			return set
+		} else if v > gi {
+			set = append(set, 0)
+			copy(set[i+1:], set[i:])
+			set[i] = gi
+			return set
+		}
+	}
+	return append(set, gi)
+}
+
+// register resolves the routes for the full tag list, the caller must hold the muxer lock
+func (tr *tagRouter) register(tags []string) {
+	var copies int32
+	if len(tr.def) > 1 {
+		copies = 1
+	}
+	sets := make([][]int, len(tags))
+	for i, name := range tags {
+		if sets[i] = tr.route(name); len(sets[i]) > 1 {
+			copies = 1
+		}
+	}
+	tr.sets.Store(sets)
+	atomic.StoreInt32(&tr.copies, copies)
+}
+
+// replicates returns true if any tag is delivered to more than one group
+func (tr *tagRouter) replicates() bool {
+	return atomic.LoadInt32(&tr.copies) != 0
+}
+
+// groups returns the groups an entry with the given local tag is delivered to,
+// tags the muxer does not know about go to the default set
+func (tr *tagRouter) groups(tg entry.EntryTag) []int {
+	if sets := tr.sets.Load().([][]int); int(tg) < len(sets) {
+		return sets[tg]
+	}
+	return tr.def
+}
+
+// allowed returns true if targets in a group may receive the tag
+func (tr *tagRouter) allowed(tg entry.EntryTag, gi int) bool {
+	for _, v := range tr.groups(tg) {
+		if v == gi {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGroups makes sure every group receives at least one tag, a target with
+// nothing to negotiate can never connect
+func (tr *tagRouter) checkGroups(ngroups, ntags int) error {
+	for gi := 0; gi < ngroups; gi++ {
+		var ok bool
+		for tg := 0; tg < ntags && !ok; tg++ {
+			ok = tr.allowed(entry.EntryTag(tg), gi)
+		}
+		if !ok {
+			return ErrGroupNoTags
+		}
+	}
+	return nil
+}
+
+// groupTags returns the tag names the targets in a group negotiate, the caller must hold the lock
+func (im *IngestMuxer) groupTags(grp *muxGroup) []string {
+	if !im.routing() {
+		return im.tags
+	}
+	tags := make([]string, 0, len(im.tags))
+	for i, name := range im.tags {
+		if im.router.allowed(entry.EntryTag(i), grp.idx) {
+			tags = append(tags, name)
+		}
+	}
+	return tags
+}
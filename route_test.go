@@ -0,0 +1,174 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestTagRouter(t *testing.T) {
+	groups := []TargetGroup{{Name: DefaultGroupName}, {Name: `compliance`}, {Name: `archive`}}
+	c := MuxerConfig{
+		Routes: []TagRoute{
+			{Tag: `audit*`, Group: `compliance`},
+			{Tag: `auditd`, Group: `archive`},
+			{Tag: `auditd`, Group: `compliance`},
+		},
+	}
+	tr, err := newTagRouter(c, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.register([]string{`syslog`, `audit-win`, `auditd`})
+	checks := []struct {
+		tg  entry.EntryTag
+		set []int
+	}{
+		{0, []int{0}},
+		{1, []int{1}},
+		{2, []int{1, 2}},
+		{entry.GravwellTagId, []int{0}}, //unknown tags take the default route
+	}
+	for _, v := range checks {
+		if set := tr.groups(v.tg); !reflect.DeepEqual(set, v.set) {
+			t.Fatalf("tag %d routed to %v, expected %v", v.tg, set, v.set)
+		}
+	}
+	if tr.allowed(0, 1) || !tr.allowed(2, 2) {
+		t.Fatal("Bad allowed check")
+	}
+	if err = tr.checkGroups(3, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.checkGroups(3, 2); err != ErrGroupNoTags {
+		t.Fatal("Failed to catch a group with no tags", err)
+	}
+	//auditd goes to two groups, without it every tag has a single group
+	if !tr.replicates() {
+		t.Fatal("Overlapping routes not flagged as replicating")
+	}
+	if tr.register([]string{`syslog`, `audit-win`}); tr.replicates() {
+		t.Fatal("Routing only flagged as replicating")
+	}
+
+	//replicating with no default group sends unrouted tags everywhere
+	c.Replicate = true
+	if tr, err = newTagRouter(c, groups); err != nil {
+		t.Fatal(err)
+	} else if set := tr.route(`syslog`); !reflect.DeepEqual(set, []int{0, 1, 2}) {
+		t.Fatal("Bad replicated default route", set)
+	} else if !tr.replicates() {
+		t.Fatal("Replicated default route not flagged as replicating")
+	}
+	c.DefaultGroup = `archive`
+	if tr, err = newTagRouter(c, groups); err != nil {
+		t.Fatal(err)
+	} else if set := tr.route(`syslog`); !reflect.DeepEqual(set, []int{2}) {
+		t.Fatal("Bad default group route", set)
+	}
+
+	bad := []struct {
+		c   MuxerConfig
+		err error
+	}{
+		{MuxerConfig{Routes: []TagRoute{{Tag: ``, Group: `archive`}}}, ErrInvalidTagRoute},
+		{MuxerConfig{Routes: []TagRoute{{Tag: `[a`, Group: `archive`}}}, ErrInvalidTagRoute},
+		{MuxerConfig{Routes: []TagRoute{{Tag: `a`, Group: `nope`}}}, ErrGroupNotFound},
+		{MuxerConfig{DefaultGroup: `nope`}, ErrGroupNotFound},
+	}
+	for i, v := range bad {
+		if _, err = newTagRouter(v.c, groups); err != v.err {
+			t.Fatalf("%d: expected %v, got %v", i, v.err, err)
+		}
+	}
+	//without replication there has to be somewhere for unrouted tags to go
+	if _, err = newTagRouter(MuxerConfig{}, groups[1:]); err != ErrNoDefaultGroup {
+		t.Fatal("Failed to catch a missing default group", err)
+	}
+}
+
+func TestMuxerRoutes(t *testing.T) {
+	tiGen := newTestIndexer(t)
+	defer tiGen.Close()
+	tiComp := newTestIndexer(t)
+	defer tiComp.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{tiGen.Target()},
+		TargetGroups: []TargetGroup{{Name: `compliance`, Destinations: []Target{tiComp.Target()}}},
+		Routes:       []TagRoute{{Tag: `audit*`, Group: `compliance`}},
+		Tags:         []string{`syslog`, `auditd`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//tags added to the muxer follow the same routes as the configured tags
+	names := []string{`syslog`, `auditd`, `audit-win`, `netflow`}
+	tags := make([]entry.EntryTag, len(names))
+	for i, name := range names {
+		if tags[i], err = im.NegotiateTag(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForHotCount(t, im, 2)
+	for j, name := range names {
+		tag := tags[j]
+		for i := 0; i < 10; i++ {
+			if err := im.Write(entry.Now(), tag, []byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(ti *testIndexer, allowed ...string) {
+		ti.Lock()
+		defer ti.Unlock()
+		names := map[entry.EntryTag]string{}
+		for name, tg := range ti.tags {
+			names[tg] = name
+		}
+		want := map[string]bool{}
+		for _, name := range allowed {
+			want[name] = true
+		}
+		//only the routed tags may be negotiated
+		for name := range ti.tags {
+			if !want[name] {
+				t.Fatal("Negotiated an unrouted tag", name)
+			}
+		}
+		counts := map[string]int{}
+		for _, e := range ti.ents {
+			if name := names[e.Tag]; name != string(e.Data) {
+				t.Fatalf("Entry %s arrived with tag %q", e.Data, name)
+			}
+			counts[string(e.Data)]++
+		}
+		for _, name := range allowed {
+			if counts[name] != 10 {
+				t.Fatalf("Got %d %s entries", counts[name], name)
+			}
+		}
+	}
+	check(tiGen, `syslog`, `netflow`)
+	check(tiComp, `auditd`, `audit-win`)
+}
@@ -0,0 +1,317 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	defaultSequenceWindow uint64 = 64 * 1024
+)
+
+var (
+	ErrSequenceNeedsUUID = errors.New("Sequencing entries requires an ingester UUID")
+)
+
+// entrySequencer hands out the sequence numbers sent with each entry.  Entries
+// are numbered as the muxer admits them and keep the number until they are
+// confirmed or lost, replicas share the number of the entry they copy.  A file
+// backed cache or the in-flight journal takes the number along when it stores
+// an entry and restores it when the entry comes back out, so an entry replayed
+// after a restart carries the number it was first sent with.  Entries stored
+// without one, such as those cached before sequencing was turned on, pick up a
+// fresh number when they are sent.  A file backed cache saves the next number
+// when it is closed cleanly and the next run resumes from it, keeping numbers
+// contiguous so that replays of entries sent before the restart still land in
+// an indexer's window.  Without a saved number, after a crash or on the first
+// run, numbers start at the wall clock in nanoseconds so that they keep
+// climbing across restarts of an ingester with the same UUID.
+type entrySequencer struct {
+	mtx  sync.Mutex
+	next uint64
+	seqs map[*entry.Entry]uint64
+}
+
+func newEntrySequencer() *entrySequencer {
+	return &entrySequencer{
+		next: uint64(time.Now().UnixNano()),
+		seqs: map[*entry.Entry]uint64{},
+	}
+}
+
+// resume continues numbering from a number saved by a previous run, zero is ignored
+func (es *entrySequencer) resume(next uint64) {
+	if next == 0 {
+		return
+	}
+	es.mtx.Lock()
+	es.next = next
+	es.mtx.Unlock()
+}
+
+// peek returns the next number the sequencer will hand out
+func (es *entrySequencer) peek() uint64 {
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+	return es.next
+}
+
+// assign numbers admitted entries, entries that already have one keep it
+func (es *entrySequencer) assign(ents ...*entry.Entry) {
+	if es == nil {
+		return
+	}
+	es.mtx.Lock()
+	for _, e := range ents {
+		if e == nil {
+			continue
+		} else if _, ok := es.seqs[e]; !ok {
+			es.seqs[e] = es.next
+			es.next++
+		}
+	}
+	es.mtx.Unlock()
+}
+
+// get returns the sequence number of an entry, assigning one if it has none
+func (es *entrySequencer) get(e *entry.Entry) uint64 {
+	es.mtx.Lock()
+	defer es.mtx.Unlock()
+	if seq, ok := es.seqs[e]; ok {
+		return seq
+	}
+	seq := es.next
+	es.next++
+	es.seqs[e] = seq
+	return seq
+}
+
+// share gives the replicas of an entry its number
+func (es *entrySequencer) share(ent *entry.Entry, replicas []*entry.Entry) {
+	if es == nil {
+		return
+	}
+	es.mtx.Lock()
+	if seq, ok := es.seqs[ent]; ok {
+		for _, e := range replicas {
+			if e != nil {
+				es.seqs[e] = seq
+			}
+		}
+	}
+	es.mtx.Unlock()
+}
+
+// take hands over the numbers of entries moving into a store, entries without
+// one get zero.  The sequencer forgets them, restore picks them back up.
+func (es *entrySequencer) take(ents []*entry.Entry) []uint64 {
+	seqs := make([]uint64, len(ents))
+	es.mtx.Lock()
+	for i, e := range ents {
+		if seq, ok := es.seqs[e]; ok {
+			seqs[i] = seq
+			delete(es.seqs, e)
+		}
+	}
+	es.mtx.Unlock()
+	return seqs
+}
+
+// restore gives entries pulled out of a store the numbers they went in with,
+// zero means the entry had none
+func (es *entrySequencer) restore(ents []*entry.Entry, seqs []uint64) {
+	es.mtx.Lock()
+	for i, e := range ents {
+		if i < len(seqs) && seqs[i] != 0 && e != nil {
+			es.seqs[e] = seqs[i]
+		}
+	}
+	es.mtx.Unlock()
+}
+
+// forget drops the numbers of entries that are confirmed or lost
+func (es *entrySequencer) forget(ents ...*entry.Entry) {
+	if es == nil {
+		return
+	}
+	es.mtx.Lock()
+	for _, e := range ents {
+		delete(es.seqs, e)
+	}
+	es.mtx.Unlock()
+}
+
+// SequenceTracker is a helper for indexers that drops entries an ingester
+// replays after a reconnect.  Entries read with EntryReader.ReadSequence
+// carry a sequence number scoped to the UUID the ingester identified with,
+// the tracker keeps a high-water mark for each UUID along with a window of
+// the sequences seen just below it.  Entries can arrive out of order when
+// an ingester holds several connections, so only sequences that were seen
+// are dropped; sequences that fall behind the window cannot be checked and
+// are let through, storing a duplicate is better than losing an entry.
+//
+// Each UUID costs window/8 bytes, 8KB with the default window, and is held
+// until Forget is called or, with SetIdleTimeout, until the ingester has gone
+// quiet for the timeout.  Replays arrive after a reconnect, so callers that
+// track ingesters that come and go should set a timeout longer than the
+// outages they need to ride out rather than calling Forget on disconnect.
+type SequenceTracker struct {
+	dropped uint64 //atomic, must stay at the top for alignment
+	mtx     sync.Mutex
+	window  uint64
+	idle    time.Duration
+	swept   time.Time
+	marks   map[string]*seqWindow
+}
+
+// seqWindow is a high-water mark and a bitmap of the sequences seen below it,
+// bit 0 of the bitmap is the high-water mark itself
+type seqWindow struct {
+	hwm  uint64
+	seen []uint64
+	last time.Time //only maintained with an idle timeout
+}
+
+// NewSequenceTracker creates a tracker that remembers window sequences below
+// each high-water mark, a zero window uses the default of 64k sequences
+func NewSequenceTracker(window uint64) *SequenceTracker {
+	if window == 0 {
+		window = defaultSequenceWindow
+	}
+	//round up to a whole word
+	window = (window + 63) &^ 63
+	return &SequenceTracker{
+		window: window,
+		marks:  map[string]*seqWindow{},
+	}
+}
+
+// SetIdleTimeout drops the state held for ingesters that have not sent a
+// sequence for d, zero keeps it until Forget is called
+func (st *SequenceTracker) SetIdleTimeout(d time.Duration) {
+	now := time.Now()
+	st.mtx.Lock()
+	st.idle, st.swept = d, now
+	for _, sw := range st.marks {
+		sw.last = now
+	}
+	st.mtx.Unlock()
+}
+
+// Replay returns true if the ingester identified by uuid has already delivered
+// seq, otherwise the sequence is recorded.  A zero sequence is never a replay,
+// it is what ReadSequence returns for entries sent without one.
+func (st *SequenceTracker) Replay(uuid string, seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	var now time.Time
+	if st.idle > 0 {
+		now = time.Now()
+		if now.Sub(st.swept) >= st.idle {
+			st.expire(now)
+		}
+	}
+	sw, ok := st.marks[uuid]
+	if !ok {
+		sw = &seqWindow{seen: make([]uint64, st.window/64)}
+		st.marks[uuid] = sw
+	}
+	sw.last = now
+	if sw.check(seq, st.window) {
+		atomic.AddUint64(&st.dropped, 1)
+		return true
+	}
+	return false
+}
+
+// HighWater returns the highest sequence seen from an ingester, zero if it has not sent any
+func (st *SequenceTracker) HighWater(uuid string) uint64 {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if sw, ok := st.marks[uuid]; ok {
+		return sw.hwm
+	}
+	return 0
+}
+
+// expire drops every window that has been idle for the timeout, the caller must hold the lock
+func (st *SequenceTracker) expire(now time.Time) {
+	for uuid, sw := range st.marks {
+		if now.Sub(sw.last) >= st.idle {
+			delete(st.marks, uuid)
+		}
+	}
+	st.swept = now
+}
+
+// Forget drops the state held for an ingester
+func (st *SequenceTracker) Forget(uuid string) {
+	st.mtx.Lock()
+	delete(st.marks, uuid)
+	st.mtx.Unlock()
+}
+
+// Dropped returns the number of replays the tracker has caught
+func (st *SequenceTracker) Dropped() uint64 {
+	return atomic.LoadUint64(&st.dropped)
+}
+
+// check returns true if seq was already seen and marks it as seen otherwise
+func (sw *seqWindow) check(seq, window uint64) bool {
+	if seq > sw.hwm {
+		sw.shift(seq - sw.hwm)
+		sw.hwm = seq
+		sw.seen[0] |= 1
+		return false
+	}
+	d := sw.hwm - seq
+	if d >= window {
+		return false
+	}
+	w, b := d/64, uint64(1)<<(d%64)
+	if sw.seen[w]&b != 0 {
+		return true
+	}
+	sw.seen[w] |= b
+	return false
+}
+
+// shift slides the bitmap up by n sequences
+func (sw *seqWindow) shift(n uint64) {
+	words := uint64(len(sw.seen))
+	if n >= words*64 {
+		for i := range sw.seen {
+			sw.seen[i] = 0
+		}
+		return
+	}
+	ws, bs := n/64, n%64
+	for i := words - 1; ; i-- {
+		var v uint64
+		if i >= ws {
+			v = sw.seen[i-ws] << bs
+			if bs != 0 && i > ws {
+				v |= sw.seen[i-ws-1] >> (64 - bs)
+			}
+		}
+		sw.seen[i] = v
+		if i == 0 {
+			break
+		}
+	}
+}
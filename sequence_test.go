@@ -0,0 +1,504 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	st := NewSequenceTracker(128)
+	for _, seq := range []uint64{10, 11, 13, 12, 300, 250, 299} {
+		if st.Replay(`A`, seq) {
+			t.Fatal("Fresh sequence flagged as a replay", seq)
+		}
+	}
+	for _, seq := range []uint64{300, 299, 250, 200 + 64, 250} {
+		if seq == 264 {
+			//never seen but inside the window
+			if st.Replay(`A`, seq) {
+				t.Fatal("Fresh sequence flagged as a replay", seq)
+			}
+		} else if !st.Replay(`A`, seq) {
+			t.Fatal("Missed a replay", seq)
+		}
+	}
+	//13 fell out of the window, it cannot be checked so it goes through
+	if st.Replay(`A`, 13) {
+		t.Fatal("Sequence behind the window was dropped")
+	}
+	//sequences are scoped to the ingester, zero is never tracked
+	if st.Replay(`B`, 300) || st.Replay(`A`, 0) || st.Replay(`A`, 0) {
+		t.Fatal("Bad replay")
+	}
+	if st.HighWater(`A`) != 300 || st.HighWater(`B`) != 300 || st.HighWater(`C`) != 0 {
+		t.Fatal("Bad high-water marks", st.HighWater(`A`), st.HighWater(`B`))
+	}
+	if st.Dropped() != 4 {
+		t.Fatal("Bad drop count", st.Dropped())
+	}
+	st.Forget(`A`)
+	if st.HighWater(`A`) != 0 || st.Replay(`A`, 300) {
+		t.Fatal("Ingester was not forgotten")
+	}
+}
+
+func TestSequenceTrackerIdle(t *testing.T) {
+	st := NewSequenceTracker(0)
+	st.Replay(`A`, 10)
+	st.SetIdleTimeout(200 * time.Millisecond)
+	time.Sleep(120 * time.Millisecond)
+	st.Replay(`B`, 10)
+	time.Sleep(120 * time.Millisecond)
+	//A has gone quiet past the timeout, B is still inside it
+	if !st.Replay(`B`, 10) {
+		t.Fatal("Missed a replay")
+	}
+	if st.HighWater(`A`) != 0 || st.HighWater(`B`) != 10 {
+		t.Fatal("Bad expiry", st.HighWater(`A`), st.HighWater(`B`))
+	}
+}
+
+func TestSequenceWindowShift(t *testing.T) {
+	sw := &seqWindow{seen: make([]uint64, 4)}
+	var seqs []uint64
+	for seq := uint64(1); seq < 256; seq += 3 {
+		seqs = append(seqs, seq)
+	}
+	//shifts of every size up to the window have to keep every bit in place
+	for _, seq := range seqs {
+		if sw.check(seq, 256) {
+			t.Fatal("Fresh sequence flagged as a replay", seq)
+		}
+	}
+	for _, seq := range seqs {
+		if !sw.check(seq, 256) {
+			t.Fatal("Missed a replay", seq)
+		}
+		if !sw.check(seq, 256) || sw.check(seq+1, 256) {
+			t.Fatal("Bad window state", seq)
+		}
+	}
+}
+
+func TestEntrySequencer(t *testing.T) {
+	es := newEntrySequencer()
+	ents := testEntries(4, 10)
+	es.assign(ents[:2]...)
+	a := es.get(ents[0])
+	if a == 0 || es.get(ents[0]) != a {
+		t.Fatal("Resend did not keep its sequence")
+	}
+	if b := es.get(ents[1]); b != a+1 {
+		t.Fatal("Sequence is not monotonic", a, b)
+	}
+	//admitting an entry again does not renumber it
+	es.assign(ents[0])
+	if es.get(ents[0]) != a {
+		t.Fatal("Entry was renumbered")
+	}
+	//replicas carry the number of the entry they copy
+	r := *ents[1]
+	es.share(ents[1], []*entry.Entry{ents[1], &r})
+	if es.get(&r) != a+1 {
+		t.Fatal("Replica did not share the sequence")
+	}
+	//entries moving into a store take their numbers with them
+	seqs := es.take([]*entry.Entry{ents[0], ents[3]})
+	if len(seqs) != 2 || seqs[0] != a || seqs[1] != 0 {
+		t.Fatal("Bad taken sequences", seqs)
+	}
+	if len(es.seqs) != 2 {
+		t.Fatal("Taken entries were not forgotten", len(es.seqs))
+	}
+	later := newEntrySequencer()
+	later.restore([]*entry.Entry{ents[2], ents[3]}, seqs)
+	if later.get(ents[2]) != a || later.get(ents[3]) <= a+1 {
+		t.Fatal("Bad restored sequences")
+	}
+	es.forget(ents[1], &r)
+	if c := es.get(ents[1]); c != a+2 {
+		t.Fatal("Forgotten entry kept its sequence", a, c)
+	}
+	//a later sequencer for the same ingester picks up above the last one
+	if d := newEntrySequencer().get(ents[2]); d <= a+2 {
+		t.Fatal("Sequence went backwards across sequencers", a, d)
+	}
+}
+
+func TestCacheSequences(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `seq`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := IngestCacheConfig{
+		FileBackingLocation: filepath.Join(dir, `cache.db`),
+		MemoryCacheSize:     memCacheSize,
+	}
+	ic, err := NewIngestCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.seq = newEntrySequencer()
+	j := newInflightJournal(ic)
+	j.seq = ic.seq
+
+	//half the entries are cached and half are in flight, all but one numbered
+	ents := testEntries(8, 1)
+	for i := range ents {
+		ents[i].TS = ents[0].TS
+		ents[i].Data = []byte{byte(i)}
+	}
+	ic.seq.assign(ents[1:]...)
+	want := map[string]uint64{}
+	for _, e := range ents[1:] {
+		want[string(e.Data)] = ic.seq.get(e)
+	}
+	if _, err := ic.cacheEntries(ents[:4]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.record(nil, ents[4:]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.flush(); err != nil {
+		t.Fatal(err)
+	}
+	//the one without a number picks one up in the journal, the cache leaves it bare
+	want[string(ents[4].Data)] = ic.seq.get(ents[4])
+	if err := ic.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ic, err = NewIngestCache(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Close()
+	ic.seq = newEntrySequencer()
+	blk, err := ic.PopBlock()
+	if err != nil || blk == nil || blk.Count() != len(ents) {
+		t.Fatal("Bad replayed block", blk, err)
+	}
+	for _, e := range blk.Entries() {
+		seq, ok := ic.seq.seqs[e]
+		if w := want[string(e.Data)]; seq != w || ok != (w != 0) {
+			t.Fatal("Bad restored sequence", e.Data, seq, w)
+		}
+	}
+}
+
+func TestSequencedEntries(t *testing.T) {
+	if err := cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	lst, cli, srv, err := getConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	defer closeConnections(cli, srv)
+	er, err := NewEntryReader(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := er.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer er.Close()
+	ew, err := NewEntryWriter(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := newEntrySequencer()
+	ents := testEntries(4, 100)
+
+	//servers that are too old never see sequenced entries
+	ew.serverVersion = MINIMUM_SEQ_VERSION - 1
+	ew.setSeqHook(es.get)
+	if err := ew.WriteBatch(ents[:2]); err != nil {
+		t.Fatal(err)
+	}
+	ew.serverVersion = MINIMUM_SEQ_VERSION
+	ew.setSeqHook(es.get)
+	if err := ew.WriteBatch(ents[2:]); err != nil {
+		t.Fatal(err)
+	}
+	//a resend carries the same sequence
+	if err := ew.Write(ents[3]); err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ew.ForceAck()
+	}()
+
+	want := []*entry.Entry{ents[0], ents[1], ents[2], ents[3], ents[3]}
+	seqs := []uint64{0, 0, es.get(ents[2]), es.get(ents[3]), es.get(ents[3])}
+	st := NewSequenceTracker(0)
+	for i := range want {
+		ent, seq, err := er.ReadSequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ent.Data, want[i].Data) || ent.TS != want[i].TS {
+			t.Fatal("Bad entry", i)
+		}
+		if seq != seqs[i] {
+			t.Fatal("Bad sequence", i, seq, seqs[i])
+		}
+		if st.Replay(`test`, seq) != (i == 4) {
+			t.Fatal("Bad replay check", i)
+		}
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for confirmations")
+	}
+}
+
+func TestMuxerSequenceEntries(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	c := MuxerConfig{
+		Destinations:    []Target{ti.Target()},
+		Tags:            []string{`testA`},
+		SequenceEntries: true,
+	}
+	if _, err := NewMuxer(c); err != ErrSequenceNeedsUUID {
+		t.Fatal("Failed to catch missing UUID", err)
+	}
+	c.IngesterUUID = `6c4e7cbe-3d44-4b35-8b14-4ae1a3a8a1bf`
+	im, err := NewMuxer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := testEntries(20, 100)
+	for _, e := range ents {
+		e.Tag = tag
+	}
+	if err := im.WriteBatch(ents); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	st := NewSequenceTracker(0)
+	got := ti.Entries()
+	seqs := ti.Sequences()
+	for i, e := range got {
+		if countData([]*entry.Entry{e}) == 0 {
+			continue
+		}
+		if seqs[i] <= last {
+			t.Fatal("Sequence is not monotonic", seqs[i], last)
+		}
+		last = seqs[i]
+		if st.Replay(c.IngesterUUID, seqs[i]) {
+			t.Fatal("Fresh entry flagged as a replay")
+		}
+	}
+	if countData(got) != len(ents) {
+		t.Fatal("Bad entry count", countData(got))
+	}
+	//confirmed entries are forgotten by the sequencer
+	im.seq.mtx.Lock()
+	n := len(im.seq.seqs)
+	im.seq.mtx.Unlock()
+	if n != 0 {
+		t.Fatal("Sequencer is holding confirmed entries", n)
+	}
+}
+
+func TestMuxerSequenceCacheRestart(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `seq`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//grab an address that nothing is listening on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := Target{Address: `tcp://` + lst.Addr().String(), Secret: testIndexerSecret}
+	lst.Close()
+	c := MuxerConfig{
+		Destinations:    []Target{down},
+		Tags:            []string{`testA`},
+		IngesterUUID:    `6c4e7cbe-3d44-4b35-8b14-4ae1a3a8a1bf`,
+		SequenceEntries: true,
+		EnableCache:     true,
+		CacheConfig: IngestCacheConfig{
+			FileBackingLocation: filepath.Join(dir, `cache.db`),
+			MemoryCacheSize:     memCacheSize,
+		},
+	}
+	im, err := NewMuxer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ents := testEntries(10, 100)
+	for _, e := range ents {
+		e.Tag = tag
+	}
+	if err := im.WriteBatch(ents); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now()
+	for im.groups[0].cache.Count() != uint64(len(ents)) {
+		if time.Since(ts) > 5*time.Second {
+			t.Fatal("Entries were not cached", im.groups[0].cache.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := map[uint64]bool{}
+	im.seq.mtx.Lock()
+	for _, e := range ents {
+		want[im.seq.seqs[e]] = true
+	}
+	im.seq.mtx.Unlock()
+	if len(want) != len(ents) || want[0] {
+		t.Fatal("Entries were not numbered on admission", len(want))
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the next run drains the cache with the numbers the entries were admitted with
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	c.Destinations = []Target{ti.Target()}
+	if im, err = NewMuxer(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ts = time.Now()
+	for countData(ti.Entries()) != len(ents) {
+		if time.Since(ts) > 10*time.Second {
+			t.Fatal("Cached entries were never delivered", countData(ti.Entries()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	seqs := ti.Sequences()
+	for i, e := range ti.Entries() {
+		if countData([]*entry.Entry{e}) == 1 && !want[seqs[i]] {
+			t.Fatal("Cached entry was renumbered", seqs[i])
+		}
+	}
+}
+
+func TestMuxerSequenceResume(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `seq`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	c := MuxerConfig{
+		Destinations:    []Target{ti.Target()},
+		Tags:            []string{`testA`},
+		IngesterUUID:    `6c4e7cbe-3d44-4b35-8b14-4ae1a3a8a1bf`,
+		SequenceEntries: true,
+		EnableCache:     true,
+		CacheConfig: IngestCacheConfig{
+			FileBackingLocation: filepath.Join(dir, `cache.db`),
+			MemoryCacheSize:     memCacheSize,
+		},
+	}
+	//each run delivers a batch, the tracker sees everything the indexer got
+	st := NewSequenceTracker(0)
+	run := func() []uint64 {
+		before := len(ti.Sequences())
+		im, err := NewMuxer(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := im.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := im.WaitForHot(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		tag, err := im.GetTag(`testA`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents := testEntries(10, 100)
+		for _, e := range ents {
+			e.Tag = tag
+		}
+		if err := im.WriteBatch(ents); err != nil {
+			t.Fatal(err)
+		}
+		if err := im.Sync(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := im.Close(); err != nil {
+			t.Fatal(err)
+		}
+		seqs := ti.Sequences()[before:]
+		for _, seq := range seqs {
+			if st.Replay(c.IngesterUUID, seq) {
+				t.Fatal("New entry reported as a replay", seq)
+			}
+		}
+		return seqs
+	}
+	first := run()
+	second := run()
+	if second[0] <= first[len(first)-1] || second[0]-first[len(first)-1] > defaultSequenceWindow {
+		t.Fatal("Numbering did not resume across the restart", first[len(first)-1], second[0])
+	}
+	//entries from before the restart replayed after it must be caught
+	for _, seq := range first {
+		if !st.Replay(c.IngesterUUID, seq) {
+			t.Fatal("Replay from before the restart was let through", seq)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 const (
 	MIN_REMOTE_KEYSIZE int           = 16
 	DIAL_TIMEOUT       time.Duration = (1 * time.Second)
+	tlsDialTimeout     time.Duration = 5 * time.Second
 	CHANNEL_BUFFER     int           = 4096
 	DEFAULT_TLS_PORT   int           = 4024
 	DEFAULT_CLEAR_PORT int           = 4023
@@ -73,6 +74,12 @@ func ConnectionType(dst string) (string, string, error) {
 //
 // Deprecated: Use the IngestMuxer instead.
 func InitializeConnection(dst, authString string, tags []string, pubKey, privKey string, verifyRemoteKey bool) (*IngestConnection, error) {
+	return initializeConnection(dst, authString, tags, pubKey, privKey, verifyRemoteKey, nil)
+}
+
+// initializeConnection is InitializeConnection with control over how targets
+// are dialed, a nil connDialer connects directly
+func initializeConnection(dst, authString string, tags []string, pubKey, privKey string, verifyRemoteKey bool, cd *connDialer) (*IngestConnection, error) {
 	auth, err := GenAuthHash(authString)
 	if err != nil {
 		return nil, err
@@ -94,11 +101,11 @@ func InitializeConnection(dst, authString string, tags []string, pubKey, privKey
 		} else if certs == nil {
 			return nil, ErrInvalidCerts
 		}
-		return NewTLSConnection(dest, auth, certs, verifyRemoteKey, tags)
+		return newTLSConnection(dest, auth, certs, verifyRemoteKey, tags, cd)
 	case "tcp":
-		return NewTCPConnection(dest, auth, tags)
+		return newTCPConnection(dest, auth, tags, cd)
 	case "pipe":
-		return NewPipeConnection(dest, auth, tags)
+		return newPipeConnection(dest, auth, tags, cd)
 	default:
 		break
 	}
@@ -180,20 +187,27 @@ func checkTLSPublicKey(local, remote []byte) bool {
 //
 // Deprecated: Use the IngestMuxer instead.
 func NewTLSConnection(dst string, auth AuthHash, certs *TLSCerts, verify bool, tags []string) (*IngestConnection, error) {
+	return newTLSConnection(dst, auth, certs, verify, tags, nil)
+}
+
+func newTLSConnection(dst string, auth AuthHash, certs *TLSCerts, verify bool, tags []string, cd *connDialer) (*IngestConnection, error) {
 	if err := checkTags(tags); err != nil {
 		return nil, err
 	}
-	conn, src, err := newTlsConn(dst, certs, verify)
+	conn, src, err := newTlsConn(dst, certs, verify, cd)
 	if err != nil {
 		return nil, err
 	}
 
-	return completeIngestConnection(conn, src, auth, tags)
+	return completeIngestConnection(conn, src, auth, tags, cd)
 }
 
 //negotiate a TLS connection and check the public cert if requested
-func newTlsConn(dst string, certs *TLSCerts, verify bool) (net.Conn, net.IP, error) {
+//if a dialer is set the TLS session is run over the connection it returns
+func newTlsConn(dst string, certs *TLSCerts, verify bool, cd *connDialer) (net.Conn, net.IP, error) {
 	var src net.IP
+	var conn *tls.Conn
+	var err error
 
 	config := tls.Config{
 		InsecureSkipVerify: !verify,
@@ -202,22 +216,48 @@ func newTlsConn(dst string, certs *TLSCerts, verify bool) (net.Conn, net.IP, err
 		config.Certificates = []tls.Certificate{certs.Cert}
 	}
 
-	dialer := &net.Dialer{Timeout: 5 * time.Second}
-	conn, err := tls.DialWithDialer(dialer, "tcp", dst, &config)
-	if err != nil {
+	if dial := cd.dialer(); dial == nil {
+		dialer := &net.Dialer{Timeout: tlsDialTimeout}
+		if conn, err = tls.DialWithDialer(dialer, "tcp", dst, &config); err != nil {
+			return nil, src, err
+		}
+	} else if conn, err = dialTLS(dst, &config, dial); err != nil {
 		return nil, src, err
 	}
-	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
-	if err != nil {
-		return nil, src, ErrFailedParseLocalIP
-	}
-	if src = net.ParseIP(host); src == nil {
-		return nil, src, ErrFailedParseLocalIP
+	if src, err = localIP(conn, cd); err != nil {
+		return nil, src, err
 	}
 
 	return conn, src, nil
 }
 
+// dialTLS runs a TLS handshake over a connection from dial
+func dialTLS(dst string, config *tls.Config, dial dialFunc) (*tls.Conn, error) {
+	raw, err := dial("tcp", dst)
+	if err != nil {
+		return nil, err
+	}
+	//tls.Dial fills in the server name from the address, so we do too
+	if config.ServerName == `` {
+		if host, _, err := net.SplitHostPort(dst); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = dst
+		}
+	}
+	conn := tls.Client(raw, config)
+	if err = conn.SetDeadline(time.Now().Add(tlsDialTimeout)); err == nil {
+		if err = conn.Handshake(); err == nil {
+			err = conn.SetDeadline(time.Time{})
+		}
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // This function will create a new cleartext TCP connection to a remote system.
 // No verification of the server is performed AT ALL.  All traffic is snoopable
 // and modifiable.  If someone has control of the network, they will be able to
@@ -228,31 +268,33 @@ func newTlsConn(dst string, certs *TLSCerts, verify bool) (net.Conn, net.IP, err
 //
 // Deprecated: Use the IngestMuxer instead.
 func NewTCPConnection(dst string, auth AuthHash, tags []string) (*IngestConnection, error) {
+	return newTCPConnection(dst, auth, tags, nil)
+}
+
+func newTCPConnection(dst string, auth AuthHash, tags []string, cd *connDialer) (*IngestConnection, error) {
 	err := checkTags(tags)
 	if err != nil {
 		return nil, err
 	}
-	conn, src, err := newTcpConn(dst)
+	conn, src, err := newTcpConn(dst, cd)
 	if err != nil {
 		return nil, err
 	}
-	return completeIngestConnection(conn, src, auth, tags)
+	return completeIngestConnection(conn, src, auth, tags, cd)
 }
 
-func newTcpConn(dst string) (net.Conn, net.IP, error) {
+func newTcpConn(dst string, cd *connDialer) (net.Conn, net.IP, error) {
 	var src net.IP
-	//try to dial with a timeout of 3 seconds
-	conn, err := net.DialTimeout("tcp", dst, DIAL_TIMEOUT)
-	if err != nil {
-		return nil, src, err
+	dial := cd.dialer()
+	if dial == nil {
+		dial = defaultDial
 	}
-	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	conn, err := dial("tcp", dst)
 	if err != nil {
 		return nil, src, err
 	}
-	src = net.ParseIP(host)
-	if src == nil {
-		return nil, src, ErrFailedParseLocalIP
+	if src, err = localIP(conn, cd); err != nil {
+		return nil, src, err
 	}
 	return conn, src, nil
 }
@@ -265,34 +307,53 @@ func newTcpConn(dst string) (net.Conn, net.IP, error) {
 //
 // Deprecated: Use the IngestMuxer instead.
 func NewPipeConnection(dst string, auth AuthHash, tags []string) (*IngestConnection, error) {
+	return newPipeConnection(dst, auth, tags, nil)
+}
+
+func newPipeConnection(dst string, auth AuthHash, tags []string, cd *connDialer) (*IngestConnection, error) {
 	err := checkTags(tags)
 	if err != nil {
 		return nil, err
 	}
-	conn, src, err := newPipeConn(dst)
+	conn, src, err := newPipeConn(dst, cd)
 	if err != nil {
 		return nil, err
 	}
-	return completeIngestConnection(conn, src, auth, tags)
+	return completeIngestConnection(conn, src, auth, tags, cd)
 }
 
-func newPipeConn(dst string) (net.Conn, net.IP, error) {
+func newPipeConn(dst string, cd *connDialer) (net.Conn, net.IP, error) {
 	var src net.IP
-	conn, err := net.DialTimeout("unix", dst, DIAL_TIMEOUT)
+	dial := cd.dialer()
+	if dial == nil {
+		dial = defaultDial
+	}
+	conn, err := dial("unix", dst)
 	if err != nil {
 		return nil, src, err
 	}
 	return conn, localhostAddr, nil
 }
 
-func negotiateEntryWriter(conn net.Conn, auth AuthHash, tags []string) (*EntryWriter, map[string]entry.EntryTag, error) {
+func negotiateEntryWriter(conn net.Conn, auth AuthHash, tags []string, keepBuffers bool) (*EntryWriter, map[string]entry.EntryTag, error) {
 	tagIDs, serverVersion, err := authenticate(conn, auth, tags)
 	if err != nil {
 		conn.Close()
 		return nil, nil, err
 	}
 
-	ew, err := NewEntryWriter(conn)
+	var ew *EntryWriter
+	if keepBuffers {
+		//the dialer already sized the receive buffer, so skip the resize NewEntryWriter does
+		ew, err = NewEntryWriterEx(EntryReaderWriterConfig{
+			Conn:                  conn,
+			OutstandingEntryCount: MAX_UNCONFIRMED_COUNT,
+			BufferSize:            WRITE_BUFFER_SIZE,
+			Timeout:               CLOSING_SERVICE_ACK_TIMEOUT,
+		})
+	} else {
+		ew, err = NewEntryWriter(conn)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -301,8 +362,8 @@ func negotiateEntryWriter(conn net.Conn, auth AuthHash, tags []string) (*EntryWr
 }
 
 //completeIngestConnection performs the authentication and tag negotiation
-func completeIngestConnection(conn net.Conn, src net.IP, auth AuthHash, tags []string) (*IngestConnection, error) {
-	ew, tagIDs, err := negotiateEntryWriter(conn, auth, tags)
+func completeIngestConnection(conn net.Conn, src net.IP, auth AuthHash, tags []string, cd *connDialer) (*IngestConnection, error) {
+	ew, tagIDs, err := negotiateEntryWriter(conn, auth, tags, cd.keepBuffers())
 	if err != nil {
 		return nil, err
 	}
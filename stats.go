@@ -0,0 +1,385 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+// targetCounters holds counters for a single target, they are accumulated
+// across every connection made to the target.  All fields are accessed atomically.
+type targetCounters struct {
+	entries    uint64
+	bytes      uint64
+	acks       uint64
+	recycled   uint64
+	reconnects uint64
+	throttleNs uint64
+}
+
+func (tc *targetCounters) written(ent *entry.Entry) {
+	atomic.AddUint64(&tc.entries, 1)
+	atomic.AddUint64(&tc.bytes, ent.Size())
+}
+
+// throttled accounts for time spent waiting on a throttle request from the indexer
+func (tc *targetCounters) throttled(start time.Time) {
+	atomic.AddUint64(&tc.throttleNs, uint64(time.Since(start)))
+}
+
+func (tc *targetCounters) recycle(cnt int) {
+	if tc != nil && cnt > 0 {
+		atomic.AddUint64(&tc.recycled, uint64(cnt))
+	}
+}
+
+// TargetStats contains the connection state and counters for a single target.
+// Entry and byte counts are for entries written to the target, Acks is the number
+// of entries the target has confirmed.  Outstanding is the number of entries
+// written on the current connection which have not yet been confirmed.
+// ThrottleTime is the total time spent honoring throttle requests from the target.
+// Group is the name of the target group the target belongs to.  A target with
+// parallel connections is reported once, Connections is the number of connections
+// and HotConnections the number that are hot, the counters cover all of them.
+type TargetStats struct {
+	TargetStatus
+	Group          string
+	Connections    int
+	HotConnections int
+	EntriesWritten uint64
+	BytesWritten   uint64
+	Acks           uint64
+	Recycled       uint64
+	Reconnects     uint64
+	Outstanding    int
+	ThrottleTime   time.Duration
+}
+
+// GroupStats contains the queue and cache state of a single target group.
+// Spilled counts entries diverted into the group cache because the group fell behind.
+type GroupStats struct {
+	Name              string
+	Hot               int
+	EntryQueueDepth   int
+	BatchQueueDepth   int
+	EmergencyQueued   int
+	Spilled           uint64
+	CacheIn           uint64
+	CacheOut          uint64
+	CacheHotBlocks    int
+	CacheStoredBlocks int
+	CacheMemorySize   uint64
+}
+
+// MuxerStats is a point in time snapshot of the muxer counters.  The feature
+// specific counters are only populated when the feature is in use.
+type MuxerStats struct {
+	Timestamp            time.Time
+	Uptime               time.Duration
+	Targets              []TargetStats
+	EntryQueueDepth      int
+	BatchQueueDepth      int
+	EmergencyQueued      int
+	EmergencyPushes      uint64 //times entries were pushed into the emergency queue
+	EmergencyBytes       uint64 //size of what the emergency queue currently holds
+	EmergencySpilled     uint64 //entries the emergency queue had no room for that went to the cache
+	EmergencyDropped     uint64 //entries the emergency queue had no room for that were lost
+	EmergencyDropBytes   uint64
+	CacheEnabled         bool
+	CacheIn              uint64 //entries moved into the ingest cache
+	CacheOut             uint64 //entries moved out of the ingest cache
+	CacheHotBlocks       int
+	CacheStoredBlocks    int
+	CacheMemorySize      uint64
+	UnknownTagDrops      uint64           //entries dropped because their tag was never negotiated
+	RateLimitWait        time.Duration    //time writers were held back by the muxer wide rate limit
+	PriorityQueueDepth   map[Priority]int //only set when tag priorities are in use
+	PriorityShed         uint64           //low priority entries shed because their lane was full
+	TagLimits            []TagLimitStats  //consumption of every tag with a configured limit
+	DedupEnabled         bool
+	DedupSuppressed      uint64 //entries dropped as duplicates
+	DedupTracked         int    //entries currently remembered by the duplicate suppression window
+	TimestampEnabled     bool
+	TimestampClamped     uint64 //entries the timestamp policy moved to the current time
+	TimestampRejected    uint64 //entries the timestamp policy dropped
+	TimestampQuarantined uint64 //entries the timestamp policy moved to the quarantine tag
+	LingerEnabled        bool
+	LingerBatches        uint64 //batches built from single entry writes
+	LingerEntries        uint64 //entries carried by linger batches
+	InFlightLimit        uint64 //only set when an in-flight byte budget is configured
+	InFlightBytes        uint64 //currently charged against the budget
+	InFlightEntries      int
+	InFlightWaits        uint64 //writes that waited for room in the budget
+	InFlightWaitTime     time.Duration
+	InFlightDiverted     uint64 //entries sent to the cache because the budget was exhausted
+	Paused               bool
+	JournalEnabled       bool         //set when in-flight entries are persisted
+	JournalPending       int          //entries sent but not yet resolved
+	JournalReplayed      uint64       //entries recovered from a previous run when the muxer was created
+	Groups               []GroupStats //only set with more than one group, the queue and cache counters above are totals
+}
+
+// Stats returns per target and muxer wide counters
+func (im *IngestMuxer) Stats() (ms MuxerStats) {
+	im.mtx.RLock()
+	defer im.mtx.RUnlock()
+	ms.Timestamp = time.Now()
+	if !im.started.IsZero() {
+		ms.Uptime = ms.Timestamp.Sub(im.started)
+	}
+	ms.Targets = make([]TargetStats, 0, len(im.targets))
+	idx := make(map[string]int, len(im.targets))
+	for _, mt := range im.targets {
+		i, ok := idx[mt.Address]
+		if !ok {
+			i = len(ms.Targets)
+			idx[mt.Address] = i
+			ms.Targets = append(ms.Targets, TargetStats{Group: mt.grp.name})
+		}
+		ts := &ms.Targets[i]
+		st := mt.health.snapshot()
+		if ok {
+			ts.TargetStatus = mergeStatus(ts.TargetStatus, st)
+		} else {
+			ts.TargetStatus = st
+			ts.Address = mt.Address
+		}
+		ts.Connections++
+		if st.State == TargetHot {
+			ts.HotConnections++
+		}
+		ts.EntriesWritten += atomic.LoadUint64(&mt.counters.entries)
+		ts.BytesWritten += atomic.LoadUint64(&mt.counters.bytes)
+		ts.Acks += atomic.LoadUint64(&mt.counters.acks)
+		ts.Recycled += atomic.LoadUint64(&mt.counters.recycled)
+		ts.Reconnects += atomic.LoadUint64(&mt.counters.reconnects)
+		ts.ThrottleTime += time.Duration(atomic.LoadUint64(&mt.counters.throttleNs))
+		if mt.ig != nil && mt.ig.ew != nil {
+			ts.Outstanding += mt.ig.ew.unconfirmedCount()
+		}
+	}
+	ms.EntryQueueDepth = len(im.eChan)
+	ms.BatchQueueDepth = len(im.bChan)
+	ms.EmergencyQueued = im.eq.len()
+	ms.EmergencyPushes = atomic.LoadUint64(&im.eqPushes)
+	ms.EmergencyBytes = im.eq.bytes()
+	ms.EmergencySpilled = atomic.LoadUint64(&im.eqSpilled)
+	ms.EmergencyDropped = atomic.LoadUint64(&im.eqDropped)
+	ms.EmergencyDropBytes = atomic.LoadUint64(&im.eqDroppedBytes)
+	ms.UnknownTagDrops = atomic.LoadUint64(&im.unknownTagDrops)
+	for _, grp := range im.groups {
+		gs := grp.stats()
+		if im.routing() {
+			ms.EntryQueueDepth += gs.EntryQueueDepth
+			ms.BatchQueueDepth += gs.BatchQueueDepth
+			ms.EmergencyQueued += gs.EmergencyQueued
+			ms.EmergencyBytes += grp.eq.bytes()
+			ms.Groups = append(ms.Groups, gs)
+		}
+		if grp.cache != nil {
+			ms.CacheEnabled = true
+			ms.CacheIn += gs.CacheIn
+			ms.CacheOut += gs.CacheOut
+			ms.CacheHotBlocks += gs.CacheHotBlocks
+			ms.CacheStoredBlocks += gs.CacheStoredBlocks
+			ms.CacheMemorySize += gs.CacheMemorySize
+		}
+	}
+	if im.rateParent != nil {
+		ms.RateLimitWait = im.rateParent.waitTime()
+	}
+	if im.lanes != nil {
+		ms.PriorityQueueDepth = make(map[Priority]int, numLanes)
+		for i, d := range im.lanes.depth() {
+			ms.PriorityQueueDepth[PriorityHigh-Priority(i)] = d
+		}
+		ms.PriorityShed = atomic.LoadUint64(&im.lanes.shed)
+	}
+	if im.limits != nil {
+		ms.TagLimits = im.limits.stats()
+	}
+	if im.dedup != nil {
+		ms.DedupEnabled = true
+		ms.DedupSuppressed = atomic.LoadUint64(&im.dedup.suppressed)
+		ms.DedupTracked = im.dedup.tracked()
+	}
+	if im.tsPolicy != nil {
+		ms.TimestampEnabled = true
+		ms.TimestampClamped = atomic.LoadUint64(&im.tsPolicy.clamped)
+		ms.TimestampRejected = atomic.LoadUint64(&im.tsPolicy.rejected)
+		ms.TimestampQuarantined = atomic.LoadUint64(&im.tsPolicy.quarantined)
+	}
+	if im.linger != nil {
+		ms.LingerEnabled = true
+		ms.LingerBatches = atomic.LoadUint64(&im.linger.batches)
+		ms.LingerEntries = atomic.LoadUint64(&im.linger.entries)
+	}
+	if im.budget != nil {
+		ms.InFlightLimit = im.budget.max
+		ms.InFlightBytes, ms.InFlightEntries = im.budget.inUse()
+		ms.InFlightWaits = atomic.LoadUint64(&im.budget.waits)
+		ms.InFlightWaitTime = time.Duration(atomic.LoadInt64(&im.budget.waitTime))
+		ms.InFlightDiverted = atomic.LoadUint64(&im.budget.diverted)
+	}
+	ms.Paused = im.Paused()
+	for _, grp := range im.groups {
+		if grp.journal != nil {
+			ms.JournalEnabled = true
+			ms.JournalPending += grp.journal.pending()
+			ms.JournalReplayed += grp.cache.Replayed()
+		}
+	}
+	return
+}
+
+func (grp *muxGroup) stats() (gs GroupStats) {
+	gs.Name = grp.name
+	gs.Hot = int(atomic.LoadInt32(&grp.connHot))
+	gs.EntryQueueDepth = len(grp.eChan)
+	gs.BatchQueueDepth = len(grp.bChan)
+	gs.EmergencyQueued = grp.eq.len()
+	gs.Spilled = atomic.LoadUint64(&grp.spilled)
+	if grp.cache != nil {
+		gs.CacheIn = grp.cache.EntriesIn()
+		gs.CacheOut = grp.cache.EntriesOut()
+		gs.CacheHotBlocks = grp.cache.HotBlocks()
+		gs.CacheStoredBlocks = grp.cache.StoredBlocks()
+		gs.CacheMemorySize = grp.cache.MemoryCacheSize()
+	}
+	return
+}
+
+// EntriesWritten returns the total number of entries written across all targets
+func (ms MuxerStats) EntriesWritten() (v uint64) {
+	for _, ts := range ms.Targets {
+		v += ts.EntriesWritten
+	}
+	return
+}
+
+// BytesWritten returns the total number of bytes written across all targets
+func (ms MuxerStats) BytesWritten() (v uint64) {
+	for _, ts := range ms.Targets {
+		v += ts.BytesWritten
+	}
+	return
+}
+
+// String renders the counters for a target in human readable form
+func (ts TargetStats) String() string {
+	s := fmt.Sprintf("%s %s entries: %s (%s) acks: %s outstanding: %d recycled: %s reconnects: %d",
+		ts.Address, ts.State, HumanCount(ts.EntriesWritten), HumanSize(ts.BytesWritten),
+		HumanCount(ts.Acks), ts.Outstanding, HumanCount(ts.Recycled), ts.Reconnects)
+	if ts.Connections > 1 {
+		s += fmt.Sprintf(" connections: %d/%d", ts.HotConnections, ts.Connections)
+	}
+	if ts.LastError != nil {
+		s += fmt.Sprintf(" last error: %v (%s)", ts.LastError, ts.LastErrorTS.Format(time.RFC3339))
+	}
+	return s
+}
+
+// String renders the muxer counters in human readable form, average
+// rates are calculated over the lifetime of the muxer
+func (ms MuxerStats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "uptime: %v entries: %s (%s)", ms.Uptime.Round(time.Second),
+		HumanCount(ms.EntriesWritten()), HumanSize(ms.BytesWritten()))
+	if ms.Uptime > 0 {
+		fmt.Fprintf(&sb, " rate: %s %s", HumanEntryRate(ms.EntriesWritten(), ms.Uptime), HumanRate(ms.BytesWritten(), ms.Uptime))
+	}
+	fmt.Fprintf(&sb, " queued: %d/%d emergency: %d (%d pushes) cache in/out: %s/%s unknown tag drops: %d\n",
+		ms.EntryQueueDepth, ms.BatchQueueDepth, ms.EmergencyQueued, ms.EmergencyPushes,
+		HumanCount(ms.CacheIn), HumanCount(ms.CacheOut), ms.UnknownTagDrops)
+	if ms.EmergencySpilled > 0 || ms.EmergencyDropped > 0 {
+		fmt.Fprintf(&sb, "\temergency overflow spilled: %s dropped: %s (%s)\n",
+			HumanCount(ms.EmergencySpilled), HumanCount(ms.EmergencyDropped), HumanSize(ms.EmergencyDropBytes))
+	}
+	if ms.PriorityQueueDepth != nil {
+		fmt.Fprintf(&sb, "\tpriority queued high/normal/low: %d/%d/%d shed: %s\n",
+			ms.PriorityQueueDepth[PriorityHigh], ms.PriorityQueueDepth[PriorityNormal],
+			ms.PriorityQueueDepth[PriorityLow], HumanCount(ms.PriorityShed))
+	}
+	if ms.DedupEnabled {
+		fmt.Fprintf(&sb, "\tduplicates suppressed: %s tracked: %d\n", HumanCount(ms.DedupSuppressed), ms.DedupTracked)
+	}
+	if ms.TimestampEnabled {
+		fmt.Fprintf(&sb, "\ttimestamps clamped: %s rejected: %s quarantined: %s\n",
+			HumanCount(ms.TimestampClamped), HumanCount(ms.TimestampRejected), HumanCount(ms.TimestampQuarantined))
+	}
+	if ms.LingerEnabled {
+		fmt.Fprintf(&sb, "\tlinger batches: %s entries: %s\n", HumanCount(ms.LingerBatches), HumanCount(ms.LingerEntries))
+	}
+	if ms.InFlightLimit > 0 {
+		fmt.Fprintf(&sb, "\tin flight: %s/%s entries: %d waits: %s (%v) diverted: %s\n",
+			HumanSize(ms.InFlightBytes), HumanSize(ms.InFlightLimit), ms.InFlightEntries,
+			HumanCount(ms.InFlightWaits), ms.InFlightWaitTime, HumanCount(ms.InFlightDiverted))
+	}
+	if ms.JournalEnabled {
+		fmt.Fprintf(&sb, "\tjournaled in flight: %d replayed: %s\n", ms.JournalPending, HumanCount(ms.JournalReplayed))
+	}
+	if ms.Paused {
+		sb.WriteString("\tpaused\n")
+	}
+	for _, gs := range ms.Groups {
+		fmt.Fprintf(&sb, "\tgroup %s hot: %d queued: %d/%d emergency: %d spilled: %s cache in/out: %s/%s\n",
+			gs.Name, gs.Hot, gs.EntryQueueDepth, gs.BatchQueueDepth, gs.EmergencyQueued,
+			HumanCount(gs.Spilled), HumanCount(gs.CacheIn), HumanCount(gs.CacheOut))
+	}
+	for _, tl := range ms.TagLimits {
+		fmt.Fprintf(&sb, "\ttag %s entries: %s (%s) quota used: %s dropped: %s cached: %s blocked: %v\n",
+			tl.Tag, HumanCount(tl.Entries), HumanSize(tl.Bytes), HumanSize(tl.QuotaUsed),
+			HumanCount(tl.Dropped), HumanCount(tl.Cached), tl.BlockedTime.Round(time.Millisecond))
+	}
+	for _, ts := range ms.Targets {
+		sb.WriteString("\t")
+		sb.WriteString(ts.String())
+		if ms.Uptime > 0 {
+			sb.WriteString(" rate: ")
+			sb.WriteString(HumanRate(ts.BytesWritten, ms.Uptime))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// CloseReport accounts for the entries that were in flight when a muxer closed.
+// Delivered counts entries confirmed by an indexer while closing, Cached counts
+// entries written to a file backed cache, and Lost counts entries that were
+// discarded, including anything held by a memory only cache.  Replicated entries
+// are counted once for every group they were routed to.
+type CloseReport struct {
+	Delivered      uint64
+	DeliveredBytes uint64
+	Cached         uint64
+	CachedBytes    uint64
+	Lost           uint64
+	LostBytes      uint64
+}
+
+func (cr *CloseReport) lose(ents ...*entry.Entry) {
+	for _, e := range ents {
+		if e != nil {
+			cr.Lost++
+			cr.LostBytes += e.Size()
+		}
+	}
+}
+
+// String renders the report in human readable form
+func (cr CloseReport) String() string {
+	return fmt.Sprintf("delivered: %s (%s) cached: %s (%s) lost: %s (%s)",
+		HumanCount(cr.Delivered), HumanSize(cr.DeliveredBytes), HumanCount(cr.Cached),
+		HumanSize(cr.CachedBytes), HumanCount(cr.Lost), HumanSize(cr.LostBytes))
+}
@@ -0,0 +1,87 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestMuxerStats(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 100
+	data := []byte(`test data`)
+	for i := 0; i < count; i++ {
+		if err := im.Write(entry.Now(), tag, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := im.Stats()
+	if len(ms.Targets) != 1 {
+		t.Fatal("Bad target count", len(ms.Targets))
+	}
+	ts := ms.Targets[0]
+	if ts.Address != ti.Target().Address || ts.State != TargetHot {
+		t.Fatal("Bad target status", ts.TargetStatus)
+	}
+	//the muxer also writes its own log entries, so expect at least our count
+	if ts.EntriesWritten < count || ts.Acks != ts.EntriesWritten || ts.Outstanding != 0 {
+		t.Fatal("Bad target counters", ts)
+	}
+	if ts.BytesWritten < uint64(count*(len(data)+entry.ENTRY_HEADER_SIZE)) {
+		t.Fatal("Bad byte count", ts.BytesWritten)
+	}
+	if ms.EntriesWritten() != ts.EntriesWritten || ms.BytesWritten() != ts.BytesWritten {
+		t.Fatal("Bad aggregate counters")
+	}
+	if s := ms.String(); !strings.Contains(s, ti.Target().Address) || !strings.Contains(s, `HOT`) {
+		t.Fatal("Bad stats string", s)
+	}
+
+	//a tag the muxer has never heard of is dropped
+	if err := im.Write(entry.Now(), entry.EntryTag(100), data); err != nil {
+		t.Fatal(err)
+	}
+	//the relay may still be handling the bad entry when the queues drain
+	for ts := time.Now(); ms.UnknownTagDrops == 0 && time.Since(ts) < time.Second; ms = im.Stats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ms.UnknownTagDrops != 1 {
+		t.Fatal("Bad unknown tag drop count", ms.UnknownTagDrops)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,544 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrInvalidTagLimit       = errors.New("Invalid tag limit")
+	ErrInvalidTagLimitAction = errors.New("Invalid tag limit action")
+	ErrTagLimitNoCache       = errors.New("Tag limit diverts to the cache but the cache is not enabled")
+)
+
+// TagLimitAction is what happens to an entry that exceeds its tag limit
+type TagLimitAction int
+
+const (
+	TagLimitBlock TagLimitAction = iota // block the writer until the limit allows the entry
+	TagLimitDrop                        // drop the entry
+	TagLimitCache                       // divert the entry into the ingest cache
+)
+
+func (a TagLimitAction) String() string {
+	switch a {
+	case TagLimitBlock:
+		return `block`
+	case TagLimitDrop:
+		return `drop`
+	case TagLimitCache:
+		return `cache`
+	}
+	return `unknown`
+}
+
+// ParseTagLimitAction converts an action name into a TagLimitAction
+func ParseTagLimitAction(v string) (TagLimitAction, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case `block`, ``:
+		return TagLimitBlock, nil
+	case `drop`:
+		return TagLimitDrop, nil
+	case `cache`:
+		return TagLimitCache, nil
+	}
+	return TagLimitBlock, ErrInvalidTagLimitAction
+}
+
+// TagLimit caps the data written for a single tag.  RateBps is in bytes per
+// second, DailyQuota is in bytes per UTC day; a zero value disables either.
+// Entries diverted to the cache are unloaded at the rate the limit allows and
+// stay in the cache while the daily quota is spent.  Only the number of
+// diverted entries is tracked, so entries still cached when the muxer restarts
+// are unloaded without the limit.
+type TagLimit struct {
+	RateBps    int64
+	DailyQuota uint64
+	Action     TagLimitAction
+}
+
+func (tl TagLimit) validate(cacheEnabled bool) error {
+	if tl.RateBps < 0 || (tl.RateBps == 0 && tl.DailyQuota == 0) {
+		return ErrInvalidTagLimit
+	}
+	switch tl.Action {
+	case TagLimitBlock, TagLimitDrop:
+	case TagLimitCache:
+		if !cacheEnabled {
+			return ErrTagLimitNoCache
+		}
+	default:
+		return ErrInvalidTagLimitAction
+	}
+	return nil
+}
+
+// TagLimitStats shows the consumption of a limited tag.  Entries and Bytes are
+// what was admitted, QuotaUsed is the number of bytes counted against the
+// current day's quota, and BlockedTime is how long writers waited on the limit.
+type TagLimitStats struct {
+	Tag         string
+	Limit       TagLimit
+	Entries     uint64
+	Bytes       uint64
+	Dropped     uint64
+	Cached      uint64
+	QuotaUsed   uint64
+	BlockedTime time.Duration
+}
+
+type limitVerdict int
+
+const (
+	limitAdmit limitVerdict = iota
+	limitDrop
+	limitCache
+)
+
+// tagLimiter enforces the limit for a single tag
+type tagLimiter struct {
+	//counters are updated atomically and must stay 8 byte aligned
+	entries   uint64
+	bytes     uint64
+	dropped   uint64
+	cached    uint64
+	blockedNs uint64
+	owed      int64 //entries diverted to the cache that have not been charged on the way out
+	name      string
+	cfg       TagLimit
+	lm        *rate.Limiter
+	mtx       sync.Mutex
+	day       int64
+	used      uint64
+}
+
+func newTagLimiter(name string, cfg TagLimit) *tagLimiter {
+	tl := &tagLimiter{
+		name: name,
+		cfg:  cfg,
+		day:  utcDay(time.Now()),
+	}
+	if cfg.RateBps > 0 {
+		tl.lm = rate.NewLimiter(rate.Limit(cfg.RateBps), int(cfg.RateBps))
+	}
+	return tl
+}
+
+func utcDay(t time.Time) int64 {
+	return t.Unix() / int64(24*time.Hour/time.Second)
+}
+
+// nextDay returns the start of the next UTC day
+func nextDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// takeQuota attempts to count sz bytes against the daily quota, it returns
+// the time at which the quota resets if there is not enough room
+func (tl *tagLimiter) takeQuota(sz uint64, now time.Time) (ok bool, reset time.Time) {
+	if tl.cfg.DailyQuota == 0 {
+		return true, reset
+	}
+	tl.mtx.Lock()
+	defer tl.mtx.Unlock()
+	if d := utcDay(now); d != tl.day {
+		tl.day = d
+		tl.used = 0
+	}
+	if tl.used+sz > tl.cfg.DailyQuota {
+		return false, nextDay(now)
+	}
+	tl.used += sz
+	return true, reset
+}
+
+func (tl *tagLimiter) quotaUsed() uint64 {
+	tl.mtx.Lock()
+	defer tl.mtx.Unlock()
+	if utcDay(time.Now()) != tl.day {
+		return 0
+	}
+	return tl.used
+}
+
+// admit applies the limit to an entry of sz bytes, die interrupts blocking writers
+func (tl *tagLimiter) admit(ctx context.Context, die chan bool, sz uint64) (limitVerdict, error) {
+	start := time.Now()
+	defer func() {
+		if d := time.Since(start); tl.cfg.Action == TagLimitBlock && d > time.Millisecond {
+			atomic.AddUint64(&tl.blockedNs, uint64(d))
+		}
+	}()
+	for {
+		ok, reset := tl.takeQuota(sz, time.Now())
+		if ok {
+			break
+		}
+		if v := tl.overLimit(); v != limitAdmit {
+			return v, nil
+		}
+		//block until the quota rolls over
+		tmr := time.NewTimer(time.Until(reset))
+		select {
+		case <-tmr.C:
+		case <-ctx.Done():
+			tmr.Stop()
+			return limitDrop, ctx.Err()
+		case <-die:
+			tmr.Stop()
+			return limitDrop, ErrNotRunning
+		}
+	}
+	if tl.lm != nil {
+		if tl.cfg.Action != TagLimitBlock {
+			//entries larger than the burst can never be allowed, charge them a full burst
+			n := int(sz)
+			if b := tl.lm.Burst(); n > b {
+				n = b
+			}
+			if !tl.lm.AllowN(time.Now(), n) {
+				tl.returnQuota(sz)
+				return tl.overLimit(), nil
+			}
+		} else if err := tl.wait(ctx, sz); err != nil {
+			tl.returnQuota(sz)
+			return limitDrop, err
+		}
+	}
+	atomic.AddUint64(&tl.entries, 1)
+	atomic.AddUint64(&tl.bytes, sz)
+	return limitAdmit, nil
+}
+
+// wait blocks on the rate limiter, entries larger than the burst are taken in chunks
+func (tl *tagLimiter) wait(ctx context.Context, sz uint64) error {
+	burst := uint64(tl.lm.Burst())
+	for sz > 0 {
+		n := sz
+		if n > burst {
+			n = burst
+		}
+		if err := tl.lm.WaitN(ctx, int(n)); err != nil {
+			return err
+		}
+		sz -= n
+	}
+	return nil
+}
+
+func (tl *tagLimiter) returnQuota(sz uint64) {
+	if tl.cfg.DailyQuota == 0 {
+		return
+	}
+	tl.mtx.Lock()
+	if tl.used >= sz {
+		tl.used -= sz
+	}
+	tl.mtx.Unlock()
+}
+
+// refund hands back what admit counted for an entry of sz bytes when the write
+// is abandoned, tokens taken from the rate limiter can not be returned
+func (tl *tagLimiter) refund(v limitVerdict, sz uint64) {
+	switch v {
+	case limitAdmit:
+		tl.returnQuota(sz)
+		atomic.AddUint64(&tl.entries, ^uint64(0))
+		atomic.AddUint64(&tl.bytes, ^(sz - 1))
+	case limitDrop:
+		atomic.AddUint64(&tl.dropped, ^uint64(0))
+	case limitCache:
+		atomic.AddUint64(&tl.cached, ^uint64(0))
+	}
+}
+
+// replay charges an entry of sz bytes unloaded from the cache against the limit
+// while diverted entries are owed, waiting out the rate limit.  False is
+// returned if the daily quota is spent and the entry should stay in the cache.
+func (tl *tagLimiter) replay(ctx context.Context, sz uint64) (bool, error) {
+	for {
+		n := atomic.LoadInt64(&tl.owed)
+		if n <= 0 {
+			return true, nil
+		} else if atomic.CompareAndSwapInt64(&tl.owed, n, n-1) {
+			break
+		}
+	}
+	if ok, _ := tl.takeQuota(sz, time.Now()); !ok {
+		atomic.AddInt64(&tl.owed, 1)
+		return false, nil
+	}
+	if tl.lm != nil {
+		if err := tl.wait(ctx, sz); err != nil {
+			tl.returnQuota(sz)
+			atomic.AddInt64(&tl.owed, 1)
+			return false, err
+		}
+	}
+	atomic.AddUint64(&tl.entries, 1)
+	atomic.AddUint64(&tl.bytes, sz)
+	return true, nil
+}
+
+// unloadable reports if diverted entries are owed and the limit has room for them
+func (tl *tagLimiter) unloadable() bool {
+	if atomic.LoadInt64(&tl.owed) <= 0 {
+		return false
+	}
+	return tl.cfg.DailyQuota == 0 || tl.quotaUsed() < tl.cfg.DailyQuota
+}
+
+func (tl *tagLimiter) overLimit() limitVerdict {
+	switch tl.cfg.Action {
+	case TagLimitDrop:
+		atomic.AddUint64(&tl.dropped, 1)
+		return limitDrop
+	case TagLimitCache:
+		atomic.AddUint64(&tl.cached, 1)
+		return limitCache
+	}
+	return limitAdmit
+}
+
+func (tl *tagLimiter) stats() TagLimitStats {
+	return TagLimitStats{
+		Tag:         tl.name,
+		Limit:       tl.cfg,
+		Entries:     atomic.LoadUint64(&tl.entries),
+		Bytes:       atomic.LoadUint64(&tl.bytes),
+		Dropped:     atomic.LoadUint64(&tl.dropped),
+		Cached:      atomic.LoadUint64(&tl.cached),
+		QuotaUsed:   tl.quotaUsed(),
+		BlockedTime: time.Duration(atomic.LoadUint64(&tl.blockedNs)),
+	}
+}
+
+// tagLimits maps muxer tags to their limiters
+type tagLimits struct {
+	mtx    sync.RWMutex
+	byName map[string]*tagLimiter
+	byTag  map[entry.EntryTag]*tagLimiter
+}
+
+func newTagLimits(cfg map[string]TagLimit, tagMap map[string]entry.EntryTag, cacheEnabled bool) (*tagLimits, error) {
+	tls := &tagLimits{
+		byName: make(map[string]*tagLimiter, len(cfg)),
+		byTag:  map[entry.EntryTag]*tagLimiter{},
+	}
+	for k, v := range cfg {
+		if err := v.validate(cacheEnabled); err != nil {
+			return nil, fmt.Errorf("Tag %s: %v", k, err)
+		}
+		tls.byName[k] = newTagLimiter(k, v)
+	}
+	for k, v := range tagMap {
+		tls.register(k, v)
+	}
+	return tls, nil
+}
+
+func (tls *tagLimits) register(name string, tag entry.EntryTag) {
+	tls.mtx.Lock()
+	if tl, ok := tls.byName[name]; ok {
+		tls.byTag[tag] = tl
+	}
+	tls.mtx.Unlock()
+}
+
+func (tls *tagLimits) get(tag entry.EntryTag) *tagLimiter {
+	tls.mtx.RLock()
+	tl := tls.byTag[tag]
+	tls.mtx.RUnlock()
+	return tl
+}
+
+func (tls *tagLimits) stats() []TagLimitStats {
+	tls.mtx.RLock()
+	r := make([]TagLimitStats, 0, len(tls.byName))
+	for _, tl := range tls.byName {
+		r = append(r, tl.stats())
+	}
+	tls.mtx.RUnlock()
+	sort.Slice(r, func(i, j int) bool { return r[i].Tag < r[j].Tag })
+	return r
+}
+
+// limitBatch applies tag limits to a batch, returning the entries that should be queued.
+// Every entry is admitted before any is dropped or diverted, if the writer gives up
+// partway through the entries already admitted hand back what they were counted for.
+// The caller's slice is only copied if something has to be removed.
+func (im *IngestMuxer) limitBatch(ctx context.Context, b []*entry.Entry) ([]*entry.Entry, error) {
+	var tls []*tagLimiter
+	var vs []limitVerdict
+	for i, e := range b {
+		if e == nil {
+			continue
+		}
+		tl := im.limits.get(e.Tag)
+		if tl == nil {
+			continue
+		} else if tls == nil {
+			tls = make([]*tagLimiter, len(b))
+			vs = make([]limitVerdict, len(b))
+		}
+		v, err := tl.admit(ctx, im.dieChan, e.Size())
+		if err != nil {
+			for j := range b[:i] {
+				if tls[j] != nil {
+					tls[j].refund(vs[j], b[j].Size())
+				}
+			}
+			return nil, err
+		}
+		tls[i], vs[i] = tl, v
+	}
+	if tls == nil {
+		return b, nil
+	}
+
+	var out []*entry.Entry
+	var kick bool
+	for i, e := range b {
+		if e == nil {
+			continue
+		}
+		ok := true
+		if tl := tls[i]; tl != nil {
+			ok = im.applyVerdict(tl, e, vs[i])
+			kick = kick || tl.unloadable()
+		}
+		if !ok && out == nil {
+			out = make([]*entry.Entry, i, len(b))
+			copy(out, b[:i])
+		} else if ok && out != nil {
+			out = append(out, e)
+		}
+	}
+	if kick {
+		im.kickCaches()
+	}
+	if out == nil {
+		return b, nil
+	}
+	return out, nil
+}
+
+// applyVerdict drops or diverts an entry the limit did not admit, it returns
+// false if the entry should not be queued
+func (im *IngestMuxer) applyVerdict(tl *tagLimiter, e *entry.Entry, v limitVerdict) bool {
+	switch v {
+	case limitDrop:
+		im.acks.resolve(e, ErrEntryDropped)
+		return false
+	case limitCache:
+		//the cache resolves any ack waiter as it takes the entry, it may be
+		//unloaded before we are done so it is owed up front
+		atomic.AddInt64(&tl.owed, 1)
+		if missed, err := im.cacheEntries(e); err != nil {
+			atomic.AddInt64(&tl.owed, -1)
+			im.acks.resolveSet(missed, err)
+		}
+		return false
+	}
+	return true
+}
+
+// cacheUnlimited diverts entries into the cache before their tag limits were
+// applied, the limits are owed the entries and charge them as they are unloaded
+func (im *IngestMuxer) cacheUnlimited(ents ...*entry.Entry) error {
+	im.oweLimits(ents, 1)
+	missed, err := im.cacheEntries(ents...)
+	if err != nil {
+		im.oweLimits(missed, -1)
+		if im.replicating() {
+			//the writer can only roll back the originals, replicas are settled here
+			im.acks.resolveSet(missed, err)
+		}
+	}
+	return err
+}
+
+func (im *IngestMuxer) oweLimits(ents []*entry.Entry, n int64) {
+	if im.limits == nil {
+		return
+	}
+	for _, e := range ents {
+		if e == nil {
+			continue
+		} else if tl := im.limits.get(e.Tag); tl != nil {
+			atomic.AddInt64(&tl.owed, n)
+		}
+	}
+}
+
+// refundLimits hands back what admitted entries were counted for when the write
+// is abandoned after they passed their tag limits
+func (im *IngestMuxer) refundLimits(ents ...*entry.Entry) {
+	for _, e := range ents {
+		if e == nil {
+			continue
+		} else if tl := im.limits.get(e.Tag); tl != nil {
+			tl.refund(limitAdmit, e.Size())
+		}
+	}
+}
+
+// kickCaches prods the cache routines so that entries diverted by a tag limit
+// are unloaded without waiting for a connection to come or go
+func (im *IngestMuxer) kickCaches() {
+	im.mtx.RLock()
+	if im.state == running {
+		for _, grp := range im.groups {
+			if grp.cache == nil || !grp.cacheRunning {
+				continue
+			}
+			select {
+			case grp.cacheSignal <- true:
+			default:
+			}
+		}
+	}
+	im.mtx.RUnlock()
+}
+
+// replayLimits charges entries unloaded from the cache against their tag limits
+// in place of the entries the limits diverted.  Entries over a daily quota are
+// split off to go back into the cache, if the wait is cut short the entries that
+// were not handled are left on the end of out.
+func (im *IngestMuxer) replayLimits(ctx context.Context, ents []*entry.Entry) (out, held []*entry.Entry, err error) {
+	out = ents[:0]
+	for i, e := range ents {
+		if e == nil {
+			continue
+		}
+		if tl := im.limits.get(e.Tag); tl != nil {
+			var ok bool
+			if ok, err = tl.replay(ctx, e.Size()); err != nil {
+				out = append(out, ents[i:]...)
+				return
+			} else if !ok {
+				held = append(held, e)
+				continue
+			}
+		}
+		out = append(out, e)
+	}
+	return
+}
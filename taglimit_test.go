@@ -0,0 +1,339 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestParseTagLimitAction(t *testing.T) {
+	tests := map[string]TagLimitAction{
+		`block`:  TagLimitBlock,
+		` DROP `: TagLimitDrop,
+		`cache`:  TagLimitCache,
+		``:       TagLimitBlock,
+	}
+	for k, v := range tests {
+		if a, err := ParseTagLimitAction(k); err != nil || a != v {
+			t.Fatal("Bad action", k, a, err)
+		}
+	}
+	if _, err := ParseTagLimitAction(`explode`); err != ErrInvalidTagLimitAction {
+		t.Fatal("Failed to catch bad action", err)
+	}
+	if err := (TagLimit{}).validate(false); err != ErrInvalidTagLimit {
+		t.Fatal("Failed to catch empty limit", err)
+	}
+	if err := (TagLimit{RateBps: 1024, Action: TagLimitCache}).validate(false); err != ErrTagLimitNoCache {
+		t.Fatal("Failed to catch cache action without a cache", err)
+	}
+	if err := (TagLimit{DailyQuota: 1024, Action: TagLimitCache}).validate(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTagLimiterQuota(t *testing.T) {
+	tl := newTagLimiter(`netflow`, TagLimit{DailyQuota: 100, Action: TagLimitDrop})
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if v, err := tl.admit(ctx, nil, 10); err != nil || v != limitAdmit {
+			t.Fatal("Entry within quota not admitted", i, v, err)
+		}
+	}
+	if v, err := tl.admit(ctx, nil, 1); err != nil || v != limitDrop {
+		t.Fatal("Entry over quota not dropped", v, err)
+	}
+	st := tl.stats()
+	if st.Entries != 10 || st.Bytes != 100 || st.QuotaUsed != 100 || st.Dropped != 1 {
+		t.Fatalf("Bad stats %+v", st)
+	}
+	//the quota rolls over with the UTC day
+	now := time.Now()
+	if ok, _ := tl.takeQuota(10, now.Add(24*time.Hour)); !ok {
+		t.Fatal("Quota did not reset on a new day")
+	}
+	if ok, reset := tl.takeQuota(100, now.Add(24*time.Hour)); ok || !reset.After(now.Add(24*time.Hour)) {
+		t.Fatal("Bad quota reset time", ok, reset)
+	}
+}
+
+func TestTagLimiterRate(t *testing.T) {
+	tl := newTagLimiter(`netflow`, TagLimit{RateBps: 1000, Action: TagLimitCache})
+	ctx := context.Background()
+	if v, _ := tl.admit(ctx, nil, 1000); v != limitAdmit {
+		t.Fatal("Entry within the burst not admitted", v)
+	}
+	if v, _ := tl.admit(ctx, nil, 1000); v != limitCache {
+		t.Fatal("Entry over the rate not diverted", v)
+	}
+	if st := tl.stats(); st.Cached != 1 || st.Entries != 1 {
+		t.Fatalf("Bad stats %+v", st)
+	}
+
+	//blocking limits give up when the context does
+	tl = newTagLimiter(`netflow`, TagLimit{RateBps: 1000, DailyQuota: 100000})
+	if v, _ := tl.admit(ctx, nil, 1000); v != limitAdmit {
+		t.Fatal("Entry within the burst not admitted", v)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := tl.admit(tctx, nil, 10000); err == nil {
+		t.Fatal("Blocked entry did not time out")
+	}
+	//a refused entry does not count against the quota
+	if u := tl.quotaUsed(); u != 1000 {
+		t.Fatal("Bad quota after refusal", u)
+	}
+}
+
+func TestMuxerTagLimits(t *testing.T) {
+	//quotas count the encoded size of an entry
+	sz := uint64(10 + entry.ENTRY_HEADER_SIZE)
+	ti := newTestIndexer(t)
+	defer ti.Close()
+
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`noisy`, `quiet`},
+		TagLimits: map[string]TagLimit{
+			`noisy`: {DailyQuota: 4 * sz, Action: TagLimitDrop},
+			`late`:  {DailyQuota: 10, Action: TagLimitDrop},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	noisy, err := im.GetTag(`noisy`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet, err := im.GetTag(`quiet`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, err := im.NegotiateTag(`late`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.limits.get(late) == nil {
+		t.Fatal("Negotiated tag did not pick up its limit")
+	}
+	for i := 0; i < 8; i++ {
+		if err := im.Write(entry.Now(), noisy, []byte(`0123456789`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a batch keeps the entries that fit
+	b := []*entry.Entry{
+		{TS: entry.Now(), Tag: quiet, Data: []byte(`0123456789`)},
+		{TS: entry.Now(), Tag: noisy, Data: []byte(`0123456789`)},
+		{TS: entry.Now(), Tag: quiet, Data: []byte(`0123456789`)},
+	}
+	out, err := im.limitBatch(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0] != b[0] || out[1] != b[2] {
+		t.Fatal("Bad filtered batch", len(out))
+	}
+	if err := im.WriteBatch(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ms := im.Stats()
+	if len(ms.TagLimits) != 2 || ms.TagLimits[0].Tag != `late` || ms.TagLimits[1].Tag != `noisy` {
+		t.Fatalf("Bad tag limit stats %+v", ms.TagLimits)
+	}
+	//the quota fits 4 entries, the rest of the singles and both batch passes are dropped
+	if nst := ms.TagLimits[1]; nst.Entries != 4 || nst.Dropped != 6 || nst.QuotaUsed != 4*sz {
+		t.Fatalf("Bad noisy stats %+v", nst)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	for _, e := range ti.Entries() {
+		if string(e.Data) == `0123456789` {
+			got++
+		}
+	}
+	if got != 6 {
+		t.Fatal("Bad delivered count", got)
+	}
+}
+
+func TestLimitBatchRefund(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`counted`, `slow`},
+		TagLimits: map[string]TagLimit{
+			`counted`: {DailyQuota: 1024 * 1024, Action: TagLimitDrop},
+			`slow`:    {RateBps: 100},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted, err := im.GetTag(`counted`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := im.GetTag(`slow`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the last entry blocks past the deadline, the whole batch is refused
+	b := []*entry.Entry{
+		{TS: entry.Now(), Tag: counted, Data: []byte(`0123456789`)},
+		{TS: entry.Now(), Tag: counted, Data: []byte(`0123456789`)},
+		{TS: entry.Now(), Tag: slow, Data: make([]byte, 1000)},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := im.limitBatch(ctx, b); err == nil {
+		t.Fatal("Blocked batch did not time out")
+	}
+	for _, st := range im.limits.stats() {
+		if st.Entries != 0 || st.Bytes != 0 || st.QuotaUsed != 0 {
+			t.Fatalf("Refused batch was counted %+v", st)
+		}
+	}
+}
+
+func TestCancelledWriteKeepsQuota(t *testing.T) {
+	//grab an address that nothing is listening on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := Target{Address: `tcp://` + lst.Addr().String(), Secret: testIndexerSecret}
+	lst.Close()
+	ents := testEntries(3, 100)
+	sz := ents[0].Size()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations:     []Target{down},
+		Tags:             []string{`counted`},
+		TagLimits:        map[string]TagLimit{`counted`: {DailyQuota: 1024 * 1024, Action: TagLimitDrop}},
+		MaxInFlightBytes: sz,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	tag, err := im.GetTag(`counted`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range ents {
+		e.Tag = tag
+	}
+	quota := func() uint64 {
+		return im.limits.stats()[0].QuotaUsed
+	}
+	//the first entry holds the whole budget
+	if err := im.WriteEntry(ents[0]); err != nil {
+		t.Fatal(err)
+	}
+	if q := quota(); q != sz {
+		t.Fatal("Bad quota", q)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := im.WriteEntryContext(ctx, ents[1]); err != context.DeadlineExceeded {
+		t.Fatal("Budget not enforced", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := im.WriteBatchContext(ctx, ents[1:]); err != context.DeadlineExceeded {
+		t.Fatal("Budget not enforced", err)
+	}
+	if q := quota(); q != sz {
+		t.Fatal("Cancelled writes were charged against the quota", q)
+	}
+	//the same goes for writes held by a pause
+	if err := im.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := im.WriteEntryContext(ctx, ents[1]); err != context.DeadlineExceeded {
+		t.Fatal("Pause not enforced", err)
+	}
+	if q := quota(); q != sz {
+		t.Fatal("Paused write was charged against the quota", q)
+	}
+}
+
+func TestMuxerTagLimitCacheReplay(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`bursty`},
+		TagLimits:    map[string]TagLimit{`bursty`: {RateBps: 4096, Action: TagLimitCache}},
+		EnableCache:  true,
+		CacheConfig:  IngestCacheConfig{MemoryCacheSize: memCacheSize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`bursty`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the burst takes the first few, the rest are diverted and have to wait out the rate on the way back
+	const count = 8
+	ts := time.Now()
+	for i := 0; i < count; i++ {
+		if err := im.WriteEntry(&entry.Entry{TS: entry.Now(), Tag: tag, Data: make([]byte, 1024)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ti.Count() < count {
+		if time.Since(ts) > 10*time.Second {
+			t.Fatal("Diverted entries were not unloaded", ti.Count())
+		}
+		if err := im.Sync(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if d := time.Since(ts); d < time.Second {
+		t.Fatal("Diverted entries were unloaded without the limit", d)
+	}
+	sz := (&entry.Entry{Data: make([]byte, 1024)}).Size()
+	if st := im.limits.stats()[0]; st.Cached == 0 || st.Entries != count || st.Bytes != count*sz {
+		t.Fatalf("Bad stats %+v", st)
+	}
+}
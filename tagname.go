@@ -0,0 +1,103 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"errors"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+var (
+	ErrTagNameCount = errors.New("Tag name count does not match the number of entries")
+)
+
+// tagNegotiation tracks a tag that has been registered locally while the
+// targets learn it, writers wanting the tag wait for done
+type tagNegotiation struct {
+	tg   entry.EntryTag
+	done chan struct{}
+}
+
+// tagNegotiationConn is a connection captured when a tag was registered
+type tagNegotiationConn struct {
+	mt *muxTarget
+	ig *IngestConnection
+	tt *tagTrans
+}
+
+// WriteEntryWithTagName writes an entry using a tag name rather than a negotiated tag.
+// Tags the muxer has not seen are negotiated with every connection on demand.
+func (im *IngestMuxer) WriteEntryWithTagName(e *entry.Entry, name string) (err error) {
+	if e == nil {
+		return nil
+	}
+	if e.Tag, err = im.resolveTag(name); err != nil {
+		return
+	}
+	return im.WriteEntry(e)
+}
+
+// WriteBatchWithTagName writes a batch of entries that all carry the named tag
+func (im *IngestMuxer) WriteBatchWithTagName(b []*entry.Entry, name string) error {
+	if len(b) == 0 {
+		return nil
+	}
+	tg, err := im.resolveTag(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range b {
+		if e != nil {
+			e.Tag = tg
+		}
+	}
+	return im.WriteBatch(b)
+}
+
+// WriteBatchWithTagNames writes a batch of entries, names holds the tag name for
+// each entry.  Nothing is written if any of the tags cannot be negotiated.
+func (im *IngestMuxer) WriteBatchWithTagNames(b []*entry.Entry, names []string) error {
+	if len(b) != len(names) {
+		return ErrTagNameCount
+	} else if len(b) == 0 {
+		return nil
+	}
+	resolved := make(map[string]entry.EntryTag, 1)
+	for i, e := range b {
+		if e == nil {
+			continue
+		}
+		tg, ok := resolved[names[i]]
+		if !ok {
+			var err error
+			if tg, err = im.resolveTag(names[i]); err != nil {
+				return err
+			}
+			resolved[names[i]] = tg
+		}
+		e.Tag = tg
+	}
+	return im.WriteBatch(b)
+}
+
+// resolveTag looks a tag name up in the negotiated set, negotiating it if needed
+func (im *IngestMuxer) resolveTag(name string) (entry.EntryTag, error) {
+	im.mtx.RLock()
+	tg, ok := im.tagMap[name]
+	pending := im.negotiating[name] != nil
+	state := im.state
+	im.mtx.RUnlock()
+	if state != running {
+		return 0, ErrNotRunning
+	} else if ok && !pending {
+		return tg, nil
+	}
+	return im.NegotiateTag(name)
+}
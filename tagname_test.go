@@ -0,0 +1,229 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestWriteWithTagName(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WriteEntryWithTagName(&entry.Entry{}, `testA`); err != ErrNotRunning {
+		t.Fatal("Wrote to a muxer that is not running", err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//negotiate a pile of tags from several writers while entries are flowing
+	const writers = 4
+	const perWriter = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				name := fmt.Sprintf("dyn%d", i%10+w)
+				if err := im.WriteEntryWithTagName(&entry.Entry{TS: entry.Now(), Data: []byte(name)}, name); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	b := []*entry.Entry{
+		{TS: entry.Now(), Data: []byte(`testA`)},
+		{TS: entry.Now(), Data: []byte(`batch`)},
+	}
+	if err := im.WriteBatchWithTagNames(b, []string{`testA`}); err != ErrTagNameCount {
+		t.Fatal("Failed to catch a short name list", err)
+	}
+	if err := im.WriteBatchWithTagNames(b, []string{`testA`, `batch`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WriteBatchWithTagNames([]*entry.Entry{{Data: []byte(`bad tag`)}}, []string{`bad tag`}); err == nil {
+		t.Fatal("Wrote an invalid tag name")
+	}
+	b = []*entry.Entry{{TS: entry.Now(), Data: []byte(`same`)}, {TS: entry.Now(), Data: []byte(`same`)}}
+	if err := im.WriteBatchWithTagName(b, `same`); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ti.Lock()
+	defer ti.Unlock()
+	names := map[entry.EntryTag]string{}
+	for name, tg := range ti.tags {
+		names[tg] = name
+	}
+	var count int
+	for _, e := range ti.ents {
+		if e.Tag == entry.GravwellTagId {
+			continue
+		}
+		count++
+		if name := names[e.Tag]; name != string(e.Data) {
+			t.Fatalf("Entry %s arrived with tag %q", e.Data, name)
+		}
+	}
+	if exp := writers*perWriter + 4; count != exp {
+		t.Fatalf("Got %d entries, expected %d", count, exp)
+	}
+}
+
+func TestNegotiateTagNoStall(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the indexer takes its time learning new tags
+	ti.Lock()
+	ti.delay = 500 * time.Millisecond
+	ti.Unlock()
+	const waiters = 4
+	tags := make(chan entry.EntryTag, waiters)
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			tg, err := im.resolveTag(`slow`)
+			errs <- err
+			tags <- tg
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	//writers with known tags and stats must not wait on the negotiation
+	ts := time.Now()
+	if err := im.Write(entry.Now(), tag, []byte(`fast`)); err != nil {
+		t.Fatal(err)
+	}
+	im.Stats()
+	if d := time.Since(ts); d > 250*time.Millisecond {
+		t.Fatal("Muxer stalled behind a tag negotiation", d)
+	}
+
+	var first entry.EntryTag
+	for i := 0; i < waiters; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		tg := <-tags
+		if i == 0 {
+			first = tg
+		} else if tg != first {
+			t.Fatal("Concurrent negotiations returned different tags", first, tg)
+		}
+	}
+	if time.Since(ts) < 300*time.Millisecond {
+		t.Fatal("Waiters returned before the negotiation finished")
+	}
+	im.mtx.RLock()
+	n := len(im.tags)
+	im.mtx.RUnlock()
+	if n != 2 {
+		t.Fatal("Tag negotiated more than once", n)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNegotiateTagStoredListRollback(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tagname`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{{Address: `tcp://127.1.1.1:55555`, Secret: `x`}},
+		TargetGroups: []TargetGroup{{Name: `dr`, Destinations: []Target{{Address: `tcp://127.2.2.2:55555`, Secret: `x`}}}},
+		Replicate:    true,
+		Tags:         []string{`testA`},
+		EnableCache:  true,
+		CacheConfig: IngestCacheConfig{
+			FileBackingLocation: filepath.Join(dir, `cache.db`),
+			MemoryCacheSize:     memCacheSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	before, err := im.groups[0].cache.GetTagList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the second group cannot store the new tag list
+	if err := im.groups[1].cache.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.NegotiateTag(`lost`); err == nil {
+		t.Fatal("Failed to report the stored tag list failure")
+	}
+	if _, err := im.GetTag(`lost`); err != ErrTagNotFound {
+		t.Fatal("Failed tag was left in the tag map", err)
+	}
+	after, err := im.groups[0].cache.GetTagList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Fatal("Stored tag list was not rolled back", before, after)
+	}
+}
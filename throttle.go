@@ -3,6 +3,7 @@ package ingest
 import (
 	"context"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -13,17 +14,20 @@ const (
 )
 
 type parent struct {
-	burst int
-	lm    *rate.Limiter
+	//waitNs is updated atomically and must stay 8 byte aligned
+	waitNs uint64 //total time connections have spent waiting on the limiter
+	burst  int
+	lm     *rate.Limiter
 }
 
 type throttleConn struct {
 	net.Conn
-	burst int
-	lm    *rate.Limiter
-	to    time.Duration
-	ctx   context.Context
-	cncl  func()
+	burst  int
+	lm     *rate.Limiter
+	to     time.Duration
+	ctx    context.Context
+	cncl   func()
+	waitNs *uint64
 }
 
 type conn interface {
@@ -48,14 +52,20 @@ func newParent(bps int64, burstMult int) *parent {
 func (p *parent) newThrottleConn(c net.Conn) *throttleConn {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &throttleConn{
-		Conn:  c,
-		burst: p.burst,
-		lm:    p.lm,
-		cncl:  cancel,
-		ctx:   ctx,
+		Conn:   c,
+		burst:  p.burst,
+		lm:     p.lm,
+		cncl:   cancel,
+		ctx:    ctx,
+		waitNs: &p.waitNs,
 	}
 }
 
+// waitTime returns the total amount of time writers have been held back by the limiter
+func (p *parent) waitTime() time.Duration {
+	return time.Duration(atomic.LoadUint64(&p.waitNs))
+}
+
 func newWriteThrottler(bps int64, burstMult int, c net.Conn) (wt *throttleConn) {
 	if burstMult <= 0 {
 		burstMult = defaultBurstMultiplier
@@ -109,7 +119,12 @@ func (w *throttleConn) Write(b []byte) (n int, err error) {
 		if r, err = w.Conn.Write(b[n : n+sz]); err != nil {
 			return
 		}
-		if err = w.lm.WaitN(ctx, r); err != nil {
+		ts := time.Now()
+		err = w.lm.WaitN(ctx, r)
+		if w.waitNs != nil {
+			atomic.AddUint64(w.waitNs, uint64(time.Since(ts)))
+		}
+		if err != nil {
 			return
 		}
 		n += r
@@ -0,0 +1,161 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+var (
+	ErrInvalidTimestampPolicy = errors.New("Invalid timestamp policy")
+	ErrInvalidTimestampAction = errors.New("Invalid timestamp action")
+	ErrTimestampRejected      = errors.New("Entry timestamp is outside of the allowed range")
+)
+
+// TimestampAction is what happens to an entry whose timestamp is out of range
+type TimestampAction int
+
+const (
+	TimestampClamp      TimestampAction = iota // set the timestamp to the current time
+	TimestampReject                            // drop the entry
+	TimestampQuarantine                        // retag the entry with the quarantine tag
+)
+
+func (a TimestampAction) String() string {
+	switch a {
+	case TimestampClamp:
+		return `clamp`
+	case TimestampReject:
+		return `reject`
+	case TimestampQuarantine:
+		return `quarantine`
+	}
+	return `unknown`
+}
+
+// ParseTimestampAction converts an action name into a TimestampAction
+func ParseTimestampAction(v string) (TimestampAction, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case `clamp`, ``:
+		return TimestampClamp, nil
+	case `reject`:
+		return TimestampReject, nil
+	case `quarantine`:
+		return TimestampQuarantine, nil
+	}
+	return TimestampClamp, ErrInvalidTimestampAction
+}
+
+// TimestampPolicy bounds the timestamps the muxer will pass along.  Entries dated
+// more than MaxFutureSkew ahead of the clock or more than MaxPastAge behind it
+// are handled according to Action, a zero value disables either bound.
+// QuarantineTag names the tag out of range entries are moved to when the action
+// is TimestampQuarantine, it is negotiated along with the configured tags.
+type TimestampPolicy struct {
+	MaxFutureSkew time.Duration
+	MaxPastAge    time.Duration
+	Action        TimestampAction
+	QuarantineTag string
+}
+
+func (tp TimestampPolicy) enabled() bool {
+	return tp.MaxFutureSkew != 0 || tp.MaxPastAge != 0
+}
+
+func (tp TimestampPolicy) validate() error {
+	if tp.MaxFutureSkew < 0 || tp.MaxPastAge < 0 {
+		return ErrInvalidTimestampPolicy
+	}
+	switch tp.Action {
+	case TimestampClamp, TimestampReject:
+	case TimestampQuarantine:
+		if tp.QuarantineTag == `` {
+			return ErrInvalidTimestampPolicy
+		}
+		return CheckTag(tp.QuarantineTag)
+	default:
+		return ErrInvalidTimestampAction
+	}
+	return nil
+}
+
+// tsPolicy enforces a TimestampPolicy, the counters are accessed atomically
+type tsPolicy struct {
+	clamped     uint64
+	rejected    uint64
+	quarantined uint64
+	cfg         TimestampPolicy
+	qtag        entry.EntryTag
+}
+
+// check applies the policy to an entry, returning false if it must be dropped
+func (tp *tsPolicy) check(e *entry.Entry, now time.Time) bool {
+	ts := e.TS.StandardTime()
+	if (tp.cfg.MaxFutureSkew == 0 || !ts.After(now.Add(tp.cfg.MaxFutureSkew))) &&
+		(tp.cfg.MaxPastAge == 0 || !ts.Before(now.Add(-tp.cfg.MaxPastAge))) {
+		return true
+	}
+	switch tp.cfg.Action {
+	case TimestampReject:
+		atomic.AddUint64(&tp.rejected, 1)
+		return false
+	case TimestampQuarantine:
+		e.Tag = tp.qtag
+		atomic.AddUint64(&tp.quarantined, 1)
+	default:
+		e.TS = entry.FromStandard(now)
+		atomic.AddUint64(&tp.clamped, 1)
+	}
+	return true
+}
+
+// checkTimestamp returns false if the entry was rejected and should not be queued
+func (im *IngestMuxer) checkTimestamp(e *entry.Entry) bool {
+	if im.tsPolicy.check(e, time.Now()) {
+		return true
+	}
+	im.acks.resolve(e, ErrTimestampRejected)
+	return false
+}
+
+// checkTimestamps applies the timestamp policy to a batch, returning the entries
+// that should be queued.  The caller's slice is only copied if something has to be removed.
+func (im *IngestMuxer) checkTimestamps(b []*entry.Entry) []*entry.Entry {
+	var out []*entry.Entry
+	for i, e := range b {
+		if e == nil {
+			continue
+		}
+		ok := im.checkTimestamp(e)
+		if !ok && out == nil {
+			out = make([]*entry.Entry, i, len(b))
+			copy(out, b[:i])
+		} else if ok && out != nil {
+			out = append(out, e)
+		}
+	}
+	if out == nil {
+		return b
+	}
+	return out
+}
+
+func inTagList(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
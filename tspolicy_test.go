@@ -0,0 +1,132 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestTimestampPolicyCheck(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	future := entry.FromStandard(now.Add(time.Hour))
+	past := entry.FromStandard(now.Add(-48 * time.Hour))
+	good := entry.FromStandard(now.Add(-time.Minute))
+
+	tp := &tsPolicy{cfg: TimestampPolicy{MaxFutureSkew: time.Minute, MaxPastAge: 24 * time.Hour}}
+	e := &entry.Entry{TS: good, Tag: 1}
+	if !tp.check(e, now) || e.TS != good {
+		t.Fatal("In range entry modified")
+	}
+	for _, ts := range []entry.Timestamp{future, past} {
+		e = &entry.Entry{TS: ts, Tag: 1}
+		if !tp.check(e, now) || e.TS != entry.FromStandard(now) || e.Tag != 1 {
+			t.Fatalf("Entry not clamped %+v", e)
+		}
+	}
+
+	tp = &tsPolicy{cfg: TimestampPolicy{MaxFutureSkew: time.Minute, Action: TimestampReject}}
+	if tp.check(&entry.Entry{TS: future}, now) {
+		t.Fatal("Future entry not rejected")
+	}
+	//a zero bound is not enforced
+	if !tp.check(&entry.Entry{TS: past}, now) {
+		t.Fatal("Past entry rejected with no past bound")
+	}
+
+	tp = &tsPolicy{cfg: TimestampPolicy{MaxPastAge: time.Hour, Action: TimestampQuarantine}, qtag: 7}
+	e = &entry.Entry{TS: past, Tag: 1}
+	if !tp.check(e, now) || e.Tag != 7 || e.TS != past {
+		t.Fatalf("Entry not quarantined %+v", e)
+	}
+	if tp.clamped != 0 || tp.rejected != 0 || tp.quarantined != 1 {
+		t.Fatal("Bad counters", tp.clamped, tp.rejected, tp.quarantined)
+	}
+
+	bad := []TimestampPolicy{
+		{MaxPastAge: -time.Hour},
+		{MaxPastAge: time.Hour, Action: TimestampQuarantine},
+		{MaxPastAge: time.Hour, Action: TimestampQuarantine, QuarantineTag: `bad tag`},
+		{MaxPastAge: time.Hour, Action: TimestampAction(9)},
+	}
+	for _, v := range bad {
+		if v.validate() == nil {
+			t.Fatalf("Failed to catch bad policy %+v", v)
+		}
+	}
+	for _, name := range []string{`clamp`, `reject`, `quarantine`} {
+		if a, err := ParseTimestampAction(name); err != nil || a.String() != name {
+			t.Fatal("Bad action", name, a, err)
+		}
+	}
+}
+
+func TestMuxerTimestampPolicy(t *testing.T) {
+	ti := newTestIndexer(t)
+	defer ti.Close()
+	im, err := NewMuxer(MuxerConfig{
+		Destinations: []Target{ti.Target()},
+		Tags:         []string{`testA`},
+		TimestampPolicy: TimestampPolicy{
+			MaxPastAge:    time.Hour,
+			Action:        TimestampQuarantine,
+			QuarantineTag: `badtime`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WaitForHot(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := im.GetTag(`testA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.GetTag(`badtime`); err != nil {
+		t.Fatal("Quarantine tag not negotiated", err)
+	}
+	old := entry.FromStandard(time.Now().Add(-2 * time.Hour))
+	if err := im.WriteEntry(&entry.Entry{TS: entry.Now(), Tag: tag, Data: []byte(`good`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.WriteBatch([]*entry.Entry{
+		{TS: old, Tag: tag, Data: []byte(`old`)},
+		{TS: entry.Now(), Tag: tag, Data: []byte(`good`)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.Sync(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	ms := im.Stats()
+	if !ms.TimestampEnabled || ms.TimestampQuarantined != 1 || ms.TimestampClamped != 0 {
+		t.Fatalf("Bad stats %+v", ms)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]entry.EntryTag{}
+	for _, e := range ti.Entries() {
+		if e.Tag != entry.GravwellTagId {
+			tags[string(e.Data)] = e.Tag
+		}
+	}
+	ti.Lock()
+	good, bad := ti.tags[`testA`], ti.tags[`badtime`]
+	ti.Unlock()
+	if len(tags) != 2 || tags[`good`] != good || tags[`old`] != bad {
+		t.Fatalf("Bad entries %v", tags)
+	}
+}